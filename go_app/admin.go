@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// basicAuth lets through to next only the requests authenticated as user
+// with password.
+func basicAuth(user, password string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		gotUser, gotPassword, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(gotUser), []byte(user)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(gotPassword), []byte(password)) == 1
+		if !ok || !userOK || !passwordOK {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// jsonFamily is a metric family as rendered by metricsJSONHandler.
+type jsonFamily struct {
+	Name    string       `json:"name"`
+	Help    string       `json:"help"`
+	Type    string       `json:"type"`
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+// jsonMetric holds the value of a counter, gauge or untyped metric, or the
+// count, sum and buckets or quantiles of a histogram or summary. Bounds and
+// quantiles are keyed by their string form; NaN and infinite values are
+// null, since JSON has no numbers for them.
+type jsonMetric struct {
+	Labels    map[string]string   `json:"labels"`
+	Value     *float64            `json:"value,omitempty"`
+	Count     *uint64             `json:"count,omitempty"`
+	Sum       *float64            `json:"sum,omitempty"`
+	Buckets   map[string]uint64   `json:"buckets,omitempty"`
+	Quantiles map[string]*float64 `json:"quantiles,omitempty"`
+}
+
+// metricsJSONHandler renders the metric families of gatherer as JSON, for
+// debugging without a Prometheus server.
+func metricsJSONHandler(gatherer prometheus.Gatherer) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		families, err := gatherer.Gather()
+		if err != nil {
+			log.Printf("Gathering metrics for JSON: %v", err)
+		}
+		rendered := make([]jsonFamily, 0, len(families))
+		for _, family := range families {
+			rendered = append(rendered, renderFamily(family))
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(rendered); err != nil {
+			log.Printf("Writing the metrics as JSON: %v", err)
+		}
+	}
+}
+
+func renderFamily(family *dto.MetricFamily) jsonFamily {
+	rendered := jsonFamily{
+		Name:    family.GetName(),
+		Help:    family.GetHelp(),
+		Type:    family.GetType().String(),
+		Metrics: make([]jsonMetric, 0, len(family.GetMetric())),
+	}
+	for _, m := range family.GetMetric() {
+		metric := jsonMetric{Labels: map[string]string{}}
+		for _, pair := range m.GetLabel() {
+			metric.Labels[pair.GetName()] = pair.GetValue()
+		}
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			metric.Value = finite(m.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			metric.Value = finite(m.GetGauge().GetValue())
+		case dto.MetricType_UNTYPED:
+			metric.Value = finite(m.GetUntyped().GetValue())
+		case dto.MetricType_HISTOGRAM:
+			count, sum := m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+			metric.Count, metric.Sum = &count, finite(sum)
+			metric.Buckets = map[string]uint64{}
+			for _, bucket := range m.GetHistogram().GetBucket() {
+				metric.Buckets[formatFloat(bucket.GetUpperBound())] = bucket.GetCumulativeCount()
+			}
+		case dto.MetricType_SUMMARY:
+			count, sum := m.GetSummary().GetSampleCount(), m.GetSummary().GetSampleSum()
+			metric.Count, metric.Sum = &count, finite(sum)
+			metric.Quantiles = map[string]*float64{}
+			for _, quantile := range m.GetSummary().GetQuantile() {
+				metric.Quantiles[formatFloat(quantile.GetQuantile())] = finite(quantile.GetValue())
+			}
+		}
+		rendered.Metrics = append(rendered.Metrics, metric)
+	}
+	return rendered
+}
+
+// finite returns a pointer to value, or nil for the NaN and infinite values
+// JSON cannot encode.
+func finite(value float64) *float64 {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	return &value
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
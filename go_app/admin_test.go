@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsJSON(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Debug = true
+	cfg.AdminPassword = "secret"
+	router := NewRouter(cfg, newConfigReloader())
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/echo/hi", nil))
+
+	for _, tc := range []struct {
+		name, user, password string
+		expectedStatus       int
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized},
+		{"wrong password", "admin", "guess", http.StatusUnauthorized},
+		{"authenticated", "admin", "secret", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/admin/metrics.json", nil)
+			if tc.user != "" {
+				request.SetBasicAuth(tc.user, tc.password)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != tc.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tc.expectedStatus, recorder.Code)
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var families []jsonFamily
+			if err := json.NewDecoder(recorder.Body).Decode(&families); err != nil {
+				t.Fatal(err)
+			}
+			for _, family := range families {
+				if family.Name != "go_app_api_request_counter" {
+					continue
+				}
+				for _, metric := range family.Metrics {
+					if metric.Labels["path"] == echoEndpoint && metric.Value != nil && *metric.Value == 1 {
+						return
+					}
+				}
+				t.Fatalf("expected 1 echo request in %+v", family.Metrics)
+			}
+			t.Fatal("expected go_app_api_request_counter in the JSON")
+		})
+	}
+}
+
+func TestMetricsJSONNeedsDebugAndPassword(t *testing.T) {
+	for _, tc := range []struct {
+		debug    bool
+		password string
+	}{
+		{false, "secret"},
+		{true, ""},
+	} {
+		cfg := defaultConfig()
+		cfg.Debug = tc.debug
+		cfg.AdminPassword = tc.password
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/admin/metrics.json", nil)
+		request.SetBasicAuth(cfg.AdminUser, cfg.AdminPassword)
+		NewRouter(cfg, newConfigReloader()).ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("debug %v, password %q: expected status %d, got %d",
+				tc.debug, tc.password, http.StatusNotFound, recorder.Code)
+		}
+	}
+}
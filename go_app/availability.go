@@ -0,0 +1,101 @@
+package main
+
+import (
+	"example.com/m/recorder"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"sync"
+)
+
+// availabilityWindow is the number of recent requests the availability of
+// an endpoint is computed over.
+const availabilityWindow = 100
+
+// AvailabilityTracker publishes the share of successful requests among the
+// last requests to an endpoint. A request succeeds unless it is answered
+// with a 5xx status or its handler panics.
+type AvailabilityTracker struct {
+	availability prometheus.Gauge
+
+	mu     sync.Mutex
+	window *ratioWindow
+}
+
+// NewAvailabilityTracker creates a tracker for endpoint over its last
+// windowSize requests.
+func (m *Metrics) NewAvailabilityTracker(endpoint string, windowSize int) *AvailabilityTracker {
+	return &AvailabilityTracker{
+		availability: m.EndpointAvailability.WithLabelValues(endpoint),
+		window:       newRatioWindow(windowSize),
+	}
+}
+
+// Wrap records the outcome of every request served by requestFunction.
+func (t *AvailabilityTracker) Wrap(
+	requestFunction func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rec := recorder.NewRecorder(rw)
+		defer func() {
+			if p := recover(); p != nil {
+				t.Record(http.StatusInternalServerError)
+				panic(p)
+			}
+			t.Record(rec.Status())
+		}()
+		requestFunction(rec.Writer(), r)
+	}
+}
+
+// Record adds a request answered with status to the window, evicting the
+// oldest one once the window is full, and updates the gauge.
+func (t *AvailabilityTracker) Record(status int) {
+	success := status < http.StatusInternalServerError
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.availability.Set(t.window.Add(success))
+}
+
+// ratioWindow holds the last outcomes of a repeated event, such as whether
+// requests succeeded, and the share of them that were hits.
+type ratioWindow struct {
+	outcomes []bool
+	next     int
+	n        int
+	hits     int
+}
+
+func newRatioWindow(size int) *ratioWindow {
+	return &ratioWindow{outcomes: make([]bool, size)}
+}
+
+// Add records an outcome, evicting the oldest one once the window is full,
+// and returns the new ratio. It is not safe for concurrent use.
+func (w *ratioWindow) Add(hit bool) float64 {
+	if w.Full() {
+		if w.outcomes[w.next] {
+			w.hits--
+		}
+	} else {
+		w.n++
+	}
+	w.outcomes[w.next] = hit
+	if hit {
+		w.hits++
+	}
+	w.next = (w.next + 1) % len(w.outcomes)
+	return w.Ratio()
+}
+
+// Ratio returns the share of hits among the recorded outcomes.
+func (w *ratioWindow) Ratio() float64 {
+	if w.n == 0 {
+		return 0
+	}
+	return float64(w.hits) / float64(w.n)
+}
+
+// Full reports whether the window holds as many outcomes as it can.
+func (w *ratioWindow) Full() bool {
+	return w.n == len(w.outcomes)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAvailabilityTracker(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	tracker := metrics.NewAvailabilityTracker("/flaky", 100)
+	status := http.StatusOK
+	handler := tracker.Wrap(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(status)
+	})
+
+	for i := 0; i < 100; i++ {
+		status = http.StatusOK
+		if i%10 == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/flaky", nil))
+	}
+	if got := testutil.ToFloat64(metrics.EndpointAvailability.WithLabelValues("/flaky")); math.Abs(got-0.9) > 1e-9 {
+		t.Errorf("expected an availability of 0.9, got %v", got)
+	}
+
+	// Client errors count as successes, and push the failures out of the
+	// window.
+	for i := 0; i < 100; i++ {
+		tracker.Record(http.StatusNotFound)
+	}
+	if got := testutil.ToFloat64(metrics.EndpointAvailability.WithLabelValues("/flaky")); got != 1 {
+		t.Errorf("expected an availability of 1 once the failures left the window, got %v", got)
+	}
+}
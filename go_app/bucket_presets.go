@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sloBucketFactors place the buckets of the slo preset around its target,
+// densest just below and above it, where the SLO is decided.
+var sloBucketFactors = []float64{.1, .25, .5, .75, .9, .95, 1, 1.05, 1.1, 1.25, 1.5, 2, 5}
+
+// parseBucketPreset returns the latency buckets described by preset, one of
+// "default", "exponential:start,factor,count", "linear:start,width,count" or
+// "slo:target" with a duration target such as 300ms.
+func parseBucketPreset(preset string) ([]float64, error) {
+	kind, args := preset, ""
+	if i := strings.Index(preset, ":"); i >= 0 {
+		kind, args = preset[:i], preset[i+1:]
+	}
+	switch kind {
+	case "default":
+		if args != "" {
+			return nil, fmt.Errorf("the default preset takes no arguments")
+		}
+		return append([]float64(nil), requestDurationBuckets...), nil
+	case "exponential":
+		start, factor, count, err := parsePresetArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		if start <= 0 || factor <= 1 {
+			return nil, fmt.Errorf("exponential buckets need a positive start and a factor above 1")
+		}
+		return prometheus.ExponentialBuckets(start, factor, count), nil
+	case "linear":
+		start, width, count, err := parsePresetArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		if width <= 0 {
+			return nil, fmt.Errorf("linear buckets need a positive width")
+		}
+		return prometheus.LinearBuckets(start, width, count), nil
+	case "slo":
+		target, err := time.ParseDuration(args)
+		if err != nil || target <= 0 {
+			return nil, fmt.Errorf("the slo preset needs a positive duration target like 300ms")
+		}
+		buckets := make([]float64, len(sloBucketFactors))
+		for i, factor := range sloBucketFactors {
+			buckets[i] = roundBound(factor * target.Seconds())
+		}
+		return buckets, nil
+	default:
+		return nil, fmt.Errorf("unknown preset %q, must be default, exponential, linear or slo", kind)
+	}
+}
+
+// parsePresetArgs parses the "start,step,count" arguments of the
+// exponential and linear presets.
+func parsePresetArgs(args string) (start, step float64, count int, err error) {
+	fields := strings.Split(args, ",")
+	if len(fields) != 3 {
+		return 0, 0, 0, fmt.Errorf("expected 3 arguments, got %q", args)
+	}
+	if start, err = strconv.ParseFloat(strings.TrimSpace(fields[0]), 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid start %q", fields[0])
+	}
+	if step, err = strconv.ParseFloat(strings.TrimSpace(fields[1]), 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid step %q", fields[1])
+	}
+	if count, err = strconv.Atoi(strings.TrimSpace(fields[2])); err != nil || count < 1 {
+		return 0, 0, 0, fmt.Errorf("invalid count %q, must be a positive integer", fields[2])
+	}
+	return start, step, count, nil
+}
+
+// parseBuckets parses a comma separated list of increasing bucket bounds.
+func parseBuckets(value string) ([]float64, error) {
+	var buckets []float64
+	for _, field := range splitList(value) {
+		bound, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bound %q", field)
+		}
+		buckets = append(buckets, bound)
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("no bounds given")
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return nil, fmt.Errorf("bounds must be increasing, got %v after %v", buckets[i], buckets[i-1])
+		}
+	}
+	return buckets, nil
+}
+
+// roundBound rounds a bucket bound to three significant digits.
+func roundBound(bound float64) float64 {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(bound, 'g', 3, 64), 64)
+	return rounded
+}
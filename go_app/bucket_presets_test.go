@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBucketPreset(t *testing.T) {
+	for _, tc := range []struct {
+		preset   string
+		expected []float64
+	}{
+		{"default", requestDurationBuckets},
+		{"exponential:0.01,2,4", []float64{.01, .02, .04, .08}},
+		{"linear:1,2,3", []float64{1, 3, 5}},
+		{"slo:300ms", []float64{.03, .075, .15, .225, .27, .285, .3, .315, .33, .375, .45, .6, 1.5}},
+	} {
+		buckets, err := parseBucketPreset(tc.preset)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.preset, err)
+			continue
+		}
+		if !reflect.DeepEqual(buckets, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.preset, tc.expected, buckets)
+		}
+	}
+}
+
+func TestLoadConfigRejectsBadBucketPresets(t *testing.T) {
+	for _, preset := range []string{
+		"fibonacci", "default:1", "exponential:0,2,4", "exponential:1,1,4", "exponential:1,2",
+		"linear:0,-1,3", "linear:0,1,zero", "slo:", "slo:-1s",
+	} {
+		setenv(t, "LATENCY_BUCKET_PRESET", preset)
+		_, err := LoadConfig()
+		if err == nil || !strings.Contains(err.Error(), preset) {
+			t.Errorf("%q: expected an error naming the preset, got %v", preset, err)
+		}
+	}
+}
+
+func TestLoadConfigLatencyBuckets(t *testing.T) {
+	setenv(t, "LATENCY_BUCKET_PRESET", "linear:1,1,2")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []float64{1, 2}; !reflect.DeepEqual(cfg.LatencyBuckets, expected) {
+		t.Errorf("expected the preset buckets %v, got %v", expected, cfg.LatencyBuckets)
+	}
+
+	setenv(t, "LATENCY_BUCKETS", "0.5, 1, 5")
+	if cfg, err = LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []float64{.5, 1, 5}; !reflect.DeepEqual(cfg.LatencyBuckets, expected) {
+		t.Errorf("expected the explicit buckets %v to override the preset, got %v", expected, cfg.LatencyBuckets)
+	}
+
+	setenv(t, "LATENCY_BUCKETS", "1,0.5")
+	if _, err = LoadConfig(); err == nil {
+		t.Error("expected decreasing bounds to be rejected")
+	}
+}
+
+// bucketBounds returns the upper bounds of the histogram observer.
+func bucketBounds(t *testing.T, observer prometheus.Observer) []float64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := observer.(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	var bounds []float64
+	for _, bucket := range metric.GetHistogram().GetBucket() {
+		bounds = append(bounds, bucket.GetUpperBound())
+	}
+	return bounds
+}
+
+func TestLatencyBucketsApplied(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.LatencyBuckets = []float64{.5, 1}
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry, newMetricOpts(cfg))
+	metrics.legacyEndpointMetrics = true
+
+	for name, observer := range map[string]prometheus.Observer{
+		"request duration": metrics.RequestDuration.WithLabelValues("/", tenantUnknown),
+		"queue wait":       metrics.QueueWait.WithLabelValues("/"),
+	} {
+		if bounds := bucketBounds(t, observer); !reflect.DeepEqual(bounds, cfg.LatencyBuckets) {
+			t.Errorf("%s: expected buckets %v, got %v", name, cfg.LatencyBuckets, bounds)
+		}
+	}
+
+	// Buckets given to a route are explicit and take precedence over the
+	// configured ones.
+	handler := func(http.ResponseWriter, *http.Request) {}
+	metrics.createRequestLatencyMetric("configured_latency", "/configured", handler)(
+		httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/configured", nil))
+	explicit, err := metrics.Instrument(handler, WithPath("/explicit"),
+		WithLatency(Named("explicit_latency"), Buckets(SmartBuckets(time.Second)...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	explicit(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/explicit", nil))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string][]float64{
+		"go_app_api_configured_latency": cfg.LatencyBuckets,
+		"go_app_api_explicit_latency":   SmartBuckets(time.Second),
+	} {
+		var bounds []float64
+		for _, family := range families {
+			if family.GetName() != name {
+				continue
+			}
+			for _, bucket := range family.GetMetric()[0].GetHistogram().GetBucket() {
+				bounds = append(bounds, bucket.GetUpperBound())
+			}
+		}
+		if !reflect.DeepEqual(bounds, expected) {
+			t.Errorf("%s: expected buckets %v, got %v", name, expected, bounds)
+		}
+	}
+}
+
+func TestLatencyBucketsFromExpectedLatency(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	metrics.legacyEndpointMetrics = true
+
+	// Neither route is given Buckets, nor are LATENCY_BUCKETS configured.
+	handler := func(http.ResponseWriter, *http.Request) {}
+	metrics.createRequestLatencyMetric("slow_latency", "/slow", handler, FuncName("slow"), ExpectedLatency(20*time.Second))
+	metrics.createRequestLatencyMetric("plain_latency", "/plain", handler, FuncName("plain"))
+
+	for _, tc := range []struct {
+		name, path, funcName string
+		expected             []float64
+	}{
+		{"slow_latency", "/slow", "slow", SmartBuckets(20 * time.Second)},
+		{"plain_latency", "/plain", "plain", requestDurationBuckets},
+	} {
+		observer := metrics.legacy[tc.name].(*prometheus.HistogramVec).WithLabelValues(tc.path, tc.funcName)
+		if bounds := bucketBounds(t, observer); !reflect.DeepEqual(bounds, tc.expected) {
+			t.Errorf("%s: expected buckets %v, got %v", tc.name, tc.expected, bounds)
+		}
+	}
+	if bounds := SmartBuckets(20 * time.Second); bounds[len(bounds)-1] != 60 {
+		t.Errorf("expected the slow route's buckets to reach 60s, got %v", bounds)
+	}
+}
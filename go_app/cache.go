@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Values of the result label of ResponseCacheRequests.
+const (
+	cacheHit     = "hit"
+	cacheMiss    = "miss"
+	cacheExpired = "expired"
+)
+
+// responseCache stores the full responses of the routes listed in routes
+// for ttl and serves them again without calling the handler. Entries are
+// evicted, least recently used first, to keep the cached bytes under
+// maxBytes.
+type responseCache struct {
+	metrics  *Metrics
+	routes   map[string]bool
+	ttl      time.Duration
+	maxBytes int
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // of *cacheEntry
+	lru     *list.List               // most recently used first
+	bytes   int
+}
+
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	size    int
+	expires time.Time
+}
+
+func (m *Metrics) newResponseCache(routes []string, ttl time.Duration, maxBytes int) *responseCache {
+	c := &responseCache{
+		metrics:  m,
+		routes:   map[string]bool{},
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		now:      time.Now,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+	for _, route := range routes {
+		c.routes[route] = true
+	}
+	return c
+}
+
+// middleware serves the GET and HEAD requests of the cached routes from the
+// cache, marking the responses with X-Cache: HIT or MISS. Responses other
+// than 200 and responses setting cookies are never stored.
+func (c *responseCache) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead || !c.routes[routeLabel(r)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := r.Method + " " + r.URL.RequestURI() + " " + r.Header.Get("Accept")
+		entry, result := c.get(key)
+		c.metrics.ResponseCacheRequests.WithLabelValues(result).Inc()
+		if entry != nil {
+			copyHeader(w.Header(), entry.header)
+			w.Header().Set("X-Cache", "HIT")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+
+		captured := &capturedResponse{header: http.Header{}}
+		next.ServeHTTP(captured, r)
+		if captured.status == 0 {
+			return
+		}
+		copyHeader(w.Header(), captured.header)
+		w.Header().Set("X-Cache", "MISS")
+		w.WriteHeader(captured.status)
+		w.Write(captured.body.Bytes())
+		if captured.status == http.StatusOK && captured.header.Get("Set-Cookie") == "" {
+			c.put(key, captured)
+		}
+	})
+}
+
+// get returns the entry stored under key if it has not expired, and the
+// result the lookup is counted as.
+func (c *responseCache) get(key string) (*cacheEntry, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, cacheMiss
+	}
+	entry := element.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(element)
+		c.updateGauges()
+		return nil, cacheExpired
+	}
+	c.lru.MoveToFront(element)
+	return entry, cacheHit
+}
+
+// put stores response under key, evicting the least recently used entries
+// to make room. Responses larger than the whole cache are not stored.
+func (c *responseCache) put(key string, response *capturedResponse) {
+	entry := &cacheEntry{
+		key:     key,
+		status:  response.status,
+		header:  response.header,
+		body:    response.body.Bytes(),
+		size:    len(key) + headerSize(response.header) + response.body.Len(),
+		expires: c.now().Add(c.ttl),
+	}
+	if entry.size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	for c.bytes+entry.size > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.metrics.ResponseCacheEvictions.Inc()
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.bytes += entry.size
+	c.updateGauges()
+}
+
+// remove drops element from the cache. c.mu must be held.
+func (c *responseCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+}
+
+// updateGauges reports the size of the cache. c.mu must be held.
+func (c *responseCache) updateGauges() {
+	c.metrics.ResponseCacheEntries.Set(float64(len(c.entries)))
+	c.metrics.ResponseCacheBytes.Set(float64(c.bytes))
+}
+
+// copyHeader sets the fields of src in dst, replacing their values.
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		dst[name] = append([]string(nil), values...)
+	}
+}
+
+// capturedResponse holds the whole response of a handler, header included,
+// so it can be stored before being sent.
+type capturedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *capturedResponse) Header() http.Header {
+	return c.header
+}
+
+func (c *capturedResponse) WriteHeader(statusCode int) {
+	if c.status == 0 {
+		c.status = statusCode
+	}
+}
+
+func (c *capturedResponse) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	return c.body.Write(p)
+}
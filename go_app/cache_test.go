@@ -0,0 +1,127 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestResponseCache returns a cache of the paths /a, /b, /cookie and
+// /missing in front of a handler echoing the path, and the number of calls
+// to that handler.
+func newTestResponseCache(maxBytes int) (*responseCache, http.Handler, *int) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	cache := metrics.newResponseCache([]string{"/a", "/b", "/cookie", "/missing"}, time.Minute, maxBytes)
+	calls := 0
+	handler := cache.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/cookie":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+		case "/missing":
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Repeat(r.URL.Path, 10)))
+	}))
+	return cache, handler, &calls
+}
+
+func serveCached(handler http.Handler, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder
+}
+
+func TestResponseCacheHit(t *testing.T) {
+	cache, handler, calls := newTestResponseCache(1 << 20)
+
+	miss := serveCached(handler, "/a")
+	hit := serveCached(handler, "/a")
+	if *calls != 1 {
+		t.Fatalf("expected the handler to be called once, got %d", *calls)
+	}
+	if miss.Header().Get("X-Cache") != "MISS" || hit.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("expected X-Cache MISS then HIT, got %q and %q", miss.Header().Get("X-Cache"), hit.Header().Get("X-Cache"))
+	}
+	if hit.Code != http.StatusOK || hit.Body.String() != miss.Body.String() || hit.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("expected the stored response, got %d %v %q", hit.Code, hit.Header(), hit.Body.String())
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/a", nil)
+	request.Header.Set("Accept", "application/json")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	if *calls != 2 {
+		t.Errorf("expected another Accept to miss the cache, got %d handler calls", *calls)
+	}
+
+	for _, result := range []string{cacheHit, cacheMiss} {
+		expected := map[string]float64{cacheHit: 1, cacheMiss: 2}[result]
+		if got := testutil.ToFloat64(cache.metrics.ResponseCacheRequests.WithLabelValues(result)); got != expected {
+			t.Errorf("expected %v %s lookups, got %v", expected, result, got)
+		}
+	}
+	if got := testutil.ToFloat64(cache.metrics.ResponseCacheEntries); got != 2 {
+		t.Errorf("expected 2 cached entries, got %v", got)
+	}
+}
+
+func TestResponseCacheBypass(t *testing.T) {
+	_, handler, calls := newTestResponseCache(1 << 20)
+	for _, path := range []string{"/cookie", "/missing", "/uncached"} {
+		serveCached(handler, path)
+		serveCached(handler, path)
+	}
+	if *calls != 6 {
+		t.Errorf("expected responses with cookies or errors and other routes never to be cached, got %d handler calls", *calls)
+	}
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+	cache, handler, calls := newTestResponseCache(1 << 20)
+	clock := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return clock }
+
+	serveCached(handler, "/a")
+	clock = clock.Add(59 * time.Second)
+	serveCached(handler, "/a")
+	clock = clock.Add(time.Second)
+	if recorder := serveCached(handler, "/a"); recorder.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("expected the entry to expire after its TTL, got X-Cache %q", recorder.Header().Get("X-Cache"))
+	}
+	if *calls != 2 {
+		t.Errorf("expected 2 handler calls, got %d", *calls)
+	}
+	if got := testutil.ToFloat64(cache.metrics.ResponseCacheRequests.WithLabelValues(cacheExpired)); got != 1 {
+		t.Errorf("expected 1 expired lookup, got %v", got)
+	}
+}
+
+func TestResponseCacheMemoryCap(t *testing.T) {
+	cache, handler, calls := newTestResponseCache(1 << 20)
+	serveCached(handler, "/a")
+	entrySize := int(testutil.ToFloat64(cache.metrics.ResponseCacheBytes))
+
+	cache, handler, calls = newTestResponseCache(entrySize + entrySize/2)
+	serveCached(handler, "/a")
+	serveCached(handler, "/b")
+	if got := testutil.ToFloat64(cache.metrics.ResponseCacheEntries); got != 1 {
+		t.Errorf("expected the cap to leave room for 1 entry, got %v", got)
+	}
+	if got := testutil.ToFloat64(cache.metrics.ResponseCacheBytes); got > float64(cache.maxBytes) {
+		t.Errorf("expected at most %d cached bytes, got %v", cache.maxBytes, got)
+	}
+	if got := testutil.ToFloat64(cache.metrics.ResponseCacheEvictions); got != 1 {
+		t.Errorf("expected 1 eviction, got %v", got)
+	}
+	serveCached(handler, "/b")
+	serveCached(handler, "/a")
+	if *calls != 3 {
+		t.Errorf("expected /b to stay cached and /a to be evicted, got %d handler calls", *calls)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sync/atomic"
+)
+
+type chainDepthKey struct{}
+
+// incrementDepth counts one more middleware layer for the request of ctx,
+// if chainDepthMiddleware is counting them.
+func incrementDepth(ctx context.Context) {
+	if depth, ok := ctx.Value(chainDepthKey{}).(*int32); ok {
+		atomic.AddInt32(depth, 1)
+	}
+}
+
+// chainDepthMiddleware observes in MiddlewareChainDepth how many of the
+// middleware layers inside it called incrementDepth for each request, so a
+// middleware registered twice stands out.
+func (m *Metrics) chainDepthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		depth := new(int32)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), chainDepthKey{}, depth)))
+		m.MiddlewareChainDepth.WithLabelValues(routeLabel(r)).Observe(float64(atomic.LoadInt32(depth)))
+	})
+}
+
+// depthCounted returns mw calling incrementDepth for every request it
+// handles.
+func depthCounted(mw mux.MiddlewareFunc) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		handler := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			incrementDepth(r.Context())
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
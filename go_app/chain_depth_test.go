@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareChainDepth(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	router := metrics.NewRouteTracker(mux.NewRouter())
+	router.HandleFunc("/chain", func(http.ResponseWriter, *http.Request) {})
+	router.Router.Use(metrics.chainDepthMiddleware)
+	passThrough := func(next http.Handler) http.Handler { return next }
+	for i := 0; i < 5; i++ {
+		router.Use(passThrough)
+	}
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/chain", nil))
+
+	var metric dto.Metric
+	if err := metrics.MiddlewareChainDepth.WithLabelValues("/chain").(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	histogram := metric.GetHistogram()
+	if histogram.GetSampleCount() != 1 || histogram.GetSampleSum() != 5 {
+		t.Fatalf("expected one request observed at depth 5, got %d with sum %v",
+			histogram.GetSampleCount(), histogram.GetSampleSum())
+	}
+	for _, bucket := range histogram.GetBucket() {
+		expected := uint64(0)
+		if bucket.GetUpperBound() >= 5 {
+			expected = 1
+		}
+		if bucket.GetCumulativeCount() != expected {
+			t.Errorf("bucket le=%v: expected %d, got %d", bucket.GetUpperBound(), expected, bucket.GetCumulativeCount())
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"example.com/m/recorder"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// States of a CircuitBreaker, as reported by CircuitBreakerState.
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// CircuitBreaker stops calling a failing handler: after threshold
+// consecutive failures, 5xx responses, it opens and answers 503 Service
+// Unavailable itself. Once timeout has passed, the next request is let
+// through as a probe, half-open, whose outcome closes or reopens it.
+type CircuitBreaker struct {
+	name      string
+	threshold int
+	timeout   time.Duration
+	metrics   *Metrics
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+// NewCircuitBreaker creates a closed breaker called name, the name label of
+// its metrics.
+func (m *Metrics) NewCircuitBreaker(name string, threshold int, timeout time.Duration) *CircuitBreaker {
+	m.CircuitBreakerState.WithLabelValues(name).Set(breakerClosed)
+	return &CircuitBreaker{name: name, threshold: threshold, timeout: timeout, metrics: m, now: time.Now}
+}
+
+// Wrap calls requestFunction through the breaker. A panic counts as a
+// failure and is passed on.
+func (b *CircuitBreaker) Wrap(
+	requestFunction func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !b.allow() {
+			http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		rec := recorder.NewRecorder(rw)
+		panicked := true
+		defer func() {
+			b.record(!panicked && rec.Status() < http.StatusInternalServerError)
+		}()
+		requestFunction(rec.Writer(), r)
+		panicked = false
+	}
+}
+
+// allow reports whether a request may go through, letting a single probe
+// through once the breaker has been open for its timeout.
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		open := b.now().Sub(b.openedAt)
+		if open < b.timeout {
+			return false
+		}
+		b.metrics.CircuitBreakerOpenDuration.WithLabelValues(b.name).Observe(open.Seconds())
+		b.setState(breakerHalfOpen)
+		return true
+	default:
+		// A probe is already in flight.
+		return false
+	}
+}
+
+// record updates the breaker with the outcome of a request it let through.
+func (b *CircuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case success:
+		b.failures = 0
+		b.setState(breakerClosed)
+	case b.state == breakerHalfOpen:
+		b.open()
+	default:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.open()
+		}
+	}
+}
+
+// open opens the breaker. b.mu must be held.
+func (b *CircuitBreaker) open() {
+	b.failures = 0
+	b.openedAt = b.now()
+	b.setState(breakerOpen)
+}
+
+// setState moves the breaker to state. b.mu must be held.
+func (b *CircuitBreaker) setState(state int) {
+	b.state = state
+	b.metrics.CircuitBreakerState.WithLabelValues(b.name).Set(float64(state))
+}
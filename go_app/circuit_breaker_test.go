@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpenDuration(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	const timeout = 50 * time.Millisecond
+	breaker := metrics.NewCircuitBreaker("greeting", 2, timeout)
+	status, calls := http.StatusInternalServerError, 0
+	handler := breaker.Wrap(func(rw http.ResponseWriter, _ *http.Request) {
+		calls++
+		rw.WriteHeader(status)
+	})
+	serve := func() int {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, "/greeting/Bob", nil))
+		return recorder.Code
+	}
+	state := func() float64 { return testutil.ToFloat64(metrics.CircuitBreakerState.WithLabelValues("greeting")) }
+
+	serve()
+	serve()
+	if code := serve(); code != http.StatusServiceUnavailable || calls != 2 || state() != breakerOpen {
+		t.Fatalf("expected the breaker to open after 2 failures, got %d after %d calls in state %v", code, calls, state())
+	}
+
+	time.Sleep(timeout)
+	status = http.StatusOK
+	if code := serve(); code != http.StatusOK || state() != breakerClosed {
+		t.Fatalf("expected the probe to go through and close the breaker, got %d in state %v", code, state())
+	}
+	var metric dto.Metric
+	if err := metrics.CircuitBreakerOpenDuration.WithLabelValues("greeting").(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	histogram := metric.GetHistogram()
+	if sum := histogram.GetSampleSum(); histogram.GetSampleCount() != 1 || sum < timeout.Seconds() || sum > 4*timeout.Seconds() {
+		t.Errorf("expected 1 open duration of about %s, got %d summing to %vs", timeout, histogram.GetSampleCount(), sum)
+	}
+}
+
+func TestCircuitBreakerFailedProbeReopens(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	breaker := metrics.NewCircuitBreaker("birthday", 1, time.Minute)
+	clock := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	breaker.now = func() time.Time { return clock }
+
+	breaker.allow()
+	breaker.record(false)
+	clock = clock.Add(time.Minute)
+	if !breaker.allow() || breaker.allow() {
+		t.Fatal("expected a single probe to be let through after the timeout")
+	}
+	breaker.record(false)
+	if breaker.allow() {
+		t.Error("expected a failed probe to reopen the breaker")
+	}
+}
+
+func TestCircuitBreakerPanickingProbeReopens(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	breaker := metrics.NewCircuitBreaker("greeting", 1, time.Minute)
+	clock := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	breaker.now = func() time.Time { return clock }
+	handler := breaker.Wrap(func(http.ResponseWriter, *http.Request) {
+		panic("handler failed")
+	})
+	serve := func() {
+		defer func() {
+			if p := recover(); p != nil && p != "handler failed" {
+				t.Errorf("expected the handler's panic to be passed on, got %v", p)
+			}
+		}()
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/greeting/Bob", nil))
+	}
+
+	serve()
+	if breaker.allow() {
+		t.Fatal("expected a panic to count as a failure")
+	}
+	clock = clock.Add(time.Minute)
+	serve()
+	if state := testutil.ToFloat64(metrics.CircuitBreakerState.WithLabelValues("greeting")); state != breakerOpen {
+		t.Errorf("expected the panicking probe to reopen the breaker, got state %v", state)
+	}
+	clock = clock.Add(time.Minute)
+	if !breaker.allow() {
+		t.Error("expected another probe once the breaker has been open for its timeout")
+	}
+}
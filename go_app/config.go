@@ -0,0 +1,826 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultContentType    = "text/plain; charset=utf-8"
+	defaultBirthdayDelay  = 20 * time.Second
+	defaultGreetingDelay  = 5 * time.Second
+	defaultGreetingSLO    = 6 * time.Second
+	defaultGreetingSuffix = ":)"
+	writeTimeoutMargin    = time.Second
+	maxGreetingSuffix     = 32
+	defaultMaxBodyBytes   = 1 << 20
+	defaultShutdownWait   = 30 * time.Second
+	defaultRetryAfter     = time.Second
+	defaultRateLimitBurst = 10
+	defaultExemplarMin    = 0.5
+	defaultSlowRequest    = 10 * time.Second
+	defaultSnapshotAge    = time.Hour
+	defaultStuckRequest   = 60 * time.Second
+	defaultMaxRedirects   = 10
+	defaultPanicBody      = "Internal Server Error"
+	defaultPushInterval   = 15 * time.Second
+	defaultPushTimeout    = 5 * time.Second
+	defaultPushAttempts   = 3
+	defaultPushBackoff    = time.Second
+	defaultPushMaxBackoff = 30 * time.Second
+	defaultOTLPInterval   = time.Minute
+	defaultOTLPTimeout    = 30 * time.Second
+	defaultCacheTTL       = time.Minute
+	defaultCacheMaxBytes  = 8 << 20
+	defaultHotPathTopN    = 5
+	defaultGoroutineCheck = 10 * time.Second
+	defaultMaxPathLabels  = 1000
+	defaultNamespace      = "go_app"
+	defaultSubsystem      = "api"
+)
+
+// ServerConfig holds the application settings read from the environment.
+type ServerConfig struct {
+	// DefaultContentType is set on responses whose handler did not set a
+	// Content-Type before the first write. An empty value disables it.
+	DefaultContentType string
+
+	// BirthdayHandlerDelay and GreetingHandlerDelay are the artificial delays
+	// of the birthday and greeting handlers. Both can be changed by a reload.
+	BirthdayHandlerDelay time.Duration
+	GreetingHandlerDelay time.Duration
+	// GreetingSuffix ends the messages of the birthday and greeting
+	// handlers. An empty value leaves the messages without a suffix.
+	GreetingSuffix string
+	// StartupDelay is the time the application waits for its dependencies
+	// to warm up before /startupz reports it as started.
+	StartupDelay time.Duration
+	// GreetingLatencyBudget is the latency SLO of the greeting endpoint.
+	GreetingLatencyBudget time.Duration
+	// WriteTimeout is the http.Server WriteTimeout; 0 disables it. It must
+	// leave writeTimeoutMargin after the longest handler delay, or the
+	// slow responses would be cut off.
+	WriteTimeout time.Duration
+
+	// MaxBodyBytes limits the size of request bodies; 0 disables the limit.
+	MaxBodyBytes int64
+	// MaxHeaderBytes limits the size of request headers, including the
+	// request line. Larger requests are rejected with 431.
+	MaxHeaderBytes int
+	// GzipMinSize is the size from which responses are gzip-encoded for
+	// the clients accepting it; 0 disables compression.
+	GzipMinSize int
+	// MaxPathLabels bounds the path label values of the request counter;
+	// beyond it the least recently used paths are folded into "other". 0
+	// disables the bound.
+	MaxPathLabels int
+	// HotPathInterval is how often the HotPathDetector logs the HotPathTopN
+	// busiest paths; 0, the default, disables it.
+	HotPathInterval time.Duration
+	HotPathTopN     int
+	// GoroutineLeakThreshold is the growth of the goroutine count, per
+	// minute, above which a leak is reported; 0 disables the check. The
+	// goroutines are counted every LeakCheckInterval.
+	GoroutineLeakThreshold int
+	LeakCheckInterval      time.Duration
+	// CacheRoutes are the path templates whose responses are cached for
+	// CacheTTL, in at most CacheMaxBytes.
+	CacheRoutes   []string
+	CacheTTL      time.Duration
+	CacheMaxBytes int
+
+	// PanicResponseBody is the plain text body of the 500 sent when a
+	// handler panics. Clients preferring JSON get {"error":"internal"}.
+	PanicResponseBody string
+
+	// RequestTimeout is the deadline the application gives every request; 0
+	// leaves requests without one. Clients can ask for a shorter deadline
+	// with the X-Timeout header, which RequestTimeout caps when set.
+	RequestTimeout time.Duration
+
+	// MaxRedirects is the number of redirect hops, counted in the
+	// X-Redirect-Count header, after which a request is rejected as a
+	// redirect loop; 0 disables the check.
+	MaxRedirects int
+
+	// RequiredHeader, if set, is a header every request must carry, such as
+	// X-API-Version, with one of RequiredHeaderValues when that is not
+	// empty. Other requests are rejected with 400.
+	RequiredHeader       string
+	RequiredHeaderValues []string
+
+	// ConcurrencyLimit bounds the concurrent requests to each of the slow
+	// endpoints; 0 disables the limit. Requests over the limit wait up to
+	// QueueWaitMax for a slot before being rejected with 503. The rejection's
+	// Retry-After starts at RetryAfterBase and grows with the queue.
+	ConcurrencyLimit int
+	QueueWaitMax     time.Duration
+	RetryAfterBase   time.Duration
+
+	// RateLimitRPS bounds the rate of requests to each of the slow
+	// endpoints; 0 disables the limit. Up to RateLimitBurst requests are let
+	// through at once, the others are rejected with 429.
+	RateLimitRPS   float64
+	RateLimitBurst int
+
+	// InstrumentationSkipList holds the path templates the monitoring
+	// middleware does not record. An entry ending in "/*" matches every
+	// template below that prefix. It can be changed by a reload.
+	InstrumentationSkipList []string
+
+	// InternalNetworks are the client networks whose requests are counted
+	// as internal rather than external traffic.
+	InternalNetworks []*net.IPNet
+	// Tenants are the X-Tenant-Id values counted under their own tenant
+	// label; other requests are counted as "unknown". Can be changed by a
+	// reload.
+	Tenants []string
+
+	// DisabledMetricGroups lists the metric groups the monitoring middleware
+	// starts with disabled, see metricGroups. With UnregisterDisabledGroups
+	// the families of a disabled group are unregistered as well, instead of
+	// being exposed with the values they had.
+	DisabledMetricGroups     []string
+	UnregisterDisabledGroups bool
+
+	// MetricNamespace and MetricSubsystem prefix the names of the
+	// application metrics, so several copies of the app can be told apart.
+	MetricNamespace string
+	MetricSubsystem string
+	// MetricNaming selects the NamingConvention, "legacy" or "standard".
+	MetricNaming string
+	// LatencyBuckets are the buckets of the request latency histograms, set
+	// from LATENCY_BUCKETS or, without it, LATENCY_BUCKET_PRESET. Nil keeps
+	// the default buckets.
+	LatencyBuckets []float64
+	// UseNativeHistograms also exposes the request latency histograms as
+	// native histograms, which need Prometheus 2.40 or later to be scraped.
+	UseNativeHistograms bool
+	// ConstLabels are attached to every metric the application registers,
+	// built from APP_ENV ("env"), APP_REGION ("region") and EXTRA_LABELS.
+	ConstLabels prometheus.Labels
+	// ConstLabelsOnRuntime also attaches ConstLabels to the Go and process
+	// collectors.
+	ConstLabelsOnRuntime bool
+	// SeparateRuntimeMetrics serves the Go and process collectors on
+	// /metrics/runtime instead of /metrics.
+	SeparateRuntimeMetrics bool
+	// MetricsAddress, if set, moves the metrics endpoints to their own
+	// listener on that address, served over TLS with MetricsTLSCertFile and
+	// MetricsTLSKeyFile when set. MetricsClientCAFile then requires clients
+	// to present a certificate signed by one of its CAs and, if
+	// MetricsAllowedClients is not empty, named by one of its entries in its
+	// common name or DNS names.
+	MetricsAddress        string
+	MetricsTLSCertFile    string
+	MetricsTLSKeyFile     string
+	MetricsClientCAFile   string
+	MetricsAllowedClients []string
+
+	// CounterSnapshotFile, if set, is where the application counters are saved
+	// on shutdown and restored from on startup, so raw totals survive
+	// restarts. Snapshots older than CounterSnapshotMaxAge are ignored.
+	CounterSnapshotFile   string
+	CounterSnapshotMaxAge time.Duration
+
+	// PushgatewayURL, if set, makes the application push its metrics to that
+	// Pushgateway under PushJob every PushInterval, and a last time on
+	// shutdown. Each push gives up after PushTimeout.
+	PushgatewayURL string
+	PushJob        string
+	PushInterval   time.Duration
+	PushTimeout    time.Duration
+	// A failed push is attempted up to PushMaxAttempts times in all, waiting
+	// PushBackoff before the first retry and doubling the wait, with jitter,
+	// up to PushMaxBackoff.
+	PushMaxAttempts int
+	PushBackoff     time.Duration
+	PushMaxBackoff  time.Duration
+
+	// OTLPEndpoint, if set, makes the application also export its metrics
+	// over OTLP/gRPC to that collector every OTLPInterval, each export
+	// giving up after OTLPTimeout. They are read from the standard
+	// OTEL_EXPORTER_OTLP_* and OTEL_METRIC_EXPORT_* variables.
+	OTLPEndpoint string
+	OTLPInsecure bool
+	OTLPInterval time.Duration
+	OTLPTimeout  time.Duration
+	// ServiceName is the service.name attribute of the exported metrics.
+	ServiceName string
+
+	// ShutdownTimeout bounds the time the shutdown hooks, which let in-flight
+	// requests finish, get after SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration
+
+	// LegacyEndpointMetrics keeps exposing the per-endpoint metrics under the
+	// names their routes pass to the create*Metric helpers, next to the shared
+	// endpoint_* families. It will be removed in the next release.
+	LegacyEndpointMetrics bool
+	// PerHandlerCounters keeps counting the requests to routes wrapped by
+	// createRequestCounterMetric in their own counters too, for anyone who
+	// depends on those series. Such requests are then counted twice across
+	// the request counters.
+	PerHandlerCounters bool
+
+	// RedirectTrailingSlash redirects paths with a trailing slash, such as
+	// /greeting/Bob/, to the route without it.
+	RedirectTrailingSlash bool
+
+	// MethodOverride lets POST requests choose PUT, PATCH or DELETE with the
+	// X-HTTP-Method-Override header, for clients behind restrictive proxies.
+	MethodOverride bool
+
+	// ExemplarCoverageMin is the share of requests carrying a trace ID below
+	// which a warning is logged, because exemplars are then too sparse to be
+	// useful.
+	ExemplarCoverageMin float64
+	// CounterExemplars attaches the trace ID or, without one, the
+	// X-Request-ID of each request as an exemplar to the request counter.
+	CounterExemplars bool
+
+	// ScrapeStaleness makes the application log a warning when /metrics has
+	// not been scraped successfully for that long; 0 disables the check.
+	ScrapeStaleness time.Duration
+
+	// ServerTiming adds a Server-Timing header with the time spent in the
+	// application and, behind a concurrency limit, queued. It is off by
+	// default because it discloses timing information to clients.
+	ServerTiming bool
+
+	// SlowRequestThreshold makes the access log warn about requests taking
+	// longer; 0 disables the warning.
+	SlowRequestThreshold time.Duration
+	// SlowLogSampleRate is the share of slow requests that are logged; all
+	// of them are counted.
+	SlowLogSampleRate float64
+	// AccessLogSampleRate is the share of the fast, successful requests the
+	// access log logs; failed and slow requests are always logged.
+	AccessLogSampleRate float64
+	// StuckRequestThreshold is the age past which a request still being
+	// served is reported as stuck; 0 disables the watchdog.
+	StuckRequestThreshold time.Duration
+	// LogTimeFormat selects how access log timestamps are encoded, "rfc3339"
+	// or "epoch_millis".
+	LogTimeFormat string
+
+	// DumpDir is where the goroutine dumps written on SIGQUIT go.
+	DumpDir string
+
+	// AdminUser and AdminPassword are the basic auth credentials of the
+	// /admin endpoints, which are only served with Debug and a password.
+	AdminUser     string
+	AdminPassword string
+
+	// Debug enables features that expose internals and must stay off in
+	// production, such as the X-Debug-Timing breakdown.
+	Debug bool
+}
+
+// defaultConfig returns the configuration used when no environment
+// variables are set.
+func defaultConfig() ServerConfig {
+	return ServerConfig{
+		DefaultContentType:    defaultContentType,
+		BirthdayHandlerDelay:  defaultBirthdayDelay,
+		GreetingHandlerDelay:  defaultGreetingDelay,
+		GreetingSuffix:        defaultGreetingSuffix,
+		GreetingLatencyBudget: defaultGreetingSLO,
+		MaxBodyBytes:          defaultMaxBodyBytes,
+		MaxHeaderBytes:        http.DefaultMaxHeaderBytes,
+		CacheTTL:              defaultCacheTTL,
+		HotPathTopN:           defaultHotPathTopN,
+		LeakCheckInterval:     defaultGoroutineCheck,
+		MaxPathLabels:         defaultMaxPathLabels,
+		CacheMaxBytes:         defaultCacheMaxBytes,
+		MaxRedirects:          defaultMaxRedirects,
+		PanicResponseBody:     defaultPanicBody,
+		RedirectTrailingSlash: true,
+		RetryAfterBase:        defaultRetryAfter,
+		RateLimitBurst:        defaultRateLimitBurst,
+		ShutdownTimeout:       defaultShutdownWait,
+		PushJob:               defaultNamespace,
+		PushInterval:          defaultPushInterval,
+		PushTimeout:           defaultPushTimeout,
+		PushMaxAttempts:       defaultPushAttempts,
+		PushBackoff:           defaultPushBackoff,
+		PushMaxBackoff:        defaultPushMaxBackoff,
+		OTLPInterval:          defaultOTLPInterval,
+		OTLPTimeout:           defaultOTLPTimeout,
+		ServiceName:           defaultNamespace,
+		CounterSnapshotMaxAge: defaultSnapshotAge,
+		LegacyEndpointMetrics: true,
+		InternalNetworks:      mustParseCIDRs(defaultInternalCIDRs),
+		ExemplarCoverageMin:   defaultExemplarMin,
+		CounterExemplars:      true,
+		InstrumentationSkipList: []string{
+			"/metrics", "/metrics/runtime", "/healthz", "/readyz", "/startupz", "/debug/*",
+		},
+		MetricNamespace:       defaultNamespace,
+		MetricSubsystem:       defaultSubsystem,
+		MetricNaming:          "legacy",
+		ConstLabels:           prometheus.Labels{},
+		LogTimeFormat:         logTimeRFC3339,
+		SlowRequestThreshold:  defaultSlowRequest,
+		SlowLogSampleRate:     1,
+		AccessLogSampleRate:   1,
+		StuckRequestThreshold: defaultStuckRequest,
+		DumpDir:               os.TempDir(),
+		AdminUser:             "admin",
+	}
+}
+
+// LoadConfig builds a ServerConfig from environment variables, using the
+// defaults for the ones that are not set.
+func LoadConfig() (ServerConfig, error) {
+	cfg := defaultConfig()
+	if value, ok := os.LookupEnv("DEFAULT_CONTENT_TYPE"); ok {
+		cfg.DefaultContentType = value
+	}
+
+	if err := durationFromEnv("BIRTHDAY_DELAY", &cfg.BirthdayHandlerDelay); err != nil {
+		return cfg, err
+	}
+	if err := durationFromEnv("GREETING_DELAY", &cfg.GreetingHandlerDelay); err != nil {
+		return cfg, err
+	}
+	if value, ok := os.LookupEnv("GREETING_SUFFIX"); ok {
+		if len(value) > maxGreetingSuffix {
+			return cfg, fmt.Errorf("GREETING_SUFFIX must be at most %d bytes, got %d", maxGreetingSuffix, len(value))
+		}
+		cfg.GreetingSuffix = value
+	}
+	if err := durationFromEnv("STARTUP_DELAY", &cfg.StartupDelay); err != nil {
+		return cfg, err
+	}
+	if err := durationFromEnv("GREETING_LATENCY_BUDGET", &cfg.GreetingLatencyBudget); err != nil {
+		return cfg, err
+	}
+	if cfg.GreetingLatencyBudget <= 0 {
+		return cfg, fmt.Errorf("GREETING_LATENCY_BUDGET must be positive, got %s", cfg.GreetingLatencyBudget)
+	}
+	if err := durationFromEnv("WRITE_TIMEOUT", &cfg.WriteTimeout); err != nil {
+		return cfg, err
+	}
+	if err := checkWriteTimeout(cfg); err != nil {
+		return cfg, err
+	}
+
+	maxBodyBytes := int(cfg.MaxBodyBytes)
+	if err := intFromEnv("MAX_BODY_BYTES", &maxBodyBytes); err != nil {
+		return cfg, err
+	}
+	cfg.MaxBodyBytes = int64(maxBodyBytes)
+	if err := intFromEnv("MAX_HEADER_BYTES", &cfg.MaxHeaderBytes); err != nil {
+		return cfg, err
+	}
+	if err := intFromEnv("GZIP_MIN_SIZE", &cfg.GzipMinSize); err != nil {
+		return cfg, err
+	}
+	cfg.CacheRoutes = splitList(os.Getenv("CACHE_ROUTES"))
+	if err := durationFromEnv("CACHE_TTL", &cfg.CacheTTL); err != nil {
+		return cfg, err
+	}
+	if err := intFromEnv("CACHE_MAX_BYTES", &cfg.CacheMaxBytes); err != nil {
+		return cfg, err
+	}
+	if err := durationFromEnv("HOT_PATH_INTERVAL", &cfg.HotPathInterval); err != nil {
+		return cfg, err
+	}
+	if err := intFromEnv("HOT_PATH_TOP", &cfg.HotPathTopN); err != nil {
+		return cfg, err
+	}
+	if cfg.HotPathTopN < 1 {
+		return cfg, fmt.Errorf("HOT_PATH_TOP must be at least 1, got %d", cfg.HotPathTopN)
+	}
+	if err := intFromEnv("GOROUTINE_LEAK_THRESHOLD", &cfg.GoroutineLeakThreshold); err != nil {
+		return cfg, err
+	}
+	if err := durationFromEnv("GOROUTINE_CHECK_INTERVAL", &cfg.LeakCheckInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.GoroutineLeakThreshold > 0 && cfg.LeakCheckInterval <= 0 {
+		return cfg, fmt.Errorf("GOROUTINE_CHECK_INTERVAL must be positive, got %s", cfg.LeakCheckInterval)
+	}
+	if err := intFromEnv("MAX_PATH_LABELS", &cfg.MaxPathLabels); err != nil {
+		return cfg, err
+	}
+	if value, ok := os.LookupEnv("PANIC_RESPONSE_BODY"); ok {
+		cfg.PanicResponseBody = value
+	}
+	if err := durationFromEnv("REQUEST_TIMEOUT", &cfg.RequestTimeout); err != nil {
+		return cfg, err
+	}
+	if err := intFromEnv("MAX_REDIRECTS", &cfg.MaxRedirects); err != nil {
+		return cfg, err
+	}
+	cfg.RequiredHeader = os.Getenv("REQUIRED_HEADER")
+	cfg.RequiredHeaderValues = splitList(os.Getenv("REQUIRED_HEADER_VALUES"))
+
+	if err := intFromEnv("CONCURRENCY_LIMIT", &cfg.ConcurrencyLimit); err != nil {
+		return cfg, err
+	}
+	if err := durationFromEnv("QUEUE_WAIT_MAX", &cfg.QueueWaitMax); err != nil {
+		return cfg, err
+	}
+	if err := durationFromEnv("RETRY_AFTER_BASE", &cfg.RetryAfterBase); err != nil {
+		return cfg, err
+	}
+	if value := os.Getenv("RATE_LIMIT_RPS"); value != "" {
+		rps, err := strconv.ParseFloat(value, 64)
+		if err != nil || rps < 0 {
+			return cfg, fmt.Errorf("RATE_LIMIT_RPS must be a non-negative number, got %q", value)
+		}
+		cfg.RateLimitRPS = rps
+	}
+	if err := intFromEnv("RATE_LIMIT_BURST", &cfg.RateLimitBurst); err != nil {
+		return cfg, err
+	}
+	if cfg.RateLimitRPS > 0 && cfg.RateLimitBurst < 1 {
+		return cfg, fmt.Errorf("RATE_LIMIT_BURST must be at least 1 with RATE_LIMIT_RPS set, got %d", cfg.RateLimitBurst)
+	}
+
+	if value, ok := os.LookupEnv("INSTRUMENTATION_SKIP_LIST"); ok {
+		cfg.InstrumentationSkipList = splitList(value)
+	}
+
+	if value, ok := os.LookupEnv("INTERNAL_CIDRS"); ok {
+		networks, err := parseCIDRs(splitList(value))
+		if err != nil {
+			return cfg, fmt.Errorf("INTERNAL_CIDRS must list networks like 10.0.0.0/8: %v", err)
+		}
+		cfg.InternalNetworks = networks
+	}
+
+	cfg.Tenants = splitList(os.Getenv("TENANTS"))
+
+	if value, ok := os.LookupEnv("DISABLED_METRIC_GROUPS"); ok {
+		cfg.DisabledMetricGroups = splitList(value)
+		for _, group := range cfg.DisabledMetricGroups {
+			if !validMetricGroup(group) {
+				return cfg, fmt.Errorf("DISABLED_METRIC_GROUPS must list groups among %v, got %q", metricGroups, group)
+			}
+		}
+	}
+	if err := boolFromEnv("UNREGISTER_DISABLED_GROUPS", &cfg.UnregisterDisabledGroups); err != nil {
+		return cfg, err
+	}
+
+	if value, ok := os.LookupEnv("METRIC_NAMESPACE"); ok {
+		cfg.MetricNamespace = value
+	}
+	if value, ok := os.LookupEnv("METRIC_SUBSYSTEM"); ok {
+		cfg.MetricSubsystem = value
+	}
+	if name := prometheus.BuildFQName(cfg.MetricNamespace, cfg.MetricSubsystem, "x"); !model.IsValidMetricName(model.LabelValue(name)) {
+		return cfg, fmt.Errorf("METRIC_NAMESPACE %q and METRIC_SUBSYSTEM %q do not form a valid metric name prefix",
+			cfg.MetricNamespace, cfg.MetricSubsystem)
+	}
+
+	if value := os.Getenv("METRIC_NAMING"); value != "" {
+		if _, err := namingConvention(value); err != nil {
+			return cfg, fmt.Errorf("METRIC_NAMING must be legacy or standard, got %q", value)
+		}
+		cfg.MetricNaming = value
+	}
+
+	if err := boolFromEnv("NATIVE_HISTOGRAMS", &cfg.UseNativeHistograms); err != nil {
+		return cfg, err
+	}
+	if value := os.Getenv("LATENCY_BUCKET_PRESET"); value != "" {
+		buckets, err := parseBucketPreset(value)
+		if err != nil {
+			return cfg, fmt.Errorf("LATENCY_BUCKET_PRESET %q is invalid: %v", value, err)
+		}
+		cfg.LatencyBuckets = buckets
+	}
+	if value := os.Getenv("LATENCY_BUCKETS"); value != "" {
+		buckets, err := parseBuckets(value)
+		if err != nil {
+			return cfg, fmt.Errorf("LATENCY_BUCKETS must list increasing bounds like 0.1,0.5,1, got %q: %v", value, err)
+		}
+		cfg.LatencyBuckets = buckets
+	}
+
+	if value := os.Getenv("APP_ENV"); value != "" {
+		cfg.ConstLabels["env"] = value
+	}
+	if value := os.Getenv("APP_REGION"); value != "" {
+		cfg.ConstLabels["region"] = value
+	}
+	if value := os.Getenv("EXTRA_LABELS"); value != "" {
+		if err := parseLabels(value, cfg.ConstLabels); err != nil {
+			return cfg, fmt.Errorf("EXTRA_LABELS must be a list like k=v,k2=v2: %v", err)
+		}
+	}
+	for name := range cfg.ConstLabels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return cfg, fmt.Errorf("invalid const label name %q: must match %s and not start with __",
+				name, model.LabelNameRE)
+		}
+	}
+
+	if err := boolFromEnv("CONST_LABELS_RUNTIME", &cfg.ConstLabelsOnRuntime); err != nil {
+		return cfg, err
+	}
+	if err := boolFromEnv("SEPARATE_RUNTIME_METRICS", &cfg.SeparateRuntimeMetrics); err != nil {
+		return cfg, err
+	}
+	cfg.MetricsAddress = os.Getenv("METRICS_ADDR")
+	cfg.MetricsTLSCertFile = os.Getenv("METRICS_TLS_CERT_FILE")
+	cfg.MetricsTLSKeyFile = os.Getenv("METRICS_TLS_KEY_FILE")
+	cfg.MetricsClientCAFile = os.Getenv("METRICS_CLIENT_CA_FILE")
+	cfg.MetricsAllowedClients = splitList(os.Getenv("METRICS_ALLOWED_CLIENTS"))
+	if (cfg.MetricsTLSCertFile == "") != (cfg.MetricsTLSKeyFile == "") {
+		return cfg, fmt.Errorf("METRICS_TLS_CERT_FILE and METRICS_TLS_KEY_FILE must be set together")
+	}
+	if cfg.MetricsClientCAFile != "" && cfg.MetricsTLSCertFile == "" {
+		return cfg, fmt.Errorf("METRICS_CLIENT_CA_FILE needs METRICS_TLS_CERT_FILE and METRICS_TLS_KEY_FILE")
+	}
+	if len(cfg.MetricsAllowedClients) > 0 && cfg.MetricsClientCAFile == "" {
+		return cfg, fmt.Errorf("METRICS_ALLOWED_CLIENTS needs METRICS_CLIENT_CA_FILE")
+	}
+
+	cfg.CounterSnapshotFile = os.Getenv("COUNTER_SNAPSHOT_FILE")
+	if err := durationFromEnv("COUNTER_SNAPSHOT_MAX_AGE", &cfg.CounterSnapshotMaxAge); err != nil {
+		return cfg, err
+	}
+
+	cfg.PushgatewayURL = os.Getenv("PUSHGATEWAY_URL")
+	if value := os.Getenv("PUSH_JOB"); value != "" {
+		cfg.PushJob = value
+	}
+	if err := durationFromEnv("PUSH_INTERVAL", &cfg.PushInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.PushInterval <= 0 {
+		return cfg, fmt.Errorf("PUSH_INTERVAL must be positive, got %s", cfg.PushInterval)
+	}
+	if err := durationFromEnv("PUSH_TIMEOUT", &cfg.PushTimeout); err != nil {
+		return cfg, err
+	}
+	if cfg.PushTimeout <= 0 {
+		return cfg, fmt.Errorf("PUSH_TIMEOUT must be positive, got %s", cfg.PushTimeout)
+	}
+	if err := intFromEnv("PUSH_MAX_ATTEMPTS", &cfg.PushMaxAttempts); err != nil {
+		return cfg, err
+	}
+	if cfg.PushMaxAttempts < 1 {
+		return cfg, fmt.Errorf("PUSH_MAX_ATTEMPTS must be at least 1, got %d", cfg.PushMaxAttempts)
+	}
+	if err := durationFromEnv("PUSH_BACKOFF", &cfg.PushBackoff); err != nil {
+		return cfg, err
+	}
+	if cfg.PushBackoff <= 0 {
+		return cfg, fmt.Errorf("PUSH_BACKOFF must be positive, got %s", cfg.PushBackoff)
+	}
+	if err := durationFromEnv("PUSH_MAX_BACKOFF", &cfg.PushMaxBackoff); err != nil {
+		return cfg, err
+	}
+	if cfg.PushMaxBackoff < cfg.PushBackoff {
+		return cfg, fmt.Errorf("PUSH_MAX_BACKOFF must be at least PUSH_BACKOFF (%s), got %s", cfg.PushBackoff, cfg.PushMaxBackoff)
+	}
+
+	if err := otlpFromEnv(&cfg); err != nil {
+		return cfg, err
+	}
+
+	if err := durationFromEnv("SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout); err != nil {
+		return cfg, err
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		return cfg, fmt.Errorf("SHUTDOWN_TIMEOUT must be positive, got %s", cfg.ShutdownTimeout)
+	}
+
+	if err := boolFromEnv("LEGACY_ENDPOINT_METRICS", &cfg.LegacyEndpointMetrics); err != nil {
+		return cfg, err
+	}
+
+	if err := boolFromEnv("PER_HANDLER_COUNTERS", &cfg.PerHandlerCounters); err != nil {
+		return cfg, err
+	}
+
+	if err := ratioFromEnv("EXEMPLAR_COVERAGE_MIN", &cfg.ExemplarCoverageMin); err != nil {
+		return cfg, err
+	}
+	if err := boolFromEnv("COUNTER_EXEMPLARS", &cfg.CounterExemplars); err != nil {
+		return cfg, err
+	}
+
+	if err := durationFromEnv("SCRAPE_STALENESS", &cfg.ScrapeStaleness); err != nil {
+		return cfg, err
+	}
+
+	if err := boolFromEnv("REDIRECT_TRAILING_SLASH", &cfg.RedirectTrailingSlash); err != nil {
+		return cfg, err
+	}
+
+	if err := boolFromEnv("METHOD_OVERRIDE", &cfg.MethodOverride); err != nil {
+		return cfg, err
+	}
+
+	if err := boolFromEnv("SERVER_TIMING", &cfg.ServerTiming); err != nil {
+		return cfg, err
+	}
+
+	if err := durationFromEnv("SLOW_REQUEST_THRESHOLD", &cfg.SlowRequestThreshold); err != nil {
+		return cfg, err
+	}
+	if err := ratioFromEnv("SLOW_LOG_SAMPLE_RATE", &cfg.SlowLogSampleRate); err != nil {
+		return cfg, err
+	}
+	if err := ratioFromEnv("ACCESS_LOG_SAMPLE_RATE", &cfg.AccessLogSampleRate); err != nil {
+		return cfg, err
+	}
+	if err := durationFromEnv("STUCK_REQUEST_THRESHOLD", &cfg.StuckRequestThreshold); err != nil {
+		return cfg, err
+	}
+	if value := os.Getenv("LOG_TIME_FORMAT"); value != "" {
+		if err := validLogTimeFormat(value); err != nil {
+			return cfg, fmt.Errorf("LOG_TIME_FORMAT must be %s or %s, got %q", logTimeRFC3339, logTimeEpochMillis, value)
+		}
+		cfg.LogTimeFormat = value
+	}
+
+	if value, ok := os.LookupEnv("DUMP_DIR"); ok {
+		cfg.DumpDir = value
+	}
+
+	if value := os.Getenv("ADMIN_USER"); value != "" {
+		cfg.AdminUser = value
+	}
+	cfg.AdminPassword = os.Getenv("ADMIN_PASSWORD")
+
+	if err := boolFromEnv("DEBUG", &cfg.Debug); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// checkWriteTimeout rejects a WriteTimeout that would cut off the responses
+// of the slowest handler, which net/http does silently.
+func checkWriteTimeout(cfg ServerConfig) error {
+	if cfg.WriteTimeout <= 0 {
+		return nil
+	}
+	longest, name := cfg.BirthdayHandlerDelay, "BIRTHDAY_DELAY"
+	if cfg.GreetingHandlerDelay > longest {
+		longest, name = cfg.GreetingHandlerDelay, "GREETING_DELAY"
+	}
+	if cfg.WriteTimeout < longest+writeTimeoutMargin {
+		return fmt.Errorf("WRITE_TIMEOUT must be at least %s, %s plus %s, got %s",
+			longest+writeTimeoutMargin, name, writeTimeoutMargin, cfg.WriteTimeout)
+	}
+	return nil
+}
+
+func mustParseCIDRs(cidrs []string) []*net.IPNet {
+	networks, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+// splitList splits a comma separated value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseLabels adds the comma separated name=value pairs of value to labels.
+func parseLabels(value string, labels prometheus.Labels) error {
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("malformed pair %q", pair)
+		}
+		if _, ok := labels[parts[0]]; ok {
+			return fmt.Errorf("duplicate label %q", parts[0])
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return nil
+}
+
+// boolFromEnv parses the environment variable name into target, leaving
+// target untouched when the variable is not set.
+func boolFromEnv(name string, target *bool) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("%s must be a boolean like true or false, got %q", name, value)
+	}
+	*target = enabled
+	return nil
+}
+
+// intFromEnv parses the environment variable name into target, leaving
+// target untouched when the variable is not set. Negative values are
+// rejected.
+func intFromEnv(name string, target *int) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return fmt.Errorf("%s must be a non-negative integer, got %q", name, value)
+	}
+	*target = number
+	return nil
+}
+
+// ratioFromEnv parses the environment variable name into target, leaving
+// target untouched when the variable is not set. Values outside [0, 1] are
+// rejected.
+func ratioFromEnv(name string, target *float64) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil || ratio < 0 || ratio > 1 {
+		return fmt.Errorf("%s must be a ratio between 0 and 1, got %q", name, value)
+	}
+	*target = ratio
+	return nil
+}
+
+// millisFromEnv parses the environment variable name, a number of
+// milliseconds as the OpenTelemetry variables use, into target, leaving
+// target untouched when the variable is not set.
+func millisFromEnv(name string, target *time.Duration) error {
+	millis := -1
+	if err := intFromEnv(name, &millis); err != nil {
+		return err
+	}
+	if millis >= 0 {
+		*target = time.Duration(millis) * time.Millisecond
+	}
+	return nil
+}
+
+// otlpFromEnv reads the OTLP export settings from the standard
+// OpenTelemetry variables, the metrics specific ones taking precedence.
+func otlpFromEnv(cfg *ServerConfig) error {
+	cfg.OTLPEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if value := os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"); value != "" {
+		cfg.OTLPEndpoint = value
+	}
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_INSECURE", "OTEL_EXPORTER_OTLP_METRICS_INSECURE"} {
+		if err := boolFromEnv(name, &cfg.OTLPInsecure); err != nil {
+			return err
+		}
+	}
+	if err := millisFromEnv("OTEL_METRIC_EXPORT_INTERVAL", &cfg.OTLPInterval); err != nil {
+		return err
+	}
+	if cfg.OTLPInterval <= 0 {
+		return fmt.Errorf("OTEL_METRIC_EXPORT_INTERVAL must be positive, got %s", cfg.OTLPInterval)
+	}
+	if err := millisFromEnv("OTEL_METRIC_EXPORT_TIMEOUT", &cfg.OTLPTimeout); err != nil {
+		return err
+	}
+	if cfg.OTLPTimeout <= 0 {
+		return fmt.Errorf("OTEL_METRIC_EXPORT_TIMEOUT must be positive, got %s", cfg.OTLPTimeout)
+	}
+	if value := os.Getenv("OTEL_SERVICE_NAME"); value != "" {
+		cfg.ServiceName = value
+	}
+	return nil
+}
+
+// durationFromEnv parses the environment variable name into target, leaving
+// target untouched when the variable is not set. The error names the variable
+// and gives the current value of target as an example of the expected format.
+// Negative durations are rejected.
+func durationFromEnv(name string, target *time.Duration) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%s must be a Go duration like %s, got %q", name, *target, value)
+	}
+	if duration < 0 {
+		return fmt.Errorf("%s must not be negative, got %s", name, duration)
+	}
+	*target = duration
+	return nil
+}
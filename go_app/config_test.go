@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setenv sets an environment variable for the duration of the test.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	previous, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(key, previous)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+}
+
+func TestLoadConfigConstLabels(t *testing.T) {
+	setenv(t, "APP_ENV", "staging")
+	setenv(t, "APP_REGION", "eu-west")
+	setenv(t, "EXTRA_LABELS", "team=obs, tier=demo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{"env": "staging", "region": "eu-west", "team": "obs", "tier": "demo"}
+	if len(cfg.ConstLabels) != len(expected) {
+		t.Fatalf("expected labels %v, got %v", expected, cfg.ConstLabels)
+	}
+	for name, value := range expected {
+		if cfg.ConstLabels[name] != value {
+			t.Errorf("expected %s=%q, got %q", name, value, cfg.ConstLabels[name])
+		}
+	}
+}
+
+func TestLoadConfigRejectsInvalidLabels(t *testing.T) {
+	for _, value := range []string{"1team=obs", "team-name=obs", "__reserved=x", "team", "team=obs,team=dev"} {
+		setenv(t, "EXTRA_LABELS", value)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("expected EXTRA_LABELS=%q to be rejected", value)
+		}
+	}
+}
+
+func TestLoadConfigRejectsInvalidNamespace(t *testing.T) {
+	setenv(t, "METRIC_NAMESPACE", "demo-copy")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected METRIC_NAMESPACE=demo-copy to be rejected")
+	}
+}
+
+func TestLoadConfigDurations(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		setenv(t, "BIRTHDAY_DELAY", "1500ms")
+		cfg, err := LoadConfig()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.BirthdayHandlerDelay != 1500*time.Millisecond {
+			t.Errorf("expected 1.5s, got %s", cfg.BirthdayHandlerDelay)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		setenv(t, "BIRTHDAY_DELAY", "20")
+		_, err := LoadConfig()
+		if err == nil {
+			t.Fatal("expected BIRTHDAY_DELAY=20 to be rejected")
+		}
+		if expected := "BIRTHDAY_DELAY must be a Go duration like 20s"; !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to contain %q, got %q", expected, err)
+		}
+	})
+	t.Run("negative", func(t *testing.T) {
+		setenv(t, "BIRTHDAY_DELAY", "-1s")
+		if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "must not be negative") {
+			t.Errorf("expected BIRTHDAY_DELAY=-1s to be rejected, got %v", err)
+		}
+	})
+	t.Run("unset", func(t *testing.T) {
+		setenv(t, "BIRTHDAY_DELAY", "")
+		cfg, err := LoadConfig()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.BirthdayHandlerDelay != defaultBirthdayDelay {
+			t.Errorf("expected default %s, got %s", defaultBirthdayDelay, cfg.BirthdayHandlerDelay)
+		}
+	})
+}
+
+func TestLoadConfigRejectsUnknownNaming(t *testing.T) {
+	setenv(t, "METRIC_NAMING", "camelCase")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected METRIC_NAMING=camelCase to be rejected")
+	}
+}
+
+func TestLoadConfigWriteTimeout(t *testing.T) {
+	setenv(t, "WRITE_TIMEOUT", "10s")
+	_, err := LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "BIRTHDAY_DELAY") {
+		t.Errorf("expected a 10s WRITE_TIMEOUT to conflict with the 20s birthday delay, got %v", err)
+	}
+
+	setenv(t, "BIRTHDAY_DELAY", "1s")
+	setenv(t, "GREETING_DELAY", "9.5s")
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "GREETING_DELAY") {
+		t.Errorf("expected a 10s WRITE_TIMEOUT to leave no margin after the greeting delay, got %v", err)
+	}
+
+	setenv(t, "GREETING_DELAY", "5s")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.WriteTimeout != 10*time.Second {
+		t.Errorf("expected WriteTimeout to be 10s, got %s", cfg.WriteTimeout)
+	}
+}
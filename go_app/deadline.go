@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"example.com/m/recorder"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// timeoutHeader lets clients set the deadline of their request, as a
+	// Go duration such as "2s".
+	timeoutHeader = "X-Timeout"
+	// appliedTimeoutHeader tells the client which deadline was applied.
+	appliedTimeoutHeader = "X-Timeout-Applied"
+)
+
+// Values of the source label of RequestTimeouts.
+const (
+	timeoutSourceClient = "client"
+	timeoutSourceServer = "server"
+)
+
+// requestTimeout returns the deadline to give r and who asked for it: the
+// client's X-Timeout, capped by maxTimeout unless it is 0, or else
+// maxTimeout. A zero timeout means the request gets no deadline.
+func requestTimeout(r *http.Request, maxTimeout time.Duration) (time.Duration, string) {
+	value := r.Header.Get(timeoutHeader)
+	if value == "" {
+		return maxTimeout, timeoutSourceServer
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		slog.Debug("ignoring invalid "+timeoutHeader, "value", value, "path", r.URL.Path)
+		return maxTimeout, timeoutSourceServer
+	}
+	if maxTimeout > 0 && timeout >= maxTimeout {
+		return maxTimeout, timeoutSourceServer
+	}
+	return timeout, timeoutSourceClient
+}
+
+// deadlineMiddleware gives every request the deadline chosen by
+// requestTimeout and reports it in the X-Timeout-Applied header. Handlers
+// that stop because the deadline passed before they responded get a 504,
+// and every request that exceeded its deadline is counted in
+// RequestTimeouts and observed in TimeoutConsumed. A request that used all
+// of the server's budget is observed at 1, while one stopped earlier by the
+// client's X-Timeout is observed below 1.
+func (m *Metrics) deadlineMiddleware(maxTimeout time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout, source := requestTimeout(r, maxTimeout)
+			if timeout <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			budget := maxTimeout
+			if budget <= 0 {
+				budget = timeout
+			}
+			startTime := time.Now()
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			w.Header().Set(appliedTimeoutHeader, timeout.String())
+
+			rec := recorder.NewRecorder(w)
+			next.ServeHTTP(rec.Writer(), r.WithContext(ctx))
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return
+			}
+			path := routeLabel(r)
+			m.RequestTimeouts.WithLabelValues(path, source).Inc()
+			m.TimeoutConsumed.WithLabelValues(path).Observe(float64(time.Since(startTime)) / float64(budget))
+			rec.TimeOut(http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientTimeoutHeader(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.RequestTimeout = time.Minute
+	router := NewRouter(cfg, newConfigReloader())
+
+	request := httptest.NewRequest(http.MethodGet, "/greeting/Bob", nil)
+	request.Header.Set(timeoutHeader, "100ms")
+	recorder := httptest.NewRecorder()
+	startTime := time.Now()
+	router.ServeHTTP(recorder, request)
+
+	if elapsed := time.Since(startTime); elapsed > time.Second {
+		t.Errorf("expected the request to end at its 100ms deadline, took %s", elapsed)
+	}
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected status %d, got %d", http.StatusGatewayTimeout, recorder.Code)
+	}
+	if applied := recorder.Header().Get(appliedTimeoutHeader); applied != "100ms" {
+		t.Errorf("expected %s 100ms, got %q", appliedTimeoutHeader, applied)
+	}
+
+	families := scrape(t, router)
+	for _, metric := range families["go_app_api_request_timeouts_total"].GetMetric() {
+		source := ""
+		for _, pair := range metric.GetLabel() {
+			if pair.GetName() == "source" {
+				source = pair.GetValue()
+			}
+		}
+		expected := 0.0
+		if source == timeoutSourceClient {
+			expected = 1
+		}
+		if got := metric.GetCounter().GetValue(); got != expected {
+			t.Errorf("expected %v timeouts from the %s, got %v", expected, source, got)
+		}
+	}
+	if len(families["go_app_api_request_timeouts_total"].GetMetric()) != 1 {
+		t.Error("expected the timeout to be counted once")
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name, header    string
+		maxTimeout      time.Duration
+		expectedTimeout time.Duration
+		expectedSource  string
+	}{
+		{"no header", "", time.Minute, time.Minute, timeoutSourceServer},
+		{"no deadline", "", 0, 0, timeoutSourceServer},
+		{"client", "2s", time.Minute, 2 * time.Second, timeoutSourceClient},
+		{"uncapped client", "2s", 0, 2 * time.Second, timeoutSourceClient},
+		{"capped", "2m", time.Minute, time.Minute, timeoutSourceServer},
+		{"invalid", "soon", time.Minute, time.Minute, timeoutSourceServer},
+		{"negative", "-1s", 0, 0, timeoutSourceServer},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.header != "" {
+				request.Header.Set(timeoutHeader, tc.header)
+			}
+			timeout, source := requestTimeout(request, tc.maxTimeout)
+			if timeout != tc.expectedTimeout || source != tc.expectedSource {
+				t.Errorf("expected %s from the %s, got %s from the %s",
+					tc.expectedTimeout, tc.expectedSource, timeout, source)
+			}
+		})
+	}
+}
+
+func TestTimeoutConsumedRatio(t *testing.T) {
+	const budget = 100 * time.Millisecond
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	router := mux.NewRouter()
+	blockUntilDone := func(_ http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}
+	router.HandleFunc("/full", blockUntilDone)
+	router.HandleFunc("/half", blockUntilDone)
+	router.Use(metrics.deadlineMiddleware(budget))
+
+	// One request runs into the server's budget, the other is stopped
+	// halfway by the client's deadline.
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/full", nil))
+	request := httptest.NewRequest(http.MethodGet, "/half", nil)
+	request.Header.Set(timeoutHeader, (budget / 2).String())
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	for _, tc := range []struct {
+		path     string
+		min, max float64
+	}{
+		{"/full", 1, 1.5},
+		{"/half", 0.5, 0.75},
+	} {
+		var metric dto.Metric
+		if err := metrics.TimeoutConsumed.WithLabelValues(tc.path).(prometheus.Metric).Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		histogram := metric.GetHistogram()
+		if histogram.GetSampleCount() != 1 {
+			t.Errorf("%s: expected 1 observation, got %d", tc.path, histogram.GetSampleCount())
+		}
+		if ratio := histogram.GetSampleSum(); ratio < tc.min || ratio > tc.max {
+			t.Errorf("%s: expected a ratio between %v and %v, got %v", tc.path, tc.min, tc.max, ratio)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Dependency is a downstream service the application calls. Its health is
+// checked periodically and exposed as DependencyUp.
+type Dependency struct {
+	name     string
+	check    func(context.Context) error
+	interval time.Duration
+	up       prometheus.Gauge
+	healthy  int32
+	stop     chan struct{}
+	metrics  *Metrics
+
+	// lastErr is the error of the last health check, served by the deep
+	// health check.
+	mu      sync.Mutex
+	lastErr error
+}
+
+// RegisterDependency checks the dependency called name with check right away
+// and then every interval, each check bounded by the interval, and adds it
+// to the deep health check. Stop ends the checks.
+func (m *Metrics) RegisterDependency(name string, interval time.Duration, check func(context.Context) error) *Dependency {
+	d := &Dependency{
+		name:     name,
+		check:    check,
+		interval: interval,
+		up:       m.DependencyUp.WithLabelValues(name),
+		stop:     make(chan struct{}),
+		metrics:  m,
+	}
+	d.refresh()
+	m.dependenciesMu.Lock()
+	m.dependencies = append(m.dependencies, d)
+	m.dependenciesMu.Unlock()
+	go d.run()
+	return d
+}
+
+func (d *Dependency) run() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.refresh()
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// refresh runs the health check, records its outcome and returns its error.
+func (d *Dependency) refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.interval)
+	defer cancel()
+	err := d.check(ctx)
+	d.mu.Lock()
+	d.lastErr = err
+	d.mu.Unlock()
+	healthy := int32(0)
+	if err == nil {
+		healthy = 1
+	}
+	if previous := atomic.SwapInt32(&d.healthy, healthy); previous != healthy && err != nil {
+		log.Printf("Dependency %s is down: %v", d.name, err)
+	}
+	d.up.Set(float64(healthy))
+	return err
+}
+
+// Healthy reports the outcome of the last health check.
+func (d *Dependency) Healthy() bool {
+	return atomic.LoadInt32(&d.healthy) == 1
+}
+
+// lastError returns the error of the last health check, nil if it passed.
+func (d *Dependency) lastError() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastErr
+}
+
+// Wrap answers with 503 Service Unavailable instead of calling
+// requestFunction while the dependency is down, like an open circuit breaker.
+func (d *Dependency) Wrap(
+	requestFunction func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !d.Healthy() {
+			http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		requestFunction(rw, r)
+	}
+}
+
+// Stop ends the health checks and removes the dependency from the deep
+// health check; the gauge keeps its last value.
+func (d *Dependency) Stop() {
+	close(d.stop)
+	m := d.metrics
+	m.dependenciesMu.Lock()
+	defer m.dependenciesMu.Unlock()
+	for i, registered := range m.dependencies {
+		if registered == d {
+			m.dependencies = append(m.dependencies[:i], m.dependencies[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDependencyHealth(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	var failing int32
+	dependency := metrics.RegisterDependency("fake", time.Hour, func(context.Context) error {
+		if atomic.LoadInt32(&failing) == 1 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	defer dependency.Stop()
+	handler := dependency.Wrap(generateWelcomeMessage)
+
+	for _, tc := range []struct {
+		failing        int32
+		expectedUp     float64
+		expectedStatus int
+	}{
+		{failing: 0, expectedUp: 1, expectedStatus: http.StatusOK},
+		{failing: 1, expectedUp: 0, expectedStatus: http.StatusServiceUnavailable},
+		{failing: 0, expectedUp: 1, expectedStatus: http.StatusOK},
+	} {
+		atomic.StoreInt32(&failing, tc.failing)
+		dependency.refresh()
+
+		if up := testutil.ToFloat64(metrics.DependencyUp.WithLabelValues("fake")); up != tc.expectedUp {
+			t.Errorf("failing=%d: expected dependency_up %v, got %v", tc.failing, tc.expectedUp, up)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		if recorder.Code != tc.expectedStatus {
+			t.Errorf("failing=%d: expected status %d, got %d", tc.failing, tc.expectedStatus, recorder.Code)
+		}
+	}
+}
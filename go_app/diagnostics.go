@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// writeGoroutines writes the stack of every goroutine to w, in the format
+// of an unrecovered panic, and counts it in DiagnosticDumps.
+func (m *Metrics) writeGoroutines(w io.Writer) error {
+	m.DiagnosticDumps.Inc()
+	return pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// dumpGoroutines writes the stack of every goroutine to a file in dir named
+// after now, logs a summary and returns the path of the file.
+func (m *Metrics) dumpGoroutines(dir string, now time.Time) (string, error) {
+	path := filepath.Join(dir, fmt.Sprintf("goroutines-%s.txt", now.UTC().Format("20060102T150405.000Z")))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if err := m.writeGoroutines(file); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	log.Printf("Wrote a dump of %d goroutines, with %d requests in flight, to %s",
+		runtime.NumGoroutine(), atomic.LoadInt64(&m.inFlight.current), path)
+	return path, nil
+}
+
+// watchDumpSignal writes a goroutine dump to dir every time the process
+// receives SIGQUIT, which no longer makes it exit, until the returned
+// function is called.
+func (m *Metrics) watchDumpSignal(dir string) func(context.Context) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGQUIT)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				if _, err := m.dumpGoroutines(dir, time.Now()); err != nil {
+					log.Printf("Writing the goroutine dump failed: %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func(context.Context) error {
+		signal.Stop(signals)
+		close(done)
+		return nil
+	}
+}
+
+// goroutinesHandler serves /debug/goroutines, which is only registered in
+// debug mode, with the same dump SIGQUIT writes.
+func (m *Metrics) goroutinesHandler(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := m.writeGoroutines(rw); err != nil {
+		log.Println(err.Error())
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDumpGoroutines(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	dir := t.TempDir()
+	now := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	path, err := metrics.dumpGoroutines(dir, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(dir, "goroutines-20240301T123000.000Z.txt"); path != expected {
+		t.Errorf("expected the dump at %s, got %s", expected, path)
+	}
+	dump, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(dump), "goroutine ") || !strings.Contains(string(dump), "TestDumpGoroutines") {
+		t.Errorf("expected the dump to contain the goroutine stacks, got %q", dump)
+	}
+	if dumps := testutil.ToFloat64(metrics.DiagnosticDumps); dumps != 1 {
+		t.Errorf("expected 1 dump counted, got %v", dumps)
+	}
+}
+
+func TestGoroutinesEndpoint(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Debug = true
+	router := NewRouter(cfg, newConfigReloader())
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/goroutines", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "goroutine ") {
+		t.Errorf("expected a goroutine dump, got %d: %q", recorder.Code, recorder.Body.String())
+	}
+	family := scrape(t, router)["go_app_diagnostic_dumps_total"]
+	if dumps := family.GetMetric()[0].GetCounter().GetValue(); dumps != 1 {
+		t.Errorf("expected 1 dump counted, got %v", dumps)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// withETag makes a handler whose response only depends on the request, such
+// as the greeting, answer conditional requests. The response is buffered to
+// tag it with a hash of its body, and a request whose If-None-Match lists
+// that tag gets a 304 Not Modified without a body instead. Handlers whose
+// body changes over time must not be wrapped.
+func withETag(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		buffered := &bufferedResponse{ResponseWriter: rw}
+		next(buffered, r)
+		status := buffered.status
+		if status == 0 {
+			// Nothing written, as when the request timed out: leave the
+			// response to the middlewares.
+			return
+		}
+		if status != http.StatusOK {
+			rw.WriteHeader(status)
+			rw.Write(buffered.body.Bytes())
+			return
+		}
+
+		sum := sha256.Sum256(buffered.body.Bytes())
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+		rw.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			header := rw.Header()
+			header.Del("Content-Type")
+			header.Del("Content-Length")
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.WriteHeader(status)
+		rw.Write(buffered.body.Bytes())
+	}
+}
+
+// etagMatches reports whether the If-None-Match header value lists etag,
+// comparing weakly as RFC 9110 requires, or is "*".
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedResponse holds back the status and body written by a handler.
+// Header changes go to the underlying response writer directly.
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) WriteHeader(statusCode int) {
+	if b.status == 0 {
+		b.status = statusCode
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
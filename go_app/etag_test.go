@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestETagConditionalGet(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.GreetingHandlerDelay = 0
+	router := NewRouter(cfg, newConfigReloader())
+
+	first := httptest.NewRecorder()
+	router.ServeHTTP(first, httptest.NewRequest(http.MethodGet, "/greeting/Bob", nil))
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" || first.Body.String() != "Greetings Bob :)" {
+		t.Fatalf("expected a tagged greeting, got %d %q with ETag %q", first.Code, first.Body.String(), etag)
+	}
+
+	conditional := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/greeting/Bob", nil)
+	request.Header.Set("If-None-Match", `"stale", `+etag)
+	router.ServeHTTP(conditional, request)
+	if conditional.Code != http.StatusNotModified || conditional.Body.Len() != 0 {
+		t.Fatalf("expected an empty 304, got %d %q", conditional.Code, conditional.Body.String())
+	}
+	if conditional.Header().Get("ETag") != etag {
+		t.Errorf("expected the 304 to carry ETag %s, got %q", etag, conditional.Header().Get("ETag"))
+	}
+
+	other := httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodGet, "/greeting/Alice", nil)
+	request.Header.Set("If-None-Match", etag)
+	router.ServeHTTP(other, request)
+	if other.Code != http.StatusOK || other.Header().Get("ETag") == etag {
+		t.Errorf("expected another name to get its own tag, got %d with ETag %q", other.Code, other.Header().Get("ETag"))
+	}
+
+	families := scrape(t, router)
+	var notModified float64
+	for _, metric := range families["go_app_api_responses_total"].GetMetric() {
+		labels := map[string]string{}
+		for _, pair := range metric.GetLabel() {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		if labels["path"] == greetingEndpoint && labels["status_class"] == "3xx" {
+			notModified = metric.GetCounter().GetValue()
+		}
+	}
+	if notModified != 1 {
+		t.Errorf("expected 1 greeting counted as 3xx, got %v", notModified)
+	}
+	sizes := findMetric(families["go_app_api_response_size_bytes"], "path", greetingEndpoint).GetHistogram()
+	if sizes.GetSampleCount() != 3 || sizes.GetSampleSum() != float64(len("Greetings Bob :)")+len("Greetings Alice :)")) {
+		t.Errorf("expected 3 responses with the 304 weighing 0 bytes, got %d summing to %v", sizes.GetSampleCount(), sizes.GetSampleSum())
+	}
+}
+
+func TestETagNotOnBirthday(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.BirthdayHandlerDelay = 0
+	router := NewRouter(cfg, newConfigReloader())
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/birthday/Bob", nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("ETag") != "" {
+		t.Errorf("expected an untagged birthday message, got %d with ETag %q", recorder.Code, recorder.Header().Get("ETag"))
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"unicode/utf8"
+)
+
+// exemplarWindow is the number of recent requests per path the exemplar
+// coverage is computed over.
+const exemplarWindow = 100
+
+// traceparentPattern matches a W3C traceparent header, capturing the trace
+// ID.
+var traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+// traceID returns the trace ID of r's traceparent header, or "" if it has
+// none. The all-zero trace ID is invalid and ignored.
+func traceID(r *http.Request) string {
+	match := traceparentPattern.FindStringSubmatch(r.Header.Get("traceparent"))
+	if match == nil || match[1] == "00000000000000000000000000000000" {
+		return ""
+	}
+	return match[1]
+}
+
+// exemplarCoverage is a collector exposing, per path, the share of recent
+// request duration observations that carried a trace ID exemplar. Exemplars
+// are only useful for jumping to traces if most observations have one, so
+// a warning is logged when a full window falls below threshold.
+type exemplarCoverage struct {
+	desc      *prometheus.Desc
+	threshold float64
+
+	mu      sync.Mutex
+	windows map[string]*ratioWindow
+	low     map[string]bool
+}
+
+func newExemplarCoverage(opts MetricOpts) *exemplarCoverage {
+	return &exemplarCoverage{
+		desc: prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "exemplar_injection_rate"),
+			"Share of the recent request duration observations that carried a trace ID exemplar.",
+			[]string{"path"}, nil),
+		windows: map[string]*ratioWindow{},
+		low:     map[string]bool{},
+	}
+}
+
+// record adds an observation for path, with or without exemplar.
+func (c *exemplarCoverage) record(path string, withExemplar bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	window, ok := c.windows[path]
+	if !ok {
+		window = newRatioWindow(exemplarWindow)
+		c.windows[path] = window
+	}
+	ratio := window.Add(withExemplar)
+	if !window.Full() {
+		return
+	}
+	if low := ratio < c.threshold; low != c.low[path] {
+		c.low[path] = low
+		if low {
+			log.Printf("WARNING: only %.0f%% of the recent requests to %s carried a trace ID, below %.0f%%",
+				ratio*100, path, c.threshold*100)
+		}
+	}
+}
+
+func (c *exemplarCoverage) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *exemplarCoverage) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	paths := make([]string, 0, len(c.windows))
+	for path := range c.windows {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, c.windows[path].Ratio(), path)
+	}
+}
+
+// observeDuration observes the duration of a request to path on
+// RequestDuration, with the request's trace ID as exemplar if it has one.
+func (m *Metrics) observeDuration(path string, r *http.Request, seconds float64) {
+	observer := m.RequestDuration.WithLabelValues(path, requestTenant(r.Context()))
+	id := traceID(r)
+	if id != "" {
+		observer.(prometheus.ExemplarObserver).ObserveWithExemplar(seconds, prometheus.Labels{"trace_id": id})
+	} else {
+		observer.Observe(seconds)
+	}
+	m.exemplars.record(path, id != "")
+}
+
+// maxRequestIDExemplar bounds the request IDs attached as exemplars, which
+// OpenMetrics limits to 128 characters including the label name.
+const maxRequestIDExemplar = 64
+
+// requestExemplar returns the exemplar labels identifying r: its trace ID
+// or, without one, its X-Request-ID. It returns nil if r has neither, or
+// only a request ID that cannot be an exemplar label value.
+func requestExemplar(r *http.Request) prometheus.Labels {
+	if id := traceID(r); id != "" {
+		return prometheus.Labels{"trace_id": id}
+	}
+	if id := r.Header.Get(requestIDHeader); id != "" && utf8.ValidString(id) && utf8.RuneCountInString(id) <= maxRequestIDExemplar {
+		return prometheus.Labels{"request_id": id}
+	}
+	return nil
+}
+
+// countRequest counts r in RequestCounter, with an exemplar identifying the
+// request unless counter exemplars are disabled, within the bound of
+// requestPaths.
+func (m *Metrics) countRequest(path string, r *http.Request) {
+	m.requestPaths.count(path, []string{requestSource(r.Context()), requestTenant(r.Context())}, func(counter prometheus.Counter) {
+		if labels := requestExemplar(r); m.counterExemplars && labels != nil {
+			counter.(prometheus.ExemplarAdder).AddWithExemplar(1, labels)
+			return
+		}
+		counter.Inc()
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExemplarInjectionRate(t *testing.T) {
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+
+	cfg := defaultConfig()
+	cfg.ExemplarCoverageMin = 0.6
+	router := NewRouter(cfg, newConfigReloader())
+	for i := 0; i < 100; i++ {
+		request := httptest.NewRequest(http.MethodGet, "/echo/hi", nil)
+		if i%2 == 0 {
+			request.Header.Set("traceparent", fmt.Sprintf("00-%032x-00f067aa0ba902b7-01", i+1))
+		}
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	metric := findMetric(scrape(t, router)["go_app_api_exemplar_injection_rate"], "path", echoEndpoint)
+	if rate := metric.GetGauge().GetValue(); rate < 0.49 || rate > 0.51 {
+		t.Errorf("expected an exemplar injection rate of about 0.5, got %v", rate)
+	}
+	if !strings.Contains(logs.String(), "carried a trace ID") {
+		t.Errorf("expected a warning about the low exemplar coverage, got %q", logs.String())
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	request.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if !strings.Contains(recorder.Body.String(), `# {trace_id="`) {
+		t.Error("expected the request duration histogram to carry trace ID exemplars")
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	for header, expected := range map[string]string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": "4bf92f3577b34da6a3ce929d0e0e4736",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01": "",
+		"not-a-traceparent": "",
+		"":                  "",
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("traceparent", header)
+		if id := traceID(request); id != expected {
+			t.Errorf("traceparent %q: expected trace ID %q, got %q", header, expected, id)
+		}
+	}
+}
+
+func TestRequestExemplar(t *testing.T) {
+	for id, expected := range map[string]string{
+		"req-42":   "req-42",
+		"\xff\xfe": "",
+		strings.Repeat("x", maxRequestIDExemplar+1): "",
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/echo/hi", nil)
+		request.Header.Set(requestIDHeader, id)
+		labels := requestExemplar(request)
+		if (labels == nil) != (expected == "") || labels["request_id"] != expected {
+			t.Errorf("request ID %q: expected exemplar %q, got %v", id, expected, labels)
+		}
+	}
+}
+
+func TestRequestCounterExemplars(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		cfg := defaultConfig()
+		cfg.CounterExemplars = enabled
+		router := NewRouter(cfg, newConfigReloader())
+		request := httptest.NewRequest(http.MethodGet, "/echo/hi", nil)
+		request.Header.Set(requestIDHeader, "req-42")
+		router.ServeHTTP(httptest.NewRecorder(), request)
+
+		request = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		request.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		// OpenMetrics exposes counters without the _total suffix, such as
+		// the legacy request_counter, as unknown, exemplars included.
+		var counterLine string
+		for _, line := range strings.Split(recorder.Body.String(), "\n") {
+			if strings.HasPrefix(line, "go_app_api_request_counter{") && strings.Contains(line, echoEndpoint) {
+				counterLine = line
+			}
+		}
+		if hasExemplar := strings.Contains(counterLine, `# {request_id="req-42"} 1`); hasExemplar != enabled {
+			t.Errorf("enabled %v: expected the request counter exemplar %v, got %q", enabled, enabled, counterLine)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata with the current /metrics exposition")
+
+// goldenTraffic is the traffic sent to the router before the golden scrape,
+// touching every route and a few error paths.
+var goldenTraffic = []struct{ method, path string }{
+	{http.MethodGet, welcomeEndpoint},
+	{http.MethodGet, "/echo/hello"},
+	{http.MethodHead, "/echo/hello"},
+	{http.MethodGet, "/greeting/ana"},
+	{http.MethodGet, "/birthday/ana"},
+	{http.MethodGet, healthEndpoint},
+	{http.MethodPost, "/echo/hello"},
+	{http.MethodGet, "/missing"},
+}
+
+// TestMetricsGolden compares the /metrics exposition after goldenTraffic with
+// the golden files in testdata, so that renaming a metric, a label or a help
+// string is a deliberate change. Run go test -run TestMetricsGolden -update
+// to accept the current exposition.
+func TestMetricsGolden(t *testing.T) {
+	for name, configure := range map[string]func(*ServerConfig){
+		"default":      func(*ServerConfig) {},
+		"const_labels": func(cfg *ServerConfig) { cfg.ConstLabels = map[string]string{"env": "test"} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.BirthdayHandlerDelay = 0
+			cfg.GreetingHandlerDelay = 0
+			configure(&cfg)
+			router := NewRouter(cfg, newConfigReloader())
+			for _, request := range goldenTraffic {
+				router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(request.method, request.path, nil))
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("scraping /metrics returned status %d", recorder.Code)
+			}
+			got := normalizeExposition(recorder.Body.String())
+
+			path := filepath.Join("testdata", "metrics_"+name+".golden")
+			if *update {
+				if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v; run with -update to create it", err)
+			}
+			if diff := lineDiff(string(want), got); diff != "" {
+				t.Errorf("/metrics differs from %s (-want +got), run with -update if intended:\n%s", path, diff)
+			}
+		})
+	}
+}
+
+// normalizeExposition drops the runtime families from a text exposition and
+// replaces what depends on timing with placeholders: the values of the
+// families measuring time, and their bucket counts. Observation counts are
+// kept, as is every bucket bound, so a changed layout still shows.
+func normalizeExposition(text string) string {
+	var (
+		lines          []string
+		skip, isTiming bool
+	)
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+			name := strings.Fields(line)[2]
+			skip, isTiming = runtimeFamily(name), timingFamily(name)
+			if !skip {
+				lines = append(lines, line)
+			}
+			continue
+		}
+		if skip {
+			continue
+		}
+		// Drop the timestamp, if any, after the value.
+		series, rest := line, ""
+		if end := strings.LastIndex(line, "}"); end >= 0 {
+			series, rest = line[:end+1], line[end+1:]
+		} else if fields := strings.Fields(line); len(fields) > 0 {
+			series, rest = fields[0], strings.Join(fields[1:], " ")
+		}
+		value := strings.Fields(rest)[0]
+		name := series
+		if brace := strings.Index(series, "{"); brace >= 0 {
+			name = series[:brace]
+		}
+		switch {
+		case !isTiming || strings.HasSuffix(name, "_count"):
+		case strings.HasSuffix(name, "_bucket"):
+			value = "<count>"
+		default:
+			value = "<duration>"
+		}
+		lines = append(lines, series+" "+value)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// runtimeFamily reports whether the family describes the Go runtime or the
+// process rather than the application.
+func runtimeFamily(name string) bool {
+	if strings.HasPrefix(name, defaultNamespace+"_") {
+		return strings.HasPrefix(name, defaultNamespace+"_runtime_")
+	}
+	return strings.HasPrefix(name, "go_") || strings.HasPrefix(name, "process_")
+}
+
+// timingFamily reports whether the values of the family depend on how long
+// things took.
+func timingFamily(name string) bool {
+	for _, word := range []string{"seconds", "duration", "latency"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// lineDiff returns the lines removed from want and added in got, prefixed
+// with - and + and their line number, or "" if they are equal.
+func lineDiff(want, got string) string {
+	a, b := strings.Split(want, "\n"), strings.Split(got, "\n")
+	// common[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:].
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+	var diff strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || common[i+1][j] >= common[i][j+1]):
+			fmt.Fprintf(&diff, "-%d: %s\n", i+1, a[i])
+			i++
+		default:
+			fmt.Fprintf(&diff, "+%d: %s\n", j+1, b[j])
+			j++
+		}
+	}
+	return diff.String()
+}
+
+func TestNormalizeExposition(t *testing.T) {
+	text := `# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines 7
+# HELP go_app_runtime_heap_alloc_bytes Bytes of allocated heap objects.
+# TYPE go_app_runtime_heap_alloc_bytes gauge
+go_app_runtime_heap_alloc_bytes 1.48e+06
+# HELP go_app_api_request_duration_seconds Duration of HTTP requests.
+# TYPE go_app_api_request_duration_seconds histogram
+go_app_api_request_duration_seconds_bucket{path="/",le="0.005"} 1
+go_app_api_request_duration_seconds_bucket{path="/",le="+Inf"} 1
+go_app_api_request_duration_seconds_sum{path="/"} 2.3132e-05
+go_app_api_request_duration_seconds_count{path="/"} 1
+# HELP go_app_api_response_size_bytes Size of HTTP responses.
+# TYPE go_app_api_response_size_bytes histogram
+go_app_api_response_size_bytes_bucket{path="/",le="100"} 1
+go_app_api_response_size_bytes_sum{path="/"} 8 1700000000000
+go_app_api_response_size_bytes_count{path="/"} 1
+`
+	expected := `# HELP go_app_api_request_duration_seconds Duration of HTTP requests.
+# TYPE go_app_api_request_duration_seconds histogram
+go_app_api_request_duration_seconds_bucket{path="/",le="0.005"} <count>
+go_app_api_request_duration_seconds_bucket{path="/",le="+Inf"} <count>
+go_app_api_request_duration_seconds_sum{path="/"} <duration>
+go_app_api_request_duration_seconds_count{path="/"} 1
+# HELP go_app_api_response_size_bytes Size of HTTP responses.
+# TYPE go_app_api_response_size_bytes histogram
+go_app_api_response_size_bytes_bucket{path="/",le="100"} 1
+go_app_api_response_size_bytes_sum{path="/"} 8
+go_app_api_response_size_bytes_count{path="/"} 1
+`
+	if got := normalizeExposition(text); got != expected {
+		t.Errorf("unexpected normalization:\n%s", lineDiff(expected, got))
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	want := "a\nb\nc\n"
+	if diff := lineDiff(want, want); diff != "" {
+		t.Errorf("expected no diff for equal texts, got %q", diff)
+	}
+	if diff, expected := lineDiff(want, "a\nB\nc\n"), "-2: b\n+2: B\n"; diff != expected {
+		t.Errorf("expected %q, got %q", expected, diff)
+	}
+}
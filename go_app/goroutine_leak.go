@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log/slog"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// goroutineLeakWindow is the span over which LeakDetector measures the
+// growth of the goroutine count.
+const goroutineLeakWindow = time.Minute
+
+// LeakDetector samples the number of goroutines and flags a leak when it
+// grows faster than a threshold over the last minute, as a count that
+// keeps climbing under steady traffic usually means goroutines are stuck.
+type LeakDetector struct {
+	// threshold is the growth, in goroutines per minute, above which a
+	// leak is reported.
+	threshold    float64
+	numGoroutine func() int
+	logger       *slog.Logger
+	growth       prometheus.Gauge
+	detected     prometheus.Gauge
+
+	mu sync.Mutex
+	// samples hold the readings of the last goroutineLeakWindow, plus the
+	// newest one before it as the baseline.
+	samples []goroutineSample
+	leaking bool
+
+	ticker *time.Ticker
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type goroutineSample struct {
+	time  time.Time
+	count int
+}
+
+// NewGoroutineLeakDetector starts counting goroutines every checkInterval
+// and reporting a leak when they grow by more than threshold a minute,
+// under the default metric names. Stop ends the readings.
+func NewGoroutineLeakDetector(threshold int, checkInterval time.Duration, registry *prometheus.Registry) *LeakDetector {
+	d := newLeakDetector(registry, newMetricOpts(defaultConfig()), newLogger(os.Stderr, logTimeRFC3339), threshold)
+	d.start(checkInterval)
+	return d
+}
+
+// newLeakDetector creates a detector registering its gauges with
+// registerer. It does not start counting.
+func newLeakDetector(registerer prometheus.Registerer, opts MetricOpts, logger *slog.Logger, threshold int) *LeakDetector {
+	opts.Subsystem = "runtime"
+	factory := promauto.With(registerer)
+	return &LeakDetector{
+		threshold:    float64(threshold),
+		numGoroutine: runtime.NumGoroutine,
+		logger:       logger,
+		growth: factory.NewGauge(opts.Gauge("goroutine_growth_rate",
+			"Growth of the number of goroutines over the last minute, per minute.")),
+		detected: factory.NewGauge(opts.Gauge("goroutine_leak_detected",
+			"1 while the goroutines grow faster than the leak threshold, 0 otherwise.")),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+func (d *LeakDetector) start(interval time.Duration) {
+	d.sample(time.Now())
+	d.ticker = time.NewTicker(interval)
+	go d.run(d.ticker.C)
+}
+
+func (d *LeakDetector) run(ticks <-chan time.Time) {
+	defer close(d.done)
+	for {
+		select {
+		case now := <-ticks:
+			d.sample(now)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// sample counts the goroutines at now and updates the growth rate since the
+// oldest reading of the window. It returns the rate.
+func (d *LeakDetector) sample(now time.Time) float64 {
+	count := d.numGoroutine()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.samples = append(d.samples, goroutineSample{time: now, count: count})
+	// Keep a single reading older than the window, as its start.
+	for len(d.samples) > 2 && !d.samples[1].time.After(now.Add(-goroutineLeakWindow)) {
+		d.samples = d.samples[1:]
+	}
+	oldest := d.samples[0]
+	elapsed := now.Sub(oldest.time)
+	if elapsed <= 0 {
+		return 0
+	}
+	rate := float64(count-oldest.count) / elapsed.Minutes()
+	d.growth.Set(rate)
+
+	leaking := rate > d.threshold
+	if leaking && !d.leaking {
+		d.logger.Warn("goroutine leak suspected",
+			"goroutines", count, "growth_per_minute", rate, "threshold", d.threshold)
+	}
+	d.leaking = leaking
+	if leaking {
+		d.detected.Set(1)
+	} else {
+		d.detected.Set(0)
+	}
+	return rate
+}
+
+// Stop ends the readings; the gauges keep their last values.
+func (d *LeakDetector) Stop(context.Context) error {
+	if d.ticker != nil {
+		d.ticker.Stop()
+	}
+	close(d.stop)
+	<-d.done
+	return nil
+}
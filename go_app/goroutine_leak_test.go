@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeakDetectorTriggers(t *testing.T) {
+	var logs bytes.Buffer
+	detector := newLeakDetector(prometheus.NewRegistry(), newMetricOpts(defaultConfig()), newLogger(&logs, logTimeRFC3339), 50)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	detector.sample(start)
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+	for interval := 1; interval <= 2; interval++ {
+		for i := 0; i < 50; i++ {
+			go func() { <-stuck }()
+		}
+		detector.sample(start.Add(time.Duration(interval) * 10 * time.Second))
+	}
+
+	// 100 goroutines in 20 seconds is about 300 a minute.
+	if rate := testutil.ToFloat64(detector.growth); rate < 250 {
+		t.Errorf("expected a growth of about 300 goroutines a minute, got %v", rate)
+	}
+	if got := testutil.ToFloat64(detector.detected); got != 1 {
+		t.Errorf("expected the leak to be detected, got %v", got)
+	}
+	if !strings.Contains(logs.String(), "goroutine leak suspected") {
+		t.Errorf("expected a warning, got %q", logs.String())
+	}
+}
+
+func TestLeakDetectorWindow(t *testing.T) {
+	count := 100
+	detector := newLeakDetector(prometheus.NewRegistry(), newMetricOpts(defaultConfig()), newLogger(&bytes.Buffer{}, logTimeRFC3339), 50)
+	detector.numGoroutine = func() int { return count }
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	detector.sample(start)
+	count += 100
+	detector.sample(start.Add(30 * time.Second))
+	if got := testutil.ToFloat64(detector.detected); got != 1 {
+		t.Fatalf("expected 200 goroutines a minute to be a leak, got %v", got)
+	}
+
+	// Once the burst falls out of the window, a flat count is no leak.
+	for elapsed := 40 * time.Second; elapsed <= 2*time.Minute; elapsed += 10 * time.Second {
+		detector.sample(start.Add(elapsed))
+	}
+	if got := testutil.ToFloat64(detector.growth); got != 0 {
+		t.Errorf("expected no growth over the last minute, got %v", got)
+	}
+	if got := testutil.ToFloat64(detector.detected); got != 0 {
+		t.Errorf("expected the leak to be cleared, got %v", got)
+	}
+	if len(detector.samples) > 8 {
+		t.Errorf("expected the samples to be bounded by the window, got %d", len(detector.samples))
+	}
+}
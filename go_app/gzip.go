@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"example.com/m/recorder"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressionCounters count, by path, the bytes of the responses the gzip
+// middleware compressed, before and after compression.
+type compressionCounters struct {
+	original   *prometheus.CounterVec
+	compressed *prometheus.CounterVec
+	savings    *prometheus.CounterVec
+}
+
+func newCompressionCounters(factory familyFactory, opts MetricOpts) *compressionCounters {
+	return &compressionCounters{
+		original: factory.NewCounterVec(
+			opts.Counter("compression_original_bytes_total", "Total bytes of the gzip-encoded HTTP responses before compression."),
+			[]string{"path"}),
+		compressed: factory.NewCounterVec(
+			opts.Counter("compression_compressed_bytes_total", "Total bytes of the gzip-encoded HTTP responses after compression."),
+			[]string{"path"}),
+		savings: factory.NewCounterVec(
+			opts.Counter("request_compression_savings_bytes_total", "Total bytes saved by gzip-encoding HTTP responses."),
+			[]string{"path"}),
+	}
+}
+
+// NewGzipMiddleware returns a middleware gzip-encoding the responses of at
+// least minSizeBytes to clients accepting gzip, and registers its counters
+// with registry under the default metric names.
+func NewGzipMiddleware(minSizeBytes int, registry *prometheus.Registry) func(http.Handler) http.Handler {
+	return newCompressionCounters(familyFactory{Factory: promauto.With(registry)}, newMetricOpts(defaultConfig())).middleware(minSizeBytes)
+}
+
+func (c *compressionCounters) middleware(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize}
+			next.ServeHTTP(gw, r)
+			gw.finish()
+			if gw.gz == nil {
+				return
+			}
+			path := routeLabel(r)
+			c.original.WithLabelValues(path).Add(float64(gw.original))
+			c.compressed.WithLabelValues(path).Add(float64(gw.compressed.n))
+			// Incompressible bodies can grow a little; count them as no
+			// savings, as a counter cannot go down.
+			if saved := gw.original - gw.compressed.n; saved > 0 {
+				c.savings.WithLabelValues(path).Add(float64(saved))
+			}
+		})
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header value lists gzip
+// without a zero quality.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		quality, err := strconv.ParseFloat(q, 64)
+		return err == nil && quality > 0
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the start of the body until it reaches minSize,
+// then sends the rest gzip-encoded. Shorter bodies, bodies the handler
+// encoded itself and responses without a body are sent as they are by
+// finish.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+
+	status     int
+	buffer     bytes.Buffer
+	decided    bool
+	gz         *gzip.Writer
+	original   int64
+	compressed byteCounter
+}
+
+// byteCounter counts the bytes written through it.
+type byteCounter struct {
+	w http.ResponseWriter
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (g *gzipResponseWriter) WriteHeader(statusCode int) {
+	if g.status != 0 || g.decided {
+		return
+	}
+	g.status = statusCode
+	if !recorder.BodyAllowedForStatus(statusCode) || g.Header().Get("Content-Encoding") != "" {
+		g.passThrough()
+	}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.status == 0 {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.decided {
+		if g.gz == nil {
+			return g.ResponseWriter.Write(p)
+		}
+		g.original += int64(len(p))
+		return g.gz.Write(p)
+	}
+	g.buffer.Write(p)
+	if g.buffer.Len() >= g.minSize {
+		if err := g.startGzip(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// startGzip sends the header of a gzip-encoded response and the buffered
+// start of the body.
+func (g *gzipResponseWriter) startGzip() error {
+	g.decided = true
+	header := g.Header()
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.status)
+	g.compressed.w = g.ResponseWriter
+	g.gz = gzip.NewWriter(&g.compressed)
+	g.original = int64(g.buffer.Len())
+	_, err := g.gz.Write(g.buffer.Bytes())
+	g.buffer.Reset()
+	return err
+}
+
+// passThrough sends the header, and the body buffered so far, unencoded.
+func (g *gzipResponseWriter) passThrough() {
+	g.decided = true
+	g.ResponseWriter.WriteHeader(g.status)
+	if g.buffer.Len() > 0 {
+		g.ResponseWriter.Write(g.buffer.Bytes())
+		g.buffer.Reset()
+	}
+}
+
+// finish sends what is still buffered once the handler has returned.
+func (g *gzipResponseWriter) finish() {
+	switch {
+	case g.gz != nil:
+		g.gz.Close()
+	case !g.decided && g.status != 0:
+		g.passThrough()
+	}
+}
+
+// Hijack passes the connection through; nothing is encoded after a
+// hijack.
+func (g *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	g.decided = true
+	return hijack(g.ResponseWriter)
+}
+
+// maxDecodedBodyBytes caps the decoded request bodies when MAX_BODY_BYTES
+// does not, as a small gzip stream can decode to gigabytes.
+const maxDecodedBodyBytes = 16 << 20
+
+// decompressMiddleware decodes the gzip-encoded request bodies, so handlers
+// read them as the client wrote them. The body is decoded before the handler
+// runs: a malformed one is answered with 400, and one larger than limit
+// bytes once decoded with 413. A limit of 0 caps the decoded bodies at
+// maxDecodedBodyBytes instead.
+func decompressMiddleware(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := strings.TrimSpace(r.Header.Get("Content-Encoding"))
+			if !strings.EqualFold(encoding, "gzip") && !strings.EqualFold(encoding, "x-gzip") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			body, err := gunzip(r.Body, limit)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				http.Error(w, "malformed gzip request body", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.Header.Del("Content-Encoding")
+			r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// gunzip reads and decodes the gzip stream of body, failing with an
+// *http.MaxBytesError as soon as the decoded bytes exceed limit, or
+// maxDecodedBodyBytes if limit is 0.
+func gunzip(body io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		limit = maxDecodedBodyBytes
+	}
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	data, err := io.ReadAll(io.LimitReader(gz, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, &http.MaxBytesError{Limit: limit}
+	}
+	return data, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipMiddleware(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	body := strings.Repeat("Greetings Bob :)\n", 10240/17+1)
+	handler := NewGzipMiddleware(1024, registry)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/small" {
+			w.Write([]byte("small"))
+			return
+		}
+		w.Write([]byte(body[:5000]))
+		w.Write([]byte(body[5000:]))
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, "/large", nil)
+	request.Header.Set("Accept-Encoding", "deflate, gzip;q=0.8")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzip-encoded response, got headers %v", recorder.Header())
+	}
+	compressedSize := recorder.Body.Len()
+	reader, err := gzip.NewReader(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := ioutil.ReadAll(reader); err != nil || string(decoded) != body {
+		t.Fatalf("expected the body to decode to the original, got %d bytes, %v", len(decoded), err)
+	}
+
+	original := gatheredValue(t, registry, "go_app_api_compression_original_bytes_total")
+	compressed := gatheredValue(t, registry, "go_app_api_compression_compressed_bytes_total")
+	savings := gatheredValue(t, registry, "go_app_api_request_compression_savings_bytes_total")
+	if original != float64(len(body)) || compressed != float64(compressedSize) {
+		t.Errorf("expected %d original and %d compressed bytes, got %v and %v", len(body), compressedSize, original, compressed)
+	}
+	if compressed > original/10 || savings != original-compressed {
+		t.Errorf("expected the repetitive body to shrink tenfold, got %v of %v bytes and %v saved", compressed, original, savings)
+	}
+
+	for _, tc := range []struct{ path, acceptEncoding string }{
+		{"/small", "gzip"},
+		{"/large", ""},
+		{"/large", "gzip;q=0"},
+	} {
+		request := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		request.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Header().Get("Content-Encoding") != "" || recorder.Body.Len() == 0 {
+			t.Errorf("%s with Accept-Encoding %q: expected an unencoded body, got %v", tc.path, tc.acceptEncoding, recorder.Header())
+		}
+	}
+	if got := gatheredValue(t, registry, "go_app_api_compression_original_bytes_total"); got != original {
+		t.Errorf("expected the unencoded responses not to be counted, got %v bytes", got)
+	}
+}
+
+func TestDecompressMiddleware(t *testing.T) {
+	gzipped := func(body string) *bytes.Buffer {
+		var buffer bytes.Buffer
+		gz := gzip.NewWriter(&buffer)
+		gz.Write([]byte(body))
+		gz.Close()
+		return &buffer
+	}
+	var seen string
+	handler := Chain(maxBodyMiddleware(1024), decompressMiddleware(1024)).Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading the body: %v", err)
+		}
+		seen = string(body)
+		if r.Header.Get("Content-Encoding") != "" || r.ContentLength != int64(len(body)) {
+			t.Errorf("expected the decoded body to be described, got Content-Encoding %q and length %d",
+				r.Header.Get("Content-Encoding"), r.ContentLength)
+		}
+	}))
+
+	for name, tc := range map[string]struct {
+		body     io.Reader
+		encoding string
+		status   int
+		seen     string
+	}{
+		"gzip":           {body: gzipped(`{"name":"ana"}`), encoding: "gzip", status: http.StatusOK, seen: `{"name":"ana"}`},
+		"x-gzip":         {body: gzipped("hello"), encoding: "X-Gzip", status: http.StatusOK, seen: "hello"},
+		"identity":       {body: strings.NewReader("plain"), status: http.StatusOK, seen: "plain"},
+		"malformed":      {body: strings.NewReader("not gzip at all"), encoding: "gzip", status: http.StatusBadRequest},
+		"truncated":      {body: io.LimitReader(gzipped(strings.Repeat("truncated ", 50)), 20), encoding: "gzip", status: http.StatusBadRequest},
+		"decoded limit":  {body: gzipped(strings.Repeat("a", 1025)), encoding: "gzip", status: http.StatusRequestEntityTooLarge},
+		"decoded at max": {body: gzipped(strings.Repeat("a", 1024)), encoding: "gzip", status: http.StatusOK, seen: strings.Repeat("a", 1024)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			seen = ""
+			request := httptest.NewRequest(http.MethodPost, "/echo/hello", tc.body)
+			request.Header.Set("Content-Encoding", tc.encoding)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != tc.status {
+				t.Errorf("expected status %d, got %d: %s", tc.status, recorder.Code, recorder.Body)
+			}
+			if seen != tc.seen {
+				t.Errorf("expected the handler to read %q, got %q", tc.seen, seen)
+			}
+		})
+	}
+}
+
+func TestGunzipCapsUnlimitedBodies(t *testing.T) {
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	gz.Write(make([]byte, maxDecodedBodyBytes+1))
+	gz.Close()
+	var tooLarge *http.MaxBytesError
+	if _, err := gunzip(&buffer, 0); !errors.As(err, &tooLarge) || tooLarge.Limit != maxDecodedBodyBytes {
+		t.Errorf("expected a body over %d bytes to be refused without a limit, got %v", maxDecodedBodyBytes, err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HandlerConfig carries the settings and collectors injected into a handler
+// constructor.
+type HandlerConfig struct {
+	// Delay is the artificial delay the handler waits before responding.
+	Delay *simulatedDelay
+	// SleepHistogram observes the time the handler actually spent waiting.
+	SleepHistogram prometheus.Observer
+	// DebugTiming allows clients to request a Server-Timing breakdown.
+	DebugTiming bool
+	// Suffix ends the message, separated from it by a space.
+	Suffix string
+	// Sprintf, if set, times the formatting of a sample of the messages.
+	Sprintf *SprintfSampler
+}
+
+// message appends the configured suffix to text.
+func (cfg HandlerConfig) message(text string) string {
+	if cfg.Suffix == "" {
+		return text
+	}
+	return cfg.Sprintf.Sprintf("%s %s", text, cfg.Suffix)
+}
+
+// simulatedDelay is an artificial handler delay that can be changed while the
+// handler is serving requests.
+type simulatedDelay struct {
+	nanos int64
+}
+
+func newSimulatedDelay(d time.Duration) *simulatedDelay {
+	return &simulatedDelay{nanos: int64(d)}
+}
+
+func (d *simulatedDelay) Get() time.Duration {
+	return time.Duration(atomic.LoadInt64(&d.nanos))
+}
+
+func (d *simulatedDelay) Set(delay time.Duration) {
+	atomic.StoreInt64(&d.nanos, int64(delay))
+}
+
+func generateWelcomeMessage(rw http.ResponseWriter, _ *http.Request) {
+	if _, err := rw.Write([]byte("Welcome!")); err != nil {
+		log.Println(err.Error())
+		http.Error(rw, err.Error(), 500)
+	}
+}
+
+func generateBirthdayMessage(cfg HandlerConfig) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		greetings := cfg.message("Happy Birthday " + name)
+		timing := startServerTiming(rw, r, cfg.DebugTiming)
+		sleepStart := time.Now()
+		if err := SleepWithMetric(r.Context(), cfg.Delay.Get(), cfg.SleepHistogram); err != nil {
+			return
+		}
+		timing.Phase("sleep", sleepStart)
+		writeStart := time.Now()
+		if _, err := rw.Write([]byte(greetings)); err != nil {
+			log.Println(err.Error())
+			http.Error(rw, err.Error(), 500)
+		}
+		timing.Phase("write", writeStart)
+		timing.Finish()
+	}
+}
+
+func generateGreetingMessage(cfg HandlerConfig) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		greetings := cfg.message("Greetings " + name)
+		timing := startServerTiming(rw, r, cfg.DebugTiming)
+		sleepStart := time.Now()
+		if err := SleepWithMetric(r.Context(), cfg.Delay.Get(), cfg.SleepHistogram); err != nil {
+			return
+		}
+		timing.Phase("sleep", sleepStart)
+		writeStart := time.Now()
+		if _, err := rw.Write([]byte(greetings)); err != nil {
+			log.Println(err.Error())
+			http.Error(rw, err.Error(), 500)
+		}
+		timing.Phase("write", writeStart)
+		timing.Finish()
+	}
+}
+
+func generateEchoMessage(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	message := vars["message"]
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := rw.Write([]byte(message)); err != nil {
+		log.Println(err.Error())
+		http.Error(rw, err.Error(), 500)
+	}
+}
+
+// DecodeJSONWithMetrics decodes the JSON request body into target. A failed
+// decode increments counter, whose remaining error_type label is set to
+// "syntax", "type_mismatch", "eof" or, for anything else such as a failed
+// body read, "other".
+func DecodeJSONWithMetrics(r *http.Request, target interface{}, counter *prometheus.CounterVec) error {
+	err := json.NewDecoder(r.Body).Decode(target)
+	if err == nil {
+		return nil
+	}
+	counter.WithLabelValues(jsonErrorType(err)).Inc()
+	return fmt.Errorf("decoding JSON request body: %w", err)
+}
+
+func jsonErrorType(err error) string {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxError):
+		return "syntax"
+	case errors.As(err, &typeError):
+		return "type_mismatch"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHandlerConfig returns a HandlerConfig with a delay short enough for
+// unit tests.
+func testHandlerConfig() HandlerConfig {
+	return HandlerConfig{
+		Delay:          newSimulatedDelay(time.Millisecond),
+		SleepHistogram: prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_sleep_seconds"}),
+		Suffix:         defaultGreetingSuffix,
+	}
+}
+
+func TestGenerateMessages(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc(birthdayEndpoint, generateBirthdayMessage(testHandlerConfig()))
+	router.HandleFunc(greetingEndpoint, generateGreetingMessage(testHandlerConfig()))
+
+	for path, expected := range map[string]string{
+		"/birthday/Bob": "Happy Birthday Bob :)",
+		"/greeting/Bob": "Greetings Bob :)",
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := recorder.Body.String(); got != expected {
+			t.Errorf("GET %s: expected %q, got %q", path, expected, got)
+		}
+	}
+}
+
+func TestGreetingSuffix(t *testing.T) {
+	setenv(t, "GREETING_SUFFIX", "<3")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handlerConfig := testHandlerConfig()
+	handlerConfig.Suffix = cfg.GreetingSuffix
+	router := mux.NewRouter()
+	router.HandleFunc(birthdayEndpoint, generateBirthdayMessage(handlerConfig))
+	router.HandleFunc(greetingEndpoint, generateGreetingMessage(handlerConfig))
+
+	for path, expected := range map[string]string{
+		"/birthday/Bob": "Happy Birthday Bob <3",
+		"/greeting/Bob": "Greetings Bob <3",
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := recorder.Body.String(); got != expected {
+			t.Errorf("GET %s: expected %q, got %q", path, expected, got)
+		}
+	}
+
+	setenv(t, "GREETING_SUFFIX", strings.Repeat(":)", maxGreetingSuffix))
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected a suffix over the limit to be rejected")
+	}
+}
+
+func TestDecodeJSONWithMetrics(t *testing.T) {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_parse_errors_total"},
+		[]string{"path", "error_type"})
+	pathCounter := counter.MustCurryWith(prometheus.Labels{"path": "/test"})
+
+	for body, errorType := range map[string]string{
+		`{"name": `:         "eof",
+		``:                  "eof",
+		`{"name": Bob}`:     "syntax",
+		`{"name": 42}`:      "type_mismatch",
+		`{"name": ["Bob"]}`: "type_mismatch",
+	} {
+		var target struct {
+			Name string `json:"name"`
+		}
+		before := testutil.ToFloat64(counter.WithLabelValues("/test", errorType))
+		err := DecodeJSONWithMetrics(httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(body)), &target, pathCounter)
+		if err == nil {
+			t.Errorf("expected decoding %q to fail", body)
+			continue
+		}
+		if got := testutil.ToFloat64(counter.WithLabelValues("/test", errorType)) - before; got != 1 {
+			t.Errorf("decoding %q: expected %s counter to increase by 1, got %v", body, errorType, got)
+		}
+	}
+
+	var target struct {
+		Name string `json:"name"`
+	}
+	if err := DecodeJSONWithMetrics(httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(`{"name":"Bob"}`)), &target, pathCounter); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if target.Name != "Bob" {
+		t.Errorf("expected name Bob, got %q", target.Name)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import "net/http"
+
+// headerSizeBuckets range from 256B to 64KB.
+var headerSizeBuckets = []float64{256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+
+// headerSize returns the size of header as the sum of the lengths of its
+// names and values.
+func headerSize(header http.Header) int {
+	size := 0
+	for name, values := range header {
+		for _, value := range values {
+			size += len(name) + len(value)
+		}
+	}
+	return size
+}
+
+// headerLimitSlack is how much larger than MAX_HEADER_BYTES a request
+// header net/http reads, so that the requests exceeding the limit by less
+// reach headerLimitMiddleware, which counts them. net/http answers larger
+// ones with a 431 of its own, uncounted.
+const headerLimitSlack = 64 << 10
+
+// serverMaxHeaderBytes returns the http.Server.MaxHeaderBytes letting the
+// headers up to maxBytes plus headerLimitSlack reach the handler.
+func serverMaxHeaderBytes(maxBytes int) int {
+	if maxBytes <= 0 {
+		maxBytes = http.DefaultMaxHeaderBytes
+	}
+	return maxBytes + headerLimitSlack
+}
+
+// requestHeaderBytes returns the size of the header of r as sent by an
+// HTTP/1.1 client, request line included.
+func requestHeaderBytes(r *http.Request) int {
+	size := len(r.Method) + 1 + len(r.RequestURI) + 1 + len(r.Proto) + 2
+	if r.Host != "" {
+		size += len("Host: ") + len(r.Host) + 2
+	}
+	for name, values := range r.Header {
+		for _, value := range values {
+			size += len(name) + 2 + len(value) + 2
+		}
+	}
+	return size
+}
+
+// headerLimitMiddleware answers with 431 Request Header Fields Too Large the
+// requests whose header is larger than maxBytes, or than
+// http.DefaultMaxHeaderBytes if it is not positive, and counts them in
+// HeaderTooLarge.
+func (m *Metrics) headerLimitMiddleware(maxBytes int) func(http.Handler) http.Handler {
+	if maxBytes <= 0 {
+		maxBytes = http.DefaultMaxHeaderBytes
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if requestHeaderBytes(r) > maxBytes {
+				m.HeaderTooLarge.Inc()
+				http.Error(rw, http.StatusText(http.StatusRequestHeaderFieldsTooLarge),
+					http.StatusRequestHeaderFieldsTooLarge)
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
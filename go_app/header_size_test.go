@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// assertBucket checks that observer holds one observation, in the bucket
+// whose upper bound is le.
+func assertBucket(t *testing.T, name string, observer prometheus.Observer, le float64) {
+	t.Helper()
+	var metric dto.Metric
+	if err := observer.(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	var previous uint64
+	for _, bucket := range metric.GetHistogram().GetBucket() {
+		count := bucket.GetCumulativeCount() - previous
+		previous = bucket.GetCumulativeCount()
+		expected := uint64(0)
+		if bucket.GetUpperBound() == le {
+			expected = 1
+		}
+		if count != expected {
+			t.Errorf("%s: expected %d observations in bucket le=%v, got %d", name, expected, bucket.GetUpperBound(), count)
+		}
+	}
+}
+
+func TestHeaderSizeMetrics(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	router := mux.NewRouter()
+	router.HandleFunc("/headers", func(w http.ResponseWriter, r *http.Request) {
+		// 5 + 3000 bytes.
+		w.Header().Set("X-Big", strings.Repeat("b", 3000))
+	})
+	router.Use(metrics.monitoringMiddleware)
+
+	request := httptest.NewRequest(http.MethodGet, "/headers", nil)
+	// 9 + 1000 bytes.
+	request.Header.Set("X-Payload", strings.Repeat("p", 1000))
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	assertBucket(t, "request", metrics.RequestHeaderBytes.WithLabelValues("/headers"), 1024)
+	assertBucket(t, "response", metrics.ResponseHeaderBytes.WithLabelValues("/headers"), 4096)
+}
+
+func TestResponseHeaderCount(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	router := mux.NewRouter()
+	router.HandleFunc("/headers", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 20; i++ {
+			// 11 + 40 bytes each.
+			w.Header().Set(fmt.Sprintf("X-Custom-%02d", i), strings.Repeat("v", 40))
+		}
+	})
+	router.Use(metrics.monitoringMiddleware)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/headers", nil))
+
+	assertBucket(t, "count", metrics.ResponseHeaderCount.WithLabelValues("/headers"), 32)
+	assertBucket(t, "bytes", metrics.ResponseHeaderBytes.WithLabelValues("/headers"), 1024)
+}
+
+func TestHeaderSizeAtWriteTime(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	router := mux.NewRouter()
+	router.HandleFunc("/headers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Before", "sent")
+		w.Write([]byte("body"))
+		// Too late to be sent, so not measured either.
+		w.Header().Set("X-After", strings.Repeat("a", 1000))
+	})
+	router.Use(metrics.monitoringMiddleware)
+
+	request := httptest.NewRequest(http.MethodGet, "/headers", nil)
+	request.Header.Set("Accept", "text/plain")
+	request.Header.Set("User-Agent", "header-test")
+	request.Header.Add("X-Forwarded-For", "10.0.0.1")
+	request.Header.Add("X-Forwarded-For", "10.0.0.2")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	if count, sum := histogramSum(t, metrics.RequestHeaderBytes, "/headers"); count != 1 || sum != float64(headerSize(request.Header)) {
+		t.Errorf("expected one request observation of %d bytes, got %d totalling %v", headerSize(request.Header), count, sum)
+	}
+	if count, sum := histogramSum(t, metrics.ResponseHeaderBytes, "/headers"); count != 1 || sum == 0 || sum >= 1000 {
+		t.Errorf("expected one response observation of the header sent with the body, got %d totalling %v", count, sum)
+	}
+}
+
+func TestHeaderTooLargeCounted(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ShutdownTimeout = time.Second
+	cfg.MaxHeaderBytes = 1024
+	baseURL := startTestApp(t, cfg)
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	request, err := http.NewRequest(http.MethodGet, baseURL+"/echo/hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("X-Payload", strings.Repeat("p", 2048))
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("expected status %d, got %d", http.StatusRequestHeaderFieldsTooLarge, response.StatusCode)
+	}
+
+	family := scrapeURL(t, client, baseURL)["go_app_api_request_header_too_large_total"]
+	if family == nil || family.GetMetric()[0].GetCounter().GetValue() != 1 {
+		t.Errorf("expected 1 rejected request counted, got %v", family)
+	}
+}
+
+func TestHeaderTooLargeOverHTTP2(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	server := httptest.NewUnstartedServer(metrics.headerLimitMiddleware(1024)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("X-Payload", strings.Repeat("p", 2048))
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.ProtoMajor != 2 || response.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("expected an HTTP/2 %d, got %s %d", http.StatusRequestHeaderFieldsTooLarge, response.Proto, response.StatusCode)
+	}
+	if got := testutil.ToFloat64(metrics.HeaderTooLarge); got != 1 {
+		t.Errorf("expected 1 rejected request counted, got %v", got)
+	}
+}
+
+func TestHeaderSize(t *testing.T) {
+	header := http.Header{"A": {"12", "345"}, "Bc": {""}}
+	if got := headerSize(header); got != 1+2+1+3+2 {
+		t.Errorf("expected 9 bytes, got %d", got)
+	}
+}
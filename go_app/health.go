@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Values of the status fields of a healthReport.
+const (
+	healthUp   = "up"
+	healthDown = "down"
+)
+
+// healthReport is the body of a deep health check.
+type healthReport struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]dependencyHealth `json:"dependencies"`
+}
+
+type dependencyHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthHandler serves /healthz. By default it only tells that the process
+// answers, which keeps it cheap enough for liveness probes. With ?deep=1 it
+// reports the last health check of every registered Dependency in JSON,
+// answering 503 if any is down. It never waits for a check to run.
+func (m *Metrics) healthHandler(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("deep") != "1" {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = rw.Write([]byte("ok"))
+		return
+	}
+
+	m.dependenciesMu.Lock()
+	dependencies := append([]*Dependency(nil), m.dependencies...)
+	m.dependenciesMu.Unlock()
+
+	report := healthReport{Status: healthUp, Dependencies: map[string]dependencyHealth{}}
+	for _, dependency := range dependencies {
+		if err := dependency.lastError(); err != nil {
+			report.Status = healthDown
+			report.Dependencies[dependency.name] = dependencyHealth{Status: healthDown, Error: err.Error()}
+			continue
+		}
+		report.Dependencies[dependency.name] = dependencyHealth{Status: healthUp}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if report.Status != healthUp {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(rw).Encode(report); err != nil {
+		log.Println(err.Error())
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeepHealthCheck(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	healthy := metrics.RegisterDependency("cache", time.Hour, func(context.Context) error { return nil })
+	defer healthy.Stop()
+	failing := metrics.RegisterDependency("database", time.Hour, func(context.Context) error {
+		return errors.New("connection refused")
+	})
+	router := mux.NewRouter()
+	router.HandleFunc(healthEndpoint, metrics.healthHandler)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, healthEndpoint, nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected the shallow check to return %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, healthEndpoint+"?deep=1", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the deep check to return %d, got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+	var report healthReport
+	if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatalf("expected a JSON report, got %q: %v", recorder.Body.String(), err)
+	}
+	if report.Status != healthDown ||
+		report.Dependencies["cache"].Status != healthUp ||
+		report.Dependencies["database"].Status != healthDown ||
+		report.Dependencies["database"].Error != "connection refused" {
+		t.Errorf("expected the database to be reported down, got %+v", report)
+	}
+
+	// Once the failing dependency is gone, the deep check passes.
+	failing.Stop()
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, healthEndpoint+"?deep=1", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected the deep check to return %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestDeepHealthCheckServesLastResult(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	var checks int32
+	dependency := metrics.RegisterDependency("slow", time.Hour, func(context.Context) error {
+		atomic.AddInt32(&checks, 1)
+		return nil
+	})
+	defer dependency.Stop()
+
+	recorder := httptest.NewRecorder()
+	metrics.healthHandler(recorder, httptest.NewRequest(http.MethodGet, healthEndpoint+"?deep=1", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected the deep check to return %d, got %d", http.StatusOK, recorder.Code)
+	}
+	if checks := atomic.LoadInt32(&checks); checks != 1 {
+		t.Errorf("expected only the check at registration, got %d checks", checks)
+	}
+}
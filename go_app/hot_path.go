@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HotPathDetector periodically reads the request counter, logs the paths
+// with the highest request rate and publishes their rate as a gauge, to
+// show where the traffic goes.
+type HotPathDetector struct {
+	gatherer prometheus.Gatherer
+	// family is the name of the request counter family, which has a path
+	// label.
+	family string
+	topN   int
+	logger *slog.Logger
+	qps    *prometheus.GaugeVec
+
+	mu       sync.Mutex
+	last     map[string]float64
+	lastTime time.Time
+
+	ticker *time.Ticker
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// hotPath is a path and its request rate, as logged.
+type hotPath struct {
+	Path string  `json:"path"`
+	QPS  float64 `json:"qps"`
+}
+
+// NewHotPathDetector starts reading the request counter of registry every
+// interval and reporting its topN paths by request rate, under the default
+// metric names. Stop ends the readings.
+func NewHotPathDetector(registry *prometheus.Registry, interval time.Duration, topN int) *HotPathDetector {
+	d := newHotPathDetector(registry, registry, newMetricOpts(defaultConfig()), newLogger(os.Stderr, logTimeRFC3339), topN)
+	d.start(interval)
+	return d
+}
+
+// newHotPathDetector creates a detector reading gatherer and registering
+// its gauge with registerer. It does not start reading.
+func newHotPathDetector(gatherer prometheus.Gatherer, registerer prometheus.Registerer, opts MetricOpts,
+	logger *slog.Logger, topN int) *HotPathDetector {
+	return &HotPathDetector{
+		gatherer: gatherer,
+		family:   prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Naming.CounterName("request_counter")),
+		topN:     topN,
+		logger:   logger,
+		qps: promauto.With(registerer).NewGaugeVec(
+			opts.Gauge("hot_path_qps", "Request rate of the busiest paths over the last reading."),
+			[]string{"path"}),
+		last: map[string]float64{},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+func (d *HotPathDetector) start(interval time.Duration) {
+	d.lastTime = time.Now()
+	d.last = d.read()
+	d.ticker = time.NewTicker(interval)
+	go d.run(d.ticker.C)
+}
+
+func (d *HotPathDetector) run(ticks <-chan time.Time) {
+	defer close(d.done)
+	for {
+		select {
+		case now := <-ticks:
+			d.sample(now)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// read returns the requests counted so far by path, over every source.
+func (d *HotPathDetector) read() map[string]float64 {
+	families, err := d.gatherer.Gather()
+	if err != nil {
+		log.Printf("Gathering metrics for the hot path detector: %v", err)
+	}
+	counts := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != d.family {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if pair.GetName() == "path" {
+					counts[pair.GetValue()] += metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return counts
+}
+
+// sample reads the counter at now and reports the paths with the highest
+// rate since the previous reading.
+func (d *HotPathDetector) sample(now time.Time) []hotPath {
+	counts := d.read()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	elapsed := now.Sub(d.lastTime).Seconds()
+	if elapsed <= 0 {
+		return nil
+	}
+	var paths []hotPath
+	for path, count := range counts {
+		delta := count - d.last[path]
+		if delta < 0 {
+			// The counter was reset in between.
+			delta = count
+		}
+		if delta > 0 {
+			paths = append(paths, hotPath{Path: path, QPS: delta / elapsed})
+		}
+	}
+	d.last, d.lastTime = counts, now
+
+	sort.Slice(paths, func(i, j int) bool {
+		if paths[i].QPS != paths[j].QPS {
+			return paths[i].QPS > paths[j].QPS
+		}
+		return paths[i].Path < paths[j].Path
+	})
+	if len(paths) > d.topN {
+		paths = paths[:d.topN]
+	}
+	d.qps.Reset()
+	for _, path := range paths {
+		d.qps.WithLabelValues(path.Path).Set(path.QPS)
+	}
+	if len(paths) > 0 {
+		d.logger.Info("hot paths", "interval_seconds", elapsed, "paths", paths)
+	}
+	return paths
+}
+
+// Stop ends the readings; the gauge keeps the last hot paths.
+func (d *HotPathDetector) Stop(context.Context) error {
+	if d.ticker != nil {
+		d.ticker.Stop()
+	}
+	close(d.stop)
+	<-d.done
+	return nil
+}
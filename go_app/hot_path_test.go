@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+	"time"
+)
+
+func TestHotPathDetector(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	opts := newMetricOpts(defaultConfig())
+	metrics := NewMetrics(registry, opts)
+	var logs bytes.Buffer
+	detector := newHotPathDetector(registry, registry, opts, newLogger(&logs, logTimeRFC3339), 2)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	metrics.RequestCounter.WithLabelValues(welcomeEndpoint, sourceInternal, tenantUnknown).Add(1000)
+	detector.last, detector.lastTime = detector.read(), start
+
+	for path, requests := range map[string]float64{greetingEndpoint: 500, echoEndpoint: 20, birthdayEndpoint: 10, welcomeEndpoint: 5} {
+		metrics.RequestCounter.WithLabelValues(path, sourceInternal, tenantUnknown).Add(requests / 2)
+		metrics.RequestCounter.WithLabelValues(path, sourceExternal, tenantUnknown).Add(requests / 2)
+	}
+	hot := detector.sample(start.Add(10 * time.Second))
+
+	expected := []hotPath{{greetingEndpoint, 50}, {echoEndpoint, 2}}
+	if len(hot) != 2 || hot[0] != expected[0] || hot[1] != expected[1] {
+		t.Fatalf("expected hot paths %v, got %v", expected, hot)
+	}
+	if got := testutil.ToFloat64(detector.qps.WithLabelValues(greetingEndpoint)); got != 50 {
+		t.Errorf("expected a rate of 50 for %s, got %v", greetingEndpoint, got)
+	}
+	if got := testutil.CollectAndCount(detector.qps); got != 2 {
+		t.Errorf("expected a gauge for the 2 hot paths only, got %d", got)
+	}
+
+	var line struct {
+		Msg   string    `json:"msg"`
+		Paths []hotPath `json:"paths"`
+	}
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+		t.Fatalf("expected a JSON log line, got %q: %v", logs.String(), err)
+	}
+	if line.Msg != "hot paths" || len(line.Paths) != 2 || line.Paths[0].Path != greetingEndpoint {
+		t.Errorf("expected the hot paths logged, got %+v", line)
+	}
+
+	metrics.RequestCounter.WithLabelValues(echoEndpoint, sourceInternal, tenantUnknown).Add(100)
+	hot = detector.sample(start.Add(20 * time.Second))
+	if len(hot) != 1 || hot[0].Path != echoEndpoint {
+		t.Errorf("expected only the paths requested since the last reading, got %v", hot)
+	}
+	if got := testutil.CollectAndCount(detector.qps); got != 1 {
+		t.Errorf("expected the paths that cooled down to be dropped from the gauge, got %d series", got)
+	}
+}
+
+func TestLoadConfigRejectsNonPositiveHotPathTop(t *testing.T) {
+	for _, value := range []string{"0", "-1"} {
+		setenv(t, "HOT_PATH_TOP", value)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("expected HOT_PATH_TOP=%s to be rejected", value)
+		}
+	}
+}
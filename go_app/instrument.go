@@ -0,0 +1,437 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"time"
+)
+
+// MetricOption customises the instrumentation built by Instrument and the
+// create*Metric helpers. Options can be given in any order; setting the same
+// thing twice is an error.
+type MetricOption func(*metricOptions) error
+
+type metricOptions struct {
+	path            string
+	funcName        string
+	expectedLatency time.Duration
+	help            string
+	constLabels     prometheus.Labels
+	registerer      prometheus.Registerer
+
+	counter    *familyOptions
+	inProgress *familyOptions
+	latency    *familyOptions
+}
+
+// helpOr returns the Help text set with the Help option, or fallback.
+func (o metricOptions) helpOr(fallback string) string {
+	if o.help != "" {
+		return o.help
+	}
+	return fallback
+}
+
+func newMetricOptions(options []MetricOption) (metricOptions, error) {
+	var o metricOptions
+	for _, option := range options {
+		if err := option(&o); err != nil {
+			return o, err
+		}
+	}
+	requested := 0
+	for _, family := range []*familyOptions{o.counter, o.inProgress, o.latency} {
+		if family != nil {
+			requested++
+		}
+	}
+	switch {
+	case o.path == "":
+		return o, errors.New("WithPath is required")
+	case requested == 0:
+		return o, errors.New("no metric requested, use WithCounter, WithInProgress or WithLatency")
+	case requested > 1 && o.help != "":
+		return o, errors.New("the Help option is ambiguous with more than one metric requested")
+	case o.latency != nil && o.latency.buckets != nil && o.expectedLatency > 0:
+		return o, errors.New("latency buckets set both with Buckets and ExpectedLatency")
+	}
+	return o, nil
+}
+
+// familyOptions describe one of the metrics requested from Instrument.
+type familyOptions struct {
+	name    string
+	buckets []float64
+	methods []string
+}
+
+// FamilyOption customises one of the metrics requested with WithCounter,
+// WithInProgress or WithLatency.
+type FamilyOption func(*familyOptions)
+
+// Named sets the name of the legacy family the metric is recorded into.
+func Named(name string) FamilyOption {
+	return func(f *familyOptions) {
+		f.name = name
+	}
+}
+
+// Buckets sets the buckets of the legacy latency histogram, if it is the
+// first route to use that family's name.
+func Buckets(buckets ...float64) FamilyOption {
+	return func(f *familyOptions) {
+		f.buckets = buckets
+	}
+}
+
+// Methods creates the in-progress series of the given methods up front, so
+// they are exposed before the first request arrives.
+func Methods(methods ...string) FamilyOption {
+	return func(f *familyOptions) {
+		f.methods = methods
+	}
+}
+
+// family applies options over a family called name by default.
+func family(name string, options []FamilyOption) *familyOptions {
+	f := &familyOptions{name: name}
+	for _, option := range options {
+		option(f)
+	}
+	return f
+}
+
+// WithPath sets the path label of the metrics, the route template of the
+// instrumented handler.
+func WithPath(path string) MetricOption {
+	return func(o *metricOptions) error {
+		if o.path != "" {
+			return fmt.Errorf("path set twice, to %q and %q", o.path, path)
+		}
+		o.path = path
+		return nil
+	}
+}
+
+// WithCounter counts the requests to the handler, see
+// createRequestCounterMetric.
+func WithCounter(options ...FamilyOption) MetricOption {
+	return func(o *metricOptions) error {
+		if o.counter != nil {
+			return errors.New("counter requested twice")
+		}
+		o.counter = family("request_count", options)
+		if o.counter.buckets != nil || o.counter.methods != nil {
+			return errors.New("the counter takes neither Buckets nor Methods")
+		}
+		return nil
+	}
+}
+
+// WithInProgress tracks the requests in progress in the handler by method,
+// see createRequestsInProgressMetric.
+func WithInProgress(options ...FamilyOption) MetricOption {
+	return func(o *metricOptions) error {
+		if o.inProgress != nil {
+			return errors.New("in-progress requested twice")
+		}
+		o.inProgress = family("requests_in_progress", options)
+		if o.inProgress.buckets != nil {
+			return errors.New("the in-progress gauge takes no Buckets")
+		}
+		return nil
+	}
+}
+
+// WithLatency observes the latency of the handler, see
+// createRequestLatencyMetric.
+func WithLatency(options ...FamilyOption) MetricOption {
+	return func(o *metricOptions) error {
+		if o.latency != nil {
+			return errors.New("latency requested twice")
+		}
+		o.latency = family("request_latency", options)
+		if o.latency.methods != nil {
+			return errors.New("the latency histogram takes no Methods")
+		}
+		return nil
+	}
+}
+
+// WithConstLabels adds labels to the legacy families, if the route is the
+// first to use their names. The shared endpoint_* families are left alone.
+func WithConstLabels(labels prometheus.Labels) MetricOption {
+	return func(o *metricOptions) error {
+		if o.constLabels != nil {
+			return errors.New("const labels set twice")
+		}
+		o.constLabels = labels
+		return nil
+	}
+}
+
+// WithRegisterer creates the legacy families in reg instead of sharing them
+// with the other routes of the application. They are created whatever the
+// legacy-name settings, since the caller asked for them explicitly; families
+// reg already holds under the same name are reused.
+func WithRegisterer(reg prometheus.Registerer) MetricOption {
+	return func(o *metricOptions) error {
+		if o.registerer != nil {
+			return errors.New("registerer set twice")
+		}
+		o.registerer = reg
+		return nil
+	}
+}
+
+// FuncName sets the handler_func label of the metric, which tells apart
+// handlers registered under the same metric name and endpoint. It defaults
+// to the name of the wrapped function; set it when that function is itself
+// returned by another helper. The name is deliberately kept out of the Help
+// text, because Prometheus requires every series of a metric name to share
+// the same Help.
+func FuncName(name string) MetricOption {
+	return func(o *metricOptions) error {
+		if o.funcName != "" {
+			return fmt.Errorf("handler_func set twice, to %q and %q", o.funcName, name)
+		}
+		o.funcName = name
+		return nil
+	}
+}
+
+// ExpectedLatency makes the legacy latency histogram use SmartBuckets around
+// latency when neither Buckets nor LATENCY_BUCKETS set its buckets, if it is
+// the first route to use that family's name. EndpointLatency keeps the
+// configured buckets, because all routes share it.
+func ExpectedLatency(latency time.Duration) MetricOption {
+	return func(o *metricOptions) error {
+		if o.expectedLatency > 0 {
+			return errors.New("expected latency set twice")
+		}
+		o.expectedLatency = latency
+		return nil
+	}
+}
+
+// Help sets the Help text of the legacy family the helper creates, if it is
+// the first route to use that family's name. The shared endpoint_* families
+// keep theirs.
+func Help(text string) MetricOption {
+	return func(o *metricOptions) error {
+		if o.help != "" {
+			return errors.New("help set twice")
+		}
+		o.help = text
+		return nil
+	}
+}
+
+// Instrument wraps h with the metrics the options request. Whatever the
+// order of the options, the counter wraps the in-progress gauge, which wraps
+// the latency histogram, as the create*Metric helpers used to be chained.
+func (m *Metrics) Instrument(h http.HandlerFunc, options ...MetricOption) (http.HandlerFunc, error) {
+	o, err := newMetricOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if o.funcName == "" {
+		o.funcName = handlerFuncName(h)
+	}
+	labels := prometheus.Labels{"path": o.path, "handler_func": o.funcName}
+	if o.latency != nil {
+		if h, err = m.instrumentLatency(o, labels, h); err != nil {
+			return nil, err
+		}
+	}
+	if o.inProgress != nil {
+		if h, err = m.instrumentInProgress(o, labels, h); err != nil {
+			return nil, err
+		}
+	}
+	if o.counter != nil {
+		if h, err = m.instrumentCounter(o, labels, h); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// mustInstrument is Instrument for the create*Metric helpers, which cannot
+// return an error: like promauto, it panics on misconfiguration.
+func (m *Metrics) mustInstrument(h http.HandlerFunc, options ...MetricOption) http.HandlerFunc {
+	instrumented, err := m.Instrument(h, options...)
+	if err != nil {
+		panic(err)
+	}
+	return instrumented
+}
+
+// namedFamily returns the legacy family called name: created in the
+// registerer set with WithRegisterer, or shared with the other routes using
+// that name while the legacy names are enabled. It returns nil otherwise.
+func (m *Metrics) namedFamily(o metricOptions, name string,
+	build func(familyFactory) prometheus.Collector) (prometheus.Collector, error) {
+	if o.registerer != nil {
+		family := build(familyFactory{Factory: promauto.With(nil)})
+		if err := o.registerer.Register(family); err != nil {
+			var registered prometheus.AlreadyRegisteredError
+			if !errors.As(err, &registered) {
+				return nil, err
+			}
+			family = registered.ExistingCollector
+		}
+		return family, nil
+	}
+	if !m.legacyEndpointMetrics {
+		return nil, nil
+	}
+	return m.legacyFamily(name, func() prometheus.Collector {
+		return build(m.factory)
+	}), nil
+}
+
+// instrumentCounter counts the requests in EndpointRequests, with per-handler
+// counters enabled, and in the legacy counter.
+func (m *Metrics) instrumentCounter(o metricOptions, labels prometheus.Labels, h http.HandlerFunc) (http.HandlerFunc, error) {
+	if !m.perHandlerCounters && o.registerer == nil {
+		return h, nil
+	}
+	var counters []liveCounter
+	if m.perHandlerCounters {
+		counters = append(counters, liveCounter{m.EndpointRequests, labels})
+	}
+	name := o.counter.name
+	family, err := m.namedFamily(o, name, func(factory familyFactory) prometheus.Collector {
+		opts := m.opts.Counter(name, o.helpOr("Total HTTP requests handled by the endpoint."))
+		opts.ConstLabels = o.constLabels
+		return factory.NewCounterVec(opts, []string{"path", "handler_func"})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if family != nil {
+		legacy, ok := family.(*prometheus.CounterVec)
+		if !ok {
+			return nil, fmt.Errorf("metric %s is already registered as another type", name)
+		}
+		counters = append(counters, liveCounter{legacy, labels})
+	}
+	return func(rw http.ResponseWriter, r *http.Request) {
+		h(rw, r)
+		for _, counter := range counters {
+			counter.Inc()
+		}
+	}, nil
+}
+
+// instrumentInProgress tracks the requests in progress by method in
+// EndpointInProgress and the legacy gauge.
+func (m *Metrics) instrumentInProgress(o metricOptions, labels prometheus.Labels, h http.HandlerFunc) (http.HandlerFunc, error) {
+	vecs := []*prometheus.GaugeVec{m.EndpointInProgress.MustCurryWith(labels)}
+	name := o.inProgress.name
+	family, err := m.namedFamily(o, name, func(factory familyFactory) prometheus.Collector {
+		opts := m.opts.Gauge(name, o.helpOr("Number of HTTP requests currently in progress."))
+		opts.ConstLabels = o.constLabels
+		return factory.NewGaugeVec(opts, []string{"path", "handler_func", "method"})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if family != nil {
+		legacy, ok := family.(*prometheus.GaugeVec)
+		if !ok {
+			return nil, fmt.Errorf("metric %s is already registered as another type", name)
+		}
+		vecs = append(vecs, legacy.MustCurryWith(labels))
+	}
+	for _, vec := range vecs {
+		for _, method := range o.inProgress.methods {
+			vec.WithLabelValues(method)
+		}
+	}
+	return func(rw http.ResponseWriter, r *http.Request) {
+		for _, vec := range vecs {
+			vec.WithLabelValues(r.Method).Inc()
+		}
+		defer func() {
+			for _, vec := range vecs {
+				vec.WithLabelValues(r.Method).Dec()
+			}
+		}()
+		h(rw, r)
+	}, nil
+}
+
+// instrumentLatency observes the latency in EndpointLatency and the legacy
+// histogram.
+func (m *Metrics) instrumentLatency(o metricOptions, labels prometheus.Labels, h http.HandlerFunc) (http.HandlerFunc, error) {
+	observers := []prometheus.Observer{liveObserver(m.EndpointLatency, labels)}
+	name := o.latency.name
+	family, err := m.namedFamily(o, name, func(factory familyFactory) prometheus.Collector {
+		buckets := o.latency.buckets
+		switch {
+		case buckets != nil:
+		case m.opts.LatencyBuckets != nil:
+			buckets = m.opts.LatencyBuckets
+		case o.expectedLatency > 0:
+			buckets = SmartBuckets(o.expectedLatency)
+		default:
+			buckets = requestDurationBuckets
+		}
+		opts := m.opts.NativeHistogramOpts(
+			m.opts.Duration(name, o.helpOr("Latency of the HTTP requests handled by the endpoint."), buckets))
+		opts.ConstLabels = o.constLabels
+		return factory.NewHistogramVec(opts, []string{"path", "handler_func"})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if family != nil {
+		legacy, ok := family.(*prometheus.HistogramVec)
+		if !ok {
+			return nil, fmt.Errorf("metric %s is already registered as another type", name)
+		}
+		observers = append(observers, liveObserver(legacy, labels))
+	}
+	return func(rw http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		h(rw, r)
+		timeTaken := time.Since(startTime).Seconds()
+		for _, observer := range observers {
+			observer.Observe(timeTaken)
+		}
+	}, nil
+}
+
+// createRequestCounterMetric is a no-op kept for the routes that still use
+// it: the requests are counted once, by monitoringMiddleware. With per-handler
+// counters enabled it also counts them in EndpointRequests and, while the
+// legacy names are enabled, in the counter called name, as it used to.
+func (m *Metrics) createRequestCounterMetric(name, endpoint string,
+	requestFunction func(http.ResponseWriter, *http.Request), options ...MetricOption) func(http.ResponseWriter, *http.Request) {
+	return m.mustInstrument(requestFunction,
+		append([]MetricOption{WithPath(endpoint), WithCounter(Named(name))}, options...)...)
+}
+
+// createRequestsInProgressMetric tracks the requests in progress for the
+// endpoint by HTTP method, in EndpointInProgress and, while the legacy names
+// are enabled, in the gauge called name. The series of the given methods are
+// created up front so they are exposed before the first request arrives.
+func (m *Metrics) createRequestsInProgressMetric(name, endpoint string, methods []string,
+	requestFunction func(http.ResponseWriter, *http.Request), options ...MetricOption) func(http.ResponseWriter, *http.Request) {
+	return m.mustInstrument(requestFunction,
+		append([]MetricOption{WithPath(endpoint), WithInProgress(Named(name), Methods(methods...))}, options...)...)
+}
+
+// createRequestLatencyMetric observes the latency of the endpoint in
+// EndpointLatency and, while the legacy names are enabled, in the histogram
+// called name.
+func (m *Metrics) createRequestLatencyMetric(name, endpoint string,
+	requestFunction func(http.ResponseWriter, *http.Request), options ...MetricOption) func(http.ResponseWriter, *http.Request) {
+	return m.mustInstrument(requestFunction,
+		append([]MetricOption{WithPath(endpoint), WithLatency(Named(name))}, options...)...)
+}
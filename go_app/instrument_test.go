@@ -0,0 +1,176 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstrumentOptionOrder(t *testing.T) {
+	for name, options := range map[string][]MetricOption{
+		"counter first": {WithCounter(), WithPath("/a"), WithInProgress(Methods("GET")), WithLatency()},
+		"latency first": {WithLatency(), WithInProgress(Methods("GET")), WithPath("/a"), WithCounter()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+			metrics.legacyEndpointMetrics = true
+			metrics.perHandlerCounters = true
+			var inProgress float64
+			handler, err := metrics.Instrument(func(http.ResponseWriter, *http.Request) {
+				inProgress = testutil.ToFloat64(metrics.EndpointInProgress.WithLabelValues("/a", "instrument", "GET"))
+			}, append(options, FuncName("instrument"))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/a", nil))
+
+			if inProgress != 1 {
+				t.Errorf("expected the request to be in progress while handled, got %v", inProgress)
+			}
+			if got := testutil.ToFloat64(metrics.EndpointRequests.WithLabelValues("/a", "instrument")); got != 1 {
+				t.Errorf("expected the request to be counted once, got %v", got)
+			}
+			if count, _ := histogramSum(t, metrics.EndpointLatency.MustCurryWith(prometheus.Labels{"handler_func": "instrument"}), "/a"); count != 1 {
+				t.Errorf("expected one latency observation, got %d", count)
+			}
+			for _, name := range []string{"request_count", "requests_in_progress", "request_latency"} {
+				if _, ok := metrics.legacy[name]; !ok {
+					t.Errorf("expected the legacy family %s to be created", name)
+				}
+			}
+		})
+	}
+}
+
+func TestInstrumentInProgressAfterPanic(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	metrics.legacyEndpointMetrics = true
+	handler := recoveryMiddleware(defaultPanicBody)(http.HandlerFunc(metrics.createRequestsInProgressMetric(
+		"panicking_in_progress", "/p", []string{"GET"},
+		func(http.ResponseWriter, *http.Request) { panic("boom") }, FuncName("panicking"))))
+
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/p", nil))
+	}
+	if got := testutil.ToFloat64(metrics.EndpointInProgress.WithLabelValues("/p", "panicking", "GET")); got != 0 {
+		t.Errorf("expected no request in progress after the panics, got %v", got)
+	}
+	legacy := metrics.legacy["panicking_in_progress"].(*prometheus.GaugeVec)
+	if got := testutil.ToFloat64(legacy.With(prometheus.Labels{"path": "/p", "handler_func": "panicking", "method": "GET"})); got != 0 {
+		t.Errorf("expected the legacy gauge back at 0, got %v", got)
+	}
+}
+
+func TestInstrumentRegisterer(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	metrics.legacyEndpointMetrics = false
+	registry := prometheus.NewRegistry()
+	handler, err := metrics.Instrument(generateEchoMessage,
+		WithPath("/echo"),
+		WithLatency(Named("echo_latency"), Buckets(0.1, 1)),
+		WithCounter(Named("echo_count")),
+		WithConstLabels(prometheus.Labels{"team": "greeters"}),
+		WithRegisterer(registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/echo", nil))
+
+	if len(metrics.legacy) != 0 {
+		t.Errorf("expected no family shared with the application, got %v", metrics.legacy)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, family := range families {
+		seen[family.GetName()] = true
+		metric := family.GetMetric()[0]
+		if team := findMetric(family, "team", "greeters"); team == nil {
+			t.Errorf("%s: expected the const label team=greeters", family.GetName())
+		}
+		if family.GetName() == "go_app_api_echo_latency" {
+			var bounds []float64
+			for _, bucket := range metric.GetHistogram().GetBucket() {
+				bounds = append(bounds, bucket.GetUpperBound())
+			}
+			if !reflect.DeepEqual(bounds, []float64{0.1, 1}) {
+				t.Errorf("expected the buckets [0.1 1], got %v", bounds)
+			}
+		}
+	}
+	if !seen["go_app_api_echo_latency"] || !seen["go_app_api_echo_count"] {
+		t.Errorf("expected the families to be registered with the registerer, got %v", seen)
+	}
+
+	// A second route reuses the families the registerer already holds.
+	if _, err := metrics.Instrument(generateWelcomeMessage, WithPath("/"), WithLatency(Named("echo_latency")),
+		WithConstLabels(prometheus.Labels{"team": "greeters"}), WithRegisterer(registry)); err != nil {
+		t.Errorf("expected the existing family to be reused, got %v", err)
+	}
+}
+
+func TestInstrumentConflicts(t *testing.T) {
+	for name, tc := range map[string]struct {
+		options  []MetricOption
+		expected string
+	}{
+		"no path":            {[]MetricOption{WithCounter()}, "WithPath"},
+		"no metric":          {[]MetricOption{WithPath("/a")}, "no metric"},
+		"path twice":         {[]MetricOption{WithPath("/a"), WithPath("/b"), WithCounter()}, "path set twice"},
+		"latency twice":      {[]MetricOption{WithPath("/a"), WithLatency(), WithLatency()}, "latency requested twice"},
+		"counter buckets":    {[]MetricOption{WithPath("/a"), WithCounter(Buckets(1))}, "neither Buckets"},
+		"latency methods":    {[]MetricOption{WithPath("/a"), WithLatency(Methods("GET"))}, "no Methods"},
+		"two bucket layouts": {[]MetricOption{WithPath("/a"), WithLatency(Buckets(1)), ExpectedLatency(time.Second)}, "Buckets and ExpectedLatency"},
+		"ambiguous help":     {[]MetricOption{WithPath("/a"), WithLatency(), WithCounter(), Help("h")}, "ambiguous"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+			_, err := metrics.Instrument(generateEchoMessage, tc.options...)
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("expected an error mentioning %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestCompatibilityWrappers(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	metrics.legacyEndpointMetrics = true
+	metrics.perHandlerCounters = true
+	handler := metrics.createRequestCounterMetric("wrapped_count", "/w",
+		metrics.createRequestsInProgressMetric("wrapped_in_progress", "/w", []string{"GET"},
+			metrics.createRequestLatencyMetric("wrapped_latency", "/w", generateEchoMessage),
+			FuncName("generateEchoMessage")),
+		FuncName("generateEchoMessage"))
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/w", nil))
+
+	labels := prometheus.Labels{"path": "/w", "handler_func": "generateEchoMessage"}
+	if got := testutil.ToFloat64(metrics.legacy["wrapped_count"].(*prometheus.CounterVec).With(labels)); got != 1 {
+		t.Errorf("expected wrapped_count to be 1, got %v", got)
+	}
+	if got := testutil.CollectAndCount(metrics.legacy["wrapped_in_progress"]); got != 1 {
+		t.Errorf("expected the GET series of wrapped_in_progress, got %d series", got)
+	}
+	if count, _ := histogramSum(t, metrics.legacy["wrapped_latency"].(*prometheus.HistogramVec).MustCurryWith(
+		prometheus.Labels{"handler_func": "generateEchoMessage"}), "/w"); count != 1 {
+		t.Errorf("expected one observation in wrapped_latency, got %d", count)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected conflicting options to make the wrapper panic")
+		}
+	}()
+	metrics.createRequestLatencyMetric("conflict", "/w", generateEchoMessage, FuncName("a"), FuncName("b"))
+}
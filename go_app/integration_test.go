@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// runApp runs startApp on a free local port until stop is called, which
+// waits for the shutdown to complete.
+func runApp(t *testing.T, cfg ServerConfig) (baseURL string, stop func()) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- startApp(ctx, cfg, listener)
+	}()
+	return "http://" + listener.Addr().String(), func() {
+		cancel()
+		if err := <-stopped; err != nil {
+			t.Errorf("startApp returned %v", err)
+		}
+	}
+}
+
+// startTestApp runs startApp on a free local port and returns its base URL.
+// The server is shut down when the test ends.
+func startTestApp(t *testing.T, cfg ServerConfig) string {
+	t.Helper()
+	baseURL, stop := runApp(t, cfg)
+	t.Cleanup(stop)
+	return baseURL
+}
+
+// scrapeURL fetches and parses the metrics exposed at baseURL.
+func scrapeURL(t *testing.T, client *http.Client, baseURL string) map[string]*dto.MetricFamily {
+	t.Helper()
+	response, err := client.Get(baseURL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(response.Body)
+	if err != nil {
+		t.Fatalf("parsing /metrics: %v", err)
+	}
+	return families
+}
+
+func TestIntegrationMetrics(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.GreetingHandlerDelay = 10 * time.Millisecond
+	cfg.ShutdownTimeout = time.Second
+	baseURL := startTestApp(t, cfg)
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	for _, path := range []string{"/echo/one", "/echo/two", "/greeting/Bob"} {
+		response, err := client.Get(baseURL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s returned %d", path, response.StatusCode)
+		}
+	}
+	families := scrapeURL(t, client, baseURL)
+
+	t.Run("counter", func(t *testing.T) {
+		metric := findMetric(families["go_app_api_request_counter"], "path", echoEndpoint)
+		if metric == nil || metric.GetCounter().GetValue() != 2 {
+			t.Errorf("expected 2 echo requests counted, got %v", metric)
+		}
+	})
+	t.Run("gauge", func(t *testing.T) {
+		family := families["go_app_api_configured_greeting_delay_seconds"]
+		if family == nil || family.GetMetric()[0].GetGauge().GetValue() != 0.01 {
+			t.Errorf("expected the configured greeting delay of 0.01s, got %v", family)
+		}
+		metric := findMetric(families["go_app_api_requests_in_progress"], "path", echoEndpoint)
+		if metric == nil || metric.GetGauge().GetValue() != 0 {
+			t.Errorf("expected no echo request in progress, got %v", metric)
+		}
+	})
+	t.Run("histogram", func(t *testing.T) {
+		metric := findMetric(families["go_app_api_request_duration_seconds"], "path", greetingEndpoint)
+		if metric == nil || metric.GetHistogram().GetSampleCount() != 1 {
+			t.Fatalf("expected 1 greeting request observed, got %v", metric)
+		}
+		if sum := metric.GetHistogram().GetSampleSum(); sum < 0.01 {
+			t.Errorf("expected the greeting request to take at least its 10ms delay, took %vs", sum)
+		}
+		sleep := findMetric(families["go_app_api_handler_sleep_seconds"], "handler", "greeting")
+		if sleep == nil || sleep.GetHistogram().GetSampleCount() != 1 {
+			t.Errorf("expected 1 greeting sleep observed, got %v", sleep)
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+)
+
+// jsonValidatingWriter holds back responses whose Content-Type is JSON until
+// the handler has returned, so they can be checked before the client sees
+// them. Other responses are passed through as they are written.
+type jsonValidatingWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	buffering   bool
+	status      int
+	body        bytes.Buffer
+}
+
+func (w *jsonValidatingWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if mediaType == "application/json" {
+		w.buffering = true
+		w.status = statusCode
+		return
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *jsonValidatingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffering {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *jsonValidatingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(w.ResponseWriter)
+}
+
+// flush sends a held back response if it is valid JSON and reports whether
+// it did. An empty body is let through, as HEAD and 204 responses have none.
+func (w *jsonValidatingWriter) flush() bool {
+	if !w.buffering {
+		return true
+	}
+	if w.body.Len() > 0 && !json.Valid(w.body.Bytes()) {
+		return false
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	_, _ = w.ResponseWriter.Write(w.body.Bytes())
+	return true
+}
+
+// jsonValidationMiddleware replaces JSON responses that do not parse with a
+// 500 and counts them in InvalidJSONResponses, so a handler bug never sends
+// malformed JSON to clients.
+func (m *Metrics) jsonValidationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writer := &jsonValidatingWriter{ResponseWriter: w}
+		next.ServeHTTP(writer, r)
+		if writer.flush() {
+			return
+		}
+		path := routeLabel(r)
+		m.InvalidJSONResponses.WithLabelValues(path).Inc()
+		log.Printf("Replaced invalid JSON response to %s %s with a 500", r.Method, r.URL.Path)
+		w.Header().Del("Content-Length")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	})
+}
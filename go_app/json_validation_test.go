@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJSONValidationMiddleware(t *testing.T) {
+	for _, tc := range []struct {
+		name, contentType, body string
+		expectedStatus          int
+		expectedInvalid         float64
+	}{
+		{"valid JSON", "application/json", `{"message":"hi"}`, http.StatusCreated, 0},
+		{"invalid JSON", "application/json; charset=utf-8", `{"message":`, http.StatusInternalServerError, 1},
+		{"not JSON", "text/plain", `{"message":`, http.StatusCreated, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+			router := mux.NewRouter()
+			router.HandleFunc("/json", func(rw http.ResponseWriter, _ *http.Request) {
+				rw.Header().Set("Content-Type", tc.contentType)
+				rw.WriteHeader(http.StatusCreated)
+				_, _ = rw.Write([]byte(tc.body))
+			})
+			router.Use(metrics.jsonValidationMiddleware)
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/json", nil))
+
+			if recorder.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, recorder.Code)
+			}
+			if tc.expectedStatus != http.StatusInternalServerError && recorder.Body.String() != tc.body {
+				t.Errorf("expected body %q, got %q", tc.body, recorder.Body.String())
+			}
+			if got := testutil.ToFloat64(metrics.InvalidJSONResponses.WithLabelValues("/json")); got != tc.expectedInvalid {
+				t.Errorf("expected %v invalid JSON responses, got %v", tc.expectedInvalid, got)
+			}
+		})
+	}
+}
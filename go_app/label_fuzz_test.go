@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gorilla/mux"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fuzzPaths seed the fuzz targets with the route templates and with paths
+// that are awkward to turn into labels.
+var fuzzPaths = []string{
+	welcomeEndpoint, birthdayEndpoint, greetingEndpoint, echoEndpoint, healthEndpoint, startupEndpoint, wsEchoEndpoint,
+	"/metrics", runtimeMetricsEndpoint,
+	"/birthday/ana", "/greeting/%7Bname%7D", "/echo/a%2Fb", "/echo/%2e%2e%2f%2e%2e",
+	"/echo/%ff%fe", "/echo/%c0%af", "/%00", "/echo/%E2%80%AE", "//echo//x/", "/./../echo",
+	"/birthday/" + strings.Repeat("%41", 512), "/\xff\xfe/x", "*", "",
+}
+
+// checkLabelValues fails t for every label value of families that is not a
+// valid Prometheus label value.
+func checkLabelValues(t *testing.T, families map[string]*dto.MetricFamily) {
+	t.Helper()
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if !model.LabelValue(pair.GetValue()).IsValid() {
+					t.Errorf("%s: invalid value %q of label %s", family.GetName(), pair.GetValue(), pair.GetName())
+				}
+			}
+		}
+	}
+}
+
+func FuzzRouteLabel(f *testing.F) {
+	for _, path := range fuzzPaths {
+		f.Add(path)
+	}
+	// Without SkipClean, mux would redirect unclean paths before any route.
+	router := mux.NewRouter().SkipClean(true)
+	var label string
+	record := func(_ http.ResponseWriter, r *http.Request) { label = routeLabel(r) }
+	for _, template := range []string{birthdayEndpoint, greetingEndpoint, echoEndpoint} {
+		router.HandleFunc(template, record)
+	}
+	// Routes without a path template fall back to the request path.
+	router.MatcherFunc(func(*http.Request, *mux.RouteMatch) bool { return true }).HandlerFunc(record)
+
+	f.Fuzz(func(t *testing.T, path string) {
+		label = ""
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.URL.Path = path
+		router.ServeHTTP(httptest.NewRecorder(), request)
+		if label == "" {
+			t.Fatalf("no path label for %q", path)
+		}
+		if !model.LabelValue(label).IsValid() {
+			t.Errorf("invalid path label %q for %q", label, path)
+		}
+	})
+}
+
+func FuzzMonitoringMiddleware(f *testing.F) {
+	for _, path := range fuzzPaths {
+		f.Add(http.MethodGet, path, "")
+	}
+	f.Add(http.MethodHead, "/echo/hello", "req-1")
+	f.Add(http.MethodOptions, "/greeting/ana", "\xff\xfe")
+	f.Add("PROPFIND", "/birthday/%ff", "é")
+	f.Add(http.MethodPost, "/echo/x?a=%ff", strings.Repeat("x", 100))
+
+	cfg := defaultConfig()
+	cfg.BirthdayHandlerDelay = 0
+	cfg.GreetingHandlerDelay = 0
+	cfg.AccessLogSampleRate = 0
+	cfg.CounterExemplars = true
+	router := NewRouter(cfg, newConfigReloader())
+
+	f.Fuzz(func(t *testing.T, method, target, header string) {
+		raw := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: fuzz\r\n%s: %s\r\n%s: %s\r\n%s: %s\r\n\r\n",
+			method, target, requestIDHeader, header, tenantHeader, header, "X-Forwarded-For", header)
+		request, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+		if err != nil {
+			// net/http would have answered 400 before any middleware.
+			return
+		}
+		request.RemoteAddr = "192.0.2.1:1234"
+		router.ServeHTTP(httptest.NewRecorder(), request)
+
+		families := scrape(t, router)
+		checkLabelValues(t, families)
+		// Recovery turns a panic of the middleware inside it into a 500,
+		// but counts it.
+		if panics := families["go_app_api_handler_panics_total"].GetMetric()[0].GetCounter().GetValue(); panics != 0 {
+			t.Fatalf("%q made the middleware panic", raw)
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// simulatedLatencies holds the artificial delays of the routes, so they can
+// be changed together at runtime by a reload or through /debug/latency.
+type simulatedLatencies struct {
+	metrics *Metrics
+	mu      sync.Mutex
+	routes  map[string]simulatedRoute
+}
+
+// simulatedRoute is the delay of a route and the handler it belongs to.
+type simulatedRoute struct {
+	handler string
+	delay   *simulatedDelay
+}
+
+func (m *Metrics) newSimulatedLatencies() *simulatedLatencies {
+	return &simulatedLatencies{metrics: m, routes: map[string]simulatedRoute{}}
+}
+
+// add makes the delay of the route path, served by handler, adjustable.
+func (l *simulatedLatencies) add(path, handler string, delay *simulatedDelay) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.routes[path] = simulatedRoute{handler: handler, delay: delay}
+	l.metrics.SimulatedLatency.WithLabelValues(path).Set(delay.Get().Seconds())
+}
+
+// Set changes the delays of the routes in delays. Nothing is changed unless
+// every route is known and every delay is non-negative.
+func (l *simulatedLatencies) Set(delays map[string]time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for path, delay := range delays {
+		if _, ok := l.routes[path]; !ok {
+			return fmt.Errorf("unknown route %q", path)
+		}
+		if delay < 0 {
+			return fmt.Errorf("delay of %s must not be negative, got %s", path, delay)
+		}
+	}
+	for path, delay := range delays {
+		route := l.routes[path]
+		route.delay.Set(delay)
+		l.metrics.SimulatedLatency.WithLabelValues(path).Set(delay.Seconds())
+		l.metrics.ChaosDelay.WithLabelValues(route.handler).Set(delay.Seconds())
+	}
+	return nil
+}
+
+// Get returns the current delay of every route.
+func (l *simulatedLatencies) Get() map[string]time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delays := make(map[string]time.Duration, len(l.routes))
+	for path, route := range l.routes {
+		delays[path] = route.delay.Get()
+	}
+	return delays
+}
+
+// handler serves /debug/latency, which is only registered in debug mode.
+// GET returns the delay of every route as a Go duration string by route
+// path; PUT takes the same format, for some or all of the routes, and
+// returns the delays once applied.
+func (l *simulatedLatencies) handler(rw http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var body map[string]string
+		if err := DecodeJSONWithMetrics(r, &body, l.metrics.BodyParseErrors.MustCurryWith(
+			map[string]string{"path": routeLabel(r)})); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		delays := make(map[string]time.Duration, len(body))
+		for path, value := range body {
+			delay, err := time.ParseDuration(value)
+			if err != nil {
+				http.Error(rw, fmt.Sprintf("delay of %s must be a Go duration like 500ms, got %q", path, value),
+					http.StatusBadRequest)
+				return
+			}
+			delays[path] = delay
+		}
+		if err := l.Set(delays); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		paths := make([]string, 0, len(delays))
+		for path := range delays {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		log.Printf("Changed the simulated latency of %v on request from %s", paths, r.RemoteAddr)
+	}
+
+	current := map[string]string{}
+	for path, delay := range l.Get() {
+		current[path] = delay.String()
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(current); err != nil {
+		log.Println(err.Error())
+	}
+}
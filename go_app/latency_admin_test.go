@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugLatencyEndpoint(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Debug = true
+	cfg.GreetingHandlerDelay = time.Second
+	router := NewRouter(cfg, newConfigReloader())
+
+	put := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/debug/latency", strings.NewReader(body)))
+		return recorder
+	}
+
+	if recorder := put(`{"/greeting/{name}": "10ms"}`); recorder.Code != http.StatusOK {
+		t.Fatalf("expected the change to be accepted, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	startTime := time.Now()
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/greeting/Bob", nil))
+	if elapsed := time.Since(startTime); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the greeting to take about 10ms, took %s", elapsed)
+	}
+
+	// Invalid changes are rejected as a whole.
+	for _, body := range []string{
+		`{"/greeting/{name}": "1s", "/unknown": "1s"}`,
+		`{"/greeting/{name}": "soon"}`,
+		`{"/greeting/{name}": "-1s"}`,
+		`{"/greeting/{name}": `,
+	} {
+		if recorder := put(body); recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", body, http.StatusBadRequest, recorder.Code)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/latency", nil))
+	var current map[string]string
+	if err := json.Unmarshal(recorder.Body.Bytes(), &current); err != nil {
+		t.Fatalf("expected a JSON body, got %q: %v", recorder.Body.String(), err)
+	}
+	if current[greetingEndpoint] != "10ms" || current[birthdayEndpoint] != cfg.BirthdayHandlerDelay.String() {
+		t.Errorf("expected the greeting delay to be 10ms and the birthday one unchanged, got %v", current)
+	}
+
+	metric := findMetric(scrape(t, router)["go_app_simulated_latency_seconds"], "path", greetingEndpoint)
+	if metric == nil || metric.GetGauge().GetValue() != 0.01 {
+		t.Errorf("expected go_app_simulated_latency_seconds to be 0.01 for the greeting, got %v", metric)
+	}
+}
+
+func TestDebugLatencyEndpointNeedsDebug(t *testing.T) {
+	router := NewRouter(defaultConfig(), newConfigReloader())
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/latency", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected /debug/latency to be missing without DEBUG, got %d", recorder.Code)
+	}
+}
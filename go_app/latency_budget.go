@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// budgetSmoothing is the weight of the newest request in the exponential
+// moving average of the consumed latency budget.
+const budgetSmoothing = 0.1
+
+// LatencyBudgetTracker compares the latency of every request to an endpoint
+// with the endpoint's latency SLO. It publishes a moving average of the
+// consumed budget and counts the requests that went over it.
+type LatencyBudgetTracker struct {
+	metrics  *Metrics
+	endpoint string
+	budget   float64
+	consumed prometheus.Gauge
+	exceeded liveCounter
+
+	mu  sync.Mutex
+	ema float64
+	n   int
+}
+
+// NewLatencyBudgetTracker creates a tracker for endpoint, which is expected
+// to respond within budgetSeconds.
+func (m *Metrics) NewLatencyBudgetTracker(endpoint string, budgetSeconds float64) *LatencyBudgetTracker {
+	return &LatencyBudgetTracker{
+		metrics:  m,
+		endpoint: endpoint,
+		budget:   budgetSeconds,
+		consumed: m.BudgetConsumed.WithLabelValues(endpoint),
+		exceeded: liveCounter{m.BudgetExceeded, prometheus.Labels{"endpoint": endpoint}},
+	}
+}
+
+// Wrap instruments requestFunction with createRequestLatencyMetric and
+// records the latency of every request against the budget.
+func (t *LatencyBudgetTracker) Wrap(name string, requestFunction func(http.ResponseWriter, *http.Request),
+	options ...MetricOption) func(http.ResponseWriter, *http.Request) {
+	instrumented := t.metrics.createRequestLatencyMetric(name, t.endpoint, requestFunction, options...)
+	return func(rw http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		instrumented(rw, r)
+		t.Observe(time.Since(startTime))
+	}
+}
+
+// Observe records a request that took latency.
+func (t *LatencyBudgetTracker) Observe(latency time.Duration) {
+	ratio := latency.Seconds() / t.budget
+	if ratio > 1 {
+		t.exceeded.Inc()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.n == 0 {
+		t.ema = ratio
+	} else {
+		t.ema = budgetSmoothing*ratio + (1-budgetSmoothing)*t.ema
+	}
+	t.n++
+	t.consumed.Set(t.ema)
+}
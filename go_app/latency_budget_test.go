@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLatencyBudgetExceeded(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	budget := 50 * time.Millisecond
+	tracker := metrics.NewLatencyBudgetTracker("/slow", budget.Seconds())
+	handler := tracker.Wrap("request_latency", func(http.ResponseWriter, *http.Request) {
+		time.Sleep(budget * 11 / 10)
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+
+	if got := testutil.ToFloat64(metrics.BudgetExceeded.WithLabelValues("/slow")); got != 1 {
+		t.Errorf("expected the exceeded counter to be 1, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.BudgetConsumed.WithLabelValues("/slow")); got < 1.1 {
+		t.Errorf("expected at least 110%% of the budget consumed, got %v", got)
+	}
+}
+
+func TestLatencyBudgetMovingAverage(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	tracker := metrics.NewLatencyBudgetTracker("/fast", 1)
+
+	tracker.Observe(500 * time.Millisecond)
+	tracker.Observe(time.Second)
+
+	if got := testutil.ToFloat64(metrics.BudgetExceeded.WithLabelValues("/fast")); got != 0 {
+		t.Errorf("expected no request over budget, got %v", got)
+	}
+	if got, expected := testutil.ToFloat64(metrics.BudgetConsumed.WithLabelValues("/fast")), 0.55; got < expected-1e-9 || got > expected+1e-9 {
+		t.Errorf("expected moving average %v, got %v", expected, got)
+	}
+}
+
+func TestLoadConfigRejectsNonPositiveLatencyBudget(t *testing.T) {
+	for _, value := range []string{"0s", "-1s"} {
+		setenv(t, "GREETING_LATENCY_BUDGET", value)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("expected GREETING_LATENCY_BUDGET=%s to be rejected", value)
+		}
+	}
+}
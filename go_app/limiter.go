@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// concurrencyLimiter bounds the number of requests a handler serves at once.
+// A request over the limit waits up to maxWait for a slot and is rejected
+// with 503 Service Unavailable once the wait expires. The rejection carries
+// a Retry-After header of retryAfter, scaled up by the number of requests
+// still queued per slot.
+type concurrencyLimiter struct {
+	slots      chan struct{}
+	maxWait    time.Duration
+	retryAfter time.Duration
+	wait       prometheus.Observer
+	depth      prometheus.Gauge
+	queued     int64
+}
+
+// newConcurrencyLimiter creates a limiter allowing limit concurrent requests
+// to path. The time requests spend queued is observed on QueueWait.
+func (m *Metrics) newConcurrencyLimiter(path string, limit int, maxWait, retryAfter time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		slots:      make(chan struct{}, limit),
+		maxWait:    maxWait,
+		retryAfter: retryAfter,
+		wait:       liveObserver(m.QueueWait, prometheus.Labels{"path": path}),
+		depth:      m.QueueDepth.WithLabelValues(path),
+	}
+}
+
+func (l *concurrencyLimiter) Wrap(
+	requestFunction func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !l.acquire(r) {
+			rw.Header().Set("Retry-After", strconv.Itoa(l.retryAfterSeconds()))
+			http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		defer l.release()
+		requestFunction(rw, r)
+	}
+}
+
+// acquire takes a slot, waiting for at most maxWait, and reports whether it
+// got one. The time spent waiting is observed and added to the Server-Timing
+// header either way.
+func (l *concurrencyLimiter) acquire(r *http.Request) bool {
+	startTime := time.Now()
+	select {
+	case l.slots <- struct{}{}:
+		l.wait.Observe(0)
+		addTimingSegment(r.Context(), "queue", 0)
+		return true
+	default:
+	}
+
+	l.depth.Inc()
+	defer l.depth.Dec()
+	atomic.AddInt64(&l.queued, 1)
+	defer atomic.AddInt64(&l.queued, -1)
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+
+	acquired := false
+	select {
+	case l.slots <- struct{}{}:
+		acquired = true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	waited := time.Since(startTime)
+	l.wait.Observe(waited.Seconds())
+	addTimingSegment(r.Context(), "queue", waited)
+	return acquired
+}
+
+// retryAfterSeconds returns the Retry-After value for a rejected request: the
+// base delay times one plus the requests queued per slot, in whole seconds
+// and at least one.
+func (l *concurrencyLimiter) retryAfterSeconds() int {
+	queuedPerSlot := float64(atomic.LoadInt64(&l.queued)) / float64(cap(l.slots))
+	seconds := int(math.Ceil(l.retryAfter.Seconds() * (1 + queuedPerSlot)))
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// histogramSum returns the sample count and sum of the histogram child of
+// vec for path.
+func histogramSum(t *testing.T, vec prometheus.ObserverVec, path string) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := vec.WithLabelValues(path).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestConcurrencyLimiterQueueWait(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		maxWait        time.Duration
+		expectedStatus int
+	}{
+		{name: "queued", maxWait: time.Second, expectedStatus: http.StatusOK},
+		{name: "rejected", maxWait: 20 * time.Millisecond, expectedStatus: http.StatusServiceUnavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+			limiter := metrics.newConcurrencyLimiter("/slow", 1, tc.maxWait, time.Second)
+			router := mux.NewRouter()
+			router.HandleFunc("/slow", limiter.Wrap(func(http.ResponseWriter, *http.Request) {
+				time.Sleep(100 * time.Millisecond)
+			}))
+			router.Use(metrics.monitoringMiddleware)
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+			}()
+			for len(limiter.slots) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			second := httptest.NewRecorder()
+			router.ServeHTTP(second, httptest.NewRequest(http.MethodGet, "/slow", nil))
+			wg.Wait()
+
+			if second.Code != tc.expectedStatus {
+				t.Fatalf("expected the second request to return %d, got %d", tc.expectedStatus, second.Code)
+			}
+			if retryAfter := second.Header().Get("Retry-After"); tc.expectedStatus == http.StatusServiceUnavailable {
+				if seconds, err := strconv.Atoi(retryAfter); err != nil || seconds < 1 {
+					t.Errorf("expected a numeric Retry-After on the shed request, got %q", retryAfter)
+				}
+			} else if retryAfter != "" {
+				t.Errorf("expected no Retry-After on a served request, got %q", retryAfter)
+			}
+			count, wait := histogramSum(t, metrics.QueueWait, "/slow")
+			if count != 2 {
+				t.Errorf("expected 2 queue wait observations, got %d", count)
+			}
+			if wait <= 0 {
+				t.Error("expected the second request to spend time queued")
+			}
+			if tc.expectedStatus == http.StatusOK && wait < 0.05 {
+				t.Errorf("expected the second request to wait for the first, waited %vs", wait)
+			}
+			if _, total := histogramSum(t, metrics.RequestDuration.MustCurryWith(prometheus.Labels{"tenant": tenantUnknown}), "/slow"); total < wait {
+				t.Errorf("request duration %vs should include the queue wait %vs", total, wait)
+			}
+		})
+	}
+}
+
+func TestRetryAfterGrowsWithQueue(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	limiter := metrics.newConcurrencyLimiter("/slow", 2, time.Second, 3*time.Second)
+	if seconds := limiter.retryAfterSeconds(); seconds != 3 {
+		t.Errorf("expected the base Retry-After of 3s with an empty queue, got %d", seconds)
+	}
+	limiter.queued = 4
+	if seconds := limiter.retryAfterSeconds(); seconds != 9 {
+		t.Errorf("expected 9s with two requests queued per slot, got %d", seconds)
+	}
+}
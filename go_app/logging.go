@@ -0,0 +1,184 @@
+package main
+
+import (
+	"example.com/m/recorder"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Values of ServerConfig.LogTimeFormat.
+const (
+	logTimeRFC3339     = "rfc3339"
+	logTimeEpochMillis = "epoch_millis"
+)
+
+// validLogTimeFormat returns an error unless format is a supported
+// LOG_TIME_FORMAT.
+func validLogTimeFormat(format string) error {
+	switch format {
+	case logTimeRFC3339, logTimeEpochMillis:
+		return nil
+	default:
+		return fmt.Errorf("unknown log time format %q", format)
+	}
+}
+
+// newLogger returns a JSON logger writing to w whose timestamps are encoded
+// as RFC 3339 strings or, for log pipelines that expect them, as the number
+// of milliseconds since the Unix epoch.
+func newLogger(w io.Writer, timeFormat string) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if attr.Key != slog.TimeKey || len(groups) > 0 {
+				return attr
+			}
+			if timeFormat == logTimeEpochMillis {
+				return slog.Int64(slog.TimeKey, attr.Value.Time().UnixMilli())
+			}
+			return slog.String(slog.TimeKey, attr.Value.Time().Format(time.RFC3339))
+		},
+	}))
+}
+
+// requestIDHeader carries the ID a proxy in front of the application gave
+// the request.
+const requestIDHeader = "X-Request-ID"
+
+// slowRequestLog decides which slow requests accessLogMiddleware warns
+// about. Every request slower than threshold is counted, but only a
+// sampleRate share of them is logged, so a burst of slow requests does not
+// flood the logs.
+type slowRequestLog struct {
+	threshold  time.Duration
+	sampleRate float64
+	random     func() float64
+	total      prometheus.Counter
+	logged     prometheus.Counter
+}
+
+func (m *Metrics) newSlowRequestLog(threshold time.Duration, sampleRate float64) *slowRequestLog {
+	return &slowRequestLog{
+		threshold:  threshold,
+		sampleRate: sampleRate,
+		random:     rand.Float64,
+		total:      m.SlowRequests,
+		logged:     m.SlowRequestsLogged,
+	}
+}
+
+// slow reports whether a request that took duration is slow.
+func (l *slowRequestLog) slow(duration time.Duration) bool {
+	return l != nil && l.threshold > 0 && duration > l.threshold
+}
+
+// sample counts a request that took duration if it is slow, and reports
+// whether it should be logged.
+func (l *slowRequestLog) sample(duration time.Duration) bool {
+	if !l.slow(duration) {
+		return false
+	}
+	l.total.Inc()
+	if l.sampleRate < 1 && l.random() >= l.sampleRate {
+		return false
+	}
+	l.logged.Inc()
+	return true
+}
+
+// accessLogSampler decides which requests get an access log line. Failed
+// and slow requests are always logged, but only a rate share of the others,
+// picked by a pseudo-random generator seeded once per process.
+type accessLogSampler struct {
+	rate float64
+	// logged and suppressed look their series up on every request, so they
+	// keep counting after ResetCounters.
+	logged     liveCounter
+	suppressed liveCounter
+
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+func (m *Metrics) newAccessLogSampler(rate float64, seed int64) *accessLogSampler {
+	// Expose both outcomes before the first request.
+	m.AccessLogLines.WithLabelValues("logged")
+	m.AccessLogLines.WithLabelValues("suppressed")
+	return &accessLogSampler{
+		rate:       rate,
+		logged:     liveCounter{m.AccessLogLines, prometheus.Labels{"outcome": "logged"}},
+		suppressed: liveCounter{m.AccessLogLines, prometheus.Labels{"outcome": "suppressed"}},
+		random:     rand.New(rand.NewSource(seed)),
+	}
+}
+
+// sample reports whether a request that got status should be logged, and
+// counts the decision.
+func (s *accessLogSampler) sample(status int, slow bool) bool {
+	if s == nil {
+		return true
+	}
+	logged := status >= http.StatusBadRequest || slow || s.rate >= 1
+	if !logged {
+		s.mu.Lock()
+		logged = s.random.Float64() < s.rate
+		s.mu.Unlock()
+	}
+	if logged {
+		s.logged.Inc()
+	} else {
+		s.suppressed.Inc()
+	}
+	return logged
+}
+
+// accessLogMiddleware logs the requests sampler samples, or every request if
+// it is nil, once they have been served, and logs a warning for the slow
+// requests slow samples, unless it is nil. A request whose handler panicked
+// is logged with the 500 recovery answers it with.
+// It also drops the body of responses to HEAD requests, keeping its
+// Content-Length, so the GET handlers registered for HEAD as well do not need
+// to check the method.
+func accessLogMiddleware(logger *slog.Logger, slow *slowRequestLog, sampler *accessLogSampler) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := recorder.NewRecorder(w)
+			rec.SuppressBody = r.Method == http.MethodHead
+			startTime := time.Now()
+			defer func() {
+				p := recover()
+				status := rec.Status()
+				if p != nil && p != http.ErrAbortHandler {
+					status = http.StatusInternalServerError
+				}
+				duration := time.Since(startTime)
+				durationMS := float64(duration) / float64(time.Millisecond)
+				if sampler.sample(status, slow.slow(duration)) {
+					logger.Info("request served",
+						"method", r.Method,
+						"path", r.URL.Path,
+						"status", status,
+						"bytes", rec.BytesWritten(),
+						"duration_ms", durationMS)
+				}
+				if slow.sample(duration) {
+					logger.Warn("slow request",
+						"path", r.URL.Path,
+						"duration_ms", durationMS,
+						"request_id", r.Header.Get(requestIDHeader))
+				}
+				if p != nil {
+					panic(p)
+				}
+			}()
+			next.ServeHTTP(rec.Writer(), r)
+			rec.FinishSuppressed()
+		})
+	}
+}
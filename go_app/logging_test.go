@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccessLogTimeFormat(t *testing.T) {
+	for _, format := range []string{logTimeRFC3339, logTimeEpochMillis} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			handler := accessLogMiddleware(newLogger(&buf, format), nil, nil)(http.HandlerFunc(generateWelcomeMessage))
+			before := time.Now()
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			var entry map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatalf("expected a JSON log line, got %q: %v", buf.String(), err)
+			}
+			var logged time.Time
+			switch value := entry["time"].(type) {
+			case string:
+				if format != logTimeRFC3339 {
+					t.Fatalf("expected a numeric timestamp, got %q", value)
+				}
+				parsed, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					t.Fatalf("expected an RFC 3339 timestamp, got %q", value)
+				}
+				logged = parsed
+			case float64:
+				if format != logTimeEpochMillis {
+					t.Fatalf("expected an RFC 3339 timestamp, got %v", value)
+				}
+				logged = time.UnixMilli(int64(value))
+			default:
+				t.Fatalf("unexpected timestamp %v", entry["time"])
+			}
+			if diff := logged.Sub(before); diff < -time.Second || diff > time.Second {
+				t.Errorf("expected the timestamp to be close to %s, got %s", before, logged)
+			}
+			if entry["status"] != float64(http.StatusOK) || entry["path"] != "/" {
+				t.Errorf("unexpected access log entry %v", entry)
+			}
+		})
+	}
+}
+
+func TestSlowRequestWarning(t *testing.T) {
+	var buf bytes.Buffer
+	slow := func(http.ResponseWriter, *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	handler := accessLogMiddleware(newLogger(&buf, logTimeRFC3339),
+		metrics.newSlowRequestLog(10*time.Millisecond, 1), nil)(http.HandlerFunc(slow))
+	request := httptest.NewRequest(http.MethodGet, "/birthday/Bob", nil)
+	request.Header.Set(requestIDHeader, "req-42")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	var warning map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("expected JSON log lines, got %q: %v", line, err)
+		}
+		if entry["level"] == "WARN" {
+			warning = entry
+		}
+	}
+	if warning == nil {
+		t.Fatalf("expected a slow request warning, got %q", buf.String())
+	}
+	if warning["path"] != "/birthday/Bob" || warning["request_id"] != "req-42" {
+		t.Errorf("expected the warning to name the path and request ID, got %v", warning)
+	}
+	if duration, _ := warning["duration_ms"].(float64); duration < 20 {
+		t.Errorf("expected a duration of at least 20ms, got %v", warning["duration_ms"])
+	}
+
+	buf.Reset()
+	accessLogMiddleware(newLogger(&buf, logTimeRFC3339), metrics.newSlowRequestLog(time.Second, 1), nil)(http.HandlerFunc(generateWelcomeMessage)).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if bytes.Contains(buf.Bytes(), []byte(`"level":"WARN"`)) {
+		t.Errorf("expected no warning for a fast request, got %q", buf.String())
+	}
+}
+
+func TestSlowRequestLogSampling(t *testing.T) {
+	const sampleRate = 0.1
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	slow := metrics.newSlowRequestLog(time.Second, sampleRate)
+	slow.random = rand.New(rand.NewSource(1)).Float64
+
+	for i := 0; i < 1000; i++ {
+		slow.sample(2 * time.Second)
+	}
+	slow.sample(time.Millisecond)
+
+	total := testutil.ToFloat64(metrics.SlowRequests)
+	if total != 1000 {
+		t.Fatalf("expected every slow request to be counted, got %v", total)
+	}
+	if ratio := testutil.ToFloat64(metrics.SlowRequestsLogged) / total; math.Abs(ratio-sampleRate) > 0.03 {
+		t.Errorf("expected about %v of the slow requests to be logged, got %v", sampleRate, ratio)
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	const (
+		requests   = 5000
+		sampleRate = 0.01
+	)
+	var buf bytes.Buffer
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	handler := accessLogMiddleware(newLogger(&buf, logTimeRFC3339), nil, metrics.newAccessLogSampler(sampleRate, 1))(
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/fail" {
+				rw.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+
+	failures := 0
+	for i := 0; i < requests; i++ {
+		path := "/ok"
+		if i%10 == 0 {
+			path = "/fail"
+			failures++
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	loggedFailures, loggedSuccesses := 0, 0
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("expected JSON log lines, got %q: %v", line, err)
+		}
+		if entry["status"] == float64(http.StatusInternalServerError) {
+			loggedFailures++
+		} else {
+			loggedSuccesses++
+		}
+	}
+	if loggedFailures != failures {
+		t.Errorf("expected all %d failures to be logged, got %d", failures, loggedFailures)
+	}
+	// 4500 successes sampled at 1% give 45 lines on average.
+	if loggedSuccesses < 20 || loggedSuccesses > 75 {
+		t.Errorf("expected about 45 successes to be logged, got %d", loggedSuccesses)
+	}
+
+	logged := testutil.ToFloat64(metrics.AccessLogLines.WithLabelValues("logged"))
+	suppressed := testutil.ToFloat64(metrics.AccessLogLines.WithLabelValues("suppressed"))
+	if logged != float64(loggedFailures+loggedSuccesses) || logged+suppressed != requests {
+		t.Errorf("expected %d logged lines out of %d, counted %v logged and %v suppressed",
+			loggedFailures+loggedSuccesses, requests, logged, suppressed)
+	}
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
 	"time"
 )
 
@@ -19,129 +20,306 @@ const (
 	welcomeEndpoint  = "/"
 	birthdayEndpoint = "/birthday/{name}"
 	greetingEndpoint = "/greeting/{name}"
-)
+	echoEndpoint     = "/echo/{message}"
+	healthEndpoint   = "/healthz"
+	startupEndpoint  = "/startupz"
+	wsEchoEndpoint   = "/ws/echo"
 
-var (
-	RequestCounter = promauto.NewCounterVec(prometheus.CounterOpts{
-		Namespace: "go_app",
-		Subsystem: "api",
-		Name:      "request_counter",
-		Help:      "Total HTTP requests count for specific endpoint.",
-	}, []string{"path"})
+	runtimeMetricsEndpoint = "/metrics/runtime"
 )
 
-func monitoringMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		route := mux.CurrentRoute(r)
-		path, _ := route.GetPathTemplate()
-		next.ServeHTTP(w, r)
-		RequestCounter.WithLabelValues(path).Inc()
-	})
+func main() {
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := startApp(context.Background(), cfg, listener); err != nil {
+		log.Fatal(err.Error())
+	}
 }
 
-func generateWelcomeMessage(rw http.ResponseWriter, _ *http.Request) {
-	if _, err := rw.Write([]byte(fmt.Sprintf("Welcome!"))); err != nil {
-		log.Println(err.Error())
-		http.Error(rw, err.Error(), 500)
-	}
+// NewRouter creates the application router together with its own metrics
+// registry, which is served on /metrics. Settings that can change at runtime
+// are updated through reloader. It starts none of the background workers,
+// such as the watchdog or the pusher, which only run under startApp.
+func NewRouter(cfg ServerConfig, reloader *configReloader) *mux.Router {
+	router, _ := newRouter(cfg, reloader, newShutdownHooks())
+	return router
 }
 
-func generateBirthdayMessage(rw http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	name := vars["name"]
-	greetings := fmt.Sprintf("Happy Birthday %s :)", name)
-	time.Sleep(20 * time.Second)
-	if _, err := rw.Write([]byte(greetings)); err != nil {
-		log.Println(err.Error())
-		http.Error(rw, err.Error(), 500)
+// newRouter is NewRouter also returning the metrics of the router, for the
+// parts of the application outside of it. Its background workers are
+// registered on shutdown, to be started with startBackground.
+func newRouter(cfg ServerConfig, reloader *configReloader, shutdown *shutdownHooks) (*mux.Router, *Metrics) {
+	registry, runtimeRegistry, appRegisterer := newRegistry(cfg)
+	metrics := NewMetrics(appRegisterer, newMetricOpts(cfg))
+	metrics.SetSkipList(cfg.InstrumentationSkipList)
+	metrics.serverTiming = cfg.ServerTiming
+	metrics.legacyEndpointMetrics = cfg.LegacyEndpointMetrics
+	metrics.perHandlerCounters = cfg.PerHandlerCounters
+	metrics.requestPaths = newPathLRU(metrics.RequestCounter, cfg.MaxPathLabels)
+	metrics.exemplars.threshold = cfg.ExemplarCoverageMin
+	metrics.counterExemplars = cfg.CounterExemplars
+	metrics.groups.unregister = cfg.UnregisterDisabledGroups
+	disabled := map[string]bool{}
+	for _, group := range cfg.DisabledMetricGroups {
+		disabled[group] = false
 	}
-}
+	if err := metrics.groups.Set(disabled); err != nil {
+		log.Printf("Keeping every metric group enabled: %v", err)
+	}
+	tenants := newTenantAllowlist(cfg.Tenants)
+	reloader.OnReload(func(cfg ServerConfig) {
+		metrics.SetSkipList(cfg.InstrumentationSkipList)
+		tenants.Set(cfg.Tenants)
+	})
 
-func generateGreetingMessage(rw http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	name := vars["name"]
-	greetings := fmt.Sprintf("Greetings %s :)", name)
-	time.Sleep(5 * time.Second)
-	if _, err := rw.Write([]byte(greetings)); err != nil {
-		log.Println(err.Error())
-		http.Error(rw, err.Error(), 500)
+	birthday := HandlerConfig{
+		Delay:          newSimulatedDelay(cfg.BirthdayHandlerDelay),
+		SleepHistogram: liveObserver(metrics.SleepDuration, prometheus.Labels{"handler": "birthday"}),
+		Sprintf: NewSprintfSampler(liveObserver(metrics.SprintfDuration, prometheus.Labels{"handler": "birthday"}),
+			sprintfSampleEvery),
+		DebugTiming: cfg.Debug,
+		Suffix:      cfg.GreetingSuffix,
 	}
-}
+	greeting := HandlerConfig{
+		Delay:          newSimulatedDelay(cfg.GreetingHandlerDelay),
+		SleepHistogram: liveObserver(metrics.SleepDuration, prometheus.Labels{"handler": "greeting"}),
+		Sprintf: NewSprintfSampler(liveObserver(metrics.SprintfDuration, prometheus.Labels{"handler": "greeting"}),
+			sprintfSampleEvery),
+		DebugTiming: cfg.Debug,
+		Suffix:      cfg.GreetingSuffix,
+	}
+	metrics.registerConfiguredDelay("configured_birthday_delay_seconds", birthday.Delay)
+	metrics.registerConfiguredDelay("configured_greeting_delay_seconds", greeting.Delay)
+	latencies := metrics.newSimulatedLatencies()
+	latencies.add(birthdayEndpoint, "birthday", birthday.Delay)
+	latencies.add(greetingEndpoint, "greeting", greeting.Delay)
+	applyDelays := func(cfg ServerConfig) {
+		if err := latencies.Set(map[string]time.Duration{
+			birthdayEndpoint: cfg.BirthdayHandlerDelay,
+			greetingEndpoint: cfg.GreetingHandlerDelay,
+		}); err != nil {
+			log.Printf("Keeping the current handler delays: %v", err)
+		}
+	}
+	applyDelays(cfg)
+	reloader.OnReload(applyDelays)
 
-func createRequestCounterMetric(name, endpoint string,
-	requestFunction func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
-	RequestCount := promauto.NewCounter(prometheus.CounterOpts{
-		Namespace:   "go_app",
-		Subsystem:   "api",
-		Name:        name,
-		Help:        "Total HTTP requests count for specific endpoint.",
-		ConstLabels: prometheus.Labels{"path": endpoint},
-	})
-	return func(rw http.ResponseWriter, r *http.Request) {
-		requestFunction(rw, r)
-		RequestCount.Inc()
+	limit := func(endpoint string,
+		requestFunction func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+		if cfg.ConcurrencyLimit > 0 {
+			requestFunction = metrics.newConcurrencyLimiter(endpoint, cfg.ConcurrencyLimit, cfg.QueueWaitMax, cfg.RetryAfterBase).
+				Wrap(requestFunction)
+		}
+		if cfg.RateLimitRPS > 0 {
+			requestFunction = metrics.newRateLimiter(endpoint, cfg.RateLimitRPS, cfg.RateLimitBurst).Wrap(requestFunction)
+		}
+		return requestFunction
 	}
-}
 
-func createRequestsInProgressMetric(name, endpoint string,
-	requestFunction func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
-	RequestInProgress := promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace:   "go_app",
-		Subsystem:   "api",
-		Name:        name,
-		Help:        "Total HTTP requests in progress for specific endpoint.",
-		ConstLabels: prometheus.Labels{"path": endpoint},
-	})
-	return func(rw http.ResponseWriter, r *http.Request) {
-		RequestInProgress.Inc()
-		requestFunction(rw, r)
-		RequestInProgress.Dec()
+	// StrictSlash only applies to the routes added after it.
+	router := metrics.NewRouteTracker(mux.NewRouter().StrictSlash(cfg.RedirectTrailingSlash))
+
+	router.HandleFunc(welcomeEndpoint, generateWelcomeMessage).Methods("GET", "HEAD")
+	router.HandleFunc(birthdayEndpoint,
+		metrics.NewAvailabilityTracker(birthdayEndpoint, availabilityWindow).Wrap(
+			limit(birthdayEndpoint,
+				metrics.createRequestsInProgressMetric("requests_in_progress",
+					birthdayEndpoint, []string{"GET", "HEAD"},
+					generateBirthdayMessage(birthday))))).
+		Methods("GET", "HEAD")
+	greetingBudget := metrics.NewLatencyBudgetTracker(greetingEndpoint, cfg.GreetingLatencyBudget.Seconds())
+	router.HandleFunc(greetingEndpoint,
+		metrics.NewAvailabilityTracker(greetingEndpoint, availabilityWindow).Wrap(
+			limit(greetingEndpoint,
+				greetingBudget.Wrap("request_latency",
+					withETag(generateGreetingMessage(greeting)),
+					ExpectedLatency(cfg.GreetingHandlerDelay))))).
+		Methods("GET", "HEAD")
+	router.HandleFunc(echoEndpoint,
+		metrics.createRequestCounterMetric("request_count",
+			echoEndpoint,
+			metrics.createRequestsInProgressMetric("requests_in_progress",
+				echoEndpoint, []string{"GET", "HEAD"},
+				metrics.createRequestLatencyMetric("request_latency",
+					echoEndpoint,
+					withETag(generateEchoMessage)),
+				FuncName("generateEchoMessage")),
+			FuncName("generateEchoMessage"))).
+		Methods("GET", "HEAD")
+
+	router.HandleFunc(wsEchoEndpoint, metrics.webSocketEcho).Methods("GET")
+	router.HandleFunc(healthEndpoint, metrics.healthHandler).Methods("GET", "HEAD")
+	router.HandleFunc(startupEndpoint, metrics.startupHandler).Methods("GET", "HEAD")
+
+	if cfg.Debug {
+		router.HandleFunc("/debug/metrics/reset", metrics.resetHandler).Methods("POST")
+		router.HandleFunc("/debug/latency", latencies.handler).Methods("GET", "PUT")
+		router.HandleFunc("/debug/metrics/flags", metrics.groups.handler).Methods("GET", "PUT")
+		router.HandleFunc("/debug/goroutines", metrics.goroutinesHandler).Methods("GET")
+	}
+	if cfg.Debug && cfg.AdminPassword != "" {
+		router.Handle("/admin/metrics.json",
+			basicAuth(cfg.AdminUser, cfg.AdminPassword, metricsJSONHandler(registry))).Methods("GET")
 	}
-}
 
-func createRequestLatencyMetric(name, endpoint string,
-	requestFunction func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
-	RequestLatency := promauto.NewHistogram(prometheus.HistogramOpts{
-		Namespace:   "go_app",
-		Subsystem:   "api",
-		Name:        name,
-		Help:        "HTTP requests latency distribution for specific endpoint.",
-		ConstLabels: prometheus.Labels{"path": endpoint},
-	})
-	return func(rw http.ResponseWriter, r *http.Request) {
-		startTime := time.Now()
-		requestFunction(rw, r)
-		timeTaken := time.Since(startTime)
-		RequestLatency.Observe(timeTaken.Seconds())
+	scrapes := metrics.newScrapeMonitor()
+	if cfg.ScrapeStaleness > 0 {
+		shutdown.inBackground(func() func(context.Context) error {
+			scrapes.start(cfg.ScrapeStaleness)
+			return scrapes.Stop
+		})
 	}
-}
+	handleMetrics := router.Handle
+	if cfg.MetricsAddress != "" {
+		telemetry := mux.NewRouter()
+		handleMetrics = telemetry.Handle
+		metrics.telemetry = telemetry
+	}
+	handleMetrics("/metrics", scrapes.Wrap(metricsHandler(registry)))
+	if runtimeRegistry != registry {
+		handleMetrics(runtimeMetricsEndpoint, metricsHandler(runtimeRegistry))
+	}
+	addOptionsRoutes(router.Router)
+	metrics.registerRouteCount(router.Router)
+	router.Router.Use(metrics.chainDepthMiddleware)
+	logger := newLogger(os.Stderr, cfg.LogTimeFormat)
+	router.Use(canonicalChain(newMiddleware(cfg, metrics, logger, tenants, shutdown))...)
 
-func main() {
-	startApp()
+	if cfg.HotPathInterval > 0 {
+		hotPaths := newHotPathDetector(registry, appRegisterer, newMetricOpts(cfg), logger, cfg.HotPathTopN)
+		shutdown.inBackground(func() func(context.Context) error {
+			hotPaths.start(cfg.HotPathInterval)
+			return hotPaths.Stop
+		})
+	}
+	if cfg.GoroutineLeakThreshold > 0 {
+		leaks := newLeakDetector(appRegisterer, newMetricOpts(cfg), logger, cfg.GoroutineLeakThreshold)
+		shutdown.inBackground(func() func(context.Context) error {
+			leaks.start(cfg.LeakCheckInterval)
+			return leaks.Stop
+		})
+	}
+
+	if cfg.OTLPEndpoint != "" {
+		shutdown.inBackground(func() func(context.Context) error {
+			exporter, err := metrics.newOTLPExporter(cfg, registry)
+			if err != nil {
+				log.Printf("OTLP export disabled: %v", err)
+				return nil
+			}
+			exporter.runEvery(cfg.OTLPInterval)
+			return exporter.Shutdown
+		})
+	}
+
+	// Registered last, the final push runs right after the server has
+	// stopped serving requests.
+	if cfg.PushgatewayURL != "" {
+		pusher := metrics.newMetricsPusher(cfg, registry)
+		shutdown.inBackground(func() func(context.Context) error {
+			pusher.start(cfg.PushInterval)
+			return pusher.Shutdown
+		})
+	}
+	return router.Router, metrics
 }
 
-func startApp() {
-	router := mux.NewRouter()
+// newMiddleware returns the application middleware cfg enables, by their
+// name in middlewareOrder. The request watchdog is registered on shutdown.
+func newMiddleware(cfg ServerConfig, metrics *Metrics, logger *slog.Logger, tenants *tenantAllowlist, shutdown *shutdownHooks) map[string]mux.MiddlewareFunc {
+	middleware := map[string]mux.MiddlewareFunc{
+		"access_log": accessLogMiddleware(logger,
+			metrics.newSlowRequestLog(cfg.SlowRequestThreshold, cfg.SlowLogSampleRate),
+			metrics.newAccessLogSampler(cfg.AccessLogSampleRate, time.Now().UnixNano())),
+		"recovery":        recoveryMiddleware(cfg.PanicResponseBody),
+		"request_source":  requestSourceMiddleware(cfg.InternalNetworks),
+		"tenant":          tenantMiddleware(tenants),
+		"monitoring":      metrics.monitoringMiddleware,
+		"protocol":        metrics.protocolMiddleware,
+		"deadline":        metrics.deadlineMiddleware(cfg.RequestTimeout),
+		"json_validation": metrics.jsonValidationMiddleware,
+	}
+	if cfg.MaxRedirects > 0 {
+		middleware["redirect_loop"] = metrics.redirectLoopMiddleware(cfg.MaxRedirects)
+	}
+	if cfg.GzipMinSize > 0 {
+		middleware["gzip"] = metrics.compression.middleware(cfg.GzipMinSize)
+	}
+	if cfg.RequiredHeader != "" {
+		middleware["required_header"] = metrics.requiredHeaderMiddleware(cfg.RequiredHeader, cfg.RequiredHeaderValues)
+	}
+	if len(cfg.CacheRoutes) > 0 {
+		middleware["cache"] = metrics.newResponseCache(cfg.CacheRoutes, cfg.CacheTTL, cfg.CacheMaxBytes).middleware
+	}
+	if cfg.StuckRequestThreshold > 0 {
+		watchdog := metrics.newRequestWatchdog(cfg.StuckRequestThreshold)
+		shutdown.inBackground(func() func(context.Context) error {
+			watchdog.start()
+			return watchdog.Stop
+		})
+		middleware["watchdog"] = watchdog.Wrap
+	}
+	if cfg.MaxBodyBytes > 0 {
+		middleware["max_body"] = maxBodyMiddleware(cfg.MaxBodyBytes)
+	}
+	middleware["decompress"] = decompressMiddleware(cfg.MaxBodyBytes)
+	if cfg.DefaultContentType != "" {
+		middleware["content_type"] = contentTypeMiddleware(cfg.DefaultContentType)
+	}
+	return middleware
+}
 
-	router.HandleFunc(welcomeEndpoint, generateWelcomeMessage).Methods("GET")
-	router.HandleFunc(birthdayEndpoint,
-		createRequestsInProgressMetric("requests_in_progress",
-			birthdayEndpoint,
-			generateBirthdayMessage)).
-		Methods("GET")
-	router.HandleFunc(greetingEndpoint,
-		createRequestLatencyMetric("request_latency",
-			greetingEndpoint,
-			generateGreetingMessage)).
-		Methods("GET")
+// startApp serves the application on listener until the process receives
+// SIGINT or SIGTERM or ctx is done, and then runs the shutdown hooks.
+func startApp(ctx context.Context, cfg ServerConfig, listener net.Listener) error {
+	begin := time.Now()
+	reloader := newConfigReloader()
+	shutdown := newShutdownHooks()
+	router, metrics := newRouter(cfg, reloader, shutdown)
+	shutdown.startBackground()
+	reloader.watch(LoadConfig)
+	shutdown.onShutdown(metrics.watchDumpSignal(cfg.DumpDir))
+	panicRate := metrics.NewPanicRateGauge()
+	shutdown.onShutdown(func(context.Context) error {
+		panicRate.Stop()
+		return nil
+	})
+	if cfg.CounterSnapshotFile != "" {
+		metrics.RestoreCounters(cfg.CounterSnapshotFile, cfg.CounterSnapshotMaxAge)
+		shutdown.onShutdown(func(context.Context) error {
+			return metrics.SaveCounters(cfg.CounterSnapshotFile)
+		})
+	}
 
+	var handler http.Handler = router
+	if cfg.MethodOverride {
+		handler = methodOverrideMiddleware(router)
+	}
+	handler = metrics.headerLimitMiddleware(cfg.MaxHeaderBytes)(handler)
+	server := &http.Server{Handler: handler, MaxHeaderBytes: serverMaxHeaderBytes(cfg.MaxHeaderBytes), WriteTimeout: cfg.WriteTimeout}
+	shutdown.onShutdown(server.Shutdown)
+	if metrics.telemetry != nil {
+		if err := metrics.serveMetrics(cfg, metrics.telemetry, shutdown); err != nil {
+			return err
+		}
+	}
+	stopped := shutdown.watch(ctx, cfg.ShutdownTimeout)
 
-	router.Path("/metrics").Handler(promhttp.Handler())
-	router.Use(monitoringMiddleware)
+	warmUpCtx, cancelWarmUp := context.WithCancel(ctx)
+	defer cancelWarmUp()
+	go metrics.warmUp(warmUpCtx, begin, cfg.StartupDelay)
 
-	log.Println("Starting the application server...")
-	if err := http.ListenAndServe(address, router); err != nil {
-		log.Fatal(err.Error())
-		return
+	log.Printf("Starting the application server on %s...", listener.Addr())
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
 	}
+	<-stopped
+	log.Println("Application server stopped")
+	return nil
 }
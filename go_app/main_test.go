@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSleepWithMetricCancelled(t *testing.T) {
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_sleep_seconds"})
+	requested := time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	if err := SleepWithMetric(ctx, requested, histogram); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	var m dto.Metric
+	if err := histogram.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 1 {
+		t.Fatalf("expected 1 observation, got %d", got)
+	}
+	if got := m.GetHistogram().GetSampleSum(); got >= requested.Seconds() {
+		t.Errorf("observed sleep %.3fs should be shorter than requested %s", got, requested)
+	}
+}
+
+func TestSleepWithMetricCompleted(t *testing.T) {
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_sleep_seconds"})
+	requested := 20 * time.Millisecond
+
+	if err := SleepWithMetric(context.Background(), requested, histogram); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var m dto.Metric
+	if err := histogram.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleSum(); got < requested.Seconds() {
+		t.Errorf("observed sleep %.3fs should be at least %s", got, requested)
+	}
+}
+
+// scrape fetches /metrics from handler and parses the text exposition.
+func scrape(t *testing.T, handler http.Handler) map[string]*dto.MetricFamily {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("scraping /metrics returned status %d", recorder.Code)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(recorder.Body)
+	if err != nil {
+		t.Fatalf("parsing /metrics: %v", err)
+	}
+	return families
+}
+
+func TestEchoEndpointIntegration(t *testing.T) {
+	server := httptest.NewServer(NewRouter(defaultConfig(), newConfigReloader()))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/echo/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if string(body) != "hello" {
+		t.Fatalf("expected echoed body %q, got %q", "hello", body)
+	}
+
+	response, err = http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{
+		"go_app_api_request_counter",
+		"go_app_api_requests_in_progress",
+		"go_app_api_request_latency",
+	} {
+		metric := findMetric(families[name], "path", echoEndpoint)
+		if metric == nil {
+			t.Errorf("expected %s to have a series for %s", name, echoEndpoint)
+			continue
+		}
+		if name == "go_app_api_request_latency" {
+			if first := metric.GetHistogram().GetBucket()[0]; first.GetCumulativeCount() != 1 {
+				t.Errorf("expected the echo request in the first bucket (le=%v)", first.GetUpperBound())
+			}
+		}
+	}
+}
+
+// findMetric returns the metric of family whose label name has value, or nil.
+func findMetric(family *dto.MetricFamily, name, value string) *dto.Metric {
+	for _, metric := range family.GetMetric() {
+		for _, pair := range metric.GetLabel() {
+			if pair.GetName() == name && pair.GetValue() == value {
+				return metric
+			}
+		}
+	}
+	return nil
+}
+
+// gatheredValue gathers g and returns the value of the first metric of the
+// counter or gauge family name.
+func gatheredValue(t *testing.T, g prometheus.Gatherer, name string) float64 {
+	t.Helper()
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name || len(family.GetMetric()) == 0 {
+			continue
+		}
+		metric := family.GetMetric()[0]
+		if family.GetType() == dto.MetricType_COUNTER {
+			return metric.GetCounter().GetValue()
+		}
+		return metric.GetGauge().GetValue()
+	}
+	t.Fatalf("metric %s was not gathered", name)
+	return 0
+}
+
+func TestRegisteredRoutesGauge(t *testing.T) {
+	for name, tc := range map[string]struct {
+		debug    bool
+		expected float64
+	}{
+		// The welcome, birthday, greeting, echo and WebSocket echo routes,
+		// /healthz and /startupz, each with its OPTIONS route, plus /metrics.
+		"default": {expected: 15},
+		// Plus the four /debug routes and their OPTIONS routes.
+		"debug": {debug: true, expected: 23},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.Debug = tc.debug
+			router := NewRouter(cfg, newConfigReloader())
+			for i := 0; i < 2; i++ {
+				family := scrape(t, router)["go_app_api_registered_routes"]
+				if value := gatheredFamilyValue(t, family); value != tc.expected {
+					t.Errorf("scrape %d: expected %v registered routes, got %v", i, tc.expected, value)
+				}
+			}
+		})
+	}
+}
+
+// gatheredFamilyValue returns the value of the only metric of the counter or
+// gauge family.
+func gatheredFamilyValue(t *testing.T, family *dto.MetricFamily) float64 {
+	t.Helper()
+	if family == nil || len(family.GetMetric()) != 1 {
+		t.Fatalf("expected one metric, got %v", family)
+	}
+	if family.GetType() == dto.MetricType_COUNTER {
+		return family.GetMetric()[0].GetCounter().GetValue()
+	}
+	return family.GetMetric()[0].GetGauge().GetValue()
+}
+
+func TestHeadRequestsOnGetRoutes(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.GreetingHandlerDelay = time.Millisecond
+	router := NewRouter(cfg, newConfigReloader())
+
+	for _, path := range []string{"/", "/greeting/Bob"} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodHead, path, nil))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("HEAD %s: expected status %d, got %d", path, http.StatusOK, recorder.Code)
+		}
+		if recorder.Body.Len() != 0 {
+			t.Errorf("HEAD %s: expected no body, got %q", path, recorder.Body.String())
+		}
+	}
+}
+
+func TestTrailingSlashRedirect(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		cfg := defaultConfig()
+		cfg.RedirectTrailingSlash = enabled
+		cfg.GreetingHandlerDelay = 0
+		router := NewRouter(cfg, newConfigReloader())
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/greeting/Bob/", nil))
+		if !enabled {
+			if recorder.Code != http.StatusNotFound {
+				t.Errorf("disabled: expected status %d, got %d", http.StatusNotFound, recorder.Code)
+			}
+		} else if recorder.Code != http.StatusMovedPermanently || recorder.Header().Get("Location") != "/greeting/Bob" {
+			t.Errorf("expected a %d redirect to /greeting/Bob, got %d to %q",
+				http.StatusMovedPermanently, recorder.Code, recorder.Header().Get("Location"))
+		}
+
+		recorder = httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		if recorder.Code != http.StatusOK || recorder.Body.String() != "Welcome!" {
+			t.Errorf("enabled %v: expected / to be served as is, got %d %q", enabled, recorder.Code, recorder.Body.String())
+		}
+	}
+}
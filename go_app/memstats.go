@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"runtime"
+	"sync"
+)
+
+// memStatsCollector publishes a few fields of runtime.MemStats, read once
+// per collection. The Go collector's runtime/metrics samples are averaged
+// over GC cycles; these show the heap as the scrape finds it.
+type memStatsCollector struct {
+	// mu guards stats, which is reused across collections so that reading
+	// the stats does not allocate itself.
+	mu    sync.Mutex
+	stats runtime.MemStats
+
+	heapAlloc  *prometheus.Desc
+	heapSys    *prometheus.Desc
+	stackInuse *prometheus.Desc
+	nextGC     *prometheus.Desc
+}
+
+// NewMemStatsCollector returns a collector of the heap and stack sizes named
+// under namespace, registered with registry unless it is nil.
+func NewMemStatsCollector(namespace string, registry *prometheus.Registry) prometheus.Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "runtime", name), help, nil, nil)
+	}
+	c := &memStatsCollector{
+		heapAlloc:  desc("heap_alloc_bytes", "Bytes of allocated heap objects."),
+		heapSys:    desc("heap_sys_bytes", "Bytes of heap memory obtained from the OS."),
+		stackInuse: desc("stack_inuse_bytes", "Bytes in stack spans."),
+		nextGC:     desc("next_gc_bytes", "Heap size the next GC cycle targets."),
+	}
+	if registry != nil {
+		registry.MustRegister(c)
+	}
+	return c
+}
+
+func (c *memStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.heapAlloc
+	ch <- c.heapSys
+	ch <- c.stackInuse
+	ch <- c.nextGC
+}
+
+func (c *memStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	runtime.ReadMemStats(&c.stats)
+	ch <- prometheus.MustNewConstMetric(c.heapAlloc, prometheus.GaugeValue, float64(c.stats.HeapAlloc))
+	ch <- prometheus.MustNewConstMetric(c.heapSys, prometheus.GaugeValue, float64(c.stats.HeapSys))
+	ch <- prometheus.MustNewConstMetric(c.stackInuse, prometheus.GaugeValue, float64(c.stats.StackInuse))
+	ch <- prometheus.MustNewConstMetric(c.nextGC, prometheus.GaugeValue, float64(c.stats.NextGC))
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"runtime"
+	"testing"
+)
+
+func TestMemStatsCollector(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	NewMemStatsCollector("go_app", registry)
+
+	ballast := make([]byte, 8<<20)
+	for i := range ballast {
+		ballast[i] = byte(i)
+	}
+	heapAlloc := gatheredValue(t, registry, "go_app_runtime_heap_alloc_bytes")
+	runtime.KeepAlive(ballast)
+
+	if heapAlloc < float64(len(ballast)) {
+		t.Errorf("expected the heap to hold at least the %d bytes allocated, got %v", len(ballast), heapAlloc)
+	}
+	for _, name := range []string{"go_app_runtime_heap_sys_bytes", "go_app_runtime_stack_inuse_bytes", "go_app_runtime_next_gc_bytes"} {
+		if value := gatheredValue(t, registry, name); value <= 0 {
+			t.Errorf("expected %s to be positive, got %v", name, value)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric groups the monitoring middleware records, which can be switched
+// off at runtime when they get too expensive.
+const (
+	// metricGroupRequests is the request counter.
+	metricGroupRequests = "requests"
+	// metricGroupLatency is the request duration histogram.
+	metricGroupLatency = "latency"
+	// metricGroupStatus is the counter by status class, with its high
+	// cardinality, and the client disconnect counter.
+	metricGroupStatus = "status"
+)
+
+var metricGroups = []string{metricGroupRequests, metricGroupLatency, metricGroupStatus}
+
+func validMetricGroup(group string) bool {
+	for _, known := range metricGroups {
+		if group == known {
+			return true
+		}
+	}
+	return false
+}
+
+// metricGroupFlags tells whether each metric group is enabled. Disabled
+// groups stop receiving observations but stay registered, so their series
+// do not disappear from scrapes, unless unregister is set.
+type metricGroupFlags struct {
+	metrics    *Metrics
+	unregister bool
+	enabled    map[string]*int32
+	// mu serializes the changes, so a group is never registered twice.
+	mu sync.Mutex
+}
+
+func (m *Metrics) newMetricGroupFlags() *metricGroupFlags {
+	flags := &metricGroupFlags{metrics: m, enabled: map[string]*int32{}}
+	for _, group := range metricGroups {
+		enabled := int32(1)
+		flags.enabled[group] = &enabled
+		m.MetricGroupEnabled.WithLabelValues(group).Set(1)
+	}
+	return flags
+}
+
+// Enabled reports whether group is recorded. It is called on every request.
+func (f *metricGroupFlags) Enabled(group string) bool {
+	return atomic.LoadInt32(f.enabled[group]) == 1
+}
+
+// collectors returns the families of group.
+func (f *metricGroupFlags) collectors(group string) []prometheus.Collector {
+	m := f.metrics
+	switch group {
+	case metricGroupRequests:
+		return []prometheus.Collector{m.RequestCounter}
+	case metricGroupLatency:
+		return []prometheus.Collector{m.RequestDuration}
+	default:
+		return []prometheus.Collector{m.StatusCounter, m.ClientDisconnects}
+	}
+}
+
+// Set enables or disables the groups in states. Nothing is changed unless
+// every group is known.
+func (f *metricGroupFlags) Set(states map[string]bool) error {
+	for group := range states {
+		if !validMetricGroup(group) {
+			return fmt.Errorf("unknown metric group %q, expected one of %v", group, metricGroups)
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for group, enabled := range states {
+		if f.Enabled(group) == enabled {
+			continue
+		}
+		value := int32(0)
+		if enabled {
+			value = 1
+		}
+		if f.unregister {
+			for _, collector := range f.collectors(group) {
+				if enabled {
+					f.metrics.registerer.MustRegister(collector)
+				} else {
+					f.metrics.registerer.Unregister(collector)
+				}
+			}
+		}
+		atomic.StoreInt32(f.enabled[group], value)
+		f.metrics.MetricGroupEnabled.WithLabelValues(group).Set(float64(value))
+	}
+	return nil
+}
+
+// States returns whether each group is enabled.
+func (f *metricGroupFlags) States() map[string]bool {
+	states := make(map[string]bool, len(metricGroups))
+	for _, group := range metricGroups {
+		states[group] = f.Enabled(group)
+	}
+	return states
+}
+
+// handler serves /debug/metrics/flags, which is only registered in debug
+// mode. GET returns whether each group is enabled by group name; PUT takes
+// the same format, for some or all of the groups, and returns the states
+// once applied.
+func (f *metricGroupFlags) handler(rw http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var states map[string]bool
+		if err := DecodeJSONWithMetrics(r, &states, f.metrics.BodyParseErrors.MustCurryWith(
+			prometheus.Labels{"path": routeLabel(r)})); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := f.Set(states); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Changed the metric groups %v on request from %s", states, r.RemoteAddr)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(f.States()); err != nil {
+		log.Println(err.Error())
+	}
+}
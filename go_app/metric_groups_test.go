@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricGroupFlags(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Debug = true
+	router := NewRouter(cfg, newConfigReloader())
+	echo := func() {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/echo/hi", nil))
+	}
+	values := func() (requests, responses float64) {
+		families := scrape(t, router)
+		requests = findMetric(families["go_app_api_request_counter"], "path", echoEndpoint).GetCounter().GetValue()
+		responses = findMetric(families["go_app_api_responses_total"], "path", echoEndpoint).GetCounter().GetValue()
+		return requests, responses
+	}
+
+	echo()
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/debug/metrics/flags",
+		strings.NewReader(`{"status": false}`)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected the flags to be changed, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	echo()
+	echo()
+
+	requests, responses := values()
+	if requests != 3 {
+		t.Errorf("expected the requests group to keep counting, got %v", requests)
+	}
+	if responses != 1 {
+		t.Errorf("expected the disabled status group to keep its value of 1, got %v", responses)
+	}
+	families := scrape(t, router)
+	if enabled := findMetric(families["go_app_api_metric_group_enabled"], "group", metricGroupStatus); enabled.GetGauge().GetValue() != 0 {
+		t.Errorf("expected the status group to be reported disabled, got %v", enabled)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/debug/metrics/flags",
+		strings.NewReader(`{"sizes": false}`)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown group to be rejected, got %d", recorder.Code)
+	}
+}
+
+func TestUnregisterDisabledMetricGroups(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.DisabledMetricGroups = []string{metricGroupLatency}
+	cfg.UnregisterDisabledGroups = true
+	router := NewRouter(cfg, newConfigReloader())
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/echo/hi", nil))
+
+	families := scrape(t, router)
+	if _, ok := families["go_app_api_request_duration_seconds"]; ok {
+		t.Error("expected the disabled latency group to be unregistered")
+	}
+	if _, ok := families["go_app_api_request_counter"]; !ok {
+		t.Error("expected the requests group to stay registered")
+	}
+}
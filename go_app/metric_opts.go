@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+)
+
+// NamingConvention decides the exposed name of a metric from the name the
+// code registers it with.
+type NamingConvention interface {
+	CounterName(name string) string
+	DurationName(name string) string
+}
+
+// legacyNaming keeps the names the application has always exposed.
+type legacyNaming struct{}
+
+func (legacyNaming) CounterName(name string) string  { return name }
+func (legacyNaming) DurationName(name string) string { return name }
+
+// standardNaming follows the Prometheus naming conventions: counters end in
+// _total and durations in _seconds.
+type standardNaming struct{}
+
+// standardRenames holds legacy names that need more than a suffix.
+var standardRenames = map[string]string{
+	"request_counter": "requests_total",
+}
+
+func (standardNaming) CounterName(name string) string {
+	if renamed, ok := standardRenames[name]; ok {
+		return renamed
+	}
+	if strings.HasSuffix(name, "_total") {
+		return name
+	}
+	return name + "_total"
+}
+
+func (standardNaming) DurationName(name string) string {
+	if strings.HasSuffix(name, "_seconds") {
+		return name
+	}
+	return name + "_seconds"
+}
+
+// namingConvention returns the NamingConvention called name.
+func namingConvention(name string) (NamingConvention, error) {
+	switch name {
+	case "legacy":
+		return legacyNaming{}, nil
+	case "standard":
+		return standardNaming{}, nil
+	default:
+		return nil, fmt.Errorf("unknown naming convention %q", name)
+	}
+}
+
+// MetricOpts builds the options of every application metric, so that they
+// all share the configured namespace, subsystem and naming convention.
+type MetricOpts struct {
+	Namespace string
+	Subsystem string
+	Naming    NamingConvention
+	// NativeHistograms makes the request latency histograms native
+	// histograms as well, see NativeHistogramOpts.
+	NativeHistograms bool
+	// LatencyBuckets, if set, replace the default buckets of the request
+	// latency histograms.
+	LatencyBuckets []float64
+}
+
+func newMetricOpts(cfg ServerConfig) MetricOpts {
+	naming, err := namingConvention(cfg.MetricNaming)
+	if err != nil {
+		naming = legacyNaming{}
+	}
+	return MetricOpts{
+		Namespace:        cfg.MetricNamespace,
+		Subsystem:        cfg.MetricSubsystem,
+		Naming:           naming,
+		NativeHistograms: cfg.UseNativeHistograms,
+		LatencyBuckets:   cfg.LatencyBuckets,
+	}
+}
+
+// WithoutSubsystem returns a copy of o for metrics named directly under the
+// namespace.
+func (o MetricOpts) WithoutSubsystem() MetricOpts {
+	o.Subsystem = ""
+	return o
+}
+
+func (o MetricOpts) Counter(name, help string) prometheus.CounterOpts {
+	return prometheus.CounterOpts{Namespace: o.Namespace, Subsystem: o.Subsystem, Name: o.Naming.CounterName(name), Help: help}
+}
+
+func (o MetricOpts) Gauge(name, help string) prometheus.GaugeOpts {
+	return prometheus.GaugeOpts{Namespace: o.Namespace, Subsystem: o.Subsystem, Name: name, Help: help}
+}
+
+func (o MetricOpts) Histogram(name, help string, buckets []float64) prometheus.HistogramOpts {
+	return prometheus.HistogramOpts{Namespace: o.Namespace, Subsystem: o.Subsystem, Name: name, Help: help, Buckets: buckets}
+}
+
+// latencyBuckets returns the configured LatencyBuckets, or the buckets the
+// request latency histograms have by default.
+func (o MetricOpts) latencyBuckets() []float64 {
+	if o.LatencyBuckets != nil {
+		return o.LatencyBuckets
+	}
+	return requestDurationBuckets
+}
+
+// Duration builds the options of a histogram observing durations in seconds.
+func (o MetricOpts) Duration(name, help string, buckets []float64) prometheus.HistogramOpts {
+	return o.Histogram(o.Naming.DurationName(name), help, buckets)
+}
+
+// nativeHistogramBucketFactor bounds the growth from one native histogram
+// bucket to the next to 10%.
+const nativeHistogramBucketFactor = 1.1
+
+// NativeHistogramOpts returns opts turned into a native histogram when
+// native histograms are enabled. The classic buckets are kept, so scrapers
+// that do not negotiate native histograms see the same series as before.
+func (o MetricOpts) NativeHistogramOpts(opts prometheus.HistogramOpts) prometheus.HistogramOpts {
+	if !o.NativeHistograms {
+		return opts
+	}
+	if opts.Buckets == nil {
+		opts.Buckets = prometheus.DefBuckets
+	}
+	opts.NativeHistogramBucketFactor = nativeHistogramBucketFactor
+	return opts
+}
@@ -0,0 +1,729 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"example.com/m/recorder"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requestDurationBuckets cover both the fast endpoints and the 20 seconds the
+// birthday endpoint takes by default.
+var requestDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 15, 20, 30}
+
+const (
+	smartBucketCount = 20
+	smartBucketMin   = time.Millisecond
+)
+
+// SmartBuckets returns 20 logarithmically spaced histogram buckets from 1ms
+// to three times handlerExpectedLatency, so a handler's latency lands in the
+// densely bucketed middle of the range whether it takes milliseconds or tens
+// of seconds. Bounds are rounded to three significant digits.
+func SmartBuckets(handlerExpectedLatency time.Duration) []float64 {
+	lower := smartBucketMin.Seconds()
+	upper := 3 * handlerExpectedLatency.Seconds()
+	if upper < 3*lower {
+		upper = 3 * lower
+	}
+	factor := math.Pow(upper/lower, 1/float64(smartBucketCount-1))
+	buckets := make([]float64, smartBucketCount)
+	for i := range buckets {
+		buckets[i] = roundBound(lower * math.Pow(factor, float64(i)))
+	}
+	return buckets
+}
+
+// Metrics holds the collectors the application registers. Every collector,
+// including the per-endpoint ones created by the create*Metric helpers, is
+// registered through the same registerer so they all carry the configured
+// const labels.
+type Metrics struct {
+	// RequestCounter counts requests by path and source, internal or
+	// external.
+	RequestCounter  *prometheus.CounterVec
+	RequestDuration *prometheus.HistogramVec
+	SleepDuration   *prometheus.HistogramVec
+	// SprintfDuration is fed by TimedSprintf in the handlers, by handler.
+	SprintfDuration *prometheus.HistogramVec
+	ChaosDelay      *prometheus.GaugeVec
+	// SimulatedLatency is the artificial delay of each route, by path.
+	SimulatedLatency *prometheus.GaugeVec
+	// BodyParseErrors counts request bodies DecodeJSONWithMetrics failed to
+	// decode; curry it with the route's path before use.
+	BodyParseErrors *prometheus.CounterVec
+	// InvalidJSONResponses counts JSON responses jsonValidationMiddleware
+	// replaced with a 500 because they did not parse.
+	InvalidJSONResponses *prometheus.CounterVec
+	// RequestTimeouts counts requests that ran out of time by whether the
+	// deadline came from the client's X-Timeout or from the server.
+	RequestTimeouts *prometheus.CounterVec
+	// TimeoutConsumed observes, for every request that exceeded its
+	// deadline, how much of the budget it had used: the time it ran divided
+	// by REQUEST_TIMEOUT or, without one, by its own deadline.
+	TimeoutConsumed *prometheus.HistogramVec
+	// RedirectLoops counts requests redirectLoopMiddleware rejected.
+	RedirectLoops *prometheus.CounterVec
+	// MissingRequiredHeader counts the requests requiredHeaderMiddleware
+	// rejected, by whether the header was missing or had a value not
+	// allowed.
+	MissingRequiredHeader *prometheus.CounterVec
+	// StatusCounter counts finished requests by path and status class, with
+	// "aborted" for requests whose client disconnected.
+	StatusCounter     *prometheus.CounterVec
+	ClientDisconnects *prometheus.CounterVec
+	// BudgetConsumed and BudgetExceeded are fed by LatencyBudgetTrackers.
+	BudgetConsumed *prometheus.GaugeVec
+	BudgetExceeded *prometheus.CounterVec
+	// RateLimiterRPS and RateLimiterBurst publish the configuration of each
+	// rate limiter.
+	RateLimiterRPS   *prometheus.GaugeVec
+	RateLimiterBurst *prometheus.GaugeVec
+	// QueueWait and QueueDepth are fed by the concurrency limiters.
+	QueueWait  *prometheus.HistogramVec
+	QueueDepth *prometheus.GaugeVec
+	// EndpointRequests, EndpointInProgress and EndpointLatency are fed by the
+	// create*Metric helpers, one path and handler_func pair per route.
+	EndpointRequests   *prometheus.CounterVec
+	EndpointInProgress *prometheus.GaugeVec
+	EndpointLatency    *prometheus.HistogramVec
+	// EndpointAvailability is fed by AvailabilityTrackers.
+	EndpointAvailability *prometheus.GaugeVec
+	// DependencyUp is 1 while a registered Dependency passes its health
+	// checks and 0 otherwise.
+	DependencyUp *prometheus.GaugeVec
+	// The Scrape metrics describe the scrapes of the metrics endpoint.
+	ScrapesServed  prometheus.Counter
+	ScrapeDuration prometheus.Histogram
+	ScrapeSize     prometheus.Gauge
+	LastScrape     prometheus.Gauge
+	// SlowRequests counts the requests slower than the slow request
+	// threshold and SlowRequestsLogged the ones the access log sampled.
+	SlowRequests       prometheus.Counter
+	SlowRequestsLogged prometheus.Counter
+	// MetricGroupEnabled is 1 for the metric groups being recorded and 0
+	// for the disabled ones, see metricGroupFlags.
+	MetricGroupEnabled *prometheus.GaugeVec
+	// WebSocketUpgrades counts WebSocket handshakes by outcome, see
+	// OnUpgradeAttempt.
+	WebSocketUpgrades *prometheus.CounterVec
+	// AccessLogLines counts the access log sampling decisions, "logged" or
+	// "suppressed".
+	AccessLogLines *prometheus.CounterVec
+	// Panics counts the handler panics other than http.ErrAbortHandler, and
+	// PanicRate is their rate per minute, fed by a RateGauge.
+	Panics    prometheus.Counter
+	PanicRate prometheus.Gauge
+	// RequestProtocols counts requests by protocol version.
+	RequestProtocols *prometheus.CounterVec
+	// RequestHeaderBytes and ResponseHeaderBytes observe the size of the
+	// request and response headers, see headerSize, and ResponseHeaderCount
+	// the number of response header fields. HeaderTooLarge counts the
+	// requests rejected for exceeding MAX_HEADER_BYTES.
+	RequestHeaderBytes  *prometheus.HistogramVec
+	ResponseHeaderBytes *prometheus.HistogramVec
+	ResponseHeaderCount *prometheus.HistogramVec
+	HeaderTooLarge      prometheus.Counter
+	// ResponseBytes observes the size of the response bodies, 0 for the
+	// 304 Not Modified answers of withETag.
+	ResponseBytes *prometheus.HistogramVec
+	// ResponseCacheRequests counts the lookups of the response cache by
+	// result, ResponseCacheEvictions the entries evicted to stay under its
+	// memory cap, and ResponseCacheEntries and ResponseCacheBytes report
+	// its size.
+	ResponseCacheRequests  *prometheus.CounterVec
+	ResponseCacheEvictions prometheus.Counter
+	ResponseCacheEntries   prometheus.Gauge
+	ResponseCacheBytes     prometheus.Gauge
+	// CircuitBreakerState is the state of each CircuitBreaker, and
+	// CircuitBreakerOpenDuration observes how long they stayed open before
+	// letting a probe through.
+	CircuitBreakerState        *prometheus.GaugeVec
+	CircuitBreakerOpenDuration *prometheus.HistogramVec
+	// MetricsTLSHandshakeFailures counts the failed TLS handshakes of the
+	// metrics listener, such as clients rejected for their certificate.
+	MetricsTLSHandshakeFailures prometheus.Counter
+	// StartupDuration is the time the application took to initialize, set
+	// once /startupz starts answering 200.
+	StartupDuration prometheus.Gauge
+	// MiddlewareChainDepth observes the number of middleware layers each
+	// request went through.
+	MiddlewareChainDepth *prometheus.HistogramVec
+	// RoutesRegistered counts the routes ever registered through a
+	// RouteTracker and ActiveRoutes the ones not deregistered since.
+	RoutesRegistered prometheus.Counter
+	ActiveRoutes     prometheus.Gauge
+	// OTLPExportFailures counts the failed attempts to export the metrics
+	// over OTLP, retries included.
+	OTLPExportFailures prometheus.Counter
+	// PushFailures counts the failed attempts to push the metrics to the
+	// Pushgateway, retries included, and PushLastSuccess holds the time of
+	// the last successful push.
+	PushFailures    prometheus.Counter
+	PushLastSuccess prometheus.Gauge
+	// DiagnosticDumps counts the goroutine dumps written on SIGQUIT or
+	// served on /debug/goroutines.
+	DiagnosticDumps prometheus.Counter
+	// StuckRequests is fed by the request watchdog.
+	StuckRequests *prometheus.GaugeVec
+	// RequestRate is fed by RateGauges.
+	RequestRate *prometheus.GaugeVec
+	// The Outbound metrics are fed by the clients NewInstrumentedClient
+	// returns, labeled by the target host.
+	OutboundDNS       *prometheus.HistogramVec
+	OutboundConnect   *prometheus.HistogramVec
+	OutboundTLS       *prometheus.HistogramVec
+	OutboundFirstByte *prometheus.HistogramVec
+	OutboundConns     *prometheus.CounterVec
+	// ConnectionErrors counts the outbound requests that failed by the kind
+	// of error, see connectionErrorKind.
+	ConnectionErrors *prometheus.CounterVec
+
+	inFlight  *inFlightCollector
+	exemplars *exemplarCoverage
+	groups    *metricGroupFlags
+	// routeOrder is fed by the RouteTrackers.
+	routeOrder *routeOrder
+	// started is set to 1 by markStarted once initialization is complete.
+	started int32
+	// requestPaths bounds the path label values of RequestCounter, by
+	// default not at all.
+	requestPaths *pathLRU
+	// telemetry serves the metrics endpoints when they have their own
+	// listener, see ServerConfig.MetricsAddress.
+	telemetry http.Handler
+	// compression counts the bytes the gzip middleware compressed.
+	compression *compressionCounters
+
+	opts       MetricOpts
+	registerer prometheus.Registerer
+	factory    familyFactory
+	skipList   atomic.Value // *skipList
+	// serverTiming makes monitoringMiddleware send a Server-Timing header.
+	serverTiming bool
+	// counterExemplars attaches the trace or request ID of every request to
+	// its increment of RequestCounter.
+	counterExemplars bool
+	// legacyEndpointMetrics also records the create*Metric helpers into the
+	// families named by their callers, which predate the Endpoint metrics.
+	// legacy holds those families by name.
+	legacyEndpointMetrics bool
+	// perHandlerCounters makes createRequestCounterMetric count requests on
+	// top of RequestCounter.
+	perHandlerCounters bool
+	legacyMu           sync.Mutex
+	legacy             map[string]prometheus.Collector
+	// dependencies are the registered Dependencies, checked by the deep
+	// health check.
+	dependenciesMu sync.Mutex
+	dependencies   []*Dependency
+}
+
+// NewMetrics creates the application metrics and registers them with reg.
+func NewMetrics(reg prometheus.Registerer, opts MetricOpts) *Metrics {
+	factory := newFamilyFactory(reg)
+	m := &Metrics{
+		RequestCounter: factory.NewCounterVec(
+			opts.Counter("request_counter", "Total HTTP requests by route, client network and tenant."),
+			[]string{"path", "source", "tenant"}),
+		RequestDuration: factory.NewHistogramVec(
+			opts.NativeHistogramOpts(opts.Duration("request_duration_seconds",
+				"HTTP request latency, including the time spent queued.", opts.latencyBuckets())),
+			[]string{"path", "tenant"}),
+		SleepDuration: factory.NewHistogramVec(
+			opts.Duration("handler_sleep_seconds", "Artificial delay actually spent sleeping by a handler.",
+				[]float64{.1, .5, 1, 2.5, 5, 10, 15, 20, 30}),
+			[]string{"handler"}),
+		SprintfDuration: factory.NewHistogramVec(
+			opts.Histogram("sprintf_duration_nanoseconds",
+				"Time spent formatting strings with fmt.Sprintf in a handler, for a sample of the calls.", sprintfBuckets),
+			[]string{"handler"}),
+		ChaosDelay: factory.NewGaugeVec(
+			opts.WithoutSubsystem().Gauge("chaos_delay_seconds",
+				"Artificial delay injected into the handler, for spotting unintended values."),
+			[]string{"handler"}),
+		SimulatedLatency: factory.NewGaugeVec(
+			opts.WithoutSubsystem().Gauge("simulated_latency_seconds",
+				"Artificial delay currently configured for the route."),
+			[]string{"path"}),
+		BodyParseErrors: factory.NewCounterVec(
+			opts.Counter("request_body_parse_errors_total", "Total request bodies that failed to decode as JSON."),
+			[]string{"path", "error_type"}),
+		InvalidJSONResponses: factory.NewCounterVec(
+			opts.Counter("json_invalid_response_total", "Total JSON responses replaced with a 500 because they were not valid JSON."),
+			[]string{"path"}),
+		RequestTimeouts: factory.NewCounterVec(
+			opts.Counter("request_timeouts_total", "Total HTTP requests that exceeded their deadline, by who set it."),
+			[]string{"path", "source"}),
+		TimeoutConsumed: factory.NewHistogramVec(
+			opts.Histogram("timeout_consumed_ratio", "Share of the timeout budget used by HTTP requests that exceeded their deadline.",
+				[]float64{.1, .25, .5, .75, .9, .95, 1}),
+			[]string{"path"}),
+		RedirectLoops: factory.NewCounterVec(
+			opts.Counter("redirect_loop_detected_total", "Total HTTP requests rejected for having been redirected too many times."),
+			[]string{"path"}),
+		MissingRequiredHeader: factory.NewCounterVec(
+			opts.Counter("http_missing_required_header_total", "Total HTTP requests rejected for lacking a valid required header."),
+			[]string{"path", "reason"}),
+		StatusCounter: factory.NewCounterVec(
+			opts.Counter("responses_total", "Total finished HTTP requests by status class."),
+			[]string{"path", "status_class"}),
+		ClientDisconnects: factory.NewCounterVec(
+			opts.Counter("client_disconnects_total", "Total HTTP requests aborted because the client disconnected."),
+			[]string{"path"}),
+		BudgetConsumed: factory.NewGaugeVec(
+			opts.Gauge("latency_budget_consumed_ratio",
+				"Moving average of the request latency divided by the endpoint's latency budget."),
+			[]string{"endpoint"}),
+		BudgetExceeded: factory.NewCounterVec(
+			opts.Counter("latency_budget_exceeded_total", "Total HTTP requests slower than the endpoint's latency budget."),
+			[]string{"endpoint"}),
+		RateLimiterRPS: factory.NewGaugeVec(
+			opts.WithoutSubsystem().Gauge("rate_limiter_rps", "Requests per second the rate limiter allows."),
+			[]string{"path"}),
+		RateLimiterBurst: factory.NewGaugeVec(
+			opts.WithoutSubsystem().Gauge("rate_limiter_burst", "Requests the rate limiter allows at once above its rate."),
+			[]string{"path"}),
+		QueueWait: factory.NewHistogramVec(
+			opts.Duration("queue_wait_seconds", "Time HTTP requests spent waiting for a concurrency limiter slot.",
+				opts.latencyBuckets()),
+			[]string{"path"}),
+		QueueDepth: factory.NewGaugeVec(
+			opts.Gauge("queue_depth", "Number of HTTP requests waiting for a concurrency limiter slot."),
+			[]string{"path"}),
+		EndpointRequests: factory.NewCounterVec(
+			opts.Counter("endpoint_requests_total", "Total HTTP requests handled by each instrumented endpoint."),
+			[]string{"path", "handler_func"}),
+		EndpointInProgress: factory.NewGaugeVec(
+			opts.Gauge("endpoint_requests_in_progress", "Number of HTTP requests currently in progress, by instrumented endpoint and method."),
+			[]string{"path", "handler_func", "method"}),
+		EndpointLatency: factory.NewHistogramVec(
+			opts.NativeHistogramOpts(opts.Duration("endpoint_request_duration_seconds",
+				"Latency of the HTTP requests handled by each instrumented endpoint.", opts.latencyBuckets())),
+			[]string{"path", "handler_func"}),
+		EndpointAvailability: factory.NewGaugeVec(
+			opts.Gauge("endpoint_availability", "Share of the recent requests to the endpoint that did not fail with 5xx."),
+			[]string{"endpoint"}),
+		DependencyUp: factory.NewGaugeVec(
+			opts.Gauge("dependency_up", "Whether the downstream dependency passed its last health check."),
+			[]string{"name"}),
+		ScrapesServed: factory.NewCounter(
+			opts.Counter("scrapes_total", "Total requests served by the metrics endpoint.")),
+		ScrapeDuration: factory.NewHistogram(
+			opts.Duration("scrape_duration_seconds", "Time spent gathering and encoding the metrics for a scrape.",
+				[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1})),
+		ScrapeSize: factory.NewGauge(
+			opts.Gauge("scrape_response_size_bytes", "Size of the last metrics exposition served.")),
+		LastScrape: factory.NewGauge(
+			opts.Gauge("last_scrape_timestamp_seconds", "Unix time of the last successful scrape.")),
+		SlowRequests: factory.NewCounter(
+			opts.Counter("slow_requests_total", "Total HTTP requests slower than the slow request threshold.")),
+		SlowRequestsLogged: factory.NewCounter(
+			opts.Counter("slow_requests_logged_total", "Total slow HTTP requests sampled for logging.")),
+		MetricGroupEnabled: factory.NewGaugeVec(
+			opts.Gauge("metric_group_enabled", "Whether the metric group is recorded."),
+			[]string{"group"}),
+		WebSocketUpgrades: factory.NewCounterVec(
+			opts.WithoutSubsystem().Counter("ws_upgrade_attempts_total",
+				"Total WebSocket upgrade handshakes by outcome, success or failure."),
+			[]string{"outcome"}),
+		AccessLogLines: factory.NewCounterVec(
+			opts.Counter("access_log_lines_total", "Total served HTTP requests by whether the access log logged them."),
+			[]string{"outcome"}),
+		Panics: factory.NewCounter(
+			opts.Counter("handler_panics_total", "Total panics recovered from HTTP handlers.")),
+		PanicRate: factory.NewGauge(
+			opts.Gauge("panic_rate_per_minute", "Handler panics per minute over the last minute, computed by the application.")),
+		RequestProtocols: factory.NewCounterVec(
+			opts.Counter("request_protocol_total", "Total HTTP requests by protocol version."),
+			[]string{"proto"}),
+		RequestHeaderBytes: factory.NewHistogramVec(
+			opts.Histogram("request_header_bytes", "Size of the HTTP request headers, names and values.", headerSizeBuckets),
+			[]string{"path"}),
+		ResponseHeaderBytes: factory.NewHistogramVec(
+			opts.Histogram("response_header_bytes", "Size of the HTTP response headers, names and values.", headerSizeBuckets),
+			[]string{"path"}),
+		ResponseHeaderCount: factory.NewHistogramVec(
+			opts.Histogram("response_header_count", "Number of HTTP response header fields.",
+				prometheus.ExponentialBuckets(1, 2, 8)),
+			[]string{"path"}),
+		ResponseBytes: factory.NewHistogramVec(
+			opts.Histogram("response_size_bytes", "Size of the HTTP response bodies.",
+				prometheus.ExponentialBuckets(64, 4, 8)),
+			[]string{"path"}),
+		ResponseCacheRequests: factory.NewCounterVec(
+			opts.Counter("response_cache_requests_total", "Total lookups of the HTTP response cache by result."),
+			[]string{"result"}),
+		ResponseCacheEvictions: factory.NewCounter(
+			opts.Counter("response_cache_evictions_total", "Total HTTP responses evicted from the cache to stay under its memory cap.")),
+		ResponseCacheEntries: factory.NewGauge(
+			opts.Gauge("response_cache_entries", "Number of HTTP responses in the cache.")),
+		ResponseCacheBytes: factory.NewGauge(
+			opts.Gauge("response_cache_bytes", "Size of the HTTP responses in the cache.")),
+		CircuitBreakerState: factory.NewGaugeVec(
+			opts.WithoutSubsystem().Gauge("circuit_breaker_state", "State of the circuit breaker: 0 closed, 1 open, 2 half-open."),
+			[]string{"name"}),
+		CircuitBreakerOpenDuration: factory.NewHistogramVec(
+			opts.WithoutSubsystem().Duration("circuit_breaker_open_duration_seconds", "Time the circuit breaker stayed open before a probe.",
+				prometheus.ExponentialBuckets(0.5, 2, 10)),
+			[]string{"name"}),
+		MetricsTLSHandshakeFailures: factory.NewCounter(
+			opts.Counter("metrics_tls_handshake_failures_total", "Total failed TLS handshakes on the metrics listener.")),
+		StartupDuration: factory.NewGauge(
+			opts.Gauge("startup_duration_seconds", "Time the application took to initialize.")),
+		HeaderTooLarge: factory.NewCounter(
+			opts.Counter("request_header_too_large_total", "Total HTTP requests rejected for a header larger than the server accepts.")),
+		MiddlewareChainDepth: factory.NewHistogramVec(
+			opts.Histogram("middleware_chain_depth", "Number of middleware layers HTTP requests went through.",
+				prometheus.LinearBuckets(1, 1, 16)),
+			[]string{"path"}),
+		RoutesRegistered: factory.NewCounter(
+			opts.Counter("registered_routes_total", "Total routes registered through the route tracker.")),
+		ActiveRoutes: factory.NewGauge(
+			opts.Gauge("active_routes", "Number of routes registered through the route tracker and not deregistered since.")),
+		OTLPExportFailures: factory.NewCounter(
+			opts.WithoutSubsystem().Counter("otlp_export_failures_total", "Total failed attempts to export the metrics over OTLP.")),
+		PushFailures: factory.NewCounter(
+			opts.WithoutSubsystem().Counter("pushgateway_push_failures_total", "Total failed attempts to push the metrics to the Pushgateway.")),
+		PushLastSuccess: factory.NewGauge(
+			opts.WithoutSubsystem().Gauge("pushgateway_last_success_timestamp_seconds", "Unix time of the last successful push to the Pushgateway.")),
+		DiagnosticDumps: factory.NewCounter(
+			opts.WithoutSubsystem().Counter("diagnostic_dumps_total", "Total goroutine dumps written.")),
+		StuckRequests: factory.NewGaugeVec(
+			opts.Gauge("stuck_requests", "Number of HTTP requests being served for longer than the stuck request threshold."),
+			[]string{"path"}),
+		RequestRate: factory.NewGaugeVec(
+			opts.Gauge("request_rate", "Requests per minute over a sliding window, computed by the application."),
+			[]string{"path"}),
+		OutboundDNS: factory.NewHistogramVec(
+			opts.Duration("outbound_dns_duration_seconds", "DNS lookup time of outbound HTTP requests.",
+				outboundBuckets),
+			[]string{"host"}),
+		OutboundConnect: factory.NewHistogramVec(
+			opts.Duration("outbound_connect_duration_seconds", "TCP connect time of outbound HTTP requests.",
+				outboundBuckets),
+			[]string{"host"}),
+		OutboundTLS: factory.NewHistogramVec(
+			opts.Duration("outbound_tls_handshake_duration_seconds", "TLS handshake time of outbound HTTP requests.",
+				outboundBuckets),
+			[]string{"host"}),
+		OutboundFirstByte: factory.NewHistogramVec(
+			opts.Duration("outbound_first_byte_duration_seconds",
+				"Time from sending an outbound HTTP request to the first byte of its response.", outboundBuckets),
+			[]string{"host"}),
+		OutboundConns: factory.NewCounterVec(
+			opts.Counter("outbound_connections_total",
+				"Total connections obtained for outbound HTTP requests, by whether they were reused."),
+			[]string{"host", "reused"}),
+		ConnectionErrors: factory.NewCounterVec(
+			opts.Counter("connection_error_counter", "Total outbound HTTP requests that failed, by kind of error."),
+			[]string{"host", "error_kind"}),
+		inFlight:              newInFlightCollector(opts),
+		exemplars:             newExemplarCoverage(opts),
+		routeOrder:            newRouteOrder(opts),
+		compression:           newCompressionCounters(factory, opts),
+		opts:                  opts,
+		registerer:            reg,
+		factory:               factory,
+		legacyEndpointMetrics: true,
+		legacy:                map[string]prometheus.Collector{},
+	}
+	reg.MustRegister(m.inFlight, m.exemplars, m.routeOrder)
+	m.groups = m.newMetricGroupFlags()
+	m.requestPaths = newPathLRU(m.RequestCounter, 0)
+	m.SetSkipList(nil)
+	return m
+}
+
+// newRegistry creates the registry served on /metrics and the one holding
+// the Go and process collectors, which is the same registry unless
+// cfg.SeparateRuntimeMetrics moves them to their own, served on
+// /metrics/runtime. It also returns the registerer the application metrics
+// must use. That registerer attaches cfg.ConstLabels to everything
+// registered through it; the runtime collectors only get them when
+// cfg.ConstLabelsOnRuntime is set.
+func newRegistry(cfg ServerConfig) (registry, runtimeRegistry *prometheus.Registry, appRegisterer prometheus.Registerer) {
+	registry = prometheus.NewRegistry()
+	appRegisterer = prometheus.WrapRegistererWith(cfg.ConstLabels, registry)
+	// The memory stats are named like the application metrics and kept with
+	// them, unlike the Go collector.
+	appRegisterer.MustRegister(NewMemStatsCollector(cfg.MetricNamespace, nil))
+
+	runtimeRegistry = registry
+	if cfg.SeparateRuntimeMetrics {
+		runtimeRegistry = prometheus.NewRegistry()
+	}
+	runtimeRegisterer := prometheus.Registerer(runtimeRegistry)
+	if cfg.ConstLabelsOnRuntime {
+		runtimeRegisterer = prometheus.WrapRegistererWith(cfg.ConstLabels, runtimeRegistry)
+	}
+	runtimeRegisterer.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return registry, runtimeRegistry, appRegisterer
+}
+
+// registerConfiguredDelay exposes the current value of delay as a gauge, so
+// dashboards can annotate the artificial latency.
+func (m *Metrics) registerConfiguredDelay(name string, delay *simulatedDelay) {
+	m.factory.NewGaugeFunc(m.opts.Gauge(name, "Artificial delay currently configured for the handler."), func() float64 {
+		return delay.Get().Seconds()
+	})
+}
+
+// registerRouteCount exposes the number of routes registered on router, so
+// deployments serving a different set of routes stand out.
+func (m *Metrics) registerRouteCount(router *mux.Router) {
+	routes := 0
+	router.Walk(func(*mux.Route, *mux.Router, []*mux.Route) error {
+		routes++
+		return nil
+	})
+	m.factory.NewGauge(m.opts.Gauge("registered_routes", "Number of routes registered on the router.")).Set(float64(routes))
+}
+
+// liveObserver returns an Observer looking up the series of vec for labels on
+// every observation, so that it keeps recording after ResetCounters.
+func liveObserver(vec prometheus.ObserverVec, labels prometheus.Labels) prometheus.Observer {
+	return prometheus.ObserverFunc(func(value float64) {
+		vec.With(labels).Observe(value)
+	})
+}
+
+// liveCounter is the counter equivalent of liveObserver.
+type liveCounter struct {
+	vec    *prometheus.CounterVec
+	labels prometheus.Labels
+}
+
+func (c liveCounter) Inc() {
+	c.vec.With(c.labels).Inc()
+}
+
+// SleepWithMetric pauses for d or until ctx is done, whichever comes first,
+// and observes the time actually spent sleeping. It returns ctx.Err() when
+// the sleep was cut short.
+func SleepWithMetric(ctx context.Context, d time.Duration, histogram prometheus.Observer) error {
+	startTime := time.Now()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	histogram.Observe(time.Since(startTime).Seconds())
+	return err
+}
+
+// inFlightCollector counts the requests being served and exposes the highest
+// count reached since the previous collection. Short concurrency spikes
+// between two scrapes would be invisible to a plain gauge.
+type inFlightCollector struct {
+	desc    *prometheus.Desc
+	current int64
+	max     int64
+}
+
+func newInFlightCollector(opts MetricOpts) *inFlightCollector {
+	return &inFlightCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "in_flight_requests_max"),
+			"Maximum number of simultaneous in-flight requests since the previous scrape. "+
+				"The value is reset to the current number of in-flight requests on every collection.",
+			nil, nil),
+	}
+}
+
+func (c *inFlightCollector) Inc() {
+	current := atomic.AddInt64(&c.current, 1)
+	for {
+		max := atomic.LoadInt64(&c.max)
+		if current <= max || atomic.CompareAndSwapInt64(&c.max, max, current) {
+			return
+		}
+	}
+}
+
+func (c *inFlightCollector) Dec() {
+	atomic.AddInt64(&c.current, -1)
+}
+
+func (c *inFlightCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *inFlightCollector) Collect(ch chan<- prometheus.Metric) {
+	peak := atomic.SwapInt64(&c.max, atomic.LoadInt64(&c.current))
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(peak))
+}
+
+// skipList is a precomputed set of path templates the monitoring middleware
+// does not record. Patterns ending in "/*" are kept as prefixes.
+type skipList struct {
+	templates map[string]struct{}
+	prefixes  []string
+}
+
+func newSkipList(patterns []string) *skipList {
+	list := &skipList{templates: make(map[string]struct{}, len(patterns))}
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/*") {
+			list.prefixes = append(list.prefixes, strings.TrimSuffix(pattern, "*"))
+		} else {
+			list.templates[pattern] = struct{}{}
+		}
+	}
+	return list
+}
+
+func (l *skipList) Contains(template string) bool {
+	if _, ok := l.templates[template]; ok {
+		return true
+	}
+	for _, prefix := range l.prefixes {
+		if strings.HasPrefix(template, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSkipList replaces the path templates the monitoring middleware skips.
+// It is safe to call while requests are being served.
+func (m *Metrics) SetSkipList(patterns []string) {
+	m.skipList.Store(newSkipList(patterns))
+}
+
+// routeLabel returns the path label of a request: the path template of the
+// matched route or, for routes registered without one (e.g. only by host or
+// a custom matcher), the route name or else the cleaned request path, its
+// invalid UTF-8 replaced as label values must be valid UTF-8.
+func routeLabel(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+		if name := route.GetName(); name != "" {
+			return name
+		}
+	}
+	return strings.ToValidUTF8(path.Clean("/"+r.URL.Path), "\uFFFD")
+}
+
+func (m *Metrics) monitoringMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := routeLabel(r)
+		if m.skipList.Load().(*skipList).Contains(path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+
+		m.RequestHeaderBytes.WithLabelValues(path).Observe(float64(headerSize(r.Header)))
+		rec := recorder.NewRecorder(w)
+		startTime := time.Now()
+		var segments *timingSegments
+		if m.serverTiming {
+			r, segments = withTimingSegments(r)
+		}
+		observeHeader := func(header http.Header) {
+			m.ResponseHeaderBytes.WithLabelValues(path).Observe(float64(headerSize(header)))
+			m.ResponseHeaderCount.WithLabelValues(path).Observe(float64(len(header)))
+		}
+		rec.BeforeWriteHeader = func(header http.Header) {
+			if segments != nil {
+				header.Set("Server-Timing", segments.header(time.Since(startTime)))
+			}
+			observeHeader(header)
+		}
+		defer func() {
+			p := recover()
+			m.ResponseBytes.WithLabelValues(path).Observe(float64(rec.BytesWritten()))
+			if m.groups.Enabled(metricGroupLatency) {
+				m.observeDuration(path, r, time.Since(startTime).Seconds())
+			}
+			if m.groups.Enabled(metricGroupRequests) {
+				m.countRequest(path, r)
+			}
+			if m.groups.Enabled(metricGroupStatus) {
+				m.StatusCounter.WithLabelValues(path, m.statusClass(path, rec, r, p)).Inc()
+			}
+			if p != nil {
+				if p != http.ErrAbortHandler {
+					m.Panics.Inc()
+				}
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(rec.Writer(), r)
+		if m.serverTiming && !rec.WroteHeader() {
+			// Send the header ourselves, or net/http would send it without
+			// Server-Timing once the handler has returned.
+			rec.WriteHeader(http.StatusOK)
+		} else if !rec.WroteHeader() {
+			// net/http sends the header as it is once the handler has
+			// returned.
+			observeHeader(rec.Header())
+		}
+	})
+}
+
+// statusClass returns the status class a finished request is counted under,
+// given the value p its handler panicked with, if any. Requests whose client
+// went away are counted as "aborted" and as a client disconnect rather than
+// with the status the handler may still have written.
+func (m *Metrics) statusClass(path string, rec *recorder.Recorder, r *http.Request, p interface{}) string {
+	switch {
+	case p == http.ErrAbortHandler || errors.Is(r.Context().Err(), context.Canceled):
+		m.ClientDisconnects.WithLabelValues(path).Inc()
+		return "aborted"
+	case p != nil:
+		return "5xx"
+	default:
+		return fmt.Sprintf("%dxx", rec.Status()/100)
+	}
+}
+
+// closureSuffix matches the suffix the compiler gives function literals.
+var closureSuffix = regexp.MustCompile(`(\.func\d+)+(\.\d+)*$`)
+
+// handlerFuncName returns the name of fn without its package, and without
+// the closure suffix for handlers built by constructors such as
+// generateBirthdayMessage.
+func handlerFuncName(fn interface{}) string {
+	name := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+	name = name[strings.LastIndex(name, "/")+1:]
+	name = name[strings.Index(name, ".")+1:]
+	return closureSuffix.ReplaceAllString(name, "")
+}
+
+// legacyFamily returns the legacy family called name, creating it with
+// create on first use. Routes sharing a name share the family, so reusing a
+// name no longer fails to register.
+func (m *Metrics) legacyFamily(name string, create func() prometheus.Collector) prometheus.Collector {
+	m.legacyMu.Lock()
+	defer m.legacyMu.Unlock()
+	family, ok := m.legacy[name]
+	if !ok {
+		family = create()
+		m.legacy[name] = family
+	}
+	return family
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"strings"
+)
+
+// familyFilter is a Gatherer returning only the families of gatherer
+// selected by names. A name ending in "*" selects every family starting with
+// the rest of it.
+type familyFilter struct {
+	gatherer prometheus.Gatherer
+	names    []string
+}
+
+func (f familyFilter) Gather() ([]*dto.MetricFamily, error) {
+	families, err := f.gatherer.Gather()
+	selected := families[:0]
+	for _, family := range families {
+		if f.selects(family.GetName()) {
+			selected = append(selected, family)
+		}
+	}
+	return selected, err
+}
+
+func (f familyFilter) selects(name string) bool {
+	for _, pattern := range f.names {
+		if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// metricsHandlerOpts enables OpenMetrics, which scrapers negotiate with
+// their Accept header. Native histograms are sent to scrapers negotiating
+// the protobuf format.
+var metricsHandlerOpts = promhttp.HandlerOpts{EnableOpenMetrics: true}
+
+// metricsHandler serves the metrics of registry. Like federation, it accepts
+// name[] query parameters restricting the response to the given families.
+func metricsHandler(registry *prometheus.Registry) http.Handler {
+	all := promhttp.HandlerFor(registry, metricsHandlerOpts)
+	return promhttp.InstrumentMetricHandler(registry, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		names := r.URL.Query()["name[]"]
+		if len(names) == 0 {
+			all.ServeHTTP(rw, r)
+			return
+		}
+		promhttp.HandlerFor(familyFilter{gatherer: registry, names: names}, metricsHandlerOpts).ServeHTTP(rw, r)
+	}))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsNameFilter(t *testing.T) {
+	router := NewRouter(defaultConfig(), newConfigReloader())
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/echo/hi", nil))
+
+	for _, tc := range []struct {
+		query    string
+		expected []string
+	}{
+		{query: "?name[]=go_app_api_request_counter", expected: []string{"go_app_api_request_counter"}},
+		{query: "?name[]=go_app_api_request_counter&name[]=go_goroutines",
+			expected: []string{"go_app_api_request_counter", "go_goroutines"}},
+		{query: "?name[]=go_app_api_responses*", expected: []string{"go_app_api_responses_total"}},
+		{query: "?name[]=unknown_metric", expected: nil},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics"+tc.query, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", tc.query, recorder.Code)
+		}
+		var parser expfmt.TextParser
+		families, err := parser.TextToMetricFamilies(recorder.Body)
+		if err != nil {
+			t.Fatalf("%s: parsing the response: %v", tc.query, err)
+		}
+		if len(families) != len(tc.expected) {
+			t.Errorf("%s: expected %d families, got %d", tc.query, len(tc.expected), len(families))
+		}
+		for _, name := range tc.expected {
+			if _, ok := families[name]; !ok {
+				t.Errorf("%s: expected %s in the response", tc.query, name)
+			}
+		}
+	}
+
+	if families := scrape(t, router); len(families) < 10 {
+		t.Errorf("expected every family without a filter, got %d", len(families))
+	}
+}
+
+func TestNativeHistograms(t *testing.T) {
+	for _, native := range []bool{false, true} {
+		cfg := defaultConfig()
+		cfg.UseNativeHistograms = native
+		router := NewRouter(cfg, newConfigReloader())
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/echo/hi", nil))
+
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		request.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/openmetrics-text") {
+			t.Errorf("native %v: expected an OpenMetrics response, got %q", native, contentType)
+		}
+		body := recorder.Body.String()
+		if !strings.Contains(body, "# TYPE go_app_api_endpoint_request_duration_seconds histogram") {
+			t.Errorf("native %v: expected the latency histogram in the OpenMetrics exposition", native)
+		}
+		infBucket := false
+		for _, line := range strings.Split(body, "\n") {
+			if strings.HasPrefix(line, "go_app_api_endpoint_request_duration_seconds_bucket{") &&
+				strings.Contains(line, `le="+Inf"`) && strings.HasSuffix(line, " 1") {
+				infBucket = true
+			}
+		}
+		if !infBucket {
+			t.Errorf("native %v: expected the echo request in the +Inf bucket", native)
+		}
+
+		// Native buckets only travel in the protobuf format, so check them on
+		// the collected metric.
+		registry := prometheus.NewRegistry()
+		metrics := NewMetrics(registry, newMetricOpts(cfg))
+		metrics.createRequestLatencyMetric("request_latency", echoEndpoint, generateEchoMessage)(
+			httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/echo/hi", nil))
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, family := range families {
+			if family.GetName() != "go_app_api_endpoint_request_duration_seconds" &&
+				family.GetName() != "go_app_api_request_latency" {
+				continue
+			}
+			histogram := family.GetMetric()[0].GetHistogram()
+			if hasNative := histogram.Schema != nil; hasNative != native {
+				t.Errorf("native %v: expected %s to have native buckets %v", native, family.GetName(), native)
+			}
+			if len(histogram.GetBucket()) == 0 {
+				t.Errorf("native %v: expected %s to keep its classic buckets", native, family.GetName())
+			}
+		}
+	}
+}
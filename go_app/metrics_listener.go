@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+)
+
+// metricsTLSConfig returns the TLS configuration of the metrics listener, or
+// nil when it serves plain HTTP. With a client CA, clients must present a
+// certificate it signed, whose common name or one of whose DNS names is in
+// the allowlist, if any.
+func metricsTLSConfig(cfg ServerConfig) (*tls.Config, error) {
+	if cfg.MetricsTLSCertFile == "" {
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(cfg.MetricsTLSCertFile, cfg.MetricsTLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading the metrics TLS certificate: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	if cfg.MetricsClientCAFile == "" {
+		return config, nil
+	}
+	bundle, err := os.ReadFile(cfg.MetricsClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading the metrics client CA bundle: %v", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificate found in the metrics client CA bundle %s", cfg.MetricsClientCAFile)
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if len(cfg.MetricsAllowedClients) > 0 {
+		config.VerifyPeerCertificate = allowedClients(cfg.MetricsAllowedClients)
+	}
+	return config, nil
+}
+
+// allowedClients returns a VerifyPeerCertificate hook accepting the client
+// certificates, already verified against the client CAs, whose common name
+// or one of whose DNS names is in names.
+func allowedClients(names []string) func([][]byte, [][]*x509.Certificate) error {
+	allowed := map[string]bool{}
+	for _, name := range names {
+		allowed[name] = true
+	}
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			leaf := chain[0]
+			if allowed[leaf.Subject.CommonName] {
+				return nil
+			}
+			for _, name := range leaf.DNSNames {
+				if allowed[name] {
+					return nil
+				}
+			}
+		}
+		return errors.New("client certificate not in the metrics allowlist")
+	}
+}
+
+// newMetricsServer serves handler with tlsConfig, counting the failed TLS
+// handshakes net/http reports to its error log in
+// MetricsTLSHandshakeFailures.
+func (m *Metrics) newMetricsServer(handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+		ErrorLog:  log.New(&handshakeErrorCounter{metrics: m}, "", 0),
+	}
+}
+
+// handshakeErrorCounter forwards the error log of a server to the standard
+// logger, counting the failed TLS handshakes on the way.
+type handshakeErrorCounter struct {
+	metrics *Metrics
+}
+
+func (c *handshakeErrorCounter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("TLS handshake error")) {
+		c.metrics.MetricsTLSHandshakeFailures.Inc()
+	}
+	log.Print(string(p))
+	return len(p), nil
+}
+
+// serveMetrics serves the metrics endpoints on cfg.MetricsAddress until
+// the application shuts down.
+func (m *Metrics) serveMetrics(cfg ServerConfig, handler http.Handler, shutdown *shutdownHooks) error {
+	tlsConfig, err := metricsTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", cfg.MetricsAddress)
+	if err != nil {
+		return err
+	}
+	server := m.newMetricsServer(handler, tlsConfig)
+	shutdown.onShutdown(server.Shutdown)
+	log.Printf("Serving metrics on %s...", listener.Addr())
+	go func() {
+		serve := server.Serve
+		if tlsConfig != nil {
+			serve = func(listener net.Listener) error { return server.ServeTLS(listener, "", "") }
+		}
+		if err := serve(listener); err != http.ErrServerClosed {
+			log.Printf("Metrics server failed: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA signs the certificates of the metrics listener tests.
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pem         []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{certificate, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for commonName signed by the CA, and its key,
+// both PEM encoded.
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage, ips ...net.IP) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeTestFile(t *testing.T, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMetricsListenerClientCertificates(t *testing.T) {
+	ca, otherCA := newTestCA(t), newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "go_app", x509.ExtKeyUsageServerAuth, net.ParseIP("127.0.0.1"))
+	cfg := defaultConfig()
+	cfg.MetricsTLSCertFile = writeTestFile(t, "server.crt", serverCert)
+	cfg.MetricsTLSKeyFile = writeTestFile(t, "server.key", serverKey)
+	cfg.MetricsClientCAFile = writeTestFile(t, "ca.crt", ca.pem)
+	cfg.MetricsAllowedClients = []string{"prometheus"}
+
+	tlsConfig, err := metricsTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry, newMetricOpts(cfg))
+	server := metrics.newMetricsServer(metricsHandler(registry), tlsConfig)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(listener, "", "")
+	t.Cleanup(func() { server.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	scrapeWith := func(certPEM, keyPEM []byte) error {
+		clientConfig := &tls.Config{RootCAs: roots}
+		if certPEM != nil {
+			certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConfig.Certificates = []tls.Certificate{certificate}
+		}
+		client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		defer client.CloseIdleConnections()
+		response, err := client.Get("https://" + listener.Addr().String() + "/metrics")
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("expected the scrape to succeed, got status %d", response.StatusCode)
+		}
+		return nil
+	}
+
+	if err := scrapeWith(ca.issue(t, "prometheus", x509.ExtKeyUsageClientAuth)); err != nil {
+		t.Fatalf("expected the allowed client to scrape, got %v", err)
+	}
+	rejected := map[string]func() ([]byte, []byte){
+		"no certificate":   func() ([]byte, []byte) { return nil, nil },
+		"unknown CA":       func() ([]byte, []byte) { return otherCA.issue(t, "prometheus", x509.ExtKeyUsageClientAuth) },
+		"not in allowlist": func() ([]byte, []byte) { return ca.issue(t, "intruder", x509.ExtKeyUsageClientAuth) },
+	}
+	for name, certificate := range rejected {
+		if err := scrapeWith(certificate()); err == nil {
+			t.Errorf("%s: expected the TLS handshake to fail", name)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(metrics.MetricsTLSHandshakeFailures) != float64(len(rejected)) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(metrics.MetricsTLSHandshakeFailures); got != float64(len(rejected)) {
+		t.Errorf("expected %d failed handshakes counted, got %v", len(rejected), got)
+	}
+}
+
+func TestMetricsAddressMovesMetricsEndpoint(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MetricsAddress = "127.0.0.1:0"
+	router, metrics := newRouter(cfg, newConfigReloader(), newShutdownHooks())
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected /metrics to leave the application listener, got status %d", recorder.Code)
+	}
+	scrape(t, metrics.telemetry)
+}
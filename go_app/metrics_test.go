@@ -0,0 +1,577 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConstLabelsOnAppMetrics(t *testing.T) {
+	for _, onRuntime := range []bool{false, true} {
+		cfg := defaultConfig()
+		cfg.ConstLabels = prometheus.Labels{"env": "test", "region": "eu", "team": "obs"}
+		cfg.ConstLabelsOnRuntime = onRuntime
+		router := NewRouter(cfg, newConfigReloader())
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, welcomeEndpoint, nil))
+
+		families := scrape(t, router)
+		if _, ok := families["go_app_api_request_counter"]; !ok {
+			t.Fatal("expected go_app_api_request_counter to be exposed")
+		}
+		for name, family := range families {
+			isApp := strings.HasPrefix(name, "go_app_")
+			for _, metric := range family.GetMetric() {
+				labels := map[string]string{}
+				for _, pair := range metric.GetLabel() {
+					labels[pair.GetName()] = pair.GetValue()
+				}
+				hasConstLabels := labels["env"] == "test" && labels["region"] == "eu" && labels["team"] == "obs"
+				switch {
+				case isApp && !hasConstLabels:
+					t.Errorf("app family %s is missing const labels: %v", name, labels)
+				case !isApp && onRuntime && !hasConstLabels && !strings.HasPrefix(name, "promhttp_"):
+					t.Errorf("runtime family %s is missing const labels: %v", name, labels)
+				case !isApp && !onRuntime && hasConstLabels:
+					t.Errorf("runtime family %s should not carry const labels: %v", name, labels)
+				}
+			}
+		}
+	}
+}
+
+func TestConfiguredDelayGauges(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.BirthdayHandlerDelay = 3 * time.Second
+	cfg.GreetingHandlerDelay = 250 * time.Millisecond
+	reloader := newConfigReloader()
+	router := NewRouter(cfg, reloader)
+
+	assertGauge := func(name string, expected time.Duration) {
+		t.Helper()
+		family, ok := scrape(t, router)[name]
+		if !ok {
+			t.Fatalf("expected %s to be exposed", name)
+		}
+		if got := family.GetMetric()[0].GetGauge().GetValue(); got != expected.Seconds() {
+			t.Errorf("expected %s to be %v, got %v", name, expected.Seconds(), got)
+		}
+	}
+	assertGauge("go_app_api_configured_birthday_delay_seconds", 3*time.Second)
+	assertGauge("go_app_api_configured_greeting_delay_seconds", 250*time.Millisecond)
+
+	reloader.Reload(func() (ServerConfig, error) {
+		return ServerConfig{BirthdayHandlerDelay: time.Second, GreetingHandlerDelay: 2 * time.Second}, nil
+	})
+	assertGauge("go_app_api_configured_birthday_delay_seconds", time.Second)
+	assertGauge("go_app_api_configured_greeting_delay_seconds", 2*time.Second)
+}
+
+func TestChaosDelayGauge(t *testing.T) {
+	reloader := newConfigReloader()
+	cfg := defaultConfig()
+	cfg.BirthdayHandlerDelay = time.Millisecond
+	cfg.GreetingHandlerDelay = 2 * time.Millisecond
+	router := NewRouter(cfg, reloader)
+
+	assertDelays := func(expected map[string]time.Duration) {
+		t.Helper()
+		family, ok := scrape(t, router)["go_app_chaos_delay_seconds"]
+		if !ok {
+			t.Fatal("expected go_app_chaos_delay_seconds to be exposed")
+		}
+		for _, metric := range family.GetMetric() {
+			handler := metric.GetLabel()[0].GetValue()
+			if got := metric.GetGauge().GetValue(); got != expected[handler].Seconds() {
+				t.Errorf("expected %s delay %v, got %vs", handler, expected[handler], got)
+			}
+		}
+	}
+	assertDelays(map[string]time.Duration{"birthday": time.Millisecond, "greeting": 2 * time.Millisecond})
+
+	reloader.Reload(func() (ServerConfig, error) {
+		return ServerConfig{BirthdayHandlerDelay: time.Minute, GreetingHandlerDelay: time.Second}, nil
+	})
+	assertDelays(map[string]time.Duration{"birthday": time.Minute, "greeting": time.Second})
+}
+
+func TestCustomMetricNamespace(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MetricNamespace = "demo_copy"
+	cfg.MetricSubsystem = "http"
+	router := NewRouter(cfg, newConfigReloader())
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, welcomeEndpoint, nil))
+
+	families := scrape(t, router)
+	for _, name := range []string{
+		"demo_copy_http_request_counter",
+		"demo_copy_http_configured_greeting_delay_seconds",
+		"demo_copy_chaos_delay_seconds",
+	} {
+		if _, ok := families[name]; !ok {
+			t.Errorf("expected %s to be exposed", name)
+		}
+	}
+	for name := range families {
+		if strings.HasPrefix(name, "go_app_") {
+			t.Errorf("family %s still uses the default namespace", name)
+		}
+	}
+}
+
+func TestMonitoringMiddlewareSkipList(t *testing.T) {
+	reloader := newConfigReloader()
+	router := NewRouter(defaultConfig(), reloader)
+
+	for i := 0; i < 3; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, welcomeEndpoint, nil))
+		scrape(t, router)
+	}
+	family := scrape(t, router)["go_app_api_request_counter"]
+	if metric := findMetric(family, "path", "/metrics"); metric != nil {
+		t.Errorf("/metrics should be skipped, counted %v times", metric.GetCounter().GetValue())
+	}
+	if metric := findMetric(family, "path", welcomeEndpoint); metric == nil || metric.GetCounter().GetValue() != 3 {
+		t.Errorf("expected %s to be counted 3 times, got %v", welcomeEndpoint, metric)
+	}
+
+	reloader.Reload(func() (ServerConfig, error) {
+		cfg := defaultConfig()
+		cfg.InstrumentationSkipList = nil
+		return cfg, nil
+	})
+	scrape(t, router)
+	if findMetric(scrape(t, router)["go_app_api_request_counter"], "path", "/metrics") == nil {
+		t.Error("expected /metrics to be counted once removed from the skip list")
+	}
+}
+
+func TestSkipListPrefixes(t *testing.T) {
+	list := newSkipList([]string{"/metrics", "/debug/*"})
+	for template, expected := range map[string]bool{
+		"/metrics":             true,
+		"/debug/pprof/":        true,
+		"/debug/vars":          true,
+		"/debugger":            false,
+		"/greeting/{name}":     false,
+		"/metrics/{collector}": false,
+	} {
+		if got := list.Contains(template); got != expected {
+			t.Errorf("Contains(%q) = %v, expected %v", template, got, expected)
+		}
+	}
+}
+
+func TestInFlightRequestsMax(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry, newMetricOpts(defaultConfig()))
+	release := make(chan struct{})
+	router := mux.NewRouter()
+	router.HandleFunc("/block", func(http.ResponseWriter, *http.Request) { <-release })
+	router.Use(metrics.monitoringMiddleware)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/block", nil))
+		}()
+	}
+	for atomic.LoadInt64(&metrics.inFlight.current) != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	release <- struct{}{}
+	release <- struct{}{}
+	for atomic.LoadInt64(&metrics.inFlight.current) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if got := gatheredValue(t, registry, "go_app_api_in_flight_requests_max"); got != 3 {
+		t.Errorf("first scrape should report the peak of 3, got %v", got)
+	}
+	if got := gatheredValue(t, registry, "go_app_api_in_flight_requests_max"); got != 1 {
+		t.Errorf("second scrape should report the steady state of 1, got %v", got)
+	}
+	close(release)
+	wg.Wait()
+}
+
+func TestRequestsInProgressByMethod(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry, newMetricOpts(defaultConfig()))
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := metrics.createRequestsInProgressMetric("requests_in_progress", "/block", []string{"GET", "POST"},
+		func(http.ResponseWriter, *http.Request) {
+			started <- struct{}{}
+			<-release
+		})
+
+	var wg sync.WaitGroup
+	for _, method := range []string{http.MethodGet, http.MethodGet, http.MethodPost} {
+		wg.Add(1)
+		go func(method string) {
+			defer wg.Done()
+			handler(httptest.NewRecorder(), httptest.NewRequest(method, "/block", nil))
+		}(method)
+		<-started
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var family *dto.MetricFamily
+	for _, f := range families {
+		if f.GetName() == "go_app_api_requests_in_progress" {
+			family = f
+		}
+	}
+	for method, expected := range map[string]float64{"GET": 2, "POST": 1} {
+		metric := findMetric(family, "method", method)
+		if metric == nil || metric.GetGauge().GetValue() != expected {
+			t.Errorf("expected %v %s requests in progress, got %v", expected, method, metric)
+		}
+		if findMetric(family, "path", "/block") == nil {
+			t.Error("expected the path const label to be kept")
+		}
+	}
+	close(release)
+	wg.Wait()
+}
+
+func TestMetricNamingConventions(t *testing.T) {
+	for naming, expected := range map[string][]string{
+		"legacy": {
+			"go_app_api_request_counter",
+			"go_app_api_request_count",
+			"go_app_api_request_latency",
+			"go_app_api_handler_sleep_seconds",
+		},
+		"standard": {
+			"go_app_api_requests_total",
+			"go_app_api_request_count_total",
+			"go_app_api_request_latency_seconds",
+			"go_app_api_handler_sleep_seconds",
+		},
+	} {
+		cfg := defaultConfig()
+		cfg.MetricNaming = naming
+		cfg.GreetingHandlerDelay = time.Millisecond
+		cfg.PerHandlerCounters = true
+		router := NewRouter(cfg, newConfigReloader())
+		for _, path := range []string{"/echo/hello", "/greeting/Bob"} {
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		}
+
+		families := scrape(t, router)
+		for _, name := range expected {
+			if _, ok := families[name]; !ok {
+				t.Errorf("%s naming: expected %s to be exposed", naming, name)
+			}
+		}
+	}
+}
+
+func TestRouteLabelWithoutPathTemplate(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry, newMetricOpts(defaultConfig()))
+	router := mux.NewRouter()
+	ok := func(http.ResponseWriter, *http.Request) {}
+	router.Host("named.example.com").HandlerFunc(ok).Name("named-host")
+	router.Host("anonymous.example.com").HandlerFunc(ok)
+	router.Use(metrics.monitoringMiddleware)
+
+	for host, expected := range map[string]string{
+		"named.example.com":     "named-host",
+		"anonymous.example.com": "/some/path",
+	} {
+		request := httptest.NewRequest(http.MethodGet, "http://"+host+"/some/path/", nil)
+		router.ServeHTTP(httptest.NewRecorder(), request)
+		if got := testutil.ToFloat64(metrics.RequestCounter.WithLabelValues(expected, sourceUnknown, tenantUnknown)); got != 1 {
+			t.Errorf("expected request to %s to be counted under %q", host, expected)
+		}
+	}
+}
+
+func TestRouteLabelInvalidUTF8(t *testing.T) {
+	router := mux.NewRouter()
+	var label string
+	router.Host("anonymous.example.com").HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		label = routeLabel(r)
+	})
+	request := httptest.NewRequest(http.MethodGet, "http://anonymous.example.com/", nil)
+	request.URL.Path = "/a\xffb"
+	router.ServeHTTP(httptest.NewRecorder(), request)
+	if expected := "/a\uFFFDb"; label != expected {
+		t.Errorf("expected path label %q, got %q", expected, label)
+	}
+}
+
+func TestHandlerFuncLabel(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry, newMetricOpts(defaultConfig()))
+	welcome := metrics.createRequestLatencyMetric("request_latency", "/shared", generateWelcomeMessage)
+	echo := metrics.createRequestLatencyMetric("request_latency", "/shared", generateEchoMessage)
+	birthday := metrics.createRequestLatencyMetric("request_latency", "/other", generateBirthdayMessage(testHandlerConfig()))
+	explicit := metrics.createRequestLatencyMetric("request_latency", "/other", welcome, FuncName("wrappedWelcome"))
+	for _, handler := range []http.HandlerFunc{welcome, echo, birthday, explicit} {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/shared", nil))
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var family *dto.MetricFamily
+	for _, f := range families {
+		if f.GetName() == "go_app_api_request_latency" {
+			family = f
+		}
+	}
+	for _, funcName := range []string{"generateWelcomeMessage", "generateEchoMessage", "generateBirthdayMessage", "wrappedWelcome"} {
+		if findMetric(family, "handler_func", funcName) == nil {
+			t.Errorf("expected a series with handler_func=%q", funcName)
+		}
+	}
+}
+
+func TestEndpointMetricsShareFamilies(t *testing.T) {
+	for _, legacy := range []bool{true, false} {
+		registry := prometheus.NewRegistry()
+		metrics := NewMetrics(registry, newMetricOpts(defaultConfig()))
+		metrics.legacyEndpointMetrics = legacy
+		metrics.perHandlerCounters = true
+		var handlers []http.HandlerFunc
+		// The same name and route twice used to fail to register.
+		for _, endpoint := range []string{"/a", "/b", "/a"} {
+			handlers = append(handlers,
+				metrics.createRequestCounterMetric("request_count", endpoint,
+					metrics.createRequestsInProgressMetric("requests_in_progress", endpoint, []string{"GET"},
+						metrics.createRequestLatencyMetric("request_latency", endpoint, generateEchoMessage),
+						FuncName("generateEchoMessage")),
+					FuncName("generateEchoMessage")))
+		}
+		for _, handler := range handlers {
+			handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/echo/hi", nil))
+		}
+
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		byName := map[string]*dto.MetricFamily{}
+		for _, family := range families {
+			byName[family.GetName()] = family
+		}
+		names := []string{
+			"go_app_api_endpoint_requests_total",
+			"go_app_api_endpoint_requests_in_progress",
+			"go_app_api_endpoint_request_duration_seconds",
+		}
+		legacyNames := []string{
+			"go_app_api_request_count",
+			"go_app_api_requests_in_progress",
+			"go_app_api_request_latency",
+		}
+		if legacy {
+			names = append(names, legacyNames...)
+		} else {
+			for _, name := range legacyNames {
+				if _, ok := byName[name]; ok {
+					t.Errorf("expected %s to be gone with the legacy names disabled", name)
+				}
+			}
+		}
+		for _, name := range names {
+			family := byName[name]
+			if family == nil || len(family.GetMetric()) != 2 {
+				t.Errorf("expected %s to have one series per path, got %v", name, family)
+				continue
+			}
+			for _, endpoint := range []string{"/a", "/b"} {
+				if findMetric(family, "path", endpoint) == nil {
+					t.Errorf("expected %s to have a series for %s", name, endpoint)
+				}
+			}
+		}
+		if count := testutil.ToFloat64(metrics.EndpointRequests.WithLabelValues("/a", "generateEchoMessage")); count != 2 {
+			t.Errorf("expected the two /a routes to share a counter, got %v", count)
+		}
+	}
+}
+
+func TestSmartBuckets(t *testing.T) {
+	for _, expected := range []time.Duration{0, 10 * time.Millisecond, 5 * time.Second, 20 * time.Second} {
+		buckets := SmartBuckets(expected)
+		if len(buckets) != 20 {
+			t.Fatalf("expected 20 buckets for %s, got %d", expected, len(buckets))
+		}
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i] <= buckets[i-1] {
+				t.Fatalf("buckets for %s are not increasing at %d: %v", expected, i, buckets)
+			}
+		}
+		if buckets[0] != 0.001 {
+			t.Errorf("expected the first bucket for %s to be 1ms, got %v", expected, buckets[0])
+		}
+		if last := buckets[len(buckets)-1]; expected > 0 && last < 3*expected.Seconds()*0.99 {
+			t.Errorf("expected the last bucket for %s to cover 3x, got %v", expected, last)
+		}
+	}
+}
+
+func TestRequestsAreCountedOnce(t *testing.T) {
+	for _, perHandler := range []bool{false, true} {
+		cfg := defaultConfig()
+		cfg.PerHandlerCounters = perHandler
+		router := NewRouter(cfg, newConfigReloader())
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/echo/hi", nil))
+
+		total := 0.0
+		families := scrape(t, router)
+		for _, name := range []string{
+			"go_app_api_request_counter",
+			"go_app_api_endpoint_requests_total",
+			"go_app_api_request_count",
+		} {
+			if metric := findMetric(families[name], "path", echoEndpoint); metric != nil {
+				total += metric.GetCounter().GetValue()
+			}
+		}
+		expected := 1.0
+		if perHandler {
+			// The escape hatch restores both per-handler series.
+			expected = 3
+		}
+		if total != expected {
+			t.Errorf("per-handler counters %v: expected the echo request counted %v times, got %v",
+				perHandler, expected, total)
+		}
+	}
+}
+
+func TestNativeHistogramOpts(t *testing.T) {
+	for _, native := range []bool{false, true} {
+		opts := MetricOpts{Namespace: "test", Naming: legacyNaming{}, NativeHistograms: native}
+		histogramOpts := opts.NativeHistogramOpts(opts.Duration("latency", "Latency.", requestDurationBuckets))
+		expectedFactor := 0.0
+		if native {
+			expectedFactor = nativeHistogramBucketFactor
+		}
+		if histogramOpts.NativeHistogramBucketFactor != expectedFactor {
+			t.Errorf("native %v: expected bucket factor %v, got %v",
+				native, expectedFactor, histogramOpts.NativeHistogramBucketFactor)
+		}
+		if !reflect.DeepEqual(histogramOpts.Buckets, requestDurationBuckets) {
+			t.Errorf("native %v: expected the classic buckets to be kept, got %v", native, histogramOpts.Buckets)
+		}
+
+		// The request latency histogram of the middleware follows the setting.
+		metrics := NewMetrics(prometheus.NewRegistry(), opts)
+		metrics.RequestDuration.WithLabelValues("/", tenantUnknown).Observe(0.1)
+		var metric dto.Metric
+		if err := metrics.RequestDuration.WithLabelValues("/", tenantUnknown).(prometheus.Metric).Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		if hasNative := metric.GetHistogram().Schema != nil; hasNative != native {
+			t.Errorf("native %v: expected the request duration to have native buckets %v", native, native)
+		}
+	}
+}
+
+func TestEndpointMetricsHelp(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.PerHandlerCounters = true
+	router := NewRouter(cfg, newConfigReloader())
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/echo/hi", nil))
+	families := scrape(t, router)
+
+	expected := map[string]string{
+		"go_app_api_endpoint_requests_total":           "Total HTTP requests handled by each instrumented endpoint.",
+		"go_app_api_endpoint_requests_in_progress":     "Number of HTTP requests currently in progress, by instrumented endpoint and method.",
+		"go_app_api_endpoint_request_duration_seconds": "Latency of the HTTP requests handled by each instrumented endpoint.",
+		"go_app_api_request_count":                     "Total HTTP requests handled by the endpoint.",
+		"go_app_api_requests_in_progress":              "Number of HTTP requests currently in progress.",
+		"go_app_api_request_latency":                   "Latency of the HTTP requests handled by the endpoint.",
+	}
+	seen := map[string]string{}
+	for name, help := range expected {
+		family := families[name]
+		if family == nil {
+			t.Errorf("expected %s to be exposed", name)
+			continue
+		}
+		if family.GetHelp() != help {
+			t.Errorf("%s: expected HELP %q, got %q", name, help, family.GetHelp())
+		}
+		if other, ok := seen[family.GetHelp()]; ok {
+			t.Errorf("%s and %s share the HELP %q", name, other, family.GetHelp())
+		}
+		seen[family.GetHelp()] = name
+	}
+}
+
+func TestHelpOption(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry, newMetricOpts(defaultConfig()))
+	metrics.legacyEndpointMetrics = true
+	metrics.createRequestsInProgressMetric("custom_in_progress", "/a", []string{"GET"}, generateEchoMessage,
+		Help("Number of /a requests currently in progress."))
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "go_app_api_custom_in_progress" {
+			if family.GetHelp() != "Number of /a requests currently in progress." {
+				t.Errorf("expected the Help option to set the HELP, got %q", family.GetHelp())
+			}
+			return
+		}
+	}
+	t.Error("expected go_app_api_custom_in_progress to be registered")
+}
+
+func TestSeparateRuntimeMetrics(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SeparateRuntimeMetrics = true
+	router := NewRouter(cfg, newConfigReloader())
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, welcomeEndpoint, nil))
+
+	app := scrape(t, router)
+	if _, ok := app["go_app_api_request_counter"]; !ok {
+		t.Error("expected the app metrics on /metrics")
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, runtimeMetricsEndpoint, nil))
+	var parser expfmt.TextParser
+	runtime, err := parser.TextToMetricFamilies(recorder.Body)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", runtimeMetricsEndpoint, err)
+	}
+	if _, ok := runtime["go_goroutines"]; !ok {
+		t.Errorf("expected the Go collector on %s", runtimeMetricsEndpoint)
+	}
+	for name := range app {
+		if strings.HasPrefix(name, "go_") && !strings.HasPrefix(name, "go_app_") || strings.HasPrefix(name, "process_") {
+			t.Errorf("expected the runtime family %s only on %s", name, runtimeMetricsEndpoint)
+		}
+	}
+	for name := range runtime {
+		if strings.HasPrefix(name, "go_app_") {
+			t.Errorf("expected the app family %s only on /metrics", name)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// hijack hijacks the connection of w, for the response writer wrappers that
+// have to pass hijacking through.
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", w)
+	}
+	return hijacker.Hijack()
+}
+
+// maxBodyMiddleware limits request bodies to limit bytes. A request whose
+// declared Content-Length is over the limit is rejected with 413 without
+// reading the body; bodies of unknown or understated length are cut off by
+// http.MaxBytesReader, which makes the handler's read fail.
+func maxBodyMiddleware(limit int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// panicJSONBody is the body of the 500 a recovered panic results in, for
+// clients that prefer JSON.
+const panicJSONBody = `{"error":"internal"}`
+
+// recoveryMiddleware turns a handler panic into a 500 response and logs it
+// with the stack. The client only gets message, or {"error":"internal"} if
+// it prefers JSON, so the panic value never leaks to it.
+// http.ErrAbortHandler is re-panicked, so the server aborts the response
+// without logging it, as it does for handlers that are not wrapped.
+func recoveryMiddleware(message string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				log.Printf("Recovered from panic serving %s %s: %v\n%s", r.Method, r.URL.Path, p, debug.Stack())
+				if prefersJSON(r) {
+					w.Header().Set("Content-Type", "application/json")
+					w.Header().Set("X-Content-Type-Options", "nosniff")
+					w.WriteHeader(http.StatusInternalServerError)
+					_, _ = w.Write([]byte(panicJSONBody + "\n"))
+					return
+				}
+				http.Error(w, message, http.StatusInternalServerError)
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// prefersJSON reports whether the Accept header of r ranks application/json
+// above text/plain. Wildcards rank both the same and are ignored.
+func prefersJSON(r *http.Request) bool {
+	quality := map[string]float64{}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		quality[mediaType] = q
+	}
+	return quality["application/json"] > quality["text/plain"]
+}
+
+// contentTypeWriter sets a default Content-Type right before the response
+// header is written, unless the handler has already chosen one.
+type contentTypeWriter struct {
+	http.ResponseWriter
+	contentType string
+	wroteHeader bool
+}
+
+func (w *contentTypeWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", w.contentType)
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *contentTypeWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *contentTypeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(w.ResponseWriter)
+}
+
+func contentTypeMiddleware(contentType string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&contentTypeWriter{ResponseWriter: w, contentType: contentType}, r)
+		})
+	}
+}
+
+// methodOverrideHeader lets clients that can only send GET and POST ask for
+// another method.
+const methodOverrideHeader = "X-HTTP-Method-Override"
+
+// overridableMethods are the methods a POST may be turned into. Overriding
+// into GET or HEAD is not allowed, so a POST is never served as a safe
+// method.
+var overridableMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// methodOverrideMiddleware serves a POST carrying X-HTTP-Method-Override as
+// a request with that method, if it is one of overridableMethods. It has to
+// wrap the router, because mux middlewares only run once a route matched.
+func methodOverrideMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if method := strings.ToUpper(r.Header.Get(methodOverrideHeader)); overridableMethods[method] {
+				r.Method = method
+				r.Header.Del(methodOverrideHeader)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
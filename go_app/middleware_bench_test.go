@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The monitoring middleware must stay well under 5µs per request. On a
+// shared Xeon VM the benchmarks below measured about:
+//
+//	BenchmarkMonitoringMiddleware/baseline      2.6µs/op   2168 B/op   18 allocs/op
+//	BenchmarkMonitoringMiddleware/monitoring    5.0µs/op   2504 B/op   28 allocs/op
+//	BenchmarkMonitoringMiddleware/combined     12.9µs/op   4105 B/op   62 allocs/op
+//
+// The monitoring middleware adds about 2.4µs and 10 allocations. The whole
+// chain the router installs adds about 10µs, most of it spent encoding the
+// access log line. There is no separate combined observability middleware;
+// "combined" is that chain, built by newMiddleware and canonicalChain for
+// the default configuration.
+func BenchmarkMonitoringMiddleware(b *testing.B) {
+	cfg := defaultConfig()
+	newRouter := func(chain func(*Metrics) MiddlewareChain) *mux.Router {
+		metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(cfg))
+		router := mux.NewRouter()
+		router.HandleFunc(echoEndpoint, generateEchoMessage).Methods("GET")
+		router.Use(chain(metrics)...)
+		return router
+	}
+
+	for _, bc := range []struct {
+		name   string
+		router *mux.Router
+	}{
+		{name: "baseline", router: newRouter(func(*Metrics) MiddlewareChain { return nil })},
+		{name: "monitoring", router: newRouter(func(m *Metrics) MiddlewareChain {
+			return MiddlewareChain{m.monitoringMiddleware}
+		})},
+		{name: "combined", router: newRouter(func(m *Metrics) MiddlewareChain {
+			logger := newLogger(io.Discard, cfg.LogTimeFormat)
+			return canonicalChain(newMiddleware(cfg, m, logger, newTenantAllowlist(cfg.Tenants), newShutdownHooks()))
+		})},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			request := httptest.NewRequest(http.MethodGet, "/echo/hello", nil)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bc.router.ServeHTTP(httptest.NewRecorder(), request)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"slices"
+)
+
+// MiddlewareChain is a sequence of middleware, outermost first.
+type MiddlewareChain []mux.MiddlewareFunc
+
+// Chain returns the chain of middleware, the first of which sees every
+// request first and its response last.
+func Chain(middleware ...mux.MiddlewareFunc) MiddlewareChain {
+	return append(MiddlewareChain(nil), middleware...)
+}
+
+// Append returns a copy of c with middleware added inside it.
+func (c MiddlewareChain) Append(middleware ...mux.MiddlewareFunc) MiddlewareChain {
+	return append(append(MiddlewareChain(nil), c...), middleware...)
+}
+
+// Then wraps handler with the middleware of c.
+func (c MiddlewareChain) Then(handler http.Handler) http.Handler {
+	for i := len(c) - 1; i >= 0; i-- {
+		handler = c[i](handler)
+	}
+	return handler
+}
+
+// middlewareOrder is the canonical order of the application middleware,
+// outermost first.
+var middlewareOrder = []string{
+	// Recovery catches the panics of everything inside it: the metrics and
+	// the access log record the panic before passing it on.
+	"recovery",
+	// The source and tenant label the metrics, so they come first.
+	"request_source",
+	"tenant",
+	// The metrics measure the access log too.
+	"monitoring",
+	"access_log",
+	"protocol",
+	// The deadline and the middleware inside it are measured.
+	"deadline",
+	"redirect_loop",
+	"gzip",
+	// Requests rejected for their header or body are still measured.
+	"required_header",
+	"json_validation",
+	"cache",
+	"watchdog",
+	"max_body",
+	// Inside max_body, which limits the encoded body, to limit the decoded
+	// one too.
+	"decompress",
+	"content_type",
+}
+
+// canonicalChain returns the middleware of named in middlewareOrder,
+// skipping the ones that are not set. It panics on a name the order does not
+// know, so new middleware cannot be added without deciding its place.
+func canonicalChain(named map[string]mux.MiddlewareFunc) MiddlewareChain {
+	for name := range named {
+		if !slices.Contains(middlewareOrder, name) {
+			panic(fmt.Sprintf("middleware %q has no place in middlewareOrder", name))
+		}
+	}
+	var chain MiddlewareChain
+	for _, name := range middlewareOrder {
+		if middleware, ok := named[name]; ok {
+			chain = append(chain, middleware)
+		}
+	}
+	return chain
+}
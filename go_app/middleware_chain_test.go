@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tracing returns a middleware appending name to trace on the way in.
+func tracing(name string, trace *[]string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*trace = append(*trace, name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestChainThen(t *testing.T) {
+	var trace []string
+	chain := Chain(tracing("a", &trace), tracing("b", &trace))
+	extended := chain.Append(tracing("c", &trace))
+	extended.Then(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if !reflect.DeepEqual(trace, []string{"a", "b", "c"}) {
+		t.Errorf("expected the middleware to run outermost first, got %v", trace)
+	}
+	if len(chain) != 2 {
+		t.Errorf("expected Append to leave the chain alone, got %d middleware", len(chain))
+	}
+}
+
+func TestCanonicalChain(t *testing.T) {
+	var trace []string
+	named := map[string]mux.MiddlewareFunc{}
+	for _, name := range middlewareOrder {
+		named[name] = tracing(name, &trace)
+	}
+	delete(named, "gzip")
+	canonicalChain(named).Then(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var expected []string
+	for _, name := range middlewareOrder {
+		if name != "gzip" {
+			expected = append(expected, name)
+		}
+	}
+	if !reflect.DeepEqual(trace, expected) {
+		t.Errorf("expected the canonical order without gzip, got %v", trace)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a middleware missing from middlewareOrder to panic")
+		}
+	}()
+	canonicalChain(map[string]mux.MiddlewareFunc{"unplaced": tracing("unplaced", &trace)})
+}
+
+func TestCanonicalChainPanicIsCountedAndLogged(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	var buf bytes.Buffer
+	router := mux.NewRouter()
+	router.HandleFunc("/panic", func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	})
+	router.Use(canonicalChain(map[string]mux.MiddlewareFunc{
+		"monitoring": metrics.monitoringMiddleware,
+		"recovery":   recoveryMiddleware(defaultPanicBody),
+		"access_log": accessLogMiddleware(newLogger(&buf, logTimeRFC3339), nil, nil),
+	})...)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/panic", nil))
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("expected the panic to be answered with 500, got %d", recorder.Code)
+	}
+	if got := testutil.ToFloat64(metrics.StatusCounter.WithLabelValues("/panic", "5xx")); got != 1 {
+		t.Errorf("expected the panic to be counted as 5xx, got %v", got)
+	}
+	if log := buf.String(); !strings.Contains(log, `"path":"/panic"`) || !strings.Contains(log, `"status":500`) {
+		t.Errorf("expected the 500 to be logged, got %s", log)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContentTypeMiddlewareSetsDefault(t *testing.T) {
+	handler := contentTypeMiddleware(defaultContentType)(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("Welcome!"))
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got := recorder.Header().Get("Content-Type"); got != defaultContentType {
+		t.Errorf("expected Content-Type %q, got %q", defaultContentType, got)
+	}
+}
+
+func TestContentTypeMiddlewareKeepsExplicit(t *testing.T) {
+	handler := contentTypeMiddleware(defaultContentType)(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		_, _ = rw.Write([]byte(`{"message":"Welcome!"}`))
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got := recorder.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("expected Content-Type %q, got %q", "application/json", got)
+	}
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, recorder.Code)
+	}
+}
+
+func TestClientDisconnectIsCountedAsAborted(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.GreetingHandlerDelay = 2 * time.Second
+	router := NewRouter(cfg, newConfigReloader())
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	client := &http.Client{Timeout: 100 * time.Millisecond}
+	if _, err := client.Get(server.URL + "/greeting/Bob"); err == nil {
+		t.Fatal("expected the client to time out")
+	}
+
+	var disconnects *dto.Metric
+	for deadline := time.Now().Add(time.Second); disconnects == nil && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		disconnects = findMetric(scrape(t, router)["go_app_api_client_disconnects_total"], "path", greetingEndpoint)
+	}
+	if disconnects == nil || disconnects.GetCounter().GetValue() != 1 {
+		t.Fatalf("expected one client disconnect, got %v", disconnects)
+	}
+
+	statuses := scrape(t, router)["go_app_api_responses_total"]
+	for _, metric := range statuses.GetMetric() {
+		labels := map[string]string{}
+		for _, pair := range metric.GetLabel() {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		if labels["path"] == greetingEndpoint && labels["status_class"] != "aborted" {
+			t.Errorf("aborted request counted with status class %q", labels["status_class"])
+		}
+	}
+	if metric := findMetric(statuses, "status_class", "aborted"); metric == nil || metric.GetCounter().GetValue() != 1 {
+		t.Errorf("expected one aborted request, got %v", metric)
+	}
+}
+
+func TestErrAbortHandlerIsCountedAsDisconnect(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry, newMetricOpts(defaultConfig()))
+	router := mux.NewRouter()
+	router.HandleFunc("/abort", func(http.ResponseWriter, *http.Request) { panic(http.ErrAbortHandler) })
+	router.HandleFunc("/panic", func(http.ResponseWriter, *http.Request) { panic("boom") })
+	router.Use(recoveryMiddleware(defaultPanicBody), metrics.monitoringMiddleware)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	if _, err := http.Get(server.URL + "/abort"); err == nil {
+		t.Error("expected the aborted response to fail")
+	}
+	response, err := http.Get(server.URL + "/panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected a recovered panic to return 500, got %d", response.StatusCode)
+	}
+
+	if got := testutil.ToFloat64(metrics.ClientDisconnects.WithLabelValues("/abort")); got != 1 {
+		t.Errorf("expected one disconnect for /abort, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.StatusCounter.WithLabelValues("/abort", "aborted")); got != 1 {
+		t.Errorf("expected /abort to be counted as aborted, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.StatusCounter.WithLabelValues("/panic", "5xx")); got != 1 {
+		t.Errorf("expected /panic to be counted as 5xx, got %v", got)
+	}
+}
+
+func TestMaxBodyMiddleware(t *testing.T) {
+	const limit = 16
+	var handlerCalled bool
+	handler := maxBodyMiddleware(limit)(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		handlerCalled = true
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			http.Error(rw, err.Error(), http.StatusRequestEntityTooLarge)
+		}
+	}))
+
+	t.Run("declared length too large", func(t *testing.T) {
+		handlerCalled = false
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", limit+1))))
+		if recorder.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected 413, got %d", recorder.Code)
+		}
+		if handlerCalled {
+			t.Error("the handler should not be called for a too large Content-Length")
+		}
+	})
+	t.Run("chunked body past the limit", func(t *testing.T) {
+		handlerCalled = false
+		request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", 4*limit)))
+		request.ContentLength = -1
+		request.TransferEncoding = []string{"chunked"}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if !handlerCalled {
+			t.Fatal("expected the handler to be called for a body of unknown length")
+		}
+		if recorder.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected reading past the limit to fail with 413, got %d", recorder.Code)
+		}
+	})
+	t.Run("within the limit", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("small")))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", recorder.Code)
+		}
+	})
+}
+
+func TestMethodOverrideMiddleware(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	var inProgress float64
+	deleteItem := func(rw http.ResponseWriter, r *http.Request) {
+		inProgress = testutil.ToFloat64(metrics.EndpointInProgress.WithLabelValues("/items", "deleteItem", r.Method))
+		rw.WriteHeader(http.StatusNoContent)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/items", metrics.createRequestsInProgressMetric("requests_in_progress", "/items",
+		[]string{http.MethodDelete}, deleteItem, FuncName("deleteItem"))).Methods(http.MethodDelete)
+	router.Use(metrics.monitoringMiddleware)
+	handler := methodOverrideMiddleware(router)
+
+	for _, tc := range []struct {
+		method         string
+		override       string
+		expectedStatus int
+	}{
+		{method: http.MethodPost, override: "delete", expectedStatus: http.StatusNoContent},
+		{method: http.MethodPost, override: "", expectedStatus: http.StatusMethodNotAllowed},
+		// Only POST may be overridden, and never into a safe method.
+		{method: http.MethodGet, override: http.MethodDelete, expectedStatus: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, override: http.MethodGet, expectedStatus: http.StatusMethodNotAllowed},
+	} {
+		inProgress = 0
+		request := httptest.NewRequest(tc.method, "/items", nil)
+		if tc.override != "" {
+			request.Header.Set(methodOverrideHeader, tc.override)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != tc.expectedStatus {
+			t.Errorf("%s overridden to %q: expected status %d, got %d",
+				tc.method, tc.override, tc.expectedStatus, recorder.Code)
+		}
+		if tc.expectedStatus == http.StatusNoContent && inProgress != 1 {
+			t.Errorf("expected the request in progress under method DELETE, got %v", inProgress)
+		}
+	}
+}
+
+func TestRecoveryMiddlewareDoesNotLeakPanics(t *testing.T) {
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+
+	handler := recoveryMiddleware("Something went wrong")(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("secret database password")
+	}))
+	for _, tc := range []struct {
+		accept, expectedType, expectedBody string
+	}{
+		{"", "text/plain; charset=utf-8", "Something went wrong\n"},
+		{"application/json", "application/json", panicJSONBody + "\n"},
+		{"text/plain, application/json;q=0.5", "text/plain; charset=utf-8", "Something went wrong\n"},
+		{"text/plain;q=0.5, application/json", "application/json", panicJSONBody + "\n"},
+	} {
+		logs.Reset()
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("Accept", tc.accept)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusInternalServerError {
+			t.Errorf("Accept %q: expected status %d, got %d", tc.accept, http.StatusInternalServerError, recorder.Code)
+		}
+		if got := recorder.Header().Get("Content-Type"); got != tc.expectedType {
+			t.Errorf("Accept %q: expected Content-Type %q, got %q", tc.accept, tc.expectedType, got)
+		}
+		if body := recorder.Body.String(); body != tc.expectedBody {
+			t.Errorf("Accept %q: expected body %q, got %q", tc.accept, tc.expectedBody, body)
+		}
+		if !strings.Contains(logs.String(), "secret database password") || !strings.Contains(logs.String(), "goroutine") {
+			t.Errorf("Accept %q: expected the panic and its stack in the log, got %q", tc.accept, logs.String())
+		}
+	}
+}
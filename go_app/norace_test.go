@@ -0,0 +1,7 @@
+//go:build !race
+
+package main
+
+// raceEnabled reports whether the tests run under the race detector, which
+// slows down synchronization too much for timing assertions.
+const raceEnabled = false
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+)
+
+// addOptionsRoutes answers OPTIONS requests to every route of router that
+// is restricted to some methods with 204 No Content and an Allow header
+// listing them. The OPTIONS routes go through the router's middleware, so
+// they are instrumented like the others, but are not registered through a
+// RouteTracker, as they only mirror the application routes.
+func addOptionsRoutes(router *mux.Router) {
+	type optionsRoute struct {
+		template string
+		allow    string
+	}
+	var routes []optionsRoute
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			if method == http.MethodOptions {
+				return nil
+			}
+		}
+		routes = append(routes, optionsRoute{template, strings.Join(methods, ", ") + ", " + http.MethodOptions})
+		return nil
+	})
+	for _, route := range routes {
+		allow := route.allow
+		router.HandleFunc(route.template, func(rw http.ResponseWriter, _ *http.Request) {
+			rw.Header().Set("Allow", allow)
+			rw.WriteHeader(http.StatusNoContent)
+		}).Methods(http.MethodOptions)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHeadMatchesGet(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ShutdownTimeout = time.Second
+	cfg.GreetingHandlerDelay = 0
+	baseURL := startTestApp(t, cfg)
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	for _, path := range []string{"/", "/greeting/Bob", "/echo/hello"} {
+		responses := map[string]*http.Response{}
+		bodies := map[string][]byte{}
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			request, err := http.NewRequest(method, baseURL+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bodies[method], _ = ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			responses[method] = response
+		}
+		get, head := responses[http.MethodGet], responses[http.MethodHead]
+		if head.StatusCode != get.StatusCode {
+			t.Errorf("%s: expected HEAD status %d, got %d", path, get.StatusCode, head.StatusCode)
+		}
+		if len(bodies[http.MethodHead]) != 0 {
+			t.Errorf("%s: expected no HEAD body, got %q", path, bodies[http.MethodHead])
+		}
+		for _, name := range []string{"Content-Length", "Content-Type"} {
+			if head.Header.Get(name) != get.Header.Get(name) || get.Header.Get(name) == "" {
+				t.Errorf("%s: expected HEAD %s %q like GET, got %q", path, name, get.Header.Get(name), head.Header.Get(name))
+			}
+		}
+	}
+}
+
+func TestOptionsAllowHeader(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Debug = true
+	router := NewRouter(cfg, newConfigReloader())
+
+	for path, expected := range map[string]string{
+		"/greeting/Bob":        "GET, HEAD, OPTIONS",
+		"/ws/echo":             "GET, OPTIONS",
+		"/debug/latency":       "GET, PUT, OPTIONS",
+		"/debug/metrics/reset": "POST, OPTIONS",
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodOptions, path, nil))
+		if recorder.Code != http.StatusNoContent {
+			t.Errorf("OPTIONS %s: expected status %d, got %d", path, http.StatusNoContent, recorder.Code)
+		}
+		if allow := recorder.Header().Get("Allow"); allow != expected {
+			t.Errorf("OPTIONS %s: expected Allow %q, got %q", path, expected, allow)
+		}
+	}
+
+	families := scrape(t, router)
+	metric := findMetric(families["go_app_api_request_counter"], "path", greetingEndpoint)
+	if metric == nil || metric.GetCounter().GetValue() != 1 {
+		t.Errorf("expected the OPTIONS request to be counted, got %v", metric)
+	}
+}
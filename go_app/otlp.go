@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"log"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// otlpMaxAttempts bounds the attempts to export one reading of the
+	// registry; the next interval brings a fresh one anyway.
+	otlpMaxAttempts = 5
+	// otlpInitialBackoff is the wait before the first retry, doubled for
+	// each of the following ones.
+	otlpInitialBackoff = time.Second
+	otlpScope          = "example.com/m"
+)
+
+// otlpExporter periodically reads a registry and exports it over OTLP/gRPC,
+// next to the /metrics endpoint, for collectors that only ingest OTLP.
+type otlpExporter struct {
+	metrics  *Metrics
+	gatherer prometheus.Gatherer
+	conn     *grpc.ClientConn
+	client   collectorpb.MetricsServiceClient
+	resource *resourcepb.Resource
+	timeout  time.Duration
+	backoff  time.Duration
+	start    time.Time
+	now      func() time.Time
+
+	ticker *time.Ticker
+	// exporting is the context of the periodic exports, cancelled when
+	// Shutdown runs out of time.
+	exporting     context.Context
+	stopExporting context.CancelFunc
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+// newOTLPExporter prepares the export of gatherer to the collector at
+// endpoint, a host:port or a URL whose http or https scheme decides whether
+// TLS is used. It does not connect yet.
+func (m *Metrics) newOTLPExporter(cfg ServerConfig, gatherer prometheus.Gatherer) (*otlpExporter, error) {
+	target, useTLS := cfg.OTLPEndpoint, !cfg.OTLPInsecure
+	if strings.Contains(target, "://") {
+		endpoint, err := url.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTLP endpoint %q: %v", target, err)
+		}
+		target, useTLS = endpoint.Host, endpoint.Scheme != "http"
+	}
+	creds := insecure.NewCredentials()
+	if useTLS {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	conn, err := grpc.Dial(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	exporting, stopExporting := context.WithCancel(context.Background())
+	return &otlpExporter{
+		metrics:  m,
+		gatherer: gatherer,
+		conn:     conn,
+		client:   collectorpb.NewMetricsServiceClient(conn),
+		resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+			stringAttribute("service.name", cfg.ServiceName),
+		}},
+		timeout:       cfg.OTLPTimeout,
+		backoff:       otlpInitialBackoff,
+		start:         time.Now(),
+		now:           time.Now,
+		exporting:     exporting,
+		stopExporting: stopExporting,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}, nil
+}
+
+// runEvery exports every interval until Shutdown is called.
+func (e *otlpExporter) runEvery(interval time.Duration) {
+	e.ticker = time.NewTicker(interval)
+	go e.run(e.ticker.C)
+}
+
+// run exports on every tick until Shutdown is called.
+func (e *otlpExporter) run(ticks <-chan time.Time) {
+	defer close(e.done)
+	for {
+		select {
+		case <-ticks:
+			e.export(e.exporting)
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// export sends the current state of the registry, retrying failed attempts
+// with an exponential backoff until they run out or Shutdown is called.
+func (e *otlpExporter) export(ctx context.Context) error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		log.Printf("Gathering metrics for OTLP: %v", err)
+	}
+	request := &collectorpb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: e.resource,
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: otlpScope},
+				Metrics: otlpMetrics(families, e.start, e.now()),
+			}},
+		}},
+	}
+	backoff := e.backoff
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, e.timeout)
+		_, err = e.client.Export(attemptCtx, request)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		e.metrics.OTLPExportFailures.Inc()
+		log.Printf("Exporting metrics over OTLP failed (attempt %d of %d): %v", attempt, otlpMaxAttempts, err)
+		if attempt == otlpMaxAttempts {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-e.stop:
+			return err
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// Shutdown stops the periodic exports, abandoning the one in flight once ctx
+// is done, exports the final state of the metrics once and closes the
+// connection to the collector.
+func (e *otlpExporter) Shutdown(ctx context.Context) error {
+	if e.ticker != nil {
+		e.ticker.Stop()
+	}
+	close(e.stop)
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		e.stopExporting()
+		<-e.done
+	}
+	e.stopExporting()
+	err := e.export(ctx)
+	if closeErr := e.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// otlpMetrics converts the gathered families to OTLP metrics, the labels
+// becoming attributes and the classic histogram buckets explicit bounds.
+// Counters and histograms are cumulative since start.
+func otlpMetrics(families []*dto.MetricFamily, start, now time.Time) []*metricspb.Metric {
+	startNano, nowNano := uint64(start.UnixNano()), uint64(now.UnixNano())
+	var converted []*metricspb.Metric
+	for _, family := range families {
+		metric := &metricspb.Metric{Name: family.GetName(), Description: family.GetHelp()}
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			sum := &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+			}
+			for _, m := range family.GetMetric() {
+				sum.DataPoints = append(sum.DataPoints, numberDataPoint(m, m.GetCounter().GetValue(), startNano, nowNano))
+			}
+			metric.Data = &metricspb.Metric_Sum{Sum: sum}
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			gauge := &metricspb.Gauge{}
+			for _, m := range family.GetMetric() {
+				value := m.GetGauge().GetValue()
+				if family.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+				gauge.DataPoints = append(gauge.DataPoints, numberDataPoint(m, value, 0, nowNano))
+			}
+			metric.Data = &metricspb.Metric_Gauge{Gauge: gauge}
+		case dto.MetricType_HISTOGRAM:
+			histogram := &metricspb.Histogram{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			}
+			for _, m := range family.GetMetric() {
+				histogram.DataPoints = append(histogram.DataPoints, histogramDataPoint(m, startNano, nowNano))
+			}
+			metric.Data = &metricspb.Metric_Histogram{Histogram: histogram}
+		case dto.MetricType_SUMMARY:
+			summary := &metricspb.Summary{}
+			for _, m := range family.GetMetric() {
+				point := &metricspb.SummaryDataPoint{
+					Attributes:        otlpAttributes(m),
+					StartTimeUnixNano: startNano,
+					TimeUnixNano:      nowNano,
+					Count:             m.GetSummary().GetSampleCount(),
+					Sum:               m.GetSummary().GetSampleSum(),
+				}
+				for _, q := range m.GetSummary().GetQuantile() {
+					point.QuantileValues = append(point.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{
+						Quantile: q.GetQuantile(),
+						Value:    q.GetValue(),
+					})
+				}
+				summary.DataPoints = append(summary.DataPoints, point)
+			}
+			metric.Data = &metricspb.Metric_Summary{Summary: summary}
+		default:
+			continue
+		}
+		converted = append(converted, metric)
+	}
+	return converted
+}
+
+func numberDataPoint(m *dto.Metric, value float64, startNano, nowNano uint64) *metricspb.NumberDataPoint {
+	return &metricspb.NumberDataPoint{
+		Attributes:        otlpAttributes(m),
+		StartTimeUnixNano: startNano,
+		TimeUnixNano:      nowNano,
+		Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+	}
+}
+
+// histogramDataPoint turns the cumulative buckets of m into the per bucket
+// counts OTLP expects, the last one counting the observations above the
+// highest bound.
+func histogramDataPoint(m *dto.Metric, startNano, nowNano uint64) *metricspb.HistogramDataPoint {
+	h := m.GetHistogram()
+	sum := h.GetSampleSum()
+	point := &metricspb.HistogramDataPoint{
+		Attributes:        otlpAttributes(m),
+		StartTimeUnixNano: startNano,
+		TimeUnixNano:      nowNano,
+		Count:             h.GetSampleCount(),
+		Sum:               &sum,
+	}
+	var previous uint64
+	for _, bucket := range h.GetBucket() {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			continue
+		}
+		point.ExplicitBounds = append(point.ExplicitBounds, bucket.GetUpperBound())
+		point.BucketCounts = append(point.BucketCounts, bucket.GetCumulativeCount()-previous)
+		previous = bucket.GetCumulativeCount()
+	}
+	point.BucketCounts = append(point.BucketCounts, h.GetSampleCount()-previous)
+	return point
+}
+
+func otlpAttributes(m *dto.Metric) []*commonpb.KeyValue {
+	attributes := make([]*commonpb.KeyValue, 0, len(m.GetLabel()))
+	for _, pair := range m.GetLabel() {
+		attributes = append(attributes, stringAttribute(pair.GetName(), pair.GetValue()))
+	}
+	return attributes
+}
+
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collectorStub is an OTLP metrics collector keeping what it receives. It
+// rejects the first failures requests as unavailable, and with block set
+// holds every request until block is closed.
+type collectorStub struct {
+	collectorpb.UnimplementedMetricsServiceServer
+
+	block    chan struct{}
+	mu       sync.Mutex
+	failures int
+	requests []*collectorpb.ExportMetricsServiceRequest
+}
+
+func (c *collectorStub) Export(ctx context.Context, request *collectorpb.ExportMetricsServiceRequest) (*collectorpb.ExportMetricsServiceResponse, error) {
+	if c.block != nil {
+		select {
+		case <-c.block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		return nil, status.Error(codes.Unavailable, "collector starting")
+	}
+	c.requests = append(c.requests, request)
+	return &collectorpb.ExportMetricsServiceResponse{}, nil
+}
+
+// metric returns the metric called name in the last export, or nil.
+func (c *collectorStub) metric(name string) *metricspb.Metric {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.requests) == 0 {
+		return nil
+	}
+	last := c.requests[len(c.requests)-1]
+	for _, metric := range last.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics() {
+		if metric.GetName() == name {
+			return metric
+		}
+	}
+	return nil
+}
+
+// startCollector serves collector on a free local port until the test ends.
+func startCollector(t *testing.T, collector *collectorStub) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	collectorpb.RegisterMetricsServiceServer(server, collector)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return "http://" + listener.Addr().String()
+}
+
+// newTestOTLPExporter returns an exporter to endpoint, running without
+// ticks until the test ends.
+func newTestOTLPExporter(t *testing.T, endpoint string) (*otlpExporter, *Metrics) {
+	t.Helper()
+	exporter, metrics := newStoppedOTLPExporter(t, endpoint, time.Second)
+	go exporter.run(nil)
+	t.Cleanup(func() { exporter.Shutdown(context.Background()) })
+	return exporter, metrics
+}
+
+// newStoppedOTLPExporter returns an exporter to endpoint that does not run
+// yet, each export attempt giving up after timeout.
+func newStoppedOTLPExporter(t *testing.T, endpoint string, timeout time.Duration) (*otlpExporter, *Metrics) {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry, newMetricOpts(defaultConfig()))
+	cfg := defaultConfig()
+	cfg.OTLPEndpoint = endpoint
+	cfg.OTLPTimeout = timeout
+	exporter, err := metrics.newOTLPExporter(cfg, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter.backoff = time.Millisecond
+	return exporter, metrics
+}
+
+func TestOTLPExport(t *testing.T) {
+	collector := &collectorStub{}
+	exporter, metrics := newTestOTLPExporter(t, startCollector(t, collector))
+	metrics.RequestCounter.WithLabelValues(echoEndpoint, sourceInternal, tenantUnknown).Add(3)
+	metrics.RequestDuration.WithLabelValues(greetingEndpoint, tenantUnknown).Observe(0.2)
+
+	if err := exporter.export(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	counter := collector.metric("go_app_api_request_counter")
+	if counter == nil || !counter.GetSum().GetIsMonotonic() {
+		t.Fatalf("expected the request counter as a monotonic sum, got %v", counter)
+	}
+	point := counter.GetSum().GetDataPoints()[0]
+	if point.GetAsDouble() != 3 {
+		t.Errorf("expected 3 echo requests, got %v", point.GetAsDouble())
+	}
+	attributes := map[string]string{}
+	for _, attribute := range point.GetAttributes() {
+		attributes[attribute.GetKey()] = attribute.GetValue().GetStringValue()
+	}
+	if expected := map[string]string{"path": echoEndpoint, "source": sourceInternal, "tenant": tenantUnknown}; !reflect.DeepEqual(attributes, expected) {
+		t.Errorf("expected attributes %v, got %v", expected, attributes)
+	}
+
+	histogram := collector.metric("go_app_api_request_duration_seconds").GetHistogram().GetDataPoints()
+	if len(histogram) != 1 {
+		t.Fatalf("expected 1 request duration data point, got %d", len(histogram))
+	}
+	bounds, counts := histogram[0].GetExplicitBounds(), histogram[0].GetBucketCounts()
+	if len(counts) != len(bounds)+1 || histogram[0].GetCount() != 1 {
+		t.Fatalf("expected %d bucket counts for %d bounds and 1 observation, got %v", len(bounds)+1, len(bounds), histogram[0])
+	}
+	for i, bound := range bounds {
+		expected := uint64(0)
+		if bound >= 0.2 && (i == 0 || bounds[i-1] < 0.2) {
+			expected = 1
+		}
+		if counts[i] != expected {
+			t.Errorf("bucket le=%v: expected %d, got %d", bound, expected, counts[i])
+		}
+	}
+}
+
+func TestOTLPExportRetries(t *testing.T) {
+	collector := &collectorStub{failures: 2}
+	exporter, metrics := newTestOTLPExporter(t, startCollector(t, collector))
+
+	if err := exporter.export(context.Background()); err != nil {
+		t.Fatalf("expected the export to succeed on the third attempt, got %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.OTLPExportFailures); got != 2 {
+		t.Errorf("expected 2 failed attempts counted, got %v", got)
+	}
+
+	collector.mu.Lock()
+	collector.failures = otlpMaxAttempts
+	collector.mu.Unlock()
+	if err := exporter.export(context.Background()); err == nil {
+		t.Error("expected the export to fail once the attempts run out")
+	}
+	if got := testutil.ToFloat64(metrics.OTLPExportFailures); got != 2+otlpMaxAttempts {
+		t.Errorf("expected %d failed attempts counted, got %v", 2+otlpMaxAttempts, got)
+	}
+}
+
+func TestOTLPFinalExportOnShutdown(t *testing.T) {
+	collector := &collectorStub{}
+	exporter, metrics := newStoppedOTLPExporter(t, startCollector(t, collector), time.Second)
+	go exporter.run(nil)
+	metrics.RequestCounter.WithLabelValues(echoEndpoint, sourceInternal, tenantUnknown).Inc()
+
+	if err := exporter.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if counter := collector.metric("go_app_api_request_counter"); counter == nil {
+		t.Error("expected the final export to carry the request counter")
+	}
+}
+
+func TestOTLPShutdownHonoursContext(t *testing.T) {
+	collector := &collectorStub{block: make(chan struct{})}
+	defer close(collector.block)
+	exporter, _ := newStoppedOTLPExporter(t, startCollector(t, collector), time.Minute)
+	ticks := make(chan time.Time)
+	go exporter.run(ticks)
+	ticks <- time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	if err := exporter.Shutdown(ctx); err == nil {
+		t.Error("expected the final export to fail once the context is done")
+	}
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Errorf("expected Shutdown to give up with its context, took %s", elapsed)
+	}
+}
+
+func TestLoadConfigRejectsNonPositiveOTLPSettings(t *testing.T) {
+	for _, name := range []string{"OTEL_METRIC_EXPORT_INTERVAL", "OTEL_METRIC_EXPORT_TIMEOUT"} {
+		for _, value := range []string{"0", "-1"} {
+			setenv(t, name, value)
+			if _, err := LoadConfig(); err == nil {
+				t.Errorf("expected %s=%s to be rejected", name, value)
+			}
+		}
+		setenv(t, name, "")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// outboundBuckets cover the phases of calls to nearby services, which are
+// expected to take milliseconds rather than seconds.
+var outboundBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// instrumentedTransport records the phases of every request it sends with an
+// httptrace.ClientTrace.
+type instrumentedTransport struct {
+	base    http.RoundTripper
+	metrics *Metrics
+}
+
+// NewInstrumentedClient returns a copy of client whose requests are traced
+// into the Outbound metrics. A nil client stands for http.DefaultClient.
+func (m *Metrics) NewInstrumentedClient(client *http.Client) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	instrumented := *client
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	instrumented.Transport = &instrumentedTransport{base: base, metrics: m}
+	return &instrumented
+}
+
+func (t *instrumentedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	host := r.URL.Host
+	startTime := time.Now()
+	// The dial hooks can run concurrently when several addresses are tried.
+	var mu sync.Mutex
+	var dnsStart, connectStart, tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			t.metrics.OutboundDNS.WithLabelValues(host).Observe(time.Since(dnsStart).Seconds())
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				t.metrics.OutboundConnect.WithLabelValues(host).Observe(time.Since(connectStart).Seconds())
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				t.metrics.OutboundTLS.WithLabelValues(host).Observe(time.Since(tlsStart).Seconds())
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.metrics.OutboundConns.WithLabelValues(host, strconv.FormatBool(info.Reused)).Inc()
+		},
+		GotFirstResponseByte: func() {
+			t.metrics.OutboundFirstByte.WithLabelValues(host).Observe(time.Since(startTime).Seconds())
+		},
+	}
+	response, err := t.base.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+	if err != nil {
+		kind := connectionErrorKind(err)
+		// The transport may report a request cut short by the client's
+		// Timeout as merely canceled.
+		if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+			kind = "timeout"
+		}
+		t.metrics.ConnectionErrors.WithLabelValues(host, kind).Inc()
+	}
+	return response, err
+}
+
+// connectionErrorKind classifies the error of an outbound request as
+// "timeout", "connection_refused", "tls_cert" or "unknown". err may be the
+// *url.Error returned by the client or the error it wraps.
+func connectionErrorKind(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(err.Error(), "connection refused") {
+		return "connection_refused"
+	}
+	var (
+		verification *tls.CertificateVerificationError
+		unknownCA    x509.UnknownAuthorityError
+		invalid      x509.CertificateInvalidError
+		hostname     x509.HostnameError
+	)
+	if errors.As(err, &verification) || errors.As(err, &unknownCA) || errors.As(err, &invalid) || errors.As(err, &hostname) {
+		return "tls_cert"
+	}
+	return "unknown"
+}
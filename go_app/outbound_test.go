@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestInstrumentedClientPhases(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pong")
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := serverURL.Host
+
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	client := metrics.NewInstrumentedClient(server.Client())
+	for i := 0; i < 2; i++ {
+		response, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(response.Body)
+		response.Body.Close()
+	}
+
+	for name, vec := range map[string]*prometheus.HistogramVec{
+		"connect": metrics.OutboundConnect, "tls": metrics.OutboundTLS, "first byte": metrics.OutboundFirstByte,
+	} {
+		count, _ := histogramSum(t, vec, host)
+		expected := uint64(1)
+		if name == "first byte" {
+			expected = 2
+		}
+		if count != expected {
+			t.Errorf("expected %d %s observations, got %d", expected, name, count)
+		}
+	}
+	if reused := testutil.ToFloat64(metrics.OutboundConns.WithLabelValues(host, "true")); reused != 1 {
+		t.Errorf("expected the second request to reuse the connection, got %v reused", reused)
+	}
+	if fresh := testutil.ToFloat64(metrics.OutboundConns.WithLabelValues(host, "false")); fresh != 1 {
+		t.Errorf("expected one new connection, got %v", fresh)
+	}
+}
+
+func TestInstrumentedClientErrorKinds(t *testing.T) {
+	untrusted := httptest.NewTLSServer(http.NotFoundHandler())
+	defer untrusted.Close()
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	// An unstarted server has a listener; closing it leaves an address
+	// nothing listens on. It is freed last, so that the other servers cannot
+	// pick it up.
+	refused := httptest.NewUnstartedServer(http.NotFoundHandler())
+	refusedURL := "http://" + refused.Listener.Addr().String()
+	refused.Listener.Close()
+
+	for _, tc := range []struct {
+		kind   string
+		url    string
+		client *http.Client
+	}{
+		{kind: "connection_refused", url: refusedURL, client: &http.Client{}},
+		{kind: "tls_cert", url: untrusted.URL, client: &http.Client{}},
+		{kind: "timeout", url: slow.URL, client: &http.Client{Timeout: 50 * time.Millisecond}},
+	} {
+		t.Run(tc.kind, func(t *testing.T) {
+			metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+			serverURL, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := metrics.NewInstrumentedClient(tc.client).Get(tc.url); err == nil {
+				t.Fatal("expected the request to fail")
+			}
+			if got := testutil.ToFloat64(metrics.ConnectionErrors.WithLabelValues(serverURL.Host, tc.kind)); got != 1 {
+				t.Errorf("expected one %s error, got %v", tc.kind, got)
+			}
+		})
+	}
+}
+
+func TestConnectionErrorKind(t *testing.T) {
+	for err, expected := range map[error]string{
+		&url.Error{Op: "Get", URL: "http://a", Err: errors.New("dial tcp: connect: connection refused")}: "connection_refused",
+		&url.Error{Op: "Get", URL: "http://a", Err: x509.UnknownAuthorityError{}}:                        "tls_cert",
+		&url.Error{Op: "Get", URL: "http://a", Err: context.DeadlineExceeded}:                            "timeout",
+		errors.New("EOF"): "unknown",
+	} {
+		if got := connectionErrorKind(err); got != expected {
+			t.Errorf("%v: expected %q, got %q", err, expected, got)
+		}
+	}
+}
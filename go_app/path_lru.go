@@ -0,0 +1,140 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// otherPath is the path label the requests of evicted paths are folded
+// into.
+const otherPath = "other"
+
+// pathLRU bounds the number of path label values of RequestCounter, should
+// path labels ever stop being route templates. Once max paths are counted,
+// the least recently used one is evicted to make room for a new one: its
+// series are deleted and their counts added to the path "other", so the
+// total over all paths stays the same.
+//
+// Requests to a path already counted only touch the entry of that path;
+// the lock of the whole LRU is taken to add a path, and to evict one.
+type pathLRU struct {
+	// clock stamps the uses of the paths, in order. It comes first to be
+	// 64-bit aligned for the atomic operations.
+	clock   uint64
+	counter *prometheus.CounterVec
+	max     int
+	entries sync.Map // of path strings to *pathEntry
+
+	mu     sync.Mutex
+	size   int
+	capped bool
+}
+
+// pathEntry is a path counted by a pathLRU.
+type pathEntry struct {
+	lastUsed uint64
+	// series holds the values of the labels after path of the series of
+	// the path, by their joined values, so that they can be folded into
+	// "other" without collecting the whole vec.
+	series sync.Map
+	// mu is read-locked while a request is counted under the path, and
+	// locked to evict it, so no request is counted in a deleted series.
+	mu      sync.RWMutex
+	evicted bool
+}
+
+func newPathLRU(counter *prometheus.CounterVec, max int) *pathLRU {
+	return &pathLRU{counter: counter, max: max}
+}
+
+// count calls record with the series of the counter to count a request to
+// path in, labelValues being the values of the labels after path. The
+// series cannot be evicted before record returns.
+func (l *pathLRU) count(path string, labelValues []string, record func(prometheus.Counter)) {
+	if l.max <= 0 || path == otherPath {
+		record(l.counter.WithLabelValues(append([]string{path}, labelValues...)...))
+		return
+	}
+	for {
+		entry := l.entry(path)
+		entry.mu.RLock()
+		if entry.evicted {
+			// Evicted since it was looked up: count the path anew.
+			entry.mu.RUnlock()
+			continue
+		}
+		atomic.StoreUint64(&entry.lastUsed, atomic.AddUint64(&l.clock, 1))
+		key := strings.Join(labelValues, "\xff")
+		if _, ok := entry.series.Load(key); !ok {
+			entry.series.Store(key, append([]string(nil), labelValues...))
+		}
+		record(l.counter.WithLabelValues(append([]string{path}, labelValues...)...))
+		entry.mu.RUnlock()
+		return
+	}
+}
+
+// entry returns the entry of path, adding it, and evicting the least
+// recently used path to make room, if it is new.
+func (l *pathLRU) entry(path string) *pathEntry {
+	if entry, ok := l.entries.Load(path); ok {
+		return entry.(*pathEntry)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if entry, ok := l.entries.Load(path); ok {
+		return entry.(*pathEntry)
+	}
+	if l.size >= l.max {
+		l.evictOldest()
+	}
+	entry := &pathEntry{}
+	l.entries.Store(path, entry)
+	l.size++
+	return entry
+}
+
+// evictOldest folds the series of the least recently used path into
+// "other". l.mu must be held.
+func (l *pathLRU) evictOldest() {
+	var (
+		oldestPath  string
+		oldestEntry *pathEntry
+		oldestUse   uint64
+	)
+	l.entries.Range(func(path, entry interface{}) bool {
+		if used := atomic.LoadUint64(&entry.(*pathEntry).lastUsed); oldestEntry == nil || used < oldestUse {
+			oldestPath, oldestEntry, oldestUse = path.(string), entry.(*pathEntry), used
+		}
+		return true
+	})
+	if oldestEntry == nil {
+		return
+	}
+	if !l.capped {
+		l.capped = true
+		log.Printf("RequestCounter reached %d paths; folding the least recently used ones, starting with %s, into %q",
+			l.max, oldestPath, otherPath)
+	}
+
+	oldestEntry.mu.Lock()
+	defer oldestEntry.mu.Unlock()
+	oldestEntry.evicted = true
+	l.entries.Delete(oldestPath)
+	l.size--
+	oldestEntry.series.Range(func(_, labelValues interface{}) bool {
+		values := labelValues.([]string)
+		series := append([]string{oldestPath}, values...)
+		counter, err := l.counter.GetMetricWithLabelValues(series...)
+		if err != nil {
+			return true
+		}
+		value := counterValue(counter)
+		l.counter.DeleteLabelValues(series...)
+		l.counter.WithLabelValues(append([]string{otherPath}, values...)...).Add(value)
+		return true
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPathLRUFoldsOverflowIntoOther(t *testing.T) {
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	metrics.requestPaths = newPathLRU(metrics.RequestCounter, 2)
+	request := httptest.NewRequest("GET", "/", nil)
+	for _, path := range []string{"/a", "/a", "/b", "/a", "/c", "/d", "/d"} {
+		metrics.countRequest(path, request)
+	}
+
+	// /b, then /a, were the least recently used when /c and /d came.
+	expected := map[string]float64{"/c": 1, "/d": 2, otherPath: 4}
+	if got := testutil.CollectAndCount(metrics.RequestCounter); got != len(expected) {
+		t.Errorf("expected %d series, got %d", len(expected), got)
+	}
+	for path, value := range expected {
+		if got := testutil.ToFloat64(metrics.RequestCounter.WithLabelValues(path, sourceUnknown, tenantUnknown)); got != value {
+			t.Errorf("expected %v requests counted for %s, got %v", value, path, got)
+		}
+	}
+	if strings.Count(logs.String(), "reached 2 paths") != 1 {
+		t.Errorf("expected the cap to be logged once, got %q", logs.String())
+	}
+}
+
+func TestPathLRUConcurrentRequests(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry, newMetricOpts(defaultConfig()))
+	metrics.requestPaths = newPathLRU(metrics.RequestCounter, 4)
+	const workers, requests = 8, 500
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			request := httptest.NewRequest("GET", "/", nil)
+			for i := 0; i < requests; i++ {
+				metrics.countRequest(fmt.Sprintf("/p%d", (worker+i)%10), request)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	total, paths := 0.0, 0
+	for _, family := range families {
+		if family.GetName() != "go_app_api_request_counter" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			total += metric.GetCounter().GetValue()
+			paths++
+		}
+	}
+	if total != workers*requests {
+		t.Errorf("expected %d requests counted over all paths, got %v", workers*requests, total)
+	}
+	if paths > 5 {
+		t.Errorf("expected at most 4 paths and %q, got %d series", otherPath, paths)
+	}
+}
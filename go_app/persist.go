@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// counterSnapshot is the file format of SaveCounters.
+type counterSnapshot struct {
+	SavedAt  time.Time         `json:"saved_at"`
+	Counters []snapshotCounter `json:"counters"`
+}
+
+// snapshotCounter is one series of a counter. Family is the counterKey of
+// the counter, which stays the same when the exposed name changes with the
+// naming convention.
+type snapshotCounter struct {
+	Family string            `json:"family"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// counterKey returns the name the code registers the counter exposed as
+// name with, before the naming convention renamed it.
+func counterKey(name string) string {
+	for legacy, renamed := range standardRenames {
+		if name == renamed {
+			return legacy
+		}
+	}
+	return strings.TrimSuffix(name, "_total")
+}
+
+// persistentCounters returns the counters SaveCounters saves, every counter
+// and counter vector created by the metrics factory, by counterKey.
+// Histograms are not saved.
+func (m *Metrics) persistentCounters() map[string]prometheus.Collector {
+	m.factory.families.mu.Lock()
+	defer m.factory.families.mu.Unlock()
+	counters := map[string]prometheus.Collector{}
+	for key, counter := range m.factory.families.counters {
+		counters[key] = counter
+	}
+	return counters
+}
+
+// SaveCounters writes the current value of the persistent counters to path.
+func (m *Metrics) SaveCounters(path string) error {
+	snapshot := counterSnapshot{SavedAt: time.Now()}
+	for key, counter := range m.persistentCounters() {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(counter)
+		families, err := registry.Gather()
+		if err != nil {
+			return fmt.Errorf("gathering %s: %v", key, err)
+		}
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				labels := map[string]string{}
+				for _, pair := range metric.GetLabel() {
+					labels[pair.GetName()] = pair.GetValue()
+				}
+				snapshot.Counters = append(snapshot.Counters,
+					snapshotCounter{Family: key, Labels: labels, Value: metric.GetCounter().GetValue()})
+			}
+		}
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	// Write through a temporary file, so a crash never leaves a partial
+	// snapshot behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	log.Printf("Saved %d counter series to %s", len(snapshot.Counters), path)
+	return nil
+}
+
+// RestoreCounters adds the values saved in path to the persistent counters.
+// A missing file is ignored; a corrupt snapshot, one older than maxAge, or a
+// series that no longer matches its counter is logged and ignored, so a bad
+// snapshot never prevents the application from starting.
+func (m *Metrics) RestoreCounters(path string, maxAge time.Duration) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("WARNING: ignoring counter snapshot %s: %v", path, err)
+		return
+	}
+	var snapshot counterSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		log.Printf("WARNING: ignoring corrupt counter snapshot %s: %v", path, err)
+		return
+	}
+	if age := time.Since(snapshot.SavedAt); age > maxAge {
+		log.Printf("WARNING: ignoring counter snapshot %s saved %s ago, older than %s",
+			path, age.Round(time.Second), maxAge)
+		return
+	}
+
+	counters := m.persistentCounters()
+	restored := 0
+	for _, saved := range snapshot.Counters {
+		counter, ok := counters[saved.Family]
+		if !ok || saved.Value < 0 {
+			log.Printf("WARNING: ignoring saved series %v of counter %s", saved.Labels, saved.Family)
+			continue
+		}
+		series, err := counterSeries(counter, saved.Labels)
+		if err != nil {
+			log.Printf("WARNING: ignoring saved series %v of counter %s: %v", saved.Labels, saved.Family, err)
+			continue
+		}
+		series.Add(saved.Value)
+		restored++
+	}
+	log.Printf("Restored %d counter series from %s", restored, path)
+}
+
+// counterSeries returns the series of counter, a counter or a counter vector,
+// with labels.
+func counterSeries(counter prometheus.Collector, labels map[string]string) (prometheus.Counter, error) {
+	switch counter := counter.(type) {
+	case *prometheus.CounterVec:
+		return counter.GetMetricWith(labels)
+	case prometheus.Counter:
+		if len(labels) > 0 {
+			return nil, fmt.Errorf("counter has no labels")
+		}
+		return counter, nil
+	default:
+		return nil, fmt.Errorf("not a counter")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCountersResumeAfterRestart(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ShutdownTimeout = time.Second
+	cfg.CounterSnapshotFile = filepath.Join(t.TempDir(), "counters.json")
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	echoCount := func(baseURL string) float64 {
+		metric := findMetric(scrapeURL(t, client, baseURL)["go_app_api_request_counter"], "path", echoEndpoint)
+		return metric.GetCounter().GetValue()
+	}
+
+	for run, expected := range []float64{2, 4} {
+		baseURL, stop := runApp(t, cfg)
+		for i := 0; i < 2; i++ {
+			response, err := client.Get(baseURL + "/echo/hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(response.Body)
+			response.Body.Close()
+		}
+		got := echoCount(baseURL)
+		stop()
+		if got != expected {
+			t.Errorf("run %d: expected %v echo requests counted, got %v", run, expected, got)
+		}
+	}
+}
+
+func TestRestoreCountersIgnoresBadSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "stale.json")
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	metrics.RequestCounter.WithLabelValues(echoEndpoint, sourceExternal, tenantUnknown).Inc()
+	if err := metrics.SaveCounters(stale); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := ioutil.WriteFile(corrupt, []byte("{not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, path string
+		maxAge     time.Duration
+		warning    string
+	}{
+		{"corrupt", corrupt, time.Hour, "corrupt counter snapshot"},
+		{"stale", stale, 0, "older than"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			defer log.SetOutput(log.Writer())
+			log.SetOutput(&buf)
+
+			restored := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+			restored.RestoreCounters(tc.path, tc.maxAge)
+			if value := testutil.ToFloat64(restored.RequestCounter.WithLabelValues(echoEndpoint, sourceExternal, tenantUnknown)); value != 0 {
+				t.Errorf("expected no restored requests, got %v", value)
+			}
+			if !strings.Contains(buf.String(), tc.warning) {
+				t.Errorf("expected a warning containing %q, got %q", tc.warning, buf.String())
+			}
+		})
+	}
+}
+
+func TestSnapshotKeepsCountersAcrossNamingConventions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counters.json")
+	cfg := defaultConfig()
+	cfg.MetricNaming = "standard"
+	saved := NewMetrics(prometheus.NewRegistry(), newMetricOpts(cfg))
+	saved.RequestCounter.WithLabelValues(echoEndpoint, sourceExternal, tenantUnknown).Add(3)
+	saved.WebSocketUpgrades.WithLabelValues("success").Inc()
+	saved.compression.savings.WithLabelValues(echoEndpoint).Add(100)
+	saved.Panics.Add(2)
+	if err := saved.SaveCounters(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	restored.RestoreCounters(path, time.Hour)
+	for name, tc := range map[string]struct {
+		counter  prometheus.Counter
+		expected float64
+	}{
+		"requests":       {restored.RequestCounter.WithLabelValues(echoEndpoint, sourceExternal, tenantUnknown), 3},
+		"upgrades":       {restored.WebSocketUpgrades.WithLabelValues("success"), 1},
+		"savings":        {restored.compression.savings.WithLabelValues(echoEndpoint), 100},
+		"handler panics": {restored.Panics, 2},
+	} {
+		if value := testutil.ToFloat64(tc.counter); value != tc.expected {
+			t.Errorf("expected %v %s restored, got %v", tc.expected, name, value)
+		}
+	}
+}
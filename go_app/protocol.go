@@ -0,0 +1,13 @@
+package main
+
+import "net/http"
+
+// protocolMiddleware counts requests in RequestProtocols by the protocol
+// they arrived with, such as HTTP/1.1 or HTTP/2.0, so a load balancer
+// falling back to HTTP/1.1 shows up.
+func (m *Metrics) protocolMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.RequestProtocols.WithLabelValues(r.Proto).Inc()
+		next.ServeHTTP(w, r)
+	})
+}
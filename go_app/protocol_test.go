@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProtocolMiddleware(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	handler := metrics.protocolMiddleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	http1 := httptest.NewServer(handler)
+	defer http1.Close()
+	http2 := httptest.NewUnstartedServer(handler)
+	http2.EnableHTTP2 = true
+	http2.StartTLS()
+	defer http2.Close()
+
+	for _, server := range []*httptest.Server{http1, http2} {
+		response, err := server.Client().Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+
+	for _, proto := range []string{"HTTP/1.1", "HTTP/2.0"} {
+		if got := testutil.ToFloat64(metrics.RequestProtocols.WithLabelValues(proto)); got != 1 {
+			t.Errorf("expected 1 request over %s, got %v", proto, got)
+		}
+	}
+	if got := testutil.CollectAndCount(metrics.RequestProtocols); got != 2 {
+		t.Errorf("expected 2 protocol series, got %d", got)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// metricsPusher pushes the registry to a Pushgateway, for deployments that
+// cannot be scraped.
+type metricsPusher struct {
+	metrics     *Metrics
+	pusher      *push.Pusher
+	timeout     time.Duration
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	// jitter turns a backoff into the actual wait before a retry; it is
+	// jitteredBackoff, replaced in tests.
+	jitter func(time.Duration) time.Duration
+	now    func() time.Time
+
+	ticker *time.Ticker
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func (m *Metrics) newMetricsPusher(cfg ServerConfig, gatherer prometheus.Gatherer) *metricsPusher {
+	return &metricsPusher{
+		metrics:     m,
+		pusher:      push.New(cfg.PushgatewayURL, cfg.PushJob).Gatherer(gatherer),
+		timeout:     cfg.PushTimeout,
+		maxAttempts: cfg.PushMaxAttempts,
+		backoff:     cfg.PushBackoff,
+		maxBackoff:  cfg.PushMaxBackoff,
+		jitter:      jitteredBackoff,
+		now:         time.Now,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// start pushes every interval until Shutdown is called.
+func (p *metricsPusher) start(interval time.Duration) {
+	p.ticker = time.NewTicker(interval)
+	go p.run(p.ticker.C)
+}
+
+// run pushes on every tick until Shutdown is called.
+func (p *metricsPusher) run(ticks <-chan time.Time) {
+	defer close(p.done)
+	for {
+		select {
+		case <-ticks:
+			p.push(context.Background())
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// push sends the metrics, each attempt giving up after the push timeout.
+// Failed attempts are retried with an exponential backoff until they run
+// out, ctx is done or Shutdown is called, so the final push on shutdown is
+// attempted once.
+func (p *metricsPusher) push(ctx context.Context) error {
+	backoff := p.backoff
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, p.timeout)
+		err := p.pusher.PushContext(attemptCtx)
+		cancel()
+		if err == nil {
+			p.metrics.PushLastSuccess.Set(float64(p.now().UnixNano()) / 1e9)
+			log.Println("Pushed metrics")
+			return nil
+		}
+		p.metrics.PushFailures.Inc()
+		log.Printf("Pushing metrics failed (attempt %d of %d): %v", attempt, p.maxAttempts, err)
+		if attempt >= p.maxAttempts {
+			return err
+		}
+		select {
+		case <-time.After(p.jitter(backoff)):
+			backoff *= 2
+			if backoff > p.maxBackoff {
+				backoff = p.maxBackoff
+			}
+		case <-p.stop:
+			return err
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// jitteredBackoff returns a random wait between half of backoff and
+// backoff, so that instances failing together do not retry in lockstep.
+func jitteredBackoff(backoff time.Duration) time.Duration {
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)+1))
+}
+
+// Shutdown stops the periodic pushes and pushes the final state of the
+// metrics, so the Pushgateway does not keep the values of the last tick.
+func (p *metricsPusher) Shutdown(ctx context.Context) error {
+	if p.ticker != nil {
+		p.ticker.Stop()
+	}
+	close(p.stop)
+	<-p.done
+	return p.push(ctx)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFinalPushOnShutdown(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		pushes []map[string]*dto.MetricFamily
+	)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/metrics/job/go_app" {
+			t.Errorf("unexpected push %s %s", r.Method, r.URL.Path)
+		}
+		families := map[string]*dto.MetricFamily{}
+		// The decoder buffers the body anew on each Decode unless it
+		// already is a bufio.Reader, losing the bytes read ahead.
+		decoder := expfmt.NewDecoder(bufio.NewReader(r.Body), expfmt.ResponseFormat(r.Header))
+		for {
+			family := &dto.MetricFamily{}
+			if err := decoder.Decode(family); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("decoding push: %v", err)
+				break
+			}
+			families[family.GetName()] = family
+		}
+		mu.Lock()
+		pushes = append(pushes, families)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	cfg := defaultConfig()
+	cfg.ShutdownTimeout = time.Second
+	cfg.PushgatewayURL = gateway.URL
+	cfg.PushInterval = time.Hour
+	baseURL, stop := runApp(t, cfg)
+	response, err := http.Get(baseURL + "/echo/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(pushes) != 1 {
+		t.Fatalf("expected only the final push before exit, got %d pushes", len(pushes))
+	}
+	metric := findMetric(pushes[0]["go_app_api_request_counter"], "path", echoEndpoint)
+	if metric == nil || metric.GetCounter().GetValue() != 1 {
+		t.Errorf("expected the final push to count the echo request, got %v", metric)
+	}
+}
+
+func TestPushRetries(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		failures = 2
+		attempts int
+	)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	cfg := defaultConfig()
+	cfg.PushgatewayURL = gateway.URL
+	cfg.PushBackoff = time.Millisecond
+	cfg.PushMaxBackoff = 2 * time.Millisecond
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry, newMetricOpts(cfg))
+	pusher := metrics.newMetricsPusher(cfg, registry)
+	var waits []time.Duration
+	pusher.jitter = func(backoff time.Duration) time.Duration {
+		waits = append(waits, backoff)
+		return backoff
+	}
+	pushedAt := time.Unix(1700000000, 0)
+	pusher.now = func() time.Time { return pushedAt }
+
+	if err := pusher.push(context.Background()); err != nil {
+		t.Fatalf("expected the push to succeed on the third attempt, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+	if expected := []time.Duration{time.Millisecond, 2 * time.Millisecond}; len(waits) != 2 || waits[0] != expected[0] || waits[1] != expected[1] {
+		t.Errorf("expected the backoffs %v, got %v", expected, waits)
+	}
+	if got := testutil.ToFloat64(metrics.PushFailures); got != 2 {
+		t.Errorf("expected 2 failed attempts counted, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.PushLastSuccess); got != 1700000000 {
+		t.Errorf("expected the last success at 1700000000, got %v", got)
+	}
+
+	mu.Lock()
+	failures, attempts = cfg.PushMaxAttempts, 0
+	mu.Unlock()
+	pusher.now = func() time.Time { return pushedAt.Add(time.Minute) }
+	if err := pusher.push(context.Background()); err == nil {
+		t.Error("expected the push to fail once the attempts run out")
+	}
+	if attempts != cfg.PushMaxAttempts {
+		t.Errorf("expected %d attempts, got %d", cfg.PushMaxAttempts, attempts)
+	}
+	if got := testutil.ToFloat64(metrics.PushFailures); got != float64(2+cfg.PushMaxAttempts) {
+		t.Errorf("expected %d failed attempts counted, got %v", 2+cfg.PushMaxAttempts, got)
+	}
+	if got := testutil.ToFloat64(metrics.PushLastSuccess); got != 1700000000 {
+		t.Errorf("expected the failed push to keep the last success, got %v", got)
+	}
+}
+
+func TestJitteredBackoff(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if wait := jitteredBackoff(time.Second); wait < time.Second/2 || wait > time.Second {
+			t.Fatalf("expected a wait between 500ms and 1s, got %s", wait)
+		}
+	}
+}
+
+func TestLoadConfigRejectsNonPositivePushTimeout(t *testing.T) {
+	for _, value := range []string{"0s", "-1s"} {
+		setenv(t, "PUSH_TIMEOUT", value)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("expected PUSH_TIMEOUT=%s to be rejected", value)
+		}
+	}
+}
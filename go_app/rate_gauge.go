@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"sync"
+	"time"
+)
+
+// rateSamples is the number of counter samples a RateGauge keeps per window.
+const rateSamples = 10
+
+type rateSample struct {
+	at    time.Time
+	value float64
+}
+
+// RateGauge publishes the per-minute rate of a counter over a sliding window,
+// for consumers that receive pushed metrics and cannot run rate() themselves.
+// The counter is sampled every tenth of the window.
+type RateGauge struct {
+	source prometheus.Counter
+	gauge  prometheus.Gauge
+	now    func() time.Time
+
+	mu      sync.Mutex
+	samples []rateSample
+	stop    chan struct{}
+	stopped sync.Once
+}
+
+// panicRateWindow is the window of the rate of handler panics.
+const panicRateWindow = time.Minute
+
+// NewRateGauge starts sampling source and publishing its rate over window as
+// the RequestRate of path. Stop ends the sampling.
+func (m *Metrics) NewRateGauge(path string, source prometheus.Counter, window time.Duration) *RateGauge {
+	return newRateGauge(source, m.RequestRate.WithLabelValues(path), window)
+}
+
+// NewPanicRateGauge starts publishing the rate of Panics over the last
+// minute as PanicRate. Stop ends the sampling.
+func (m *Metrics) NewPanicRateGauge() *RateGauge {
+	return newRateGauge(m.Panics, m.PanicRate, panicRateWindow)
+}
+
+func newRateGauge(source prometheus.Counter, gauge prometheus.Gauge, window time.Duration) *RateGauge {
+	g := &RateGauge{
+		source: source,
+		gauge:  gauge,
+		now:    time.Now,
+		stop:   make(chan struct{}),
+	}
+	g.sample()
+	go g.run(window / rateSamples)
+	return g
+}
+
+func (g *RateGauge) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.sample()
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// sample records the current value of the counter and updates the gauge with
+// the rate between the oldest and the newest sample.
+func (g *RateGauge) sample() {
+	value := counterValue(g.source)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.samples = append(g.samples, rateSample{at: g.now(), value: value})
+	if len(g.samples) > rateSamples+1 {
+		g.samples = g.samples[1:]
+	}
+	oldest, newest := g.samples[0], g.samples[len(g.samples)-1]
+	if elapsed := newest.at.Sub(oldest.at); elapsed > 0 {
+		g.gauge.Set((newest.value - oldest.value) / elapsed.Minutes())
+	}
+}
+
+// Reset forgets the samples, as if the gauge had just been started.
+func (g *RateGauge) Reset() {
+	value := counterValue(g.source)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.samples = []rateSample{{at: g.now(), value: value}}
+	g.gauge.Set(0)
+}
+
+// counterValue returns the current value of counter.
+func counterValue(counter prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := counter.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
+
+// Stop ends the sampling; the gauge keeps its last value.
+func (g *RateGauge) Stop() {
+	g.stopped.Do(func() { close(g.stop) })
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRateGauge(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "source_total", Help: "Source."})
+	metrics.NewRateGauge(echoEndpoint, counter, time.Second).Stop()
+
+	// Drive the samples by hand: 60 increments spread over one second of a
+	// fake clock are 60 requests per second, which is 3600 per minute.
+	clock := time.Now()
+	gauge := &RateGauge{
+		source: counter,
+		gauge:  metrics.RequestRate.WithLabelValues(echoEndpoint),
+		now:    func() time.Time { return clock },
+	}
+	gauge.sample()
+	for tick := 0; tick < rateSamples; tick++ {
+		clock = clock.Add(100 * time.Millisecond)
+		counter.Add(6)
+		gauge.sample()
+	}
+
+	if rate := testutil.ToFloat64(metrics.RequestRate.WithLabelValues(echoEndpoint)); math.Abs(rate-3600) > 1 {
+		t.Errorf("expected about 3600 requests per minute, got %v", rate)
+	}
+
+	// Once the window slides past the burst, the rate drops to zero.
+	for tick := 0; tick < rateSamples; tick++ {
+		clock = clock.Add(100 * time.Millisecond)
+		gauge.sample()
+	}
+	if rate := testutil.ToFloat64(metrics.RequestRate.WithLabelValues(echoEndpoint)); rate != 0 {
+		t.Errorf("expected the rate to drop to 0 after the window, got %v", rate)
+	}
+}
+
+func TestPanicRateGauge(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	clock := time.Unix(0, 0)
+	gauge := &RateGauge{source: metrics.Panics, gauge: metrics.PanicRate, now: func() time.Time { return clock }}
+	gauge.Reset()
+
+	// Three panics every 30 seconds, sampled every tenth of the window.
+	for tick := 1; tick <= 2*rateSamples; tick++ {
+		clock = clock.Add(panicRateWindow / rateSamples)
+		if tick%5 == 0 {
+			metrics.Panics.Add(3)
+		}
+		gauge.sample()
+	}
+	if got := testutil.ToFloat64(metrics.PanicRate); math.Abs(got-6) > 0.5 {
+		t.Errorf("expected about 6 panics per minute, got %v", got)
+	}
+
+	gauge.Reset()
+	if got := testutil.ToFloat64(metrics.PanicRate); got != 0 {
+		t.Errorf("expected the rate to be 0 after Reset, got %v", got)
+	}
+	clock = clock.Add(panicRateWindow / rateSamples)
+	gauge.sample()
+	if got := testutil.ToFloat64(metrics.PanicRate); got != 0 {
+		t.Errorf("expected no panics since Reset, got %v", got)
+	}
+}
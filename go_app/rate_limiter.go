@@ -0,0 +1,38 @@
+package main
+
+import (
+	"golang.org/x/time/rate"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// rateLimiter bounds the rate of requests to a handler with a token bucket
+// refilled at rps tokens per second and holding up to burst of them.
+// Requests finding the bucket empty are rejected with 429 Too Many Requests
+// and a Retry-After header.
+type rateLimiter struct {
+	limiter *rate.Limiter
+}
+
+// newRateLimiter creates a limiter of the requests to path and publishes
+// its configuration in RateLimiterRPS and RateLimiterBurst.
+func (m *Metrics) newRateLimiter(path string, rps float64, burst int) *rateLimiter {
+	m.RateLimiterRPS.WithLabelValues(path).Set(rps)
+	m.RateLimiterBurst.WithLabelValues(path).Set(float64(burst))
+	return &rateLimiter{limiter: rate.NewLimiter(rate.Limit(rps), burst)}
+}
+
+func (l *rateLimiter) Wrap(
+	requestFunction func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		reservation := l.limiter.Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		requestFunction(rw, r)
+	}
+}
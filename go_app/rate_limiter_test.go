@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimiterGauges(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	metrics.newRateLimiter("/birthday", 2.5, 5)
+	metrics.newRateLimiter("/greeting", 10, 20)
+
+	for _, tc := range []struct {
+		path       string
+		rps, burst float64
+	}{
+		{path: "/birthday", rps: 2.5, burst: 5},
+		{path: "/greeting", rps: 10, burst: 20},
+	} {
+		if got := testutil.ToFloat64(metrics.RateLimiterRPS.WithLabelValues(tc.path)); got != tc.rps {
+			t.Errorf("expected rate_limiter_rps of %s to be %v, got %v", tc.path, tc.rps, got)
+		}
+		if got := testutil.ToFloat64(metrics.RateLimiterBurst.WithLabelValues(tc.path)); got != tc.burst {
+			t.Errorf("expected rate_limiter_burst of %s to be %v, got %v", tc.path, tc.burst, got)
+		}
+	}
+}
+
+func TestRateLimiterRejectsOverBurst(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	handler := metrics.newRateLimiter("/slow", 0.001, 1).Wrap(func(http.ResponseWriter, *http.Request) {})
+
+	first := httptest.NewRecorder()
+	handler(first, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if first.Code != http.StatusOK {
+		t.Fatalf("expected the first request to return 200, got %d", first.Code)
+	}
+	second := httptest.NewRecorder()
+	handler(second, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if second.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the second request to return 429, got %d", second.Code)
+	}
+	if second.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header on the rejection")
+	}
+}
+
+func TestLoadConfigRejectsRateLimitBurstBelowOne(t *testing.T) {
+	setenv(t, "RATE_LIMIT_RPS", "5")
+	setenv(t, "RATE_LIMIT_BURST", "0")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected RATE_LIMIT_BURST=0 to be rejected")
+	}
+	setenv(t, "RATE_LIMIT_RPS", "0")
+	if _, err := LoadConfig(); err != nil {
+		t.Errorf("expected the burst to be ignored without a rate limit, got %v", err)
+	}
+}
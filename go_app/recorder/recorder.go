@@ -0,0 +1,307 @@
+// Package recorder records the status, size and timing of the responses
+// written through an http.ResponseWriter, for middleware and for tests
+// asserting on handlers.
+package recorder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Recorder records the response written through the http.ResponseWriter
+// returned by Writer. The first WriteHeader wins: later calls, which
+// net/http would log as superfluous, are dropped. A Recorder is safe for
+// concurrent use, so a middleware can read it while the handler writes, or
+// reply in its place with TimeOut.
+type Recorder struct {
+	// SuppressBody makes the writes discard the body while still counting
+	// its size, for responses to HEAD requests. The header is held back
+	// until FinishSuppressed, so it can carry the Content-Length of the
+	// body. It must be set before the handler writes.
+	SuppressBody bool
+	// BeforeWriteHeader, if set, is called once right before the header is
+	// sent, so it can still add header fields. It must be set before the
+	// handler writes.
+	BeforeWriteHeader func(http.Header)
+
+	w http.ResponseWriter
+
+	mu         sync.Mutex
+	status     int
+	written    int64
+	firstWrite time.Time
+	hijacked   bool
+	// closed makes the writes of a handler that outlived its response fail
+	// with http.ErrHandlerTimeout, see TimeOut.
+	closed bool
+	// now is time.Now, replaced in tests.
+	now func() time.Time
+}
+
+// NewRecorder returns a Recorder of the response written to w.
+func NewRecorder(w http.ResponseWriter) *Recorder {
+	return &Recorder{w: w, now: time.Now}
+}
+
+// Header returns the header of the response.
+func (r *Recorder) Header() http.Header {
+	return r.w.Header()
+}
+
+// WriteHeader sends the header with statusCode unless it has been sent
+// already. Informational 1xx statuses other than 101 are passed on without
+// being recorded, as the final status is still to come.
+func (r *Recorder) WriteHeader(statusCode int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		r.w.WriteHeader(statusCode)
+		return
+	}
+	r.writeHeader(statusCode)
+}
+
+// writeHeader records and sends statusCode unless a status has been sent
+// already. r.mu must be held.
+func (r *Recorder) writeHeader(statusCode int) {
+	if r.status != 0 || r.closed {
+		return
+	}
+	r.status = statusCode
+	r.firstWrite = r.now()
+	if r.BeforeWriteHeader != nil {
+		r.BeforeWriteHeader(r.w.Header())
+	}
+	if r.SuppressBody {
+		return
+	}
+	r.w.WriteHeader(statusCode)
+}
+
+// Write writes b to the body, sending the header with 200 OK first if it has
+// not been sent.
+func (r *Recorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, http.ErrHandlerTimeout
+	}
+	r.writeHeader(http.StatusOK)
+	if r.SuppressBody {
+		r.written += int64(len(b))
+		return len(b), nil
+	}
+	n, err := r.w.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+// FinishSuppressed sends the header held back for a suppressed body, with
+// the Content-Length the body would have had unless the handler set one, so
+// a HEAD response carries the header of the GET response.
+func (r *Recorder) FinishSuppressed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.SuppressBody || r.hijacked || r.closed {
+		return
+	}
+	status := r.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if r.w.Header().Get("Content-Length") == "" && BodyAllowedForStatus(status) {
+		r.w.Header().Set("Content-Length", strconv.FormatInt(r.written, 10))
+	}
+	r.w.WriteHeader(status)
+}
+
+// BodyAllowedForStatus reports whether a response with status may have a
+// body, and so a Content-Length.
+func BodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status < 200, status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// TimeOut replies with message and code unless the response has been
+// started, and makes the later writes fail, so the handler that ran out of
+// time cannot write to a response that is already finished.
+func (r *Recorder) TimeOut(message string, code int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status == 0 {
+		r.status = code
+		r.firstWrite = r.now()
+		http.Error(r.w, message, code)
+	}
+	r.closed = true
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for
+// http.ResponseController.
+func (r *Recorder) Unwrap() http.ResponseWriter {
+	return r.w
+}
+
+// Status returns the status code sent to the client: 200 OK for a handler
+// that returns without writing anything, 101 Switching Protocols for a
+// hijacked connection.
+func (r *Recorder) Status() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// BytesWritten returns the number of body bytes written, or that would have
+// been written if the body was not suppressed.
+func (r *Recorder) BytesWritten() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.written
+}
+
+// WroteHeader reports whether the response header has been sent, or the
+// connection hijacked.
+func (r *Recorder) WroteHeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status != 0
+}
+
+// FirstWriteTime returns when the header was sent, which starts the
+// response, or the zero time if it has not been.
+func (r *Recorder) FirstWriteTime() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.firstWrite
+}
+
+// Hijacked reports whether the connection has been hijacked.
+func (r *Recorder) Hijacked() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hijacked
+}
+
+// flush sends the header and flushes the body written so far, unless the
+// body is suppressed, as nothing may be sent before FinishSuppressed then.
+func (r *Recorder) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.writeHeader(http.StatusOK)
+	if !r.SuppressBody {
+		r.w.(http.Flusher).Flush()
+	}
+}
+
+func (r *Recorder) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conn, rw, err := r.w.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("hijacking the connection: %w", err)
+	}
+	r.hijacked = true
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+		r.firstWrite = r.now()
+	}
+	return conn, rw, nil
+}
+
+func (r *Recorder) readFrom(src io.Reader) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, http.ErrHandlerTimeout
+	}
+	r.writeHeader(http.StatusOK)
+	if r.SuppressBody {
+		n, err := io.Copy(io.Discard, src)
+		r.written += n
+		return n, err
+	}
+	n, err := r.w.(io.ReaderFrom).ReadFrom(src)
+	r.written += n
+	return n, err
+}
+
+type flusher struct{ *Recorder }
+
+func (f flusher) Flush() { f.flush() }
+
+type hijacker struct{ *Recorder }
+
+func (h hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) { return h.hijack() }
+
+type readerFrom struct{ *Recorder }
+
+func (rf readerFrom) ReadFrom(src io.Reader) (int64, error) { return rf.readFrom(src) }
+
+// Writer returns the http.ResponseWriter to hand to the handler. It
+// implements http.Flusher, http.Hijacker and io.ReaderFrom exactly when the
+// wrapped writer does, so handlers probing for them see the same
+// capabilities as without the Recorder.
+func (r *Recorder) Writer() http.ResponseWriter {
+	_, canFlush := r.w.(http.Flusher)
+	_, canHijack := r.w.(http.Hijacker)
+	_, canReadFrom := r.w.(io.ReaderFrom)
+	switch {
+	case canFlush && canHijack && canReadFrom:
+		return struct {
+			*Recorder
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{r, flusher{r}, hijacker{r}, readerFrom{r}}
+	case canFlush && canHijack:
+		return struct {
+			*Recorder
+			http.Flusher
+			http.Hijacker
+		}{r, flusher{r}, hijacker{r}}
+	case canFlush && canReadFrom:
+		return struct {
+			*Recorder
+			http.Flusher
+			io.ReaderFrom
+		}{r, flusher{r}, readerFrom{r}}
+	case canHijack && canReadFrom:
+		return struct {
+			*Recorder
+			http.Hijacker
+			io.ReaderFrom
+		}{r, hijacker{r}, readerFrom{r}}
+	case canFlush:
+		return struct {
+			*Recorder
+			http.Flusher
+		}{r, flusher{r}}
+	case canHijack:
+		return struct {
+			*Recorder
+			http.Hijacker
+		}{r, hijacker{r}}
+	case canReadFrom:
+		return struct {
+			*Recorder
+			io.ReaderFrom
+		}{r, readerFrom{r}}
+	default:
+		return r
+	}
+}
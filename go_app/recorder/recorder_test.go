@@ -0,0 +1,290 @@
+package recorder
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// plainWriter is a ResponseWriter with none of the optional interfaces,
+// counting the WriteHeader calls it gets.
+type plainWriter struct {
+	header   http.Header
+	statuses []int
+	body     strings.Builder
+}
+
+func newPlainWriter() *plainWriter {
+	return &plainWriter{header: http.Header{}}
+}
+
+func (w *plainWriter) Header() http.Header { return w.header }
+
+func (w *plainWriter) WriteHeader(statusCode int) {
+	w.statuses = append(w.statuses, statusCode)
+}
+
+func (w *plainWriter) Write(b []byte) (int, error) {
+	if len(w.statuses) == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.body.Write(b)
+}
+
+// readerFromWriter is a plainWriter implementing io.ReaderFrom, recording
+// whether it was used.
+type readerFromWriter struct {
+	*plainWriter
+	readFrom bool
+}
+
+func (w *readerFromWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.readFrom = true
+	return io.Copy(&w.body, src)
+}
+
+func TestWriteBeforeWriteHeader(t *testing.T) {
+	w := newPlainWriter()
+	rec := NewRecorder(w)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rec.now = func() time.Time { return start }
+
+	if rec.WroteHeader() || !rec.FirstWriteTime().IsZero() {
+		t.Fatal("expected nothing to be recorded before the first write")
+	}
+	if _, err := rec.Writer().Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Status() != http.StatusOK || !rec.WroteHeader() {
+		t.Errorf("expected an implicit 200, got %d", rec.Status())
+	}
+	if rec.BytesWritten() != 5 || w.body.String() != "hello" {
+		t.Errorf("expected 5 bytes written through, got %d and %q", rec.BytesWritten(), w.body.String())
+	}
+	if !rec.FirstWriteTime().Equal(start) {
+		t.Errorf("expected the first write at %s, got %s", start, rec.FirstWriteTime())
+	}
+	if len(w.statuses) != 1 || w.statuses[0] != http.StatusOK {
+		t.Errorf("expected the wrapped writer to get one 200, got %v", w.statuses)
+	}
+}
+
+func TestDoubleWriteHeader(t *testing.T) {
+	w := newPlainWriter()
+	rec := NewRecorder(w)
+	writer := rec.Writer()
+	writer.WriteHeader(http.StatusEarlyHints)
+	writer.WriteHeader(http.StatusNotFound)
+	writer.WriteHeader(http.StatusInternalServerError)
+	writer.Write([]byte("missing"))
+
+	if rec.Status() != http.StatusNotFound {
+		t.Errorf("expected the first final status to win, got %d", rec.Status())
+	}
+	expected := []int{http.StatusEarlyHints, http.StatusNotFound}
+	if len(w.statuses) != len(expected) || w.statuses[0] != expected[0] || w.statuses[1] != expected[1] {
+		t.Errorf("expected the wrapped writer to get %v, got %v", expected, w.statuses)
+	}
+}
+
+func TestNoWriteDefaultsToOK(t *testing.T) {
+	rec := NewRecorder(newPlainWriter())
+	if rec.Status() != http.StatusOK || rec.WroteHeader() || rec.BytesWritten() != 0 {
+		t.Errorf("expected an untouched response to read as an unsent 200, got %d", rec.Status())
+	}
+}
+
+func TestWriterInterfaces(t *testing.T) {
+	for name, tc := range map[string]struct {
+		w                           http.ResponseWriter
+		flusher, hijacker, readFrom bool
+	}{
+		"plain":       {w: newPlainWriter()},
+		"reader from": {w: &readerFromWriter{plainWriter: newPlainWriter()}, readFrom: true},
+		"flusher":     {w: httptest.NewRecorder(), flusher: true},
+		"flusher+reader": {w: struct {
+			*httptest.ResponseRecorder
+			io.ReaderFrom
+		}{httptest.NewRecorder(), &readerFromWriter{plainWriter: newPlainWriter()}}, flusher: true, readFrom: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			writer := NewRecorder(tc.w).Writer()
+			if _, ok := writer.(http.Flusher); ok != tc.flusher {
+				t.Errorf("expected Flusher %v, got %v", tc.flusher, ok)
+			}
+			if _, ok := writer.(http.Hijacker); ok != tc.hijacker {
+				t.Errorf("expected Hijacker %v, got %v", tc.hijacker, ok)
+			}
+			if _, ok := writer.(io.ReaderFrom); ok != tc.readFrom {
+				t.Errorf("expected ReaderFrom %v, got %v", tc.readFrom, ok)
+			}
+		})
+	}
+}
+
+func TestFlushSendsHeader(t *testing.T) {
+	w := httptest.NewRecorder()
+	rec := NewRecorder(w)
+	rec.Writer().(http.Flusher).Flush()
+
+	if !w.Flushed || !rec.WroteHeader() || rec.Status() != http.StatusOK {
+		t.Errorf("expected Flush to send a 200 and flush, got flushed=%v status=%d", w.Flushed, rec.Status())
+	}
+}
+
+func TestCopyUsesReaderFrom(t *testing.T) {
+	w := &readerFromWriter{plainWriter: newPlainWriter()}
+	rec := NewRecorder(w)
+	// A LimitedReader has no WriteTo, so io.Copy falls back to ReadFrom.
+	n, err := io.Copy(rec.Writer(), io.LimitReader(strings.NewReader(strings.Repeat("x", 1000)), 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !w.readFrom {
+		t.Error("expected io.Copy to go through the wrapped ReadFrom")
+	}
+	if n != 1000 || rec.BytesWritten() != 1000 {
+		t.Errorf("expected 1000 bytes copied and recorded, got %d and %d", n, rec.BytesWritten())
+	}
+	if rec.Status() != http.StatusOK || len(w.statuses) != 1 {
+		t.Errorf("expected the copy to send a 200 first, got %v", w.statuses)
+	}
+}
+
+func TestHijackedConnection(t *testing.T) {
+	recorded := make(chan *Recorder, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := NewRecorder(w)
+		defer func() { recorded <- rec }()
+		writer := rec.Writer()
+		if _, ok := writer.(io.ReaderFrom); !ok {
+			t.Error("expected the server's writer to keep ReadFrom")
+		}
+		conn, rw, err := writer.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+		rw.Flush()
+
+		if _, err := writer.Write([]byte("late")); err != http.ErrHijacked {
+			t.Errorf("expected writes after hijacking to fail with ErrHijacked, got %v", err)
+		}
+	}))
+	defer server.Close()
+
+	conn, err := (&net.Dialer{}).Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n"))
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("expected the client to read 101, got %d", response.StatusCode)
+	}
+
+	rec := <-recorded
+	if !rec.Hijacked() || rec.Status() != http.StatusSwitchingProtocols || !rec.WroteHeader() {
+		t.Errorf("expected a hijacked connection to count as 101, got hijacked=%v status=%d", rec.Hijacked(), rec.Status())
+	}
+	if rec.BytesWritten() != 0 {
+		t.Errorf("expected no body bytes through the recorder, got %d", rec.BytesWritten())
+	}
+}
+
+func TestSuppressedBody(t *testing.T) {
+	response := httptest.NewRecorder()
+	rec := NewRecorder(response)
+	rec.SuppressBody = true
+	rec.Header().Set("X-Test", "kept")
+
+	if n, err := rec.Writer().Write([]byte("Welcome!")); n != 8 || err != nil {
+		t.Fatalf("expected Write to report 8 bytes, got %d, %v", n, err)
+	}
+	if response.Body.Len() != 0 {
+		t.Errorf("expected no body, got %q", response.Body.String())
+	}
+	if response.Flushed || response.Header().Get("Content-Length") != "" {
+		t.Errorf("expected the header to be held back until the body is complete")
+	}
+	rec.FinishSuppressed()
+	if response.Header().Get("X-Test") != "kept" || response.Code != http.StatusOK {
+		t.Errorf("expected the header and status to be sent, got %v %d", response.Header(), response.Code)
+	}
+	if length := response.Header().Get("Content-Length"); length != "8" {
+		t.Errorf("expected the Content-Length of the suppressed body, got %q", length)
+	}
+	if rec.BytesWritten() != 8 {
+		t.Errorf("expected a would-be size of 8, got %d", rec.BytesWritten())
+	}
+}
+
+// headerCountingWriter counts the WriteHeader calls reaching it.
+type headerCountingWriter struct {
+	*httptest.ResponseRecorder
+	writeHeaders int32
+}
+
+func (w *headerCountingWriter) WriteHeader(statusCode int) {
+	atomic.AddInt32(&w.writeHeaders, 1)
+	w.ResponseRecorder.WriteHeader(statusCode)
+}
+
+func TestConcurrentWriteHeader(t *testing.T) {
+	response := &headerCountingWriter{ResponseRecorder: httptest.NewRecorder()}
+	rec := NewRecorder(response)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				rec.WriteHeader(http.StatusAccepted + i%3)
+			} else {
+				rec.Write([]byte("x"))
+			}
+			rec.Status()
+		}(i)
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&response.writeHeaders); got != 1 {
+		t.Errorf("expected a single WriteHeader to reach the response, got %d", got)
+	}
+	if rec.Status() != response.Code {
+		t.Errorf("expected the recorded status %d to be the one sent, got %d", rec.Status(), response.Code)
+	}
+}
+
+func TestTimeOut(t *testing.T) {
+	response := &headerCountingWriter{ResponseRecorder: httptest.NewRecorder()}
+	rec := NewRecorder(response)
+
+	rec.TimeOut("timed out", http.StatusGatewayTimeout)
+	rec.WriteHeader(http.StatusOK)
+	if _, err := rec.Write([]byte("late")); err != http.ErrHandlerTimeout {
+		t.Errorf("expected late writes to fail with ErrHandlerTimeout, got %v", err)
+	}
+	if response.Code != http.StatusGatewayTimeout || atomic.LoadInt32(&response.writeHeaders) != 1 {
+		t.Errorf("expected only the 504 to be sent, got %d after %d WriteHeader calls", response.Code, response.writeHeaders)
+	}
+	if body := response.Body.String(); body != "timed out\n" {
+		t.Errorf("expected the timeout message alone, got %q", body)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+// redirectCountHeader carries the number of times a request has been
+// redirected so far. Every hop through the application increments it.
+const redirectCountHeader = "X-Redirect-Count"
+
+type redirectCountKey struct{}
+
+// redirectCount returns the hop count redirectLoopMiddleware stored in ctx,
+// including the current hop.
+func redirectCount(ctx context.Context) int {
+	count, _ := ctx.Value(redirectCountKey{}).(int)
+	return count
+}
+
+// redirectLoopMiddleware rejects requests with 508 Loop Detected once they
+// have been redirected more than maxRedirects times, and counts them in
+// RedirectLoops. Accepted requests carry the incremented count in their
+// X-Redirect-Count header and context, so it is passed on to upstreams.
+func (m *Metrics) redirectLoopMiddleware(maxRedirects int) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// A missing or malformed header counts as the first hop.
+			count, _ := strconv.Atoi(r.Header.Get(redirectCountHeader))
+			if count < 0 {
+				count = 0
+			}
+			count++
+			if count > maxRedirects {
+				m.RedirectLoops.WithLabelValues(routeLabel(r)).Inc()
+				http.Error(w, http.StatusText(http.StatusLoopDetected), http.StatusLoopDetected)
+				return
+			}
+			r.Header.Set(redirectCountHeader, strconv.Itoa(count))
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), redirectCountKey{}, count)))
+		})
+	}
+}
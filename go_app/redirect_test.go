@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestRedirectLoopMiddleware(t *testing.T) {
+	const maxRedirects = 3
+	for _, tc := range []struct {
+		name           string
+		header         string
+		expectedStatus int
+		expectedCount  int
+	}{
+		{"no header", "", http.StatusOK, 1},
+		{"below", "1", http.StatusOK, 2},
+		{"at", strconv.Itoa(maxRedirects - 1), http.StatusOK, maxRedirects},
+		{"above", strconv.Itoa(maxRedirects), http.StatusLoopDetected, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+			var header string
+			var count int
+			router := mux.NewRouter()
+			router.HandleFunc("/hop", func(_ http.ResponseWriter, r *http.Request) {
+				header = r.Header.Get(redirectCountHeader)
+				count = redirectCount(r.Context())
+			})
+			router.Use(metrics.redirectLoopMiddleware(maxRedirects))
+
+			request := httptest.NewRequest(http.MethodGet, "/hop", nil)
+			if tc.header != "" {
+				request.Header.Set(redirectCountHeader, tc.header)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, recorder.Code)
+			}
+			if count != tc.expectedCount {
+				t.Errorf("expected the handler to see count %d, got %d", tc.expectedCount, count)
+			}
+			if tc.expectedCount > 0 && header != strconv.Itoa(tc.expectedCount) {
+				t.Errorf("expected %s %d, got %q", redirectCountHeader, tc.expectedCount, header)
+			}
+			expectedLoops := 0.0
+			if tc.expectedStatus == http.StatusLoopDetected {
+				expectedLoops = 1
+			}
+			if got := testutil.ToFloat64(metrics.RedirectLoops.WithLabelValues("/hop")); got != expectedLoops {
+				t.Errorf("expected %v detected loops, got %v", expectedLoops, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// configReloader re-reads the configuration on SIGHUP and passes it to the
+// hooks registered by the components whose settings can change at runtime.
+type configReloader struct {
+	mu    sync.Mutex
+	hooks []func(ServerConfig)
+}
+
+func newConfigReloader() *configReloader {
+	return &configReloader{}
+}
+
+// OnReload registers hook to be called with every successfully reloaded
+// configuration.
+func (r *configReloader) OnReload(hook func(ServerConfig)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, hook)
+}
+
+// Reload loads a new configuration and applies it. A configuration that
+// fails to load is logged and the current one is kept.
+func (r *configReloader) Reload(load func() (ServerConfig, error)) {
+	cfg, err := load()
+	if err != nil {
+		log.Printf("Keeping the current configuration, reload failed: %v", err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, hook := range r.hooks {
+		hook(cfg)
+	}
+	log.Println("Configuration reloaded")
+}
+
+// watch reloads the configuration every time the process receives SIGHUP.
+func (r *configReloader) watch(load func() (ServerConfig, error)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			r.Reload(load)
+		}
+	}()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// requiredHeaderMiddleware rejects with 400 the requests without header or,
+// when allowed is not empty, with a value not in allowed, and counts them in
+// MissingRequiredHeader. The routes the monitoring middleware skips, such as
+// /metrics and /healthz, are not checked, as scrapers and probes do not send
+// the header.
+func (m *Metrics) requiredHeaderMiddleware(header string, allowed []string) mux.MiddlewareFunc {
+	values := make(map[string]bool, len(allowed))
+	for _, value := range allowed {
+		values[value] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := routeLabel(r)
+			if m.skipList.Load().(*skipList).Contains(path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			value := r.Header.Get(header)
+			switch {
+			case value == "":
+				m.MissingRequiredHeader.WithLabelValues(path, "missing").Inc()
+				http.Error(w, fmt.Sprintf("missing required header %s", header), http.StatusBadRequest)
+			case len(values) > 0 && !values[value]:
+				m.MissingRequiredHeader.WithLabelValues(path, "invalid").Inc()
+				http.Error(w, fmt.Sprintf("unsupported %s %q", header, value), http.StatusBadRequest)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
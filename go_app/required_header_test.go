@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequiredHeaderMiddleware(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		path, value    string
+		expectedStatus int
+		expectedReason string
+	}{
+		{"valid", "/api", "2", http.StatusOK, ""},
+		{"invalid", "/api", "3", http.StatusBadRequest, "invalid"},
+		{"absent", "/api", "", http.StatusBadRequest, "missing"},
+		{"skipped route", "/metrics", "", http.StatusOK, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+			metrics.SetSkipList([]string{"/metrics"})
+			router := mux.NewRouter()
+			router.HandleFunc("/api", func(http.ResponseWriter, *http.Request) {})
+			router.HandleFunc("/metrics", func(http.ResponseWriter, *http.Request) {})
+			router.Use(metrics.requiredHeaderMiddleware("X-API-Version", []string{"1", "2"}))
+
+			request := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.value != "" {
+				request.Header.Set("X-API-Version", tc.value)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, recorder.Code)
+			}
+			for _, reason := range []string{"missing", "invalid"} {
+				expected := 0.0
+				if reason == tc.expectedReason {
+					expected = 1
+				}
+				if got := testutil.ToFloat64(metrics.MissingRequiredHeader.WithLabelValues(tc.path, reason)); got != expected {
+					t.Errorf("expected %v rejections as %s, got %v", expected, reason, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRequiredHeaderWithoutAllowedValues(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	router := mux.NewRouter()
+	router.HandleFunc("/api", func(http.ResponseWriter, *http.Request) {})
+	router.Use(metrics.requiredHeaderMiddleware("X-API-Version", nil))
+
+	request := httptest.NewRequest(http.MethodGet, "/api", nil)
+	request.Header.Set("X-API-Version", "anything")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected any value to be accepted, got status %d", recorder.Code)
+	}
+}
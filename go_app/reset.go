@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// resettable is a counter or histogram vector ResetCounters can clear.
+type resettable interface {
+	prometheus.Collector
+	Reset()
+}
+
+// familyFactory is the promauto.Factory of the application metrics. It
+// remembers the counters and histogram vectors it creates, the legacy
+// families included, so that ResetCounters and SaveCounters cover every one
+// of them.
+type familyFactory struct {
+	promauto.Factory
+	families *createdFamilies
+}
+
+// createdFamilies are the families a familyFactory created.
+type createdFamilies struct {
+	mu         sync.Mutex
+	resettable []resettable
+	// counters hold the counters and counter vectors by counterKey.
+	counters map[string]prometheus.Collector
+}
+
+func newFamilyFactory(reg prometheus.Registerer) familyFactory {
+	return familyFactory{
+		Factory:  promauto.With(reg),
+		families: &createdFamilies{counters: map[string]prometheus.Collector{}},
+	}
+}
+
+func (f familyFactory) NewCounter(opts prometheus.CounterOpts) prometheus.Counter {
+	counter := f.Factory.NewCounter(opts)
+	f.addCounter(opts.Name, counter)
+	return counter
+}
+
+func (f familyFactory) NewCounterVec(opts prometheus.CounterOpts, labelNames []string) *prometheus.CounterVec {
+	vec := f.Factory.NewCounterVec(opts, labelNames)
+	f.add(vec)
+	f.addCounter(opts.Name, vec)
+	return vec
+}
+
+func (f familyFactory) NewHistogramVec(opts prometheus.HistogramOpts, labelNames []string) *prometheus.HistogramVec {
+	vec := f.Factory.NewHistogramVec(opts, labelNames)
+	f.add(vec)
+	return vec
+}
+
+func (f familyFactory) add(family resettable) {
+	if f.families == nil {
+		return
+	}
+	f.families.mu.Lock()
+	defer f.families.mu.Unlock()
+	f.families.resettable = append(f.families.resettable, family)
+}
+
+func (f familyFactory) addCounter(name string, counter prometheus.Collector) {
+	if f.families == nil {
+		return
+	}
+	f.families.mu.Lock()
+	defer f.families.mu.Unlock()
+	f.families.counters[counterKey(name)] = counter
+}
+
+// ResetCounters deletes every series of the application's counters and
+// histograms and returns the names of the families that had any. Gauges are
+// left alone, because they describe current state such as the requests in
+// progress. The Go and process collectors are never touched. Each family is
+// reset atomically; requests in flight are recorded either before or after.
+func (m *Metrics) ResetCounters() []string {
+	m.factory.families.mu.Lock()
+	families := append([]resettable(nil), m.factory.families.resettable...)
+	m.factory.families.mu.Unlock()
+
+	// Gather the families on their own to learn which of them have series.
+	registry := prometheus.NewRegistry()
+	for _, family := range families {
+		registry.MustRegister(family)
+	}
+	gathered, err := registry.Gather()
+	if err != nil {
+		log.Printf("Listing the metrics to reset failed: %v", err)
+	}
+	names := []string{}
+	for _, family := range gathered {
+		names = append(names, family.GetName())
+	}
+	sort.Strings(names)
+
+	for _, family := range families {
+		family.Reset()
+	}
+	return names
+}
+
+// resetHandler serves POST /debug/metrics/reset, which is only registered
+// in debug mode.
+func (m *Metrics) resetHandler(rw http.ResponseWriter, r *http.Request) {
+	names := m.ResetCounters()
+	log.Printf("Reset %d metric families on request from %s", len(names), r.RemoteAddr)
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(struct {
+		Reset []string `json:"reset"`
+	}{names})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResetMetrics(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Debug = true
+	cfg.GreetingHandlerDelay = time.Millisecond
+	router := NewRouter(cfg, newConfigReloader())
+	for _, path := range []string{"/echo/hi", "/greeting/Bob"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if metric := findMetric(scrape(t, router)["go_app_api_request_counter"], "path", echoEndpoint); metric.GetCounter().GetValue() != 1 {
+		t.Fatalf("expected the echo request to be counted, got %v", metric)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/debug/metrics/reset", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected the reset to succeed, got %d", recorder.Code)
+	}
+	var summary struct {
+		Reset []string `json:"reset"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	reset := map[string]bool{}
+	for _, name := range summary.Reset {
+		reset[name] = true
+	}
+	for _, name := range []string{
+		"go_app_api_request_counter", "go_app_api_handler_sleep_seconds",
+		"go_app_api_request_protocol_total", "go_app_api_response_header_bytes",
+	} {
+		if !reset[name] {
+			t.Errorf("expected %s in the reset summary %v", name, summary.Reset)
+		}
+	}
+
+	families := scrape(t, router)
+	if metric := findMetric(families["go_app_api_request_counter"], "path", echoEndpoint); metric != nil {
+		t.Errorf("expected the echo counter to be reset, got %v", metric)
+	}
+	if _, ok := families["go_goroutines"]; !ok {
+		t.Error("expected the Go collector to be left alone")
+	}
+
+	// Series held by handlers are recreated on their next use.
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/greeting/Bob", nil))
+	families = scrape(t, router)
+	if metric := findMetric(families["go_app_api_handler_sleep_seconds"], "handler", "greeting"); metric.GetHistogram().GetSampleCount() != 1 {
+		t.Errorf("expected the greeting sleep to be recorded after the reset, got %v", metric)
+	}
+	// The reset request itself, the greeting request and the scrape before
+	// this one.
+	if metric := findMetric(families["go_app_api_access_log_lines_total"], "outcome", "logged"); metric.GetCounter().GetValue() != 3 {
+		t.Errorf("expected the access log lines to be counted after the reset, got %v", metric)
+	}
+}
+
+func TestResetMetricsRequiresDebug(t *testing.T) {
+	router := NewRouter(defaultConfig(), newConfigReloader())
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/debug/metrics/reset", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected the reset endpoint to be missing without debug, got %d", recorder.Code)
+	}
+}
+
+func TestResetCountersCoversEveryVector(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	created := map[resettable]bool{}
+	for _, family := range metrics.factory.families.resettable {
+		created[family] = true
+	}
+	// Every counter and histogram vector of Metrics, or of a struct it
+	// points to, must have been created by its factory.
+	var check func(prefix string, value reflect.Value)
+	check = func(prefix string, value reflect.Value) {
+		for i := 0; i < value.NumField(); i++ {
+			field, name := value.Field(i), prefix+value.Type().Field(i).Name
+			if !field.CanInterface() {
+				continue
+			}
+			switch vec := field.Interface().(type) {
+			case *prometheus.CounterVec, *prometheus.HistogramVec:
+				if !created[vec.(resettable)] {
+					t.Errorf("%s is not reset by ResetCounters", name)
+				}
+				continue
+			}
+			if field.Kind() == reflect.Ptr && field.Elem().Kind() == reflect.Struct && field.Type().Elem().PkgPath() == "main" {
+				check(name+".", field.Elem())
+			}
+		}
+	}
+	check("", reflect.ValueOf(metrics).Elem())
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// RouteTracker wraps a router to count the routes registered on it, for
+// applications adding and removing routes at runtime, to record the order
+// in which they are registered and the middleware layers requests go
+// through.
+type RouteTracker struct {
+	*mux.Router
+	metrics *Metrics
+
+	mu sync.Mutex
+	// active holds, for every tracked route, the flag its matcher checks:
+	// 1 while the route is active, 0 once deregistered.
+	active map[*mux.Route]*int32
+}
+
+// NewRouteTracker returns a RouteTracker registering its routes on router.
+func (m *Metrics) NewRouteTracker(router *mux.Router) *RouteTracker {
+	return &RouteTracker{Router: router, metrics: m, active: map[*mux.Route]*int32{}}
+}
+
+// HandleFunc registers a new route like mux.Router.HandleFunc and counts it.
+func (t *RouteTracker) HandleFunc(path string, f func(http.ResponseWriter, *http.Request)) *mux.Route {
+	return t.track(t.Router.HandleFunc(path, f))
+}
+
+// Handle registers a new route like mux.Router.Handle and counts it.
+func (t *RouteTracker) Handle(path string, handler http.Handler) *mux.Route {
+	return t.track(t.Router.Handle(path, handler))
+}
+
+// Use appends middleware to the chain like mux.Router.Use, counting each
+// one in the chain depth of the requests.
+func (t *RouteTracker) Use(mwf ...mux.MiddlewareFunc) {
+	for _, mw := range mwf {
+		t.Router.Use(depthCounted(mw))
+	}
+}
+
+// track counts route and adds the matcher that DeregisterRoute turns off.
+// The matcher is added before the route serves any request, so
+// deregistering never touches the matchers mux reads.
+func (t *RouteTracker) track(route *mux.Route) *mux.Route {
+	active := int32(1)
+	route.MatcherFunc(func(*http.Request, *mux.RouteMatch) bool {
+		return atomic.LoadInt32(&active) == 1
+	})
+	t.mu.Lock()
+	t.active[route] = &active
+	t.mu.Unlock()
+	t.metrics.RoutesRegistered.Inc()
+	t.metrics.ActiveRoutes.Inc()
+	t.metrics.routeOrder.add(route)
+	return route
+}
+
+// DeregisterRoute stops route from matching any request, as mux cannot
+// remove it, and no longer counts it as active. Deregistering a route twice,
+// or one not registered through t, has no effect.
+func (t *RouteTracker) DeregisterRoute(route *mux.Route) {
+	t.mu.Lock()
+	active, ok := t.active[route]
+	t.mu.Unlock()
+	if ok && atomic.CompareAndSwapInt32(active, 1, 0) {
+		t.metrics.ActiveRoutes.Dec()
+	}
+}
+
+// anyMethod is the method label of the routes matching every method.
+const anyMethod = "*"
+
+// routeOrder is a collector exposing, by path template and method, the
+// position at which each route was registered through a RouteTracker,
+// starting at 1. mux tries the routes in that order, so it tells which of
+// two overlapping routes wins. Deregistered routes keep their position. The
+// methods are read on collection, as they are set on a route after it is
+// registered.
+type routeOrder struct {
+	desc *prometheus.Desc
+
+	mu     sync.Mutex
+	routes []*mux.Route
+}
+
+func newRouteOrder(opts MetricOpts) *routeOrder {
+	return &routeOrder{
+		desc: prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "route_registration_order"),
+			"Position at which the route was registered on the router, which matches requests in that order.",
+			[]string{"path", "method"}, nil),
+	}
+}
+
+func (o *routeOrder) add(route *mux.Route) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.routes = append(o.routes, route)
+}
+
+func (o *routeOrder) Describe(ch chan<- *prometheus.Desc) {
+	ch <- o.desc
+}
+
+// Collect exposes the routes with a path template. Of the routes registered
+// twice for the same path and method, only the first one, which shadows
+// the other, is exposed.
+func (o *routeOrder) Collect(ch chan<- prometheus.Metric) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	seen := map[[2]string]bool{}
+	for i, route := range o.routes {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			continue
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{anyMethod}
+		}
+		for _, method := range methods {
+			if key := [2]string{path, method}; !seen[key] {
+				seen[key] = true
+				ch <- prometheus.MustNewConstMetric(o.desc, prometheus.GaugeValue, float64(i+1), path, method)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRouteTracker(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	tracker := metrics.NewRouteTracker(mux.NewRouter())
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	tracker.HandleFunc("/one", ok)
+	two := tracker.HandleFunc("/two", ok)
+	tracker.Handle("/three", http.HandlerFunc(ok))
+	if got := testutil.ToFloat64(metrics.ActiveRoutes); got != 3 {
+		t.Fatalf("expected 3 active routes, got %v", got)
+	}
+
+	tracker.DeregisterRoute(two)
+	tracker.DeregisterRoute(two)
+	if got := testutil.ToFloat64(metrics.ActiveRoutes); got != 2 {
+		t.Errorf("expected 2 active routes after deregistering one, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.RoutesRegistered); got != 3 {
+		t.Errorf("expected deregistering to leave 3 routes registered in total, got %v", got)
+	}
+
+	for path, expected := range map[string]int{"/one": http.StatusOK, "/two": http.StatusNotFound, "/three": http.StatusOK} {
+		recorder := httptest.NewRecorder()
+		tracker.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code != expected {
+			t.Errorf("GET %s: expected status %d, got %d", path, expected, recorder.Code)
+		}
+	}
+}
+
+func TestRegisterRouteCount(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry, newMetricOpts(defaultConfig()))
+	tracker := metrics.NewRouteTracker(mux.NewRouter())
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	tracker.HandleFunc("/one", ok)
+	tracker.Handle("/two", http.HandlerFunc(ok))
+	tracker.Path("/three").HandlerFunc(ok)
+	tracker.PathPrefix("/static/").HandlerFunc(ok)
+	api := tracker.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/users", ok)
+	metrics.registerRouteCount(tracker.Router)
+
+	// The subrouter counts as a route of its own, besides its /users route.
+	if got := gatheredValue(t, registry, "go_app_api_registered_routes"); got != 6 {
+		t.Errorf("expected 6 registered routes, got %v", got)
+	}
+}
+
+func TestRouteRegistrationOrder(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry, newMetricOpts(defaultConfig()))
+	tracker := metrics.NewRouteTracker(mux.NewRouter())
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	tracker.HandleFunc("/", ok).Methods("GET")
+	tracker.HandleFunc("/users/{id}", ok).Methods("GET", "HEAD")
+	tracker.HandleFunc("/users/{id}", ok).Methods("DELETE")
+	tracker.Handle("/metrics", http.HandlerFunc(ok))
+	tracker.DeregisterRoute(tracker.HandleFunc("/users/me", ok).Methods("GET"))
+	// Shadowed by the second route, so not exposed.
+	tracker.HandleFunc("/users/{id}", ok).Methods("GET")
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var family *dto.MetricFamily
+	for _, f := range families {
+		if f.GetName() == "go_app_api_route_registration_order" {
+			family = f
+		}
+	}
+	got := map[string]float64{}
+	for _, metric := range family.GetMetric() {
+		labels := map[string]string{}
+		for _, pair := range metric.GetLabel() {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		got[labels["method"]+" "+labels["path"]] = metric.GetGauge().GetValue()
+	}
+	expected := map[string]float64{
+		"GET /":              1,
+		"GET /users/{id}":    2,
+		"HEAD /users/{id}":   2,
+		"DELETE /users/{id}": 3,
+		"* /metrics":         4,
+		"GET /users/me":      5,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the registration order %v, got %v", expected, got)
+	}
+}
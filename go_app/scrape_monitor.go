@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"example.com/m/recorder"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// scrapeMonitor observes the scrapes of the metrics endpoint and warns when
+// they stop.
+type scrapeMonitor struct {
+	metrics *Metrics
+	now     func() time.Time
+	warn    func(format string, args ...interface{})
+
+	lastScrape int64 // Unix nanoseconds, starting at creation
+	warned     int32
+
+	ticker *time.Ticker
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func (m *Metrics) newScrapeMonitor() *scrapeMonitor {
+	return &scrapeMonitor{
+		metrics:    m,
+		now:        time.Now,
+		warn:       log.Printf,
+		lastScrape: time.Now().UnixNano(),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Wrap instruments the metrics handler next.
+func (s *scrapeMonitor) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rec := recorder.NewRecorder(rw)
+		startTime := s.now()
+		next.ServeHTTP(rec.Writer(), r)
+		s.metrics.ScrapeDuration.Observe(s.now().Sub(startTime).Seconds())
+		s.metrics.ScrapesServed.Inc()
+		s.metrics.ScrapeSize.Set(float64(rec.BytesWritten()))
+		if rec.Status() == http.StatusOK {
+			now := s.now()
+			atomic.StoreInt64(&s.lastScrape, now.UnixNano())
+			atomic.StoreInt32(&s.warned, 0)
+			s.metrics.LastScrape.Set(float64(now.UnixNano()) / float64(time.Second))
+		}
+	})
+}
+
+// start checks every half window whether the scrapes went stale. Stop ends
+// the checks.
+func (s *scrapeMonitor) start(window time.Duration) {
+	s.ticker = time.NewTicker(window / 2)
+	go s.watch(window, s.ticker.C)
+}
+
+// watch checks on every tick whether the last successful scrape is older
+// than window at the time of the tick, until Stop.
+func (s *scrapeMonitor) watch(window time.Duration, ticks <-chan time.Time) {
+	defer close(s.done)
+	for {
+		select {
+		case now := <-ticks:
+			s.checkStaleness(now, window)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Stop ends the staleness checks.
+func (s *scrapeMonitor) Stop(context.Context) error {
+	if s.ticker != nil {
+		s.ticker.Stop()
+	}
+	close(s.stop)
+	<-s.done
+	return nil
+}
+
+// checkStaleness warns, once per gap between scrapes, when no scrape
+// succeeded within window before now.
+func (s *scrapeMonitor) checkStaleness(now time.Time, window time.Duration) {
+	since := now.Sub(time.Unix(0, atomic.LoadInt64(&s.lastScrape)))
+	if since > window && atomic.CompareAndSwapInt32(&s.warned, 0, 1) {
+		s.warn("WARNING: /metrics has not been scraped for %s", since.Round(time.Second))
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScrapeSelfObservability(t *testing.T) {
+	router := NewRouter(defaultConfig(), newConfigReloader())
+	before := float64(time.Now().Unix())
+	scrape(t, router)
+	families := scrape(t, router)
+
+	// The second scrape reports the first one.
+	if served := families["go_app_api_scrapes_total"].GetMetric()[0].GetCounter().GetValue(); served != 1 {
+		t.Errorf("expected 1 scrape served before the second, got %v", served)
+	}
+	if count := families["go_app_api_scrape_duration_seconds"].GetMetric()[0].GetHistogram().GetSampleCount(); count != 1 {
+		t.Errorf("expected 1 scrape duration observed, got %v", count)
+	}
+	if size := families["go_app_api_scrape_response_size_bytes"].GetMetric()[0].GetGauge().GetValue(); size < 1000 {
+		t.Errorf("expected the size of the first exposition, got %v bytes", size)
+	}
+	if last := families["go_app_api_last_scrape_timestamp_seconds"].GetMetric()[0].GetGauge().GetValue(); last < before {
+		t.Errorf("expected the last scrape timestamp after %v, got %v", before, last)
+	}
+}
+
+func TestScrapeStalenessWarning(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	monitor := metrics.newScrapeMonitor()
+	clock := time.Now()
+	monitor.now = func() time.Time { return clock }
+	var warnings []string
+	monitor.warn = func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+	handler := monitor.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("up 1\n"))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	ticks := make(chan time.Time)
+	go monitor.watch(time.Minute, ticks)
+	for _, elapsed := range []time.Duration{30 * time.Second, 90 * time.Second, 120 * time.Second} {
+		ticks <- clock.Add(elapsed)
+	}
+	monitor.Stop(context.Background())
+
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "has not been scraped") {
+		t.Errorf("expected a single staleness warning, got %q", warnings)
+	}
+}
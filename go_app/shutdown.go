@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownHooks holds the functions that stop the application's subsystems.
+// They run in the reverse order of their registration, so a subsystem is
+// stopped before the ones it was started after and may depend on. It also
+// holds the background workers that are only started with the server.
+type shutdownHooks struct {
+	mu      sync.Mutex
+	hooks   []func(context.Context) error
+	workers []func() func(context.Context) error
+}
+
+func newShutdownHooks() *shutdownHooks {
+	return &shutdownHooks{}
+}
+
+// onShutdown registers hook to be called when the application shuts down.
+func (s *shutdownHooks) onShutdown(hook func(context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+// inBackground registers start, which starts a background worker and returns
+// the hook stopping it, or nil if there is nothing to stop. It is only
+// called by startBackground, so a router that is never served, as in tests,
+// starts no goroutines.
+func (s *shutdownHooks) inBackground(start func() func(context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.workers = append(s.workers, start)
+}
+
+// startBackground starts the workers registered with inBackground, in their
+// order, registering the hooks stopping them.
+func (s *shutdownHooks) startBackground() {
+	s.mu.Lock()
+	workers := s.workers
+	s.workers = nil
+	s.mu.Unlock()
+	for _, start := range workers {
+		if stop := start(); stop != nil {
+			s.onShutdown(stop)
+		}
+	}
+}
+
+// Shutdown calls the registered hooks in LIFO order, all sharing the
+// deadline of ctx. A failing hook is logged and does not stop the others.
+func (s *shutdownHooks) Shutdown(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.hooks) - 1; i >= 0; i-- {
+		if err := s.hooks[i](ctx); err != nil {
+			log.Printf("Shutdown hook failed: %v", err)
+		}
+	}
+}
+
+// watch runs Shutdown with the given timeout once the process receives
+// SIGINT or SIGTERM or ctx is done. The returned channel is closed when the
+// hooks are done.
+func (s *shutdownHooks) watch(ctx context.Context, timeout time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		defer close(done)
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			log.Printf("Received %s, shutting down", sig)
+		case <-ctx.Done():
+			log.Println("Shutting down")
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		s.Shutdown(shutdownCtx)
+	}()
+	return done
+}
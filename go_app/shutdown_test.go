@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestShutdownHooksRunInReverseOrder(t *testing.T) {
+	hooks := newShutdownHooks()
+	var calls []string
+	hooks.onShutdown(func(ctx context.Context) error {
+		calls = append(calls, "first")
+		return nil
+	})
+	hooks.onShutdown(func(ctx context.Context) error {
+		calls = append(calls, "second")
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("expected the hook context to carry the shutdown deadline")
+		}
+		return errors.New("flush failed")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	hooks.Shutdown(ctx)
+
+	if expected := []string{"second", "first"}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected hooks to run as %v, got %v", expected, calls)
+	}
+}
+
+func TestBackgroundWorkersStartWithStartBackground(t *testing.T) {
+	hooks := newShutdownHooks()
+	var calls []string
+	for _, name := range []string{"first", "second"} {
+		name := name
+		hooks.inBackground(func() func(context.Context) error {
+			calls = append(calls, "start "+name)
+			return func(context.Context) error {
+				calls = append(calls, "stop "+name)
+				return nil
+			}
+		})
+	}
+	hooks.inBackground(func() func(context.Context) error { return nil })
+	if len(calls) != 0 {
+		t.Fatalf("expected no worker to start before startBackground, got %v", calls)
+	}
+
+	hooks.startBackground()
+	hooks.Shutdown(context.Background())
+	expected := []string{"start first", "start second", "stop second", "stop first"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected %v, got %v", expected, calls)
+	}
+}
+
+func TestLoadConfigRejectsNonPositiveShutdownTimeout(t *testing.T) {
+	for _, value := range []string{"0s", "-1s"} {
+		setenv(t, "SHUTDOWN_TIMEOUT", value)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("expected SHUTDOWN_TIMEOUT=%s to be rejected", value)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Values of the source label of RequestCounter.
+const (
+	sourceInternal = "internal"
+	sourceExternal = "external"
+	// sourceUnknown is used when requestSourceMiddleware did not run.
+	sourceUnknown = "unknown"
+)
+
+// defaultInternalCIDRs are the private and loopback networks, where the
+// other services of a deployment usually run.
+var defaultInternalCIDRs = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8", "::1/128"}
+
+// parseCIDRs parses a list of networks in CIDR notation.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// RealIPFromRequest returns the address of the client that sent r: the
+// X-Real-IP header or the first address of X-Forwarded-For, as set by a
+// proxy in front of the application, or else the remote address of the
+// connection. It returns nil if none of them is an IP address. The headers
+// can be set by clients too, so the result is only good for statistics.
+func RealIPFromRequest(r *http.Request) net.IP {
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		if ip := net.ParseIP(strings.TrimSpace(strings.Split(forwarded, ",")[0])); ip != nil {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+type requestSourceKey struct{}
+
+// requestSource returns the source requestSourceMiddleware stored in ctx.
+func requestSource(ctx context.Context) string {
+	if source, ok := ctx.Value(requestSourceKey{}).(string); ok {
+		return source
+	}
+	return sourceUnknown
+}
+
+// requestSourceMiddleware tells internal requests, whose client is in one
+// of internalNetworks, from external ones, and stores the answer in the
+// request context for monitoringMiddleware, which must run after it.
+func requestSourceMiddleware(internalNetworks []*net.IPNet) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			source := sourceExternal
+			if ip := RealIPFromRequest(r); ip != nil {
+				for _, network := range internalNetworks {
+					if network.Contains(ip) {
+						source = sourceInternal
+						break
+					}
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestSourceKey{}, source)))
+		})
+	}
+}
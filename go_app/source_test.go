@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestSource(t *testing.T) {
+	for _, tc := range []struct {
+		name, remoteAddr, header, value string
+		expected                        string
+	}{
+		{"private remote address", "10.1.2.3:4567", "", "", sourceInternal},
+		{"public remote address", "203.0.113.7:4567", "", "", sourceExternal},
+		{"loopback", "127.0.0.1:4567", "", "", sourceInternal},
+		{"private client behind a proxy", "203.0.113.7:4567", "X-Forwarded-For", "192.168.1.10, 203.0.113.7", sourceInternal},
+		{"public client behind a proxy", "10.0.0.1:4567", "X-Real-IP", "198.51.100.2", sourceExternal},
+		{"malformed header", "10.0.0.1:4567", "X-Real-IP", "somewhere", sourceInternal},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var source string
+			handler := requestSourceMiddleware(mustParseCIDRs(defaultInternalCIDRs))(
+				http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+					source = requestSource(r.Context())
+				}))
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.RemoteAddr = tc.remoteAddr
+			if tc.header != "" {
+				request.Header.Set(tc.header, tc.value)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			if source != tc.expected {
+				t.Errorf("expected source %q, got %q", tc.expected, source)
+			}
+		})
+	}
+}
+
+func TestRequestCounterBySource(t *testing.T) {
+	router := NewRouter(defaultConfig(), newConfigReloader())
+	for _, remoteAddr := range []string{"10.1.2.3:4567", "203.0.113.7:4567", "203.0.113.8:4567"} {
+		request := httptest.NewRequest(http.MethodGet, "/echo/hi", nil)
+		request.RemoteAddr = remoteAddr
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	family := scrape(t, router)["go_app_api_request_counter"]
+	for source, expected := range map[string]float64{sourceInternal: 1, sourceExternal: 2} {
+		if metric := findMetric(family, "source", source); metric.GetCounter().GetValue() != expected {
+			t.Errorf("expected %v %s requests, got %v", expected, source, metric)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"testing"
+)
+
+func TestTimedSprintf(t *testing.T) {
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_sprintf_nanoseconds", Buckets: sprintfBuckets})
+	for i := 0; i < 2; i++ {
+		if got := TimedSprintf("%s is %d", histogram, "answer", i); got != fmt.Sprintf("answer is %d", i) {
+			t.Fatalf("expected %q, got %q", fmt.Sprintf("answer is %d", i), got)
+		}
+	}
+	if got := TimedSprintf("%s", nil, "unobserved"); got != "unobserved" {
+		t.Errorf("expected %q without a histogram, got %q", "unobserved", got)
+	}
+
+	var m dto.Metric
+	if err := histogram.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 2 {
+		t.Fatalf("expected both calls to be observed, got %d observations", got)
+	}
+	if got := m.GetHistogram().GetSampleSum(); got <= 0 {
+		t.Errorf("expected a positive duration in nanoseconds, got %v", got)
+	}
+}
+
+func TestSprintfSampler(t *testing.T) {
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_sampled_nanoseconds", Buckets: sprintfBuckets})
+	sampler := NewSprintfSampler(histogram, 4)
+	for i := 0; i < 8; i++ {
+		if got := sampler.Sprintf("%s is %d", "answer", i); got != fmt.Sprintf("answer is %d", i) {
+			t.Fatalf("expected %q, got %q", fmt.Sprintf("answer is %d", i), got)
+		}
+	}
+	var nilSampler *SprintfSampler
+	if got := nilSampler.Sprintf("%s", "untimed"); got != "untimed" {
+		t.Errorf("expected %q from a nil sampler, got %q", "untimed", got)
+	}
+
+	var m dto.Metric
+	if err := histogram.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 2 {
+		t.Errorf("expected the first call and one in 4 after it to be timed, got %d observations", got)
+	}
+}
+
+// maxSprintfOverhead bounds what the handlers' SprintfSampler adds on
+// average to fmt.Sprintf. Timing a call reads the clock twice, which costs
+// 100 to 150ns on shared VMs, so only a sample of the calls fits the bound.
+const maxSprintfOverhead = 100
+
+func TestSprintfOverhead(t *testing.T) {
+	if testing.Short() || raceEnabled {
+		t.Skip("benchmarks in short mode or under the race detector")
+	}
+	// The fastest of a few runs each, as a busy machine only slows runs
+	// down.
+	var raw, sampled int64
+	for i := 0; i < 3; i++ {
+		raw = fastest(raw, testing.Benchmark(func(b *testing.B) { benchmarkSprintf(b, rawSprintf) }))
+		sampled = fastest(sampled, testing.Benchmark(func(b *testing.B) { benchmarkSprintf(b, sampledSprintf) }))
+	}
+	if overhead := sampled - raw; overhead >= maxSprintfOverhead {
+		t.Errorf("expected the sampled TimedSprintf to add under %dns, got %dns (%dns vs %dns per call)",
+			maxSprintfOverhead, overhead, sampled, raw)
+	}
+}
+
+// fastest returns the ns/op of result if it is below best, or best is 0.
+func fastest(best int64, result testing.BenchmarkResult) int64 {
+	if ns := result.NsPerOp(); best == 0 || ns < best {
+		return ns
+	}
+	return best
+}
+
+// BenchmarkTimedSprintf compares fmt.Sprintf with TimedSprintf timing every
+// call and with the one-in-sprintfSampleEvery sample of the handlers.
+func BenchmarkTimedSprintf(b *testing.B) {
+	b.Run("raw", func(b *testing.B) { benchmarkSprintf(b, rawSprintf) })
+	b.Run("timed", func(b *testing.B) { benchmarkSprintf(b, timedSprintf) })
+	b.Run("sampled", func(b *testing.B) { benchmarkSprintf(b, sampledSprintf) })
+}
+
+const (
+	rawSprintf = iota
+	timedSprintf
+	sampledSprintf
+)
+
+func benchmarkSprintf(b *testing.B, mode int) {
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "bench_sprintf_nanoseconds", Buckets: sprintfBuckets})
+	sampler := NewSprintfSampler(histogram, sprintfSampleEvery)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		switch mode {
+		case timedSprintf:
+			TimedSprintf("Greetings %s %s", histogram, "ana", defaultGreetingSuffix)
+		case sampledSprintf:
+			sampler.Sprintf("Greetings %s %s", "ana", defaultGreetingSuffix)
+		default:
+			_ = fmt.Sprintf("Greetings %s %s", "ana", defaultGreetingSuffix)
+		}
+	}
+}
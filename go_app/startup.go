@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// startupHandler serves /startupz for startup probes: 503 until the
+// application has finished initializing, 200 afterwards. Unlike /healthz it
+// never goes back to failing.
+func (m *Metrics) startupHandler(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if atomic.LoadInt32(&m.started) == 0 {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = rw.Write([]byte("starting"))
+		return
+	}
+	_, _ = rw.Write([]byte("ok"))
+}
+
+// markStarted records that the initialization, which took d, is complete.
+func (m *Metrics) markStarted(d time.Duration) {
+	m.StartupDuration.Set(d.Seconds())
+	atomic.StoreInt32(&m.started, 1)
+}
+
+// startupPollInterval is how often warmUp checks the dependencies.
+const startupPollInterval = 100 * time.Millisecond
+
+// warmUp completes the initialization started at begin once the server is
+// accepting connections, waiting delay first to let dependencies such as
+// caches warm up, and then for every registered Dependency to be healthy.
+// It gives up if ctx is done before.
+func (m *Metrics) warmUp(ctx context.Context, begin time.Time, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return
+	}
+	ticker := time.NewTicker(startupPollInterval)
+	defer ticker.Stop()
+	for !m.dependenciesHealthy() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+	d := time.Since(begin)
+	m.markStarted(d)
+	log.Printf("Initialization completed in %s", d)
+}
+
+// dependenciesHealthy reports whether the last health check of every
+// registered Dependency passed.
+func (m *Metrics) dependenciesHealthy() bool {
+	m.dependenciesMu.Lock()
+	defer m.dependenciesMu.Unlock()
+	for _, dependency := range m.dependencies {
+		if !dependency.Healthy() {
+			return false
+		}
+	}
+	return true
+}
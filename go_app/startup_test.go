@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStartupProbe(t *testing.T) {
+	router, metrics := newRouter(defaultConfig(), newConfigReloader(), newShutdownHooks())
+	probe := func() int {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, startupEndpoint, nil))
+		return recorder.Code
+	}
+
+	if code := probe(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before initialization, got %d", code)
+	}
+	metrics.warmUp(context.Background(), time.Now().Add(-3*time.Second), time.Millisecond)
+	if code := probe(); code != http.StatusOK {
+		t.Fatalf("expected 200 once initialized, got %d", code)
+	}
+	if got := testutil.ToFloat64(metrics.StartupDuration); got < 3 {
+		t.Errorf("expected a startup duration of at least 3s, got %v", got)
+	}
+}
+
+func TestStartupProbeCancelled(t *testing.T) {
+	_, metrics := newRouter(defaultConfig(), newConfigReloader(), newShutdownHooks())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	metrics.warmUp(ctx, time.Now(), time.Hour)
+	if metrics.started != 0 {
+		t.Error("expected a cancelled warm-up not to complete the initialization")
+	}
+}
+
+func TestStartupProbeWaitsForDependencies(t *testing.T) {
+	router, metrics := newRouter(defaultConfig(), newConfigReloader(), newShutdownHooks())
+	var healthy int32
+	dependency := metrics.RegisterDependency("database", 10*time.Millisecond, func(context.Context) error {
+		if atomic.LoadInt32(&healthy) == 0 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	defer dependency.Stop()
+	probe := func() int {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, startupEndpoint, nil))
+		return recorder.Code
+	}
+
+	done := make(chan struct{})
+	go func() {
+		metrics.warmUp(context.Background(), time.Now(), 0)
+		close(done)
+	}()
+	time.Sleep(3 * startupPollInterval)
+	if code := probe(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while the dependency is down, got %d", code)
+	}
+	atomic.StoreInt32(&healthy, 1)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the initialization to complete once the dependency is up")
+	}
+	if code := probe(); code != http.StatusOK {
+		t.Errorf("expected 200 once the dependency is up, got %d", code)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	// tenantHeader names the team a request is made for.
+	tenantHeader = "X-Tenant-Id"
+	// tenantUnknown is the tenant label of the requests without a tenant
+	// in the allowlist, which keeps the number of series bounded.
+	tenantUnknown = "unknown"
+)
+
+// tenantAllowlist holds the tenants counted under their own label value.
+// It is safe to replace while requests are being served.
+type tenantAllowlist struct {
+	tenants atomic.Value // map[string]bool
+}
+
+func newTenantAllowlist(tenants []string) *tenantAllowlist {
+	allowlist := &tenantAllowlist{}
+	allowlist.Set(tenants)
+	return allowlist
+}
+
+// Set replaces the tenants of the allowlist.
+func (a *tenantAllowlist) Set(tenants []string) {
+	allowed := make(map[string]bool, len(tenants))
+	for _, tenant := range tenants {
+		allowed[tenant] = true
+	}
+	a.tenants.Store(allowed)
+}
+
+// tenant returns the tenant label of a request with the given tenant
+// header.
+func (a *tenantAllowlist) tenant(header string) string {
+	if a.tenants.Load().(map[string]bool)[header] {
+		return header
+	}
+	return tenantUnknown
+}
+
+type requestTenantKey struct{}
+
+// requestTenant returns the tenant tenantMiddleware stored in ctx.
+func requestTenant(ctx context.Context) string {
+	if tenant, ok := ctx.Value(requestTenantKey{}).(string); ok {
+		return tenant
+	}
+	return tenantUnknown
+}
+
+// tenantMiddleware stores the tenant of the request, from its X-Tenant-Id
+// header, in the request context for monitoringMiddleware, which must run
+// after it. Tenants missing from allowlist are stored as "unknown".
+func tenantMiddleware(allowlist *tenantAllowlist) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant := allowlist.tenant(r.Header.Get(tenantHeader))
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestTenantKey{}, tenant)))
+		})
+	}
+}
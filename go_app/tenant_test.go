@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// tenantCounts returns the requests counted by tenant in the request counter
+// of router.
+func tenantCounts(t *testing.T, router http.Handler) map[string]float64 {
+	t.Helper()
+	counts := map[string]float64{}
+	for _, metric := range scrape(t, router)["go_app_api_request_counter"].GetMetric() {
+		for _, pair := range metric.GetLabel() {
+			if pair.GetName() == "tenant" {
+				counts[pair.GetValue()] += metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return counts
+}
+
+func requestAsTenant(router http.Handler, tenant string) {
+	request := httptest.NewRequest(http.MethodGet, "/echo/hi", nil)
+	if tenant != "" {
+		request.Header.Set(tenantHeader, tenant)
+	}
+	router.ServeHTTP(httptest.NewRecorder(), request)
+}
+
+func TestTenantLabel(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Tenants = []string{"payments", "search"}
+	reloader := newConfigReloader()
+	router := NewRouter(cfg, reloader)
+
+	for _, tenant := range []string{"payments", "payments", "search", "intruder", ""} {
+		requestAsTenant(router, tenant)
+	}
+	expected := map[string]float64{"payments": 2, "search": 1, tenantUnknown: 2}
+	if counts := tenantCounts(t, router); fmt.Sprint(counts) != fmt.Sprint(expected) {
+		t.Errorf("expected requests by tenant %v, got %v", expected, counts)
+	}
+
+	for i := 0; i < 200; i++ {
+		requestAsTenant(router, fmt.Sprintf("tenant-%d", rand.Int63()))
+	}
+	if counts := tenantCounts(t, router); len(counts) != 3 || counts[tenantUnknown] != 202 {
+		t.Errorf("expected random tenants to be counted as %s only, got %v", tenantUnknown, counts)
+	}
+
+	reloader.Reload(func() (ServerConfig, error) {
+		cfg.Tenants = []string{"payments", "ads"}
+		return cfg, nil
+	})
+	requestAsTenant(router, "ads")
+	requestAsTenant(router, "search")
+	if counts := tenantCounts(t, router); counts["ads"] != 1 || counts["search"] != 1 || counts[tenantUnknown] != 203 {
+		t.Errorf("expected the reloaded allowlist to apply, got %v", counts)
+	}
+}
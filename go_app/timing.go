@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const debugTimingHeader = "X-Debug-Timing"
+
+// serverTiming collects the phases of a request for a Server-Timing trailer,
+// sent when debugging is enabled and the client asked for it with
+// X-Debug-Timing: 1. A nil *serverTiming is valid and records nothing, so
+// handlers can use it unconditionally.
+type serverTiming struct {
+	rw     http.ResponseWriter
+	start  time.Time
+	phases []string
+}
+
+// startServerTiming returns nil unless enabled is set and r asked for a
+// timing breakdown. It must be called before anything is written to rw,
+// because the Server-Timing trailer has to be announced in the header.
+func startServerTiming(rw http.ResponseWriter, r *http.Request, enabled bool) *serverTiming {
+	if !enabled || r.Header.Get(debugTimingHeader) != "1" {
+		return nil
+	}
+	rw.Header().Add("Trailer", "Server-Timing")
+	return &serverTiming{rw: rw, start: time.Now()}
+}
+
+// Phase records the time elapsed since start as the phase called name.
+func (t *serverTiming) Phase(name string, start time.Time) {
+	if t == nil {
+		return
+	}
+	t.phases = append(t.phases, formatTiming(name, time.Since(start)))
+}
+
+// Finish adds the total phase and sets the trailer. It must be called after
+// the response body has been written.
+func (t *serverTiming) Finish() {
+	if t == nil {
+		return
+	}
+	phases := append(t.phases, formatTiming("total", time.Since(t.start)))
+	t.rw.Header().Set("Server-Timing", strings.Join(phases, ", "))
+}
+
+func formatTiming(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, float64(d)/float64(time.Millisecond))
+}
+
+// timingSegments collects the Server-Timing segments the middlewares and
+// handlers of a request record, such as the time it queued for a limiter
+// slot. The monitoring middleware sends them in the response header.
+type timingSegments struct {
+	mu       sync.Mutex
+	segments []string
+}
+
+type timingSegmentsKey struct{}
+
+// withTimingSegments returns a copy of r whose context collects timing
+// segments, together with the collector.
+func withTimingSegments(r *http.Request) (*http.Request, *timingSegments) {
+	segments := &timingSegments{}
+	return r.WithContext(context.WithValue(r.Context(), timingSegmentsKey{}, segments)), segments
+}
+
+// addTimingSegment records d as the segment called name. It does nothing
+// unless the Server-Timing header is enabled for the request.
+func addTimingSegment(ctx context.Context, name string, d time.Duration) {
+	segments, ok := ctx.Value(timingSegmentsKey{}).(*timingSegments)
+	if !ok {
+		return
+	}
+	segments.mu.Lock()
+	defer segments.mu.Unlock()
+	segments.segments = append(segments.segments, formatTiming(name, d))
+}
+
+// header returns the Server-Timing header value, with the app segment
+// reporting the time the request has taken so far.
+func (s *timingSegments) header(app time.Duration) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.Join(append([]string{formatTiming("app", app)}, s.segments...), ", ")
+}
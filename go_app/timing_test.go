@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerTimingTrailer(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		debug       bool
+		header      string
+		expectTimes bool
+	}{
+		{name: "requested", debug: true, header: "1", expectTimes: true},
+		{name: "not requested", debug: true, header: ""},
+		{name: "debug disabled", debug: false, header: "1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testHandlerConfig()
+			cfg.DebugTiming = tc.debug
+			router := mux.NewRouter()
+			router.HandleFunc(greetingEndpoint, generateGreetingMessage(cfg))
+
+			request := httptest.NewRequest(http.MethodGet, "/greeting/Bob", nil)
+			if tc.header != "" {
+				request.Header.Set(debugTimingHeader, tc.header)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+
+			timing := recorder.Result().Trailer.Get("Server-Timing")
+			if !tc.expectTimes {
+				if timing != "" {
+					t.Errorf("expected no Server-Timing, got %q", timing)
+				}
+				return
+			}
+			for _, phase := range []string{"sleep;dur=", "write;dur=", "total;dur="} {
+				if !strings.Contains(timing, phase) {
+					t.Errorf("expected Server-Timing %q to contain %q", timing, phase)
+				}
+			}
+		})
+	}
+}
+
+// parseServerTiming returns the durations of a Server-Timing header by
+// segment name.
+func parseServerTiming(t *testing.T, header string) map[string]time.Duration {
+	t.Helper()
+	durations := map[string]time.Duration{}
+	for _, segment := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(segment), ";dur=", 2)
+		if len(parts) != 2 {
+			t.Fatalf("malformed Server-Timing segment %q", segment)
+		}
+		ms, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			t.Fatalf("malformed Server-Timing duration %q: %v", segment, err)
+		}
+		durations[parts[0]] = time.Duration(ms * float64(time.Millisecond))
+	}
+	return durations
+}
+
+func TestServerTimingHeader(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	cfg := defaultConfig()
+	cfg.GreetingHandlerDelay = delay
+	cfg.ConcurrencyLimit = 1
+	cfg.QueueWaitMax = time.Second
+	cfg.ServerTiming = true
+	router := NewRouter(cfg, newConfigReloader())
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/greeting/Bob", nil))
+
+	header := recorder.Header().Get("Server-Timing")
+	durations := parseServerTiming(t, header)
+	if app := durations["app"]; app < delay || app > delay+500*time.Millisecond {
+		t.Errorf("expected app duration close to %s, got %s in %q", delay, app, header)
+	}
+	if queue, ok := durations["queue"]; !ok || queue > delay {
+		t.Errorf("expected a short queue segment, got %q", header)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if _, ok := parseServerTiming(t, recorder.Header().Get("Server-Timing"))["app"]; !ok {
+		t.Errorf("expected an app segment on the welcome page, got %q", recorder.Header().Get("Server-Timing"))
+	}
+}
+
+func TestServerTimingHeaderDisabled(t *testing.T) {
+	cfg := defaultConfig()
+	router := NewRouter(cfg, newConfigReloader())
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/echo/hi", nil))
+	if timing := recorder.Header().Get("Server-Timing"); timing != "" {
+		t.Errorf("expected no Server-Timing header, got %q", timing)
+	}
+}
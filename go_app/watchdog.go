@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// requestWatchdog keeps the start time of every request being served and
+// reports the requests that have been running for longer than threshold,
+// which usually means a handler is blocked for good.
+type requestWatchdog struct {
+	metrics   *Metrics
+	threshold time.Duration
+	now       func() time.Time
+	warn      func(format string, args ...interface{})
+
+	mu       sync.Mutex
+	nextID   uint64
+	requests map[uint64]watchedRequest
+	// reported holds the paths StuckRequests has a series for, so they are
+	// set back to 0 once their requests finish.
+	reported map[string]bool
+
+	ticker *time.Ticker
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type watchedRequest struct {
+	path    string
+	started time.Time
+}
+
+func (m *Metrics) newRequestWatchdog(threshold time.Duration) *requestWatchdog {
+	return &requestWatchdog{
+		metrics:   m,
+		threshold: threshold,
+		now:       time.Now,
+		warn:      log.Printf,
+		requests:  map[uint64]watchedRequest{},
+		reported:  map[string]bool{},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Wrap tracks the requests served by next until they return, even by
+// panicking. Upgrade requests are left out, because the connections they
+// turn into are meant to stay open.
+func (d *requestWatchdog) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer d.track(routeLabel(r))()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// track records that a request to path started and returns the function
+// that records its end.
+func (d *requestWatchdog) track(path string) func() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := d.nextID
+	d.nextID++
+	d.requests[id] = watchedRequest{path: path, started: d.now()}
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.requests, id)
+	}
+}
+
+// start checks for stuck requests every half threshold. Stop ends the
+// checks.
+func (d *requestWatchdog) start() {
+	d.ticker = time.NewTicker(d.threshold / 2)
+	go d.watch(d.ticker.C)
+}
+
+// watch checks for stuck requests on every tick, until Stop.
+func (d *requestWatchdog) watch(ticks <-chan time.Time) {
+	defer close(d.done)
+	for {
+		select {
+		case now := <-ticks:
+			d.check(now)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// Stop ends the checks for stuck requests.
+func (d *requestWatchdog) Stop(context.Context) error {
+	if d.ticker != nil {
+		d.ticker.Stop()
+	}
+	close(d.stop)
+	<-d.done
+	return nil
+}
+
+// check updates StuckRequests with the requests older than the threshold at
+// now, and logs each of them with its age.
+func (d *requestWatchdog) check(now time.Time) {
+	d.mu.Lock()
+	stuck := map[string]int{}
+	var ages []string
+	for _, request := range d.requests {
+		if age := now.Sub(request.started); age > d.threshold {
+			stuck[request.path]++
+			ages = append(ages, request.path+" ("+age.Round(time.Second).String()+")")
+		}
+	}
+	for path := range stuck {
+		d.reported[path] = true
+	}
+	for path := range d.reported {
+		d.metrics.StuckRequests.WithLabelValues(path).Set(float64(stuck[path]))
+	}
+	d.mu.Unlock()
+
+	if len(ages) > 0 {
+		sort.Strings(ages)
+		d.warn("WARNING: %d requests running for longer than %s: %v", len(ages), d.threshold, ages)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestWatchdogReportsStuckRequests(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	watchdog := metrics.newRequestWatchdog(time.Minute)
+	clock := time.Now()
+	watchdog.now = func() time.Time { return clock }
+	var warnings []string
+	watchdog.warn = func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+
+	release := make(chan struct{})
+	served := make(chan struct{})
+	handler := watchdog.Wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-release
+	}))
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/birthday/Bob", nil))
+		close(served)
+	}()
+	stuck := func() float64 {
+		return testutil.ToFloat64(metrics.StuckRequests.WithLabelValues("/birthday/Bob"))
+	}
+
+	// Wait for the request to be tracked.
+	for deadline := time.Now().Add(time.Second); trackedRequests(watchdog) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	watchdog.check(clock.Add(30 * time.Second))
+	if got := stuck(); got != 0 {
+		t.Errorf("expected no stuck request after 30s, got %v", got)
+	}
+	watchdog.check(clock.Add(90 * time.Second))
+	if got := stuck(); got != 1 {
+		t.Errorf("expected 1 stuck request after 90s, got %v", got)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "/birthday/Bob (1m30s)") {
+		t.Errorf("expected a warning naming the stuck request, got %q", warnings)
+	}
+
+	close(release)
+	<-served
+	watchdog.check(clock.Add(120 * time.Second))
+	if got := stuck(); got != 0 {
+		t.Errorf("expected no stuck request once it finished, got %v", got)
+	}
+}
+
+func TestRequestWatchdogForgetsPanickedRequests(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	watchdog := metrics.newRequestWatchdog(time.Minute)
+	handler := watchdog.Wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("handler failed")
+	}))
+
+	func() {
+		defer func() { recover() }()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+
+	if tracked := trackedRequests(watchdog); tracked != 0 {
+		t.Errorf("expected the panicked request to be forgotten, got %d tracked", tracked)
+	}
+}
+
+func TestRequestWatchdogStop(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), newMetricOpts(defaultConfig()))
+	watchdog := metrics.newRequestWatchdog(time.Millisecond)
+	watchdog.start()
+	time.Sleep(5 * time.Millisecond)
+
+	stopped := make(chan error)
+	go func() { stopped <- watchdog.Stop(context.Background()) }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("expected the watchdog to stop cleanly, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Stop to end the checks")
+	}
+}
+
+func trackedRequests(watchdog *requestWatchdog) int {
+	watchdog.mu.Lock()
+	defer watchdog.mu.Unlock()
+	return len(watchdog.requests)
+}
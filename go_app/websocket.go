@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Values of the outcome label of WebSocketUpgrades.
+const (
+	upgradeSuccess = "success"
+	upgradeFailure = "failure"
+)
+
+// OnUpgradeAttempt records the outcome of a WebSocket upgrade handshake.
+func (m *Metrics) OnUpgradeAttempt(success bool) {
+	outcome := upgradeFailure
+	if success {
+		outcome = upgradeSuccess
+	}
+	m.WebSocketUpgrades.WithLabelValues(outcome).Inc()
+}
+
+// upgradeWebSocket upgrades the request to a WebSocket connection with
+// upgrader and records the outcome. On failure the upgrader has already
+// answered the client, with 400 or 426 Upgrade Required for a request that
+// is not a valid handshake.
+func (m *Metrics) upgradeWebSocket(upgrader *websocket.Upgrader, rw http.ResponseWriter, r *http.Request,
+	responseHeader http.Header) (*websocket.Conn, error) {
+	conn, err := upgrader.Upgrade(rw, r, responseHeader)
+	m.OnUpgradeAttempt(err == nil)
+	return conn, err
+}
+
+var echoUpgrader = websocket.Upgrader{}
+
+// Limits of the /ws/echo connections, so an idle or abusive client cannot
+// hold a goroutine and a buffer for good.
+const (
+	// wsMaxMessageBytes is the size of the largest message read; a larger
+	// one closes the connection.
+	wsMaxMessageBytes = 64 << 10
+	// wsPongWait is how long the connection stays open without a message or
+	// a pong from the client.
+	wsPongWait = 60 * time.Second
+	// wsPingPeriod is how often the client is pinged, often enough for its
+	// pong to arrive within wsPongWait.
+	wsPingPeriod = wsPongWait * 9 / 10
+	// wsWriteWait bounds every write to the client.
+	wsWriteWait = 10 * time.Second
+)
+
+// webSocketEcho serves /ws/echo, which sends every message it receives back
+// to the client until the connection is closed, the client stops answering
+// pings or it sends a message larger than wsMaxMessageBytes.
+func (m *Metrics) webSocketEcho(rw http.ResponseWriter, r *http.Request) {
+	conn, err := m.upgradeWebSocket(&echoUpgrader, rw, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(wsMaxMessageBytes)
+	extendReadDeadline := func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	}
+	extendReadDeadline("")
+	conn.SetPongHandler(extendReadDeadline)
+
+	done := make(chan struct{})
+	defer close(done)
+	go pingWebSocket(conn, done)
+
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println(err.Error())
+			}
+			return
+		}
+		extendReadDeadline("")
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		if err := conn.WriteMessage(messageType, message); err != nil {
+			log.Println(err.Error())
+			return
+		}
+	}
+}
+
+// pingWebSocket pings the client of conn every wsPingPeriod until done is
+// closed or a ping fails.
+func pingWebSocket(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebSocketUpgradeAttempts(t *testing.T) {
+	router := NewRouter(defaultConfig(), newConfigReloader())
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+wsEchoEndpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "hello" {
+		t.Errorf("expected the message to be echoed, got %q, %v", message, err)
+	}
+	conn.Close()
+
+	// A plain HTTP request is not a valid handshake.
+	response, err := http.Get(server.URL + wsEchoEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a plain request to fail with %d, got %d", http.StatusBadRequest, response.StatusCode)
+	}
+
+	family := scrape(t, router)["go_app_ws_upgrade_attempts_total"]
+	for _, outcome := range []string{upgradeSuccess, upgradeFailure} {
+		if metric := findMetric(family, "outcome", outcome); metric.GetCounter().GetValue() != 1 {
+			t.Errorf("expected 1 %s upgrade, got %v", outcome, metric)
+		}
+	}
+}
+
+func TestWebSocketEchoRejectsLargeMessages(t *testing.T) {
+	server := httptest.NewServer(NewRouter(defaultConfig(), newConfigReloader()))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+wsEchoEndpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.BinaryMessage, make([]byte, wsMaxMessageBytes+1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("expected the connection to be closed for a message too big, got %v", err)
+	}
+}